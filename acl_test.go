@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestACLDBRule checks that db=N restricts a new user, allowed all the databases, to the listed ones
+func TestACLDBRule(t *testing.T) {
+	srv := startServer(t, nil)
+	c := srv.client()
+	c.ok("acl", "setuser", "app", "on", ">pw", "allcommands", "allkeys", "db=1", "db=2")
+
+	list := c.ok("acl", "list").([]any)
+	var rules string
+	for _, user := range list {
+		if strings.HasPrefix(str(user), "user app ") {
+			rules = str(user)
+		}
+	}
+	if !strings.Contains(rules, "resetdbs db=1 db=2") {
+		t.Errorf("acl list = %q, expected app restricted to the databases 1 and 2", rules)
+	}
+
+	app := srv.client()
+	app.ok("auth", "app", "pw")
+	app.ok("select", "1")
+	app.ok("set", "k", "v")
+	app.ok("select", "2")
+	for _, db := range []string{"0", "3"} {
+		if reply, ok := app.do("select", db).(replyError); !ok || !strings.HasPrefix(string(reply), "NOPERM") {
+			t.Errorf("select %s = %q, expected a NOPERM error", db, reply)
+		}
+	}
+
+	// alldbs lifts the restriction
+	c.ok("acl", "setuser", "app", "alldbs")
+	app.ok("select", "3")
+}
@@ -0,0 +1,77 @@
+// Package cdc encodes the change data capture events and delivers them to a sink
+package cdc
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Event is a change of a key, sent as a line of JSON
+type Event struct {
+	ID  int64  `json:"id"`
+	DB  int    `json:"db"`
+	Key string `json:"key,omitempty"`
+	// KeyEncoding is base64 when the key is not valid UTF-8, Key then holds its base64 encoding
+	KeyEncoding string `json:"key_encoding,omitempty"`
+	Op          string `json:"op"`             // set, del, expired, expire, persist or flushdb
+	Type        string `json:"type,omitempty"` // Redis type of the key
+	OldHash     string `json:"old_hash,omitempty"`
+	NewHash     string `json:"new_hash,omitempty"`
+	Time        int64  `json:"ts"` // Unix time in milliseconds
+}
+
+// SetKey stores the key in the event, encoded when it is not valid UTF-8
+func (e *Event) SetKey(key []byte) {
+	if utf8.Valid(key) {
+		e.Key = string(key)
+		return
+	}
+
+	e.Key = base64.StdEncoding.EncodeToString(key)
+	e.KeyEncoding = "base64"
+}
+
+// AppendJSON appends the event as a line of JSON
+func (e *Event) AppendJSON(buf []byte) ([]byte, error) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(append(buf, line...), '\n'), nil
+}
+
+// Hash returns the hash of a value given in the events, the hex SHA-256 of its bytes
+func Hash(value []byte) string {
+	sum := sha256.Sum256(value)
+	return hex.EncodeToString(sum[:])
+}
+
+// Sink receives the events in order
+type Sink interface {
+	// Send delivers a batch of events, one JSON object per line, the id of the last one is lastID.
+	// It returns once the sink acknowledged them, an error means that they must be sent again
+	Send(batch []byte, lastID int64) error
+	Close() error
+}
+
+// Open returns the sink of a target: file:path, unix:path or an http:// or https:// URL
+func Open(target string) (Sink, error) {
+	switch {
+	case strings.HasPrefix(target, "file://"):
+		return openFileSink(strings.TrimPrefix(target, "file://"))
+	case strings.HasPrefix(target, "file:"):
+		return openFileSink(strings.TrimPrefix(target, "file:"))
+	case strings.HasPrefix(target, "unix:"):
+		return &socketSink{path: strings.TrimPrefix(target, "unix:")}, nil
+	case strings.HasPrefix(target, "http://"), strings.HasPrefix(target, "https://"):
+		return newWebhookSink(target), nil
+	}
+
+	return nil, fmt.Errorf("unknown sink %q, expected file:path, unix:path or an http(s) URL", target)
+}
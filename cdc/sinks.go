@@ -0,0 +1,140 @@
+package cdc
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sinkTimeout is how long a socket or a webhook has to acknowledge a batch
+const sinkTimeout = 30 * time.Second
+
+// fileSink appends the events to a file, a batch is acknowledged once it is on disk
+type fileSink struct {
+	file *os.File
+}
+
+func openFileSink(path string) (*fileSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileSink{file: file}, nil
+}
+
+func (s *fileSink) Send(batch []byte, lastID int64) error {
+	if _, err := s.file.Write(batch); err != nil {
+		return err
+	}
+
+	return s.file.Sync()
+}
+
+func (s *fileSink) Close() error {
+	return s.file.Close()
+}
+
+/*
+socketSink writes the events to a Unix socket, connecting again after an error.
+The consumer acknowledges each batch by writing back the id of its last event followed by a newline,
+so that the events still in the socket when the connection breaks are sent again.
+*/
+type socketSink struct {
+	path   string
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (s *socketSink) Send(batch []byte, lastID int64) error {
+	if s.conn == nil {
+		conn, err := net.DialTimeout("unix", s.path, sinkTimeout)
+		if err != nil {
+			return err
+		}
+		s.conn, s.reader = conn, bufio.NewReader(conn)
+	}
+
+	err := s.send(batch, lastID)
+	if err != nil {
+		s.Close()
+	}
+
+	return err
+}
+
+func (s *socketSink) send(batch []byte, lastID int64) error {
+	s.conn.SetDeadline(time.Now().Add(sinkTimeout))
+	if _, err := s.conn.Write(batch); err != nil {
+		return err
+	}
+
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		acked, err := strconv.ParseInt(strings.TrimSpace(line), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid acknowledgment %q", line)
+		}
+		// the consumer may acknowledge the events as it goes, the batch is done with its last one
+		if acked >= lastID {
+			return nil
+		}
+	}
+}
+
+func (s *socketSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn, s.reader = nil, nil
+
+	return err
+}
+
+// webhookSink posts each batch to a URL as newline delimited JSON, any 2xx status acknowledges it
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func newWebhookSink(url string) *webhookSink {
+	return &webhookSink{url: url, client: &http.Client{Timeout: sinkTimeout}}
+}
+
+func (s *webhookSink) Send(batch []byte, lastID int64) error {
+	request, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(batch))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/x-ndjson")
+	request.Header.Set("X-Bigdis-Last-Event", strconv.FormatInt(lastID, 10))
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("webhook replied %s", response.Status)
+	}
+
+	return nil
+}
+
+func (s *webhookSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
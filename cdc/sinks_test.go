@@ -0,0 +1,161 @@
+package cdc
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	firstBatch  = "{\"id\":1}\n{\"id\":2}\n"
+	secondBatch = "{\"id\":3}\n"
+)
+
+func TestOpen(t *testing.T) {
+	dir := t.TempDir()
+	for target, expected := range map[string]string{
+		"file:" + filepath.Join(dir, "a"):   "*cdc.fileSink",
+		"file://" + filepath.Join(dir, "b"): "*cdc.fileSink",
+		"unix:/run/consumer.sock":           "*cdc.socketSink",
+		"http://localhost/events":           "*cdc.webhookSink",
+		"https://localhost/events":          "*cdc.webhookSink",
+	} {
+		sink, err := Open(target)
+		if err != nil {
+			t.Errorf("Open(%q): %s", target, err)
+			continue
+		}
+		if got := fmt.Sprintf("%T", sink); got != expected {
+			t.Errorf("Open(%q) = %s, expected %s", target, got, expected)
+		}
+		sink.Close()
+	}
+
+	if _, err := Open("kafka://localhost"); err == nil {
+		t.Error("Open of an unknown sink succeeded")
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	for _, batch := range []string{firstBatch, secondBatch} {
+		// the file is appended to across restarts
+		sink, err := Open("file:" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.Send([]byte(batch), 0); err != nil {
+			t.Fatal(err)
+		}
+		sink.Close()
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != firstBatch+secondBatch {
+		t.Errorf("file holds %q", content)
+	}
+}
+
+func TestSocketSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "consumer.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	received := make(chan string, 10)
+	go func() {
+		// the first connection breaks before acknowledging, the second one acknowledges the events one by one
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		received <- "dropped " + line
+		conn.Close()
+
+		conn, err = listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			received <- line
+			io.WriteString(conn, strings.TrimSuffix(strings.TrimPrefix(line, "{\"id\":"), "}\n")+"\n")
+		}
+	}()
+
+	sink, err := Open("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	if err := sink.Send([]byte(firstBatch), 2); err == nil {
+		t.Fatal("a batch that wasn't acknowledged was sent")
+	}
+	if err := sink.Send([]byte(firstBatch), 2); err != nil {
+		t.Fatalf("sending again: %s", err)
+	}
+	if err := sink.Send([]byte(secondBatch), 3); err != nil {
+		t.Fatal(err)
+	}
+
+	var lines []string
+	for len(lines) < 4 {
+		lines = append(lines, <-received)
+	}
+	expected := []string{"dropped {\"id\":1}\n", "{\"id\":1}\n", "{\"id\":2}\n", "{\"id\":3}\n"}
+	if strings.Join(lines, "") != strings.Join(expected, "") {
+		t.Errorf("consumer received %q, expected %q", lines, expected)
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	var bodies []string
+	status := http.StatusServiceUnavailable
+	consumer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/x-ndjson" {
+			t.Errorf("%s request with the content type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, r.Header.Get("X-Bigdis-Last-Event")+" "+string(body))
+		w.WriteHeader(status)
+	}))
+	defer consumer.Close()
+
+	sink, err := Open(consumer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	if err := sink.Send([]byte(firstBatch), 2); err == nil {
+		t.Error("a batch refused by the webhook was acknowledged")
+	}
+	status = http.StatusNoContent
+	if err := sink.Send([]byte(firstBatch), 2); err != nil {
+		t.Error(err)
+	}
+
+	expected := []string{"2 " + firstBatch, "2 " + firstBatch}
+	if strings.Join(bodies, "|") != strings.Join(expected, "|") {
+		t.Errorf("webhook received %q, expected %q", bodies, expected)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhook is a stand-in for the consumer of the change events, it can fail the first deliveries
+type webhook struct {
+	sync.Mutex
+	events []map[string]any
+	fail   int
+}
+
+func (h *webhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.fail > 0 {
+		h.fail--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		event := map[string]any{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		h.events = append(h.events, event)
+	}
+}
+
+// summary returns the events received as "op key type"
+func (h *webhook) summary() []string {
+	h.Lock()
+	defer h.Unlock()
+
+	summary := make([]string, len(h.events))
+	for i, event := range h.events {
+		summary[i] = fmt.Sprintf("%s %v %v", event["op"], event["key"], event["type"])
+	}
+
+	return summary
+}
+
+func startCDCServer(t *testing.T, hook *webhook) (*testServer, *testClient) {
+	consumer := httptest.NewServer(hook)
+	t.Cleanup(consumer.Close)
+
+	srv := startServer(t, map[string]map[string]any{"cdc": {"sink": consumer.URL}})
+
+	return srv, srv.client()
+}
+
+func waitEvents(t *testing.T, hook *webhook, expected []string) {
+	t.Helper()
+	eventually(t, 10*time.Second, func() bool { return len(hook.summary()) >= len(expected) })
+	if got := hook.summary(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("events:\n%q\nexpected:\n%q", got, expected)
+	}
+}
+
+// TestCDCEvents checks that every kind of key mutation is recorded
+func TestCDCEvents(t *testing.T) {
+	hook := &webhook{}
+	_, c := startCDCServer(t, hook)
+
+	c.ok("set", "s", "1")
+	c.ok("incrby", "s", "2")
+	c.ok("append", "s", "x")
+	c.ok("rpush", "l", "a", "b")
+	c.ok("lpop", "l")
+	c.ok("rpop", "l")
+	c.ok("hset", "h", "f", "v")
+	c.ok("hincrby", "h", "n", "1")
+	c.ok("hdel", "h", "f", "n")
+	c.ok("sadd", "st", "a")
+	c.ok("srem", "st", "a")
+	c.ok("zadd", "z", "1", "a")
+	c.ok("zincrby", "z", "1", "a")
+	c.ok("sadd", "src", "a", "b")
+	c.ok("sinterstore", "dst", "src", "src")
+	c.ok("expire", "s", "100")
+	c.ok("persist", "s")
+	c.ok("rpush", "tmp", "a")
+	// a TTL already past when the command runs deletes the key, it must outlive the command
+	c.ok("pexpire", "tmp", "100")
+	time.Sleep(200 * time.Millisecond)
+	c.ok("sadd", "tmp", "b")
+	c.ok("del", "src")
+	c.ok("flushdb")
+
+	waitEvents(t, hook, []string{
+		"set s string",
+		"set s string",
+		"set s string",
+		"set l list",
+		"set l list",
+		"del l list",
+		"set h hash",
+		"set h hash",
+		"del h hash",
+		"set st set",
+		"del st set",
+		"set z zset",
+		"set z zset",
+		"set src set",
+		"set dst set",
+		"expire s string",
+		"persist s string",
+		"set tmp list",
+		"expire tmp list",
+		"expired tmp list",
+		"set tmp set",
+		"del src set",
+		"flushdb <nil> <nil>",
+	})
+
+	// the hashes of strings are given in the events
+	hook.Lock()
+	first := hook.events[0]
+	hook.Unlock()
+	if first["new_hash"] != "6b86b273ff34fce19d6b804eff5a3f5747ada4eaa22f1d49c01e52ddb7875b4b" {
+		t.Errorf("new_hash of set s 1 = %v", first["new_hash"])
+	}
+}
+
+// TestCDCRetry checks that the events a webhook failed to take are sent again, in order
+func TestCDCRetry(t *testing.T) {
+	hook := &webhook{fail: 2}
+	_, c := startCDCServer(t, hook)
+
+	c.ok("set", "a", "1")
+	c.ok("set", "b", "2")
+	c.ok("del", "a")
+
+	waitEvents(t, hook, []string{"set a string", "set b string", "del a string"})
+
+	// each event is received once, as the webhook took none of the failed deliveries
+	hook.Lock()
+	defer hook.Unlock()
+	for i, event := range hook.events {
+		if i > 0 && event["id"].(float64) != hook.events[i-1]["id"].(float64)+1 {
+			t.Errorf("event %d has the id %v after %v", i, event["id"], hook.events[i-1]["id"])
+		}
+	}
+}
+
+// TestDelMissingKeys checks that DEL only counts, records and logs the keys it actually deleted
+func TestDelMissingKeys(t *testing.T) {
+	hook := &webhook{}
+	_, c := startCDCServer(t, hook)
+
+	c.ok("set", "a", "1")
+	c.ok("rpush", "b", "x")
+	before := offset(c)
+	if got := c.ok("del", "nothere", "neither"); got != int64(0) {
+		t.Errorf("del of missing keys = %v", got)
+	}
+	if after := offset(c); after != before {
+		t.Errorf("del of missing keys moved the change log from %d to %d", before, after)
+	}
+	if got := c.ok("del", "a", "nothere", "b"); got != int64(2) {
+		t.Errorf("del of 2 keys out of 3 = %v", got)
+	}
+
+	waitEvents(t, hook, []string{"set a string", "set b list", "del a string", "del b list"})
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clientFields returns the fields of a line of CLIENT LIST or CLIENT INFO
+func clientFields(line string) map[string]string {
+	fields := map[string]string{}
+	for _, field := range strings.Fields(line) {
+		name, value, _ := strings.Cut(field, "=")
+		fields[name] = value
+	}
+
+	return fields
+}
+
+// clientList returns the fields of the clients listed by CLIENT LIST with args, by id
+func clientList(t *testing.T, c *testClient, args ...string) map[string]map[string]string {
+	t.Helper()
+
+	list := map[string]map[string]string{}
+	reply := c.ok(append([]string{"client", "list"}, args...)...)
+	for _, line := range strings.Split(strings.TrimSuffix(str(reply), "\n"), "\n") {
+		if line != "" {
+			fields := clientFields(line)
+			list[fields["id"]] = fields
+		}
+	}
+
+	return list
+}
+
+// closed tells whether the server closed the connection of the client
+func closed(c *testClient) bool {
+	c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err := readReply(c.reader)
+
+	return err != nil
+}
+
+func TestClient(t *testing.T) {
+	srv := startServer(t, nil)
+	c := srv.client()
+	id := c.ok("client", "id").(int64)
+	other := srv.client()
+	otherID := other.ok("client", "id").(int64)
+	if otherID <= id {
+		t.Errorf("client id = %d after %d, expected increasing ids", otherID, id)
+	}
+
+	checkReplies(t, c, []replyTest{
+		{[]string{"client", "getname"}, nil},
+		{[]string{"client", "setname", "conn-1"}, "OK"},
+		{[]string{"client", "getname"}, []byte("conn-1")},
+		{[]string{"client", "setname", "bad name"}, replyError("ERR Client names cannot contain spaces, newlines or special characters.")},
+		{[]string{"client", "getname"}, []byte("conn-1")},
+		{[]string{"client", "no-evict", "maybe"}, replyError("ERR syntax error")},
+		{[]string{"client", "no-evict", "on"}, "OK"},
+		{[]string{"client", "list", "type", "nosuchtype"}, replyError("ERR Unknown client type 'nosuchtype'")},
+		{[]string{"client", "list", "id", "0"}, replyError("ERR Invalid client ID '0'")},
+		{[]string{"client", "list", "nosuchfilter", "x"}, replyError("ERR syntax error")},
+		{[]string{"client", "id", "x"}, replyError("ERR wrong number of arguments for 'client|id' command")},
+		{[]string{"client", "nosuchsubcommand"}, replyError("ERR unknown subcommand 'nosuchsubcommand'. Try CLIENT HELP.")},
+		{[]string{"select", "3"}, "OK"},
+	})
+
+	fields := clientFields(str(c.ok("client", "info")))
+	for name, expected := range map[string]string{"name": "conn-1", "db": "3", "flags": "e", "multi": "-1", "user": "default", "resp": "2", "cmd": "client|info"} {
+		if fields[name] != expected {
+			t.Errorf("client info %s = %q, expected %q", name, fields[name], expected)
+		}
+	}
+
+	other.ok("subscribe", "channel")
+	list := clientList(t, c)
+	if len(list) != 2 || list[str(id)]["name"] != "conn-1" || list[str(otherID)]["sub"] != "1" {
+		t.Errorf("client list = %v", list)
+	}
+	if list := clientList(t, c, "type", "pubsub"); len(list) != 1 || list[str(otherID)] == nil {
+		t.Errorf("client list type pubsub = %v, expected the subscriber", list)
+	}
+	if list := clientList(t, c, "id", str(id), "1000"); len(list) != 1 || list[str(id)] == nil {
+		t.Errorf("client list id = %v, expected the client %d", list, id)
+	}
+}
+
+func TestClientKill(t *testing.T) {
+	srv := startServer(t, nil)
+	c := srv.client()
+	c.ok("acl", "setuser", "app", "on", ">pw", "allcommands", "allkeys")
+
+	checkReplies(t, c, []replyTest{
+		{[]string{"client", "kill", "127.0.0.1:1"}, replyError("ERR No such client")},
+		{[]string{"client", "kill", "id", "x"}, replyError("ERR Invalid client ID 'x'")},
+		{[]string{"client", "kill", "id", "1", "skipme"}, replyError("ERR syntax error")},
+		{[]string{"client", "kill", "skipme", "maybe"}, replyError("ERR syntax error")},
+		{[]string{"client", "kill", "nosuchfilter", "x"}, replyError("ERR syntax error")},
+	})
+
+	byID := srv.client()
+	if got := c.ok("client", "kill", "id", str(byID.ok("client", "id"))); got != int64(1) {
+		t.Errorf("client kill id = %v, expected 1", got)
+	}
+	if !closed(byID) {
+		t.Error("the client killed by id is connected")
+	}
+
+	// the old form with the address
+	byAddr := srv.client()
+	addr := clientFields(str(byAddr.ok("client", "info")))["addr"]
+	if got := c.ok("client", "kill", addr); got != "OK" {
+		t.Errorf("client kill %s = %v, expected OK", addr, got)
+	}
+	if !closed(byAddr) {
+		t.Error("the client killed by address is connected")
+	}
+	if got := c.ok("client", "kill", "addr", addr); got != int64(0) {
+		t.Errorf("client kill addr of a closed client = %v, expected 0", got)
+	}
+
+	apps := []*testClient{srv.client(), srv.client()}
+	for _, app := range apps {
+		app.ok("auth", "app", "pw")
+	}
+	if got := c.ok("client", "kill", "user", "app"); got != int64(2) {
+		t.Errorf("client kill user app = %v, expected 2", got)
+	}
+	for _, app := range apps {
+		if !closed(app) {
+			t.Error("a client of the user app is connected")
+		}
+	}
+
+	// the client is only killed along with the others with SKIPME no
+	eventually(t, 5*time.Second, func() bool { return len(clientList(t, c)) == 1 })
+	if got := c.ok("client", "kill", "user", "default"); got != int64(0) {
+		t.Errorf("client kill user default = %v, expected 0", got)
+	}
+	if got := c.ok("client", "kill", "user", "default", "skipme", "no"); got != int64(1) {
+		t.Errorf("client kill user default skipme no = %v, expected 1", got)
+	}
+	if !closed(c) {
+		t.Error("the client killed itself and is connected")
+	}
+}
+
+func TestClientPause(t *testing.T) {
+	srv := startServer(t, nil)
+	c, other := srv.client(), srv.client()
+
+	checkReplies(t, c, []replyTest{
+		{[]string{"client", "pause", "x"}, replyError("ERR timeout is not an integer or out of range")},
+		{[]string{"client", "pause", "-1"}, replyError("ERR timeout is negative")},
+		{[]string{"client", "pause", "10", "maybe"}, replyError("ERR syntax error")},
+	})
+
+	// WRITE only pauses the writes
+	c.ok("client", "pause", "500", "write")
+	start := time.Now()
+	other.ok("get", "k")
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Errorf("a read waited %s during a pause of the writes", elapsed)
+	}
+	other.ok("set", "k", "v")
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("a write waited %s during a pause of 500ms", elapsed)
+	}
+
+	// CLIENT UNPAUSE, itself never paused, resumes the clients
+	c.ok("client", "pause", "10000")
+	time.AfterFunc(200*time.Millisecond, func() {
+		io.WriteString(c.conn, "*2\r\n$6\r\nclient\r\n$7\r\nunpause\r\n")
+	})
+	start = time.Now()
+	other.ok("get", "k")
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("a read waited %s during a pause ended by CLIENT UNPAUSE after 200ms", elapsed)
+	}
+	if got := c.read(); got != "OK" {
+		t.Errorf("client unpause = %q, expected OK", got)
+	}
+}
+
+func TestClientReply(t *testing.T) {
+	c := startServer(t, nil).client()
+
+	// with the replies off, the next reply is the OK of CLIENT REPLY ON
+	c.ok("set", "n", "1")
+	c.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	io.WriteString(c.conn, "*3\r\n$6\r\nclient\r\n$5\r\nreply\r\n$3\r\noff\r\n"+
+		"*2\r\n$4\r\nincr\r\n$1\r\nn\r\n"+
+		"*3\r\n$6\r\nclient\r\n$5\r\nreply\r\n$4\r\nskip\r\n"+
+		"*3\r\n$6\r\nclient\r\n$5\r\nreply\r\n$2\r\non\r\n")
+	if got := c.read(); got != "OK" {
+		t.Errorf("client reply on = %q, expected OK", got)
+	}
+
+	// SKIP only drops the reply of the next command
+	io.WriteString(c.conn, "*3\r\n$6\r\nclient\r\n$5\r\nreply\r\n$4\r\nskip\r\n"+
+		"*2\r\n$4\r\nincr\r\n$1\r\nn\r\n")
+	checkReplies(t, c, []replyTest{
+		{[]string{"get", "n"}, []byte("3")},
+		{[]string{"client", "reply", "maybe"}, replyError("ERR syntax error")},
+		{[]string{"client", "reply", "on"}, "OK"},
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCommand(t *testing.T) {
+	c := startServer(t, nil).client()
+
+	commands := c.ok("command").([]any)
+	if got := c.ok("command", "count"); got != int64(len(commands)) {
+		t.Errorf("command count = %v, command lists %d commands", got, len(commands))
+	}
+	if got := c.ok("command", "list").([]any); len(got) != len(commands) {
+		t.Errorf("command list has %d commands, command lists %d", len(got), len(commands))
+	}
+
+	checkReplies(t, c, []replyTest{
+		{[]string{"command", "info", "get", "nosuchcommand"}, []any{
+			[]any{[]byte("get"), int64(2), []any{"readonly", "fast"}, int64(1), int64(1), int64(1), []any{"@read", "@fast", "@string"}, []any{}, []any{}, []any{}},
+			nil,
+		}},
+		{[]string{"command", "info", "MSET"}, []any{
+			[]any{[]byte("mset"), int64(-3), []any{"write", "denyoom"}, int64(1), int64(-1), int64(2), []any{"@write", "@slow", "@string"}, []any{}, []any{}, []any{}},
+		}},
+		// the unknown commands are left out of the docs
+		{[]string{"command", "docs", "get", "nosuchcommand"}, []any{
+			[]byte("get"), bulks("summary", "Returns the string value of a key.", "group", "string"),
+		}},
+		{[]string{"command", "list", "filterby", "pattern", "zpop*"}, bulks("zpopmax", "zpopmin")},
+		{[]string{"command", "list", "filterby", "module", "json"}, []any{}},
+		{[]string{"command", "list", "filterby", "pattern"}, replyError("ERR syntax error")},
+		{[]string{"command", "list", "filterby", "nosuchfilter", "x"}, replyError("ERR syntax error")},
+		{[]string{"command", "count", "x"}, replyError("ERR wrong number of arguments for 'command|count' command")},
+		{[]string{"command", "nosuchsubcommand"}, replyError("ERR unknown subcommand 'nosuchsubcommand'. Try COMMAND HELP.")},
+	})
+
+	for _, name := range c.ok("command", "list", "filterby", "aclcat", "hash").([]any) {
+		if !strings.HasPrefix(str(name), "h") {
+			t.Errorf("command list filterby aclcat hash lists %s", name)
+		}
+	}
+}
+
+func TestCommandGetKeys(t *testing.T) {
+	c := startServer(t, nil).client()
+
+	checkReplies(t, c, []replyTest{
+		{[]string{"command", "getkeys", "set", "k", "v"}, bulks("k")},
+		{[]string{"command", "getkeys", "mset", "k1", "v1", "k2", "v2"}, bulks("k1", "k2")},
+		{[]string{"command", "getkeys", "sintercard", "2", "s1", "s2", "limit", "1"}, bulks("s1", "s2")},
+		{[]string{"command", "getkeys", "zunionstore", "dst", "2", "z1", "z2", "weights", "1", "2"}, bulks("dst", "z1", "z2")},
+		{[]string{"command", "getkeys", "sintercard", "3", "s1", "s2"}, replyError("ERR Invalid arguments specified for command")},
+		{[]string{"command", "getkeys", "nosuchcommand", "k"}, replyError("ERR Invalid command specified")},
+		{[]string{"command", "getkeys", "get"}, replyError("ERR Invalid number of arguments specified for command")},
+		{[]string{"command", "getkeys", "ping"}, replyError("ERR The command has no key arguments")},
+		{[]string{"command", "getkeys"}, replyError("ERR wrong number of arguments for 'command|getkeys' command")},
+	})
+}
+
+// TestArity checks that every command of the table refuses too few arguments before running
+func TestArity(t *testing.T) {
+	c := startServer(t, nil).client()
+
+	for _, info := range c.ok("command").([]any) {
+		name, arity := str(info.([]any)[0]), info.([]any)[1].(int64)
+		if arity == 1 || arity == -1 {
+			continue
+		}
+
+		expected := replyError("ERR wrong number of arguments for '" + name + "' command")
+		if got := c.do(name); got != expected {
+			t.Errorf("%s without arguments = %q, expected %q", name, got, expected)
+		}
+		if arity > 1 {
+			args := append([]string{name}, strings.Split(strings.Repeat("x ", int(arity)), " ")[:arity]...)
+			if got := c.do(args...); got != expected {
+				t.Errorf("%s with %d arguments = %q, expected %q", name, arity, got, expected)
+			}
+		}
+	}
+
+	checkReplies(t, c, []replyTest{
+		{[]string{"nosuchcommand", "a", "b"}, replyError("ERR unknown command 'nosuchcommand', with args beginning with: 'a' 'b'")},
+		{[]string{"nosuchcommand"}, replyError("ERR unknown command 'nosuchcommand', with args beginning with: ")},
+	})
+}
@@ -14,33 +14,70 @@ var Config struct {
 		Host            string `json:"host"`
 		Port            int    `json:"port"`
 		SystemdWatchdog bool   `json:"systemd_watchdog"`
+		ACLFile         string `json:"acl_file"`
+		UnixSocket      string `json:"unixsocket"`
+		UnixSocketPerm  string `json:"unixsocketperm"`
+		ShutdownTimeout int    `json:"shutdown_timeout"`
+		// NotifyKeyspaceEvents holds the classes of keyspace events published, in the syntax of Redis like "KEA"
+		NotifyKeyspaceEvents string `json:"notify_keyspace_events"`
 	} `json:"server"`
+	TLS struct {
+		Port        int    `json:"port"`
+		CertFile    string `json:"cert_file"`
+		KeyFile     string `json:"key_file"`
+		CACertFile  string `json:"ca_cert_file"`
+		AuthClients string `json:"auth_clients"`
+		MinVersion  string `json:"min_version"`
+	} `json:"tls"`
 	Storage struct {
 		Path        string `json:"path"`
 		JournalMode string `json:"journal_mode"`
 		Synchronous string `json:"synchronous"`
 		GCInterval  int    `json:"gc_interval"`
+		DumpPath    string `json:"dump_path"`
+		AppendOnly  bool   `json:"appendonly"`
+		AppendFile  string `json:"appendfilename"`
+		AppendFsync string `json:"appendfsync"` // always, everysec or no
 	} `json:"storage"`
+	Replication struct {
+		ReplicaOf       string `json:"replicaof"` // "host port" of the primary, empty on a primary
+		MasterUser      string `json:"masteruser"`
+		MasterAuth      string `json:"masterauth"`
+		ReplicaReadOnly bool   `json:"replica_read_only"`
+		ChangeLogSize   int    `json:"change_log_size"`
+	} `json:"replication"`
+	CDC struct {
+		Sink      string `json:"sink"` // file:path, unix:path or an http(s) URL, empty disables the feed
+		BatchSize int    `json:"batch_size"`
+	} `json:"cdc"`
 }
 
 var (
 	journalModes     = map[string]struct{}{}
 	synchronousModes = map[string]struct{}{}
+	fsyncPolicies    = map[string]struct{}{"always": {}, "everysec": {}, "no": {}}
 )
 
-func Init(configPath string) {
+func Init(path string) {
+	configPath = path
+
 	var content []byte
 	var err error
 	// if configPath is not valid, use defaultConfig
-	if configPath == "" {
+	if path == "" {
 		content = defaultConfig
 	} else {
-		content, err = os.ReadFile(configPath)
+		content, err = os.ReadFile(path)
 		if err != nil {
 			panic(err)
 		}
 	}
 
+	// a port set to 0 disables TCP, so the defaults allowing 0 are applied before reading the file
+	Config.Server.Port = 6389
+	Config.Server.ShutdownTimeout = 10
+	Config.Replication.ReplicaReadOnly = true
+
 	err = json.Unmarshal(content, &Config)
 	if err != nil {
 		panic(err)
@@ -50,14 +87,50 @@ func Init(configPath string) {
 	if Config.Server.Host == "" {
 		Config.Server.Host = "localhost"
 	}
-	if Config.Server.Port == 0 {
-		Config.Server.Port = 6389
+
+	// like Redis, clients must present a certificate unless told otherwise
+	if Config.TLS.AuthClients == "" {
+		Config.TLS.AuthClients = "yes"
+	}
+	if Config.TLS.MinVersion == "" {
+		Config.TLS.MinVersion = "1.2"
+	}
+
+	if Config.Storage.GCInterval < 1 {
+		Config.Storage.GCInterval = 100
 	}
 
 	if Config.Storage.Path == "" {
 		Config.Storage.Path = "bigdis.db"
 	}
 
+	if Config.Storage.DumpPath == "" {
+		Config.Storage.DumpPath = "dump.db"
+	}
+
+	if Config.Storage.AppendFile == "" {
+		Config.Storage.AppendFile = "appendonly.aof"
+	}
+
+	if _, ok := fsyncPolicies[Config.Storage.AppendFsync]; !ok {
+		Config.Storage.AppendFsync = "everysec"
+	}
+
+	if Config.Replication.ChangeLogSize < 1 {
+		Config.Replication.ChangeLogSize = 1000000
+	}
+
+	// an invalid value disables the notifications
+	if flags, err := ParseKeyspaceEvents(Config.Server.NotifyKeyspaceEvents); err != nil {
+		Config.Server.NotifyKeyspaceEvents = ""
+	} else {
+		Config.Server.NotifyKeyspaceEvents = FormatKeyspaceEvents(flags)
+	}
+
+	if Config.CDC.BatchSize < 1 {
+		Config.CDC.BatchSize = 100
+	}
+
 	journalModes["wal"] = struct{}{}
 	journalModes["delete"] = struct{}{}
 	journalModes["truncate"] = struct{}{}
@@ -0,0 +1,86 @@
+package config
+
+import (
+	"errors"
+	"strings"
+)
+
+// The classes of keyspace events enabled by notify_keyspace_events, as in Redis
+const (
+	NotifyKeyspace = 1 << iota // K, published to __keyspace@<db>__:<key>
+	NotifyKeyevent             // E, published to __keyevent@<db>__:<event>
+	NotifyGeneric              // g, DEL, EXPIRE, PERSIST... and the aggregates emptied
+	NotifyString               // $
+	NotifyList                 // l
+	NotifySet                  // s
+	NotifyHash                 // h
+	NotifyZSet                 // z
+	NotifyExpired              // x
+	NotifyEvicted              // e, never sent since keys are never evicted
+	NotifyNew                  // n, a key is created
+
+	// NotifyAll is the A alias, new keys are not part of it
+	NotifyAll = NotifyGeneric | NotifyString | NotifyList | NotifySet | NotifyHash | NotifyZSet | NotifyExpired | NotifyEvicted
+)
+
+var errKeyspaceEventClass = errors.New("Invalid event class character. Use 'Ag$lshzxeKEn'.")
+
+// keyspaceEventClasses lists the classes in the order their letters are shown
+var keyspaceEventClasses = []struct {
+	letter byte
+	class  int
+}{
+	{'g', NotifyGeneric},
+	{'$', NotifyString},
+	{'l', NotifyList},
+	{'s', NotifySet},
+	{'h', NotifyHash},
+	{'z', NotifyZSet},
+	{'x', NotifyExpired},
+	{'e', NotifyEvicted},
+	{'K', NotifyKeyspace},
+	{'E', NotifyKeyevent},
+	{'n', NotifyNew},
+}
+
+// ParseKeyspaceEvents returns the classes of events enabled by a notify_keyspace_events value
+func ParseKeyspaceEvents(value string) (int, error) {
+	var flags int
+	for i := 0; i < len(value); i++ {
+		if value[i] == 'A' {
+			flags |= NotifyAll
+			continue
+		}
+
+		found := false
+		for _, class := range keyspaceEventClasses {
+			if class.letter == value[i] {
+				flags |= class.class
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, errKeyspaceEventClass
+		}
+	}
+
+	return flags, nil
+}
+
+// FormatKeyspaceEvents returns the notify_keyspace_events value of classes of events, A standing for all of them
+func FormatKeyspaceEvents(flags int) string {
+	var value strings.Builder
+	if flags&NotifyAll == NotifyAll {
+		value.WriteByte('A')
+	}
+
+	for _, class := range keyspaceEventClasses {
+		if flags&class.class == 0 || (class.class&NotifyAll != 0 && flags&NotifyAll == NotifyAll) {
+			continue
+		}
+		value.WriteByte(class.letter)
+	}
+
+	return value.String()
+}
@@ -0,0 +1,398 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"bigdis/utils"
+)
+
+var (
+	errNoConfigFile = errors.New("ERR The server is running without a config file")
+	errSetDuplicate = "ERR CONFIG SET failed (possibly related to argument '%s') - duplicate parameter"
+	errSetImmutable = "ERR CONFIG SET failed (possibly related to argument '%s') - can't set immutable config"
+	errSetInvalid   = "ERR CONFIG SET failed (possibly related to argument '%s') - %s"
+	errSetUnknown   = "ERR Unknown option or number of arguments for CONFIG SET - '%s'"
+)
+
+// Lock guards Config once the server is running,
+// the settings that CONFIG SET can change must be read with it held
+var Lock sync.RWMutex
+
+// path of the file passed with -config, CONFIG REWRITE writes there
+var configPath string
+
+// File returns the path of the config file, empty when the server runs with the default settings
+func File() string {
+	return configPath
+}
+
+// parameter is a setting exposed to CONFIG GET and CONFIG SET
+type parameter struct {
+	get func() string
+	// set validates and stores the value, it is nil when the setting can't change at runtime
+	set func(value string) error
+	// hooks apply the new value to the running server
+	hooks []func() error
+}
+
+var parameters = map[string]*parameter{
+	"host": {
+		get: func() string { return Config.Server.Host },
+	},
+	"port": {
+		get: func() string { return strconv.Itoa(Config.Server.Port) },
+	},
+	"systemd_watchdog": {
+		get: func() string { return yesNo(Config.Server.SystemdWatchdog) },
+	},
+	"acl_file": {
+		get: func() string { return Config.Server.ACLFile },
+	},
+	"shutdown_timeout": {
+		get: func() string { return strconv.Itoa(Config.Server.ShutdownTimeout) },
+		set: func(value string) error {
+			timeout, err := strconv.Atoi(value)
+			if err != nil || timeout < 0 {
+				return errors.New("argument must be a number of seconds, 0 or more")
+			}
+
+			Config.Server.ShutdownTimeout = timeout
+			return nil
+		},
+	},
+	"notify_keyspace_events": {
+		get: func() string { return Config.Server.NotifyKeyspaceEvents },
+		set: func(value string) error {
+			flags, err := ParseKeyspaceEvents(value)
+			if err != nil {
+				return err
+			}
+
+			Config.Server.NotifyKeyspaceEvents = FormatKeyspaceEvents(flags)
+			return nil
+		},
+	},
+	"unixsocket": {
+		get: func() string { return Config.Server.UnixSocket },
+	},
+	"unixsocketperm": {
+		get: func() string { return Config.Server.UnixSocketPerm },
+	},
+	"tls_port": {
+		get: func() string { return strconv.Itoa(Config.TLS.Port) },
+	},
+	"tls_cert_file": {
+		get: func() string { return Config.TLS.CertFile },
+	},
+	"tls_key_file": {
+		get: func() string { return Config.TLS.KeyFile },
+	},
+	"tls_ca_cert_file": {
+		get: func() string { return Config.TLS.CACertFile },
+	},
+	"tls_auth_clients": {
+		get: func() string { return Config.TLS.AuthClients },
+	},
+	"tls_min_version": {
+		get: func() string { return Config.TLS.MinVersion },
+	},
+	"path": {
+		get: func() string { return Config.Storage.Path },
+	},
+	"dump_path": {
+		get: func() string { return Config.Storage.DumpPath },
+		set: func(value string) error {
+			if value == "" {
+				return errors.New("dump_path can't be empty")
+			}
+
+			Config.Storage.DumpPath = value
+			return nil
+		},
+	},
+	"journal_mode": {
+		get: func() string { return Config.Storage.JournalMode },
+	},
+	"synchronous": {
+		get: func() string { return Config.Storage.Synchronous },
+		set: func(value string) error {
+			value = strings.ToLower(value)
+			if _, ok := synchronousModes[value]; !ok {
+				return errors.New("argument(s) must be one of the following: off, normal, full, extra")
+			}
+
+			Config.Storage.Synchronous = value
+			return nil
+		},
+	},
+	"gc_interval": {
+		get: func() string { return strconv.Itoa(Config.Storage.GCInterval) },
+		set: func(value string) error {
+			interval, err := strconv.Atoi(value)
+			if err != nil || interval < 1 {
+				return errors.New("argument must be a positive number of seconds")
+			}
+
+			Config.Storage.GCInterval = interval
+			return nil
+		},
+	},
+	"appendonly": {
+		get: func() string { return yesNo(Config.Storage.AppendOnly) },
+		set: func(value string) error {
+			switch strings.ToLower(value) {
+			case "yes":
+				Config.Storage.AppendOnly = true
+			case "no":
+				Config.Storage.AppendOnly = false
+			default:
+				return errors.New("argument must be 'yes' or 'no'")
+			}
+
+			return nil
+		},
+	},
+	"appendfilename": {
+		get: func() string { return Config.Storage.AppendFile },
+	},
+	"appendfsync": {
+		get: func() string { return Config.Storage.AppendFsync },
+		set: func(value string) error {
+			value = strings.ToLower(value)
+			if _, ok := fsyncPolicies[value]; !ok {
+				return errors.New("argument(s) must be one of the following: always, everysec, no")
+			}
+
+			Config.Storage.AppendFsync = value
+			return nil
+		},
+	},
+	// REPLICAOF changes replicaof, CONFIG REWRITE saves it so that a replica still follows its primary after a restart
+	"replicaof": {
+		get: func() string { return Config.Replication.ReplicaOf },
+	},
+	"masteruser": {
+		get: func() string { return Config.Replication.MasterUser },
+		set: func(value string) error {
+			Config.Replication.MasterUser = value
+			return nil
+		},
+	},
+	"masterauth": {
+		get: func() string { return Config.Replication.MasterAuth },
+		set: func(value string) error {
+			Config.Replication.MasterAuth = value
+			return nil
+		},
+	},
+	"replica_read_only": {
+		get: func() string { return yesNo(Config.Replication.ReplicaReadOnly) },
+		set: func(value string) error {
+			switch strings.ToLower(value) {
+			case "yes":
+				Config.Replication.ReplicaReadOnly = true
+			case "no":
+				Config.Replication.ReplicaReadOnly = false
+			default:
+				return errors.New("argument must be 'yes' or 'no'")
+			}
+
+			return nil
+		},
+	},
+	"change_log_size": {
+		get: func() string { return strconv.Itoa(Config.Replication.ChangeLogSize) },
+		set: func(value string) error {
+			size, err := strconv.Atoi(value)
+			if err != nil || size < 1 {
+				return errors.New("argument must be a positive number of changes")
+			}
+
+			Config.Replication.ChangeLogSize = size
+			return nil
+		},
+	},
+	"cdc_sink": {
+		get: func() string { return Config.CDC.Sink },
+	},
+	"cdc_batch_size": {
+		get: func() string { return strconv.Itoa(Config.CDC.BatchSize) },
+		set: func(value string) error {
+			size, err := strconv.Atoi(value)
+			if err != nil || size < 1 {
+				return errors.New("argument must be a positive number of events")
+			}
+
+			Config.CDC.BatchSize = size
+			return nil
+		},
+	},
+}
+
+// aliases are the names Redis gives to the parameters named differently,
+// besides the dashes it has in place of the underscores
+var aliases = map[string]string{
+	"aclfile":         "acl_file",
+	"slave-read-only": "replica_read_only",
+}
+
+// parameterName returns the name of the parameter a name of Bigdis or Redis stands for,
+// the clients relying on a setting as notify-keyspace-events set it with the name of Redis
+func parameterName(name string) string {
+	name = strings.ToLower(name)
+	if alias, ok := aliases[name]; ok {
+		return alias
+	}
+
+	return strings.ReplaceAll(name, "-", "_")
+}
+
+func yesNo(value bool) string {
+	if value {
+		return "yes"
+	}
+
+	return "no"
+}
+
+// OnSet registers a function applying a setting to the running server after CONFIG SET changed it,
+// the hook runs with Lock held and reads Config directly
+func OnSet(name string, hook func() error) {
+	parameters[name].hooks = append(parameters[name].hooks, hook)
+}
+
+// Get returns the name and the value of the settings matching any of the glob patterns.
+// A pattern matching the name of Redis of a setting replies with that name
+func Get(patterns []string) []string {
+	Lock.RLock()
+	defer Lock.RUnlock()
+
+	// the names replied with the parameters they stand for
+	matched := map[string]string{}
+	for name := range parameters {
+		dashed := strings.ReplaceAll(name, "_", "-")
+		for _, pattern := range patterns {
+			switch {
+			case utils.GlobMatch([]byte(pattern), []byte(name), true):
+				matched[name] = name
+			case parameterName(pattern) == name:
+				matched[strings.ToLower(pattern)] = name
+			case utils.GlobMatch([]byte(pattern), []byte(dashed), true):
+				matched[dashed] = name
+			}
+		}
+	}
+
+	names := make([]string, 0, len(matched))
+	for name := range matched {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names)*2)
+	for _, name := range names {
+		pairs = append(pairs, name, parameters[matched[name]].get())
+	}
+
+	return pairs
+}
+
+// Set changes all the settings or none of them, pairs alternates names and values
+func Set(pairs []string) error {
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return fmt.Errorf("ERR "+utils.WrongNumberArgs, "config|set")
+	}
+
+	Lock.Lock()
+	defer Lock.Unlock()
+
+	// check all the names before changing anything
+	seen := map[string]struct{}{}
+	for i := 0; i < len(pairs); i += 2 {
+		name := parameterName(pairs[i])
+		param, exists := parameters[name]
+		if !exists {
+			return fmt.Errorf(errSetUnknown, pairs[i])
+		}
+		if param.set == nil {
+			return fmt.Errorf(errSetImmutable, pairs[i])
+		}
+		if _, duplicate := seen[name]; duplicate {
+			return fmt.Errorf(errSetDuplicate, pairs[i])
+		}
+		seen[name] = struct{}{}
+	}
+
+	previous := Config
+	for i := 0; i < len(pairs); i += 2 {
+		if err := parameters[parameterName(pairs[i])].set(pairs[i+1]); err != nil {
+			Config = previous
+			return fmt.Errorf(errSetInvalid, pairs[i], err)
+		}
+	}
+
+	for i := 0; i < len(pairs); i += 2 {
+		for _, hook := range parameters[parameterName(pairs[i])].hooks {
+			if err := hook(); err != nil {
+				// put the server back as it was
+				Config = previous
+				for j := 0; j <= i; j += 2 {
+					for _, hook := range parameters[parameterName(pairs[j])].hooks {
+						hook()
+					}
+				}
+
+				return fmt.Errorf(errSetInvalid, pairs[i], err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Rewrite saves the current settings to the config file the server was started with
+func Rewrite() error {
+	if configPath == "" {
+		return errNoConfigFile
+	}
+
+	Lock.RLock()
+	content, err := json.MarshalIndent(&Config, "", "    ")
+	Lock.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	// the file is replaced at once so that a crash can't leave it half written
+	tmp, err := os.CreateTemp(filepath.Dir(configPath), filepath.Base(configPath)+".*")
+	if err != nil {
+		return fmt.Errorf("ERR Rewriting config file: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(content, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("ERR Rewriting config file: %s", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("ERR Rewriting config file: %s", err)
+	}
+
+	if info, err := os.Stat(configPath); err == nil {
+		os.Chmod(tmp.Name(), info.Mode())
+	}
+
+	if err := os.Rename(tmp.Name(), configPath); err != nil {
+		return fmt.Errorf("ERR Rewriting config file: %s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestConfigNames checks that the settings are named in snake_case, and that the names of Redis are accepted too
+func TestConfigNames(t *testing.T) {
+	srv := startServer(t, nil)
+	c := srv.client()
+
+	for _, name := range []string{"notify_keyspace_events", "notify-keyspace-events"} {
+		if got := c.ok("config", "get", name).([]any); len(got) != 2 || str(got[0]) != name || str(got[1]) != "" {
+			t.Errorf("config get %s = %q", name, got)
+		}
+	}
+
+	// the clients relying on the notifications enable them with the name of Redis
+	c.ok("config", "set", "notify-keyspace-events", "E$")
+	if got := c.ok("config", "get", "notify_keyspace_events").([]any); len(got) != 2 || str(got[1]) != "$E" {
+		t.Errorf("notify_keyspace_events = %q, expected $E", got)
+	}
+	subscriber := srv.client()
+	subscriber.ok("subscribe", "__keyevent@0__:set")
+	c.ok("set", "k", "v")
+	if got, expected := subscriber.ok("ping"), []any{[]byte("message"), []byte("__keyevent@0__:set"), []byte("k")}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("keyspace event = %q, expected %q", got, expected)
+	}
+
+	c.ok("config", "set", "NOTIFY_KEYSPACE_EVENTS", "")
+	if got := c.ok("config", "get", "notify-keyspace-events").([]any); len(got) != 2 || str(got[1]) != "" {
+		t.Errorf("notify-keyspace-events = %q, expected none", got)
+	}
+
+	tests := []struct {
+		pattern  string
+		expected []any
+	}{
+		{"dump-path", []any{[]byte("dump-path"), c.ok("config", "get", "dump_path").([]any)[1]}},
+		{"aclfile", []any{[]byte("aclfile"), []byte("")}},
+		{"slave-read-only", []any{[]byte("slave-read-only"), []byte("yes")}},
+		{"replica-read-*", []any{[]byte("replica-read-only"), []byte("yes")}},
+		{"replica_read_*", []any{[]byte("replica_read_only"), []byte("yes")}},
+	}
+	for _, test := range tests {
+		if got := c.ok("config", "get", test.pattern); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("config get %s = %q, expected %q", test.pattern, got, test.expected)
+		}
+	}
+
+	// the names of Redis aren't listed twice
+	for _, name := range c.ok("config", "get", "*").([]any) {
+		if strings.Contains(str(name), "-") {
+			t.Errorf("config get * lists %s", name)
+		}
+	}
+
+	// both names set the same setting
+	reply, ok := c.do("config", "set", "replica_read_only", "no", "slave-read-only", "yes").(replyError)
+	if !ok || !strings.Contains(string(reply), "duplicate parameter") {
+		t.Errorf("config set of both names = %q", reply)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"bigdis/rdb"
+)
+
+// maxExpireTime is the latest expiration in seconds, 9999-12-31 23:59:59 UTC
+const maxExpireTime = 253402300799
+
+func TestLargeExpirations(t *testing.T) {
+	c := startServer(t, nil).client()
+	c.ok("set", "k", "v")
+
+	// 10^10 seconds is over 300 years, more than a time.Duration holds
+	c.ok("expire", "k", "10000000000")
+	if got := c.ok("ttl", "k"); got != int64(10000000000) {
+		t.Errorf("ttl = %v, expected 10000000000", got)
+	}
+	if got := c.ok("pttl", "k").(int64); got <= 9999999990000 || got > 10000000000000 {
+		t.Errorf("pttl = %d, expected about 10000000000000", got)
+	}
+
+	c.ok("expireat", "k", "253402300799")
+	if got := c.ok("expiretime", "k"); got != int64(maxExpireTime) {
+		t.Errorf("expiretime = %v, expected %d", got, maxExpireTime)
+	}
+	if got := c.ok("pexpiretime", "k"); got != int64(maxExpireTime*1000) {
+		t.Errorf("pexpiretime = %v, expected %d", got, maxExpireTime*1000)
+	}
+	expected := maxExpireTime - time.Now().Unix()
+	if got := c.ok("ttl", "k").(int64); got < expected-2 || got > expected+2 {
+		t.Errorf("ttl = %d, expected about %d", got, expected)
+	}
+
+	// the RDB export keeps the expiration
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	c.ok("bigdis", "export-rdb", path)
+	c.ok("bigdis", "import-rdb", path, "flush")
+	if got := c.ok("expiretime", "k"); got != int64(maxExpireTime) {
+		t.Errorf("expiretime after an RDB round trip = %v, expected %d", got, maxExpireTime)
+	}
+}
+
+func TestInvalidExpirations(t *testing.T) {
+	c := startServer(t, nil).client()
+	c.ok("set", "k", "v")
+
+	for _, args := range [][]string{
+		// a year after 9999
+		{"expireat", "k", "253402300800"},
+		{"pexpireat", "k", "253402300800000"},
+		{"pexpire", "k", "9223372036854770"},
+		{"expire", "k", "1000000000000"},
+		// overflows
+		{"expire", "k", "9223372036854775807"},
+		{"pexpire", "k", "9223372036854775807"},
+		{"set", "k", "v", "exat", "253402300800"},
+		{"set", "k", "v", "ex", "9223372036854775807"},
+	} {
+		reply, ok := c.do(args...).(replyError)
+		if expected := "ERR invalid expire time in '" + args[0] + "' command"; !ok || string(reply) != expected {
+			t.Errorf("%v = %q, expected %q", args, reply, expected)
+		}
+	}
+
+	// the key is kept without an expiration
+	if got := c.ok("ttl", "k"); got != int64(-1) {
+		t.Errorf("ttl = %v, expected -1", got)
+	}
+	if got := c.ok("get", "k"); str(got) != "v" {
+		t.Errorf("get = %q, expected v", got)
+	}
+}
+
+// TestImportLargeExpiration imports a key from Redis expiring after 9999, it is kept until 9999
+func TestImportLargeExpiration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, err := rdb.NewWriter(file, "7.2.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// year 294303
+	entry := &rdb.Entry{Key: []byte("k"), Type: rdb.TypeString, Value: []byte("v"), ExpireAt: time.UnixMilli(9225000000000000)}
+	if err := writer.Write(entry); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c := startServer(t, nil).client()
+	if got := c.ok("bigdis", "import-rdb", path); got != int64(1) {
+		t.Fatalf("import-rdb = %v keys, expected 1", got)
+	}
+	if got := c.ok("expiretime", "k"); got != int64(maxExpireTime) {
+		t.Errorf("expiretime = %v, expected %d", got, maxExpireTime)
+	}
+	if got := c.ok("get", "k"); str(got) != "v" {
+		t.Errorf("get = %q, expected v", got)
+	}
+}
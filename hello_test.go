@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// replyType sends a command and returns the RESP type byte of its reply, the reply is read too
+func replyType(t *testing.T, c *testClient, args ...string) byte {
+	t.Helper()
+
+	command := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		command += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	c.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.WriteString(c.conn, command); err != nil {
+		t.Fatal(err)
+	}
+
+	// the peeked byte is copied, reading the reply refills the buffer
+	prefix, err := c.reader.Peek(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kind := prefix[0]
+	if _, err := readReply(c.reader); err != nil {
+		t.Fatal(err)
+	}
+
+	return kind
+}
+
+func TestHello(t *testing.T) {
+	srv := startServer(t, nil)
+	c := srv.client()
+	id := c.ok("client", "id")
+
+	// without a version HELLO keeps the protocol
+	expected := []any{
+		[]byte("server"), []byte("bigdis"),
+		[]byte("version"), []byte("7.2.0"),
+		[]byte("proto"), int64(2),
+		[]byte("id"), id,
+		[]byte("mode"), []byte("standalone"),
+		[]byte("role"), []byte("master"),
+		[]byte("modules"), []any{},
+	}
+	if got := c.ok("hello"); !reflect.DeepEqual(got, expected) {
+		t.Errorf("hello = %q, expected %q", got, expected)
+	}
+
+	expected[5] = int64(3)
+	if got := c.ok("hello", "3", "setname", "conn"); !reflect.DeepEqual(got, expected) {
+		t.Errorf("hello 3 = %q, expected %q", got, expected)
+	}
+	if got := c.ok("client", "getname"); str(got) != "conn" {
+		t.Errorf("client getname = %q, expected conn", got)
+	}
+	if got := replyType(t, c, "hello"); got != '%' {
+		t.Errorf("hello after HELLO 3 is a %q reply, expected a map", got)
+	}
+
+	// an invalid HELLO changes nothing
+	checkReplies(t, c, []replyTest{
+		{[]string{"hello", "4"}, replyError("NOPROTO unsupported protocol version")},
+		{[]string{"hello", "1"}, replyError("NOPROTO unsupported protocol version")},
+		{[]string{"hello", "three"}, replyError("ERR Protocol version is not an integer or out of range")},
+		{[]string{"hello", "2", "setname"}, replyError("ERR Syntax error in HELLO option 'setname'")},
+		{[]string{"hello", "2", "auth", "default"}, replyError("ERR Syntax error in HELLO option 'auth'")},
+		{[]string{"hello", "2", "setname", "other", "nosuchoption"}, replyError("ERR Syntax error in HELLO option 'nosuchoption'")},
+		{[]string{"client", "getname"}, []byte("conn")},
+	})
+	if got := replyType(t, c, "get", "missing"); got != '_' {
+		t.Errorf("get of a missing key is a %q reply, expected the RESP3 null", got)
+	}
+
+	c.ok("hello", "2")
+	if got := replyType(t, c, "get", "missing"); got != '$' {
+		t.Errorf("get of a missing key is a %q reply after HELLO 2, expected a null bulk string", got)
+	}
+}
+
+func TestHelloAuth(t *testing.T) {
+	srv := startServer(t, nil)
+	c := srv.client()
+	c.ok("acl", "setuser", "app", "on", ">pw", "allcommands", "allkeys")
+	c.ok("acl", "setuser", "default", "resetpass", ">secret")
+
+	app := srv.client()
+	if reply, ok := app.do("hello", "3").(replyError); !ok || !strings.HasPrefix(string(reply), "NOAUTH ") {
+		t.Errorf("hello without authentication = %q, expected a NOAUTH error", reply)
+	}
+	if reply, ok := app.do("hello", "3", "auth", "app", "wrong").(replyError); !ok || !strings.HasPrefix(string(reply), "WRONGPASS ") {
+		t.Errorf("hello with a wrong password = %q, expected a WRONGPASS error", reply)
+	}
+
+	app.ok("hello", "3", "auth", "app", "pw", "setname", "worker")
+	checkReplies(t, app, []replyTest{
+		{[]string{"acl", "whoami"}, []byte("app")},
+		{[]string{"client", "getname"}, []byte("worker")},
+	})
+}
+
+// TestRESP3Types checks the RESP3 types of the replies after HELLO 3
+func TestRESP3Types(t *testing.T) {
+	c := startServer(t, nil).client()
+	c.ok("hset", "h", "f", "v")
+	c.ok("sadd", "s", "m")
+	c.ok("zadd", "z", "1.5", "m")
+
+	tests := []struct {
+		args         []string
+		resp2, resp3 byte
+	}{
+		{[]string{"hgetall", "h"}, '*', '%'},
+		{[]string{"config", "get", "dump_path"}, '*', '%'},
+		{[]string{"smembers", "s"}, '*', '~'},
+		{[]string{"zscore", "z", "m"}, '$', ','},
+		{[]string{"get", "missing"}, '$', '_'},
+		{[]string{"lrange", "missing", "0", "-1"}, '*', '*'},
+	}
+	for _, test := range tests {
+		if got := replyType(t, c, test.args...); got != test.resp2 {
+			t.Errorf("%q is a %q reply, expected %q", test.args, got, test.resp2)
+		}
+	}
+
+	c.ok("hello", "3")
+	for _, test := range tests {
+		if got := replyType(t, c, test.args...); got != test.resp3 {
+			t.Errorf("%q is a %q reply after HELLO 3, expected %q", test.args, got, test.resp3)
+		}
+	}
+
+	checkReplies(t, c, []replyTest{
+		{[]string{"hgetall", "h"}, bulks("f", "v")},
+		{[]string{"smembers", "s"}, bulks("m")},
+		{[]string{"zscore", "z", "m"}, replyDouble("1.5")},
+	})
+}
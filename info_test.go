@@ -0,0 +1,124 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// info returns the sections of INFO in their order and their fields
+func info(t *testing.T, c *testClient, sections ...string) ([]string, map[string]string) {
+	t.Helper()
+
+	var names []string
+	fields := map[string]string{}
+	for _, line := range strings.Split(str(c.ok(append([]string{"info"}, sections...)...)), "\r\n") {
+		if name, found := strings.CutPrefix(line, "# "); found {
+			names = append(names, name)
+		} else if name, value, found := strings.Cut(line, ":"); found {
+			fields[name] = value
+		} else if line != "" {
+			t.Errorf("malformed INFO line %q", line)
+		}
+	}
+
+	return names, fields
+}
+
+func TestInfo(t *testing.T) {
+	srv := startServer(t, map[string]map[string]any{"storage": {"gc_interval": 1}})
+	c := srv.client()
+
+	// the connection checking that the server started may not be closed yet
+	if !eventually(t, 5*time.Second, func() bool {
+		_, fields := info(t, c, "clients")
+		return fields["connected_clients"] == "1"
+	}) {
+		t.Error("connected_clients isn't 1")
+	}
+
+	sections, fields := info(t, c)
+	if expected := []string{"Server", "Clients", "Persistence", "Stats", "Replication", "Keyspace", "Sqlite"}; !reflect.DeepEqual(sections, expected) {
+		t.Errorf("sections %q, expected %q", sections, expected)
+	}
+	for name, expected := range map[string]string{
+		"redis_version":       "7.2.0",
+		"tcp_port":            strconv.Itoa(srv.port),
+		"sqlite_journal_mode": "wal",
+	} {
+		if fields[name] != expected {
+			t.Errorf("%s = %q, expected %q", name, fields[name], expected)
+		}
+	}
+	pageSize, _ := strconv.Atoi(fields["sqlite_page_size"])
+	pageCount, _ := strconv.Atoi(fields["sqlite_page_count"])
+	if pageSize == 0 || pageCount == 0 || fields["sqlite_db_size"] != strconv.Itoa(pageSize*pageCount) {
+		t.Errorf("sqlite_page_size %q, sqlite_page_count %q and sqlite_db_size %q", fields["sqlite_page_size"], fields["sqlite_page_count"], fields["sqlite_db_size"])
+	}
+
+	// the sections are picked by name, whatever the case
+	if sections, _ := info(t, c, "SERVER", "keyspace"); !reflect.DeepEqual(sections, []string{"Server", "Keyspace"}) {
+		t.Errorf("sections %q, expected Server and Keyspace", sections)
+	}
+	if sections, _ := info(t, c, "everything"); len(sections) != 7 {
+		t.Errorf("info everything has the sections %q", sections)
+	}
+	if got := c.ok("info", "nosuch"); str(got) != "" {
+		t.Errorf("info nosuch = %q", got)
+	}
+
+	// the commands and the clients are counted
+	_, fields = info(t, c, "stats")
+	processed, _ := strconv.Atoi(fields["total_commands_processed"])
+	other := srv.client()
+	other.ok("ping")
+	_, fields = info(t, c, "stats", "clients")
+	if fields["total_commands_processed"] != strconv.Itoa(processed+2) {
+		t.Errorf("total_commands_processed = %s, expected %d", fields["total_commands_processed"], processed+2)
+	}
+	if fields["connected_clients"] != "2" {
+		t.Errorf("connected_clients = %s, expected 2", fields["connected_clients"])
+	}
+	other.conn.Close()
+	if !eventually(t, 5*time.Second, func() bool {
+		_, fields := info(t, c, "clients")
+		return fields["connected_clients"] == "1"
+	}) {
+		t.Error("the closed connection is still counted")
+	}
+
+	// the keyspace lists the DBs holding keys
+	c.ok("set", "a", "1")
+	c.ok("set", "b", "1", "ex", "100")
+	c.ok("select", "2")
+	c.ok("rpush", "l", "a")
+	c.ok("select", "3")
+	c.ok("set", "gone", "1")
+	c.ok("del", "gone")
+	_, fields = info(t, c, "keyspace")
+	if len(fields) != 2 || fields["db2"] != "keys=1,expires=0,avg_ttl=0" {
+		t.Errorf("keyspace = %q", fields)
+	}
+	if db0 := fields["db0"]; !strings.HasPrefix(db0, "keys=2,expires=1,avg_ttl=") {
+		t.Errorf("db0 = %q", db0)
+	} else if ttl, _ := strconv.Atoi(strings.TrimPrefix(db0, "keys=2,expires=1,avg_ttl=")); ttl <= 90000 || ttl > 100000 {
+		t.Errorf("avg_ttl of db0 = %d ms, expected about 100000", ttl)
+	}
+
+	// the garbage collection counts the expired keys
+	c.ok("set", "expiring", "v", "px", "1")
+	if !eventually(t, 5*time.Second, func() bool {
+		_, fields := info(t, c, "stats")
+		return fields["expired_keys"] == "1"
+	}) {
+		t.Error("expired_keys isn't 1")
+	}
+
+	// RESP3 replies with a verbatim string
+	c.ok("hello", "3")
+	if sections, _ := info(t, c, "server"); !reflect.DeepEqual(sections, []string{"Server"}) {
+		t.Errorf("sections in RESP3 %q", sections)
+	}
+}
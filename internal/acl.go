@@ -0,0 +1,755 @@
+package internal
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"bigdis/config"
+	"bigdis/utils"
+)
+
+/*
+Users are described with the rules of Redis ACLs:
+
+	on, off              enable or disable the user
+	>password, <password add or remove a password, only its SHA-256 is kept
+	#hash, !hash         add or remove a password by its SHA-256
+	nopass, resetpass    accept any password, or forget all of them
+	+command, -command   allow or deny a command
+	+@category, -@category
+	allcommands, nocommands
+	~pattern, allkeys    allow the keys matching a glob pattern
+	resetkeys
+	reset                back to the state of a new user
+
+On top of them Bigdis restricts the databases a user can select:
+
+	alldbs, resetdbs     allow all the databases, or none
+	db=N                 allow database N, a user allowed all of them is restricted to the listed ones
+
+A new user is off, without passwords, commands nor keys, and it can use every database.
+*/
+
+var (
+	errNoAuth            = errors.New("NOAUTH Authentication required.")
+	errHelloNoAuth       = errors.New("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+	errNoKeyPermission   = errors.New("NOPERM No permissions to access a key")
+	errDefaultNoPassword = errors.New("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+	errDeleteDefault     = errors.New("ERR The 'default' user cannot be removed")
+	errNoACLFile         = errors.New("ERR This Redis instance is not configured to use an ACL file. You may want to specify users via the ACL SETUSER command and then issue a CONFIG REWRITE (assuming you have a Redis configuration file set) in order to store users in the Redis configuration.")
+	errNoCommandPerm     = "NOPERM User %s has no permissions to run the '%s' command"
+	errNoDBPerm          = "NOPERM No permissions to access database %s"
+	errSetUserModifier   = "ERR Error in ACL SETUSER modifier '%s': %s"
+)
+
+const defaultUser = "default"
+
+// User is an ACL user, its fields are guarded by the lock of acl
+type User struct {
+	Name string
+
+	enabled      bool
+	nopass       bool
+	passwords    []string // hex encoded SHA-256 of the passwords
+	commandRules []string
+	commands     map[string]bool
+	keyPatterns  []string
+	allDBs       bool
+	dbs          map[int]struct{}
+	deleted      bool // the clients authenticated with it must authenticate again
+}
+
+func newUser(name string) *User {
+	return &User{
+		Name:         name,
+		commandRules: []string{"-@all"},
+		commands:     map[string]bool{},
+		allDBs:       true,
+		dbs:          map[int]struct{}{},
+	}
+}
+
+func (u *User) clone() *User {
+	clone := *u
+	clone.passwords = append([]string{}, u.passwords...)
+	clone.commandRules = append([]string{}, u.commandRules...)
+	clone.keyPatterns = append([]string{}, u.keyPatterns...)
+	clone.commands = map[string]bool{}
+	for name, allowed := range u.commands {
+		clone.commands[name] = allowed
+	}
+	clone.dbs = map[int]struct{}{}
+	for dbNum := range u.dbs {
+		clone.dbs[dbNum] = struct{}{}
+	}
+
+	return &clone
+}
+
+// set copies the rules of another user, the pointers held by the clients stay valid
+func (u *User) set(other *User) {
+	name := u.Name
+	*u = *other
+	u.Name = name
+}
+
+func hashPassword(password string) string {
+	hash := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(hash[:])
+}
+
+// allowCategory allows or denies all the commands of a category, the name is without the @
+func (u *User) allowCategory(category string, allowed bool) error {
+	if category != "all" && !isCategory(category) {
+		return errors.New("Unknown command category")
+	}
+
+	for name, command := range commandTable {
+		if category == "all" || command.inCategory(category) {
+			u.commands[name] = allowed
+		}
+	}
+
+	return nil
+}
+
+func (u *User) applyRule(rule string) error {
+	lower := strings.ToLower(rule)
+	switch {
+	case lower == "on":
+		u.enabled = true
+	case lower == "off":
+		u.enabled = false
+	case lower == "nopass":
+		u.nopass = true
+		u.passwords = nil
+	case lower == "resetpass":
+		u.nopass = false
+		u.passwords = nil
+	case lower == "allkeys":
+		u.keyPatterns = []string{"*"}
+	case lower == "resetkeys":
+		u.keyPatterns = nil
+	case lower == "alldbs":
+		u.allDBs = true
+		u.dbs = map[int]struct{}{}
+	case lower == "resetdbs":
+		u.allDBs = false
+		u.dbs = map[int]struct{}{}
+	case lower == "allcommands", lower == "+@all":
+		u.allowCategory("all", true)
+		u.commandRules = []string{"+@all"}
+	case lower == "nocommands", lower == "-@all":
+		u.allowCategory("all", false)
+		u.commandRules = []string{"-@all"}
+	case lower == "reset":
+		u.set(newUser(u.Name))
+	case strings.HasPrefix(lower, "db="):
+		dbNum, err := strconv.Atoi(rule[3:])
+		if err != nil || dbNum < 0 {
+			return errors.New("Syntax error")
+		}
+		// the first database allowed to a user of all the databases restricts it to the listed ones
+		u.allDBs = false
+		u.dbs[dbNum] = struct{}{}
+	case rule[0] == '>':
+		u.addPassword(hashPassword(rule[1:]))
+	case rule[0] == '<':
+		if !u.removePassword(hashPassword(rule[1:])) {
+			return errors.New("no such password")
+		}
+	case rule[0] == '#':
+		if _, err := hex.DecodeString(rule[1:]); err != nil || len(rule) != 65 {
+			return errors.New("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		u.addPassword(lower[1:])
+	case rule[0] == '!':
+		if !u.removePassword(lower[1:]) {
+			return errors.New("no such password")
+		}
+	case rule[0] == '~':
+		u.keyPatterns = append(u.keyPatterns, rule[1:])
+	case strings.HasPrefix(lower, "+@"), strings.HasPrefix(lower, "-@"):
+		if err := u.allowCategory(lower[2:], rule[0] == '+'); err != nil {
+			return err
+		}
+		u.commandRules = append(u.commandRules, lower)
+	case rule[0] == '+', rule[0] == '-':
+		if _, exists := commandTable[lower[1:]]; !exists {
+			return errors.New("Unknown command")
+		}
+		u.commands[lower[1:]] = rule[0] == '+'
+		u.commandRules = append(u.commandRules, lower)
+	default:
+		return errors.New("Syntax error")
+	}
+
+	return nil
+}
+
+func (u *User) addPassword(hash string) {
+	u.nopass = false
+	for _, password := range u.passwords {
+		if password == hash {
+			return
+		}
+	}
+	u.passwords = append(u.passwords, hash)
+}
+
+func (u *User) removePassword(hash string) bool {
+	for i, password := range u.passwords {
+		if password == hash {
+			u.passwords = append(u.passwords[:i], u.passwords[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkPassword must be called with the lock held
+func (u *User) checkPassword(password string) bool {
+	if !u.enabled {
+		return false
+	}
+	if u.nopass {
+		return true
+	}
+
+	hash := hashPassword(password)
+	for _, candidate := range u.passwords {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(candidate)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rules describes the user the way ACL LIST and the ACL file do
+func (u *User) rules() string {
+	rules := []string{"user", u.Name}
+	if u.enabled {
+		rules = append(rules, "on")
+	} else {
+		rules = append(rules, "off")
+	}
+	if u.nopass {
+		rules = append(rules, "nopass")
+	}
+	for _, password := range u.passwords {
+		rules = append(rules, "#"+password)
+	}
+	if len(u.keyPatterns) == 0 {
+		rules = append(rules, "resetkeys")
+	}
+	for _, pattern := range u.keyPatterns {
+		rules = append(rules, "~"+pattern)
+	}
+	rules = append(rules, u.dbRules()...)
+	rules = append(rules, u.commandRules...)
+
+	return strings.Join(rules, " ")
+}
+
+func (u *User) dbRules() []string {
+	if u.allDBs {
+		return []string{"alldbs"}
+	}
+
+	dbNums := make([]int, 0, len(u.dbs))
+	for dbNum := range u.dbs {
+		dbNums = append(dbNums, dbNum)
+	}
+	sort.Ints(dbNums)
+
+	rules := []string{"resetdbs"}
+	for _, dbNum := range dbNums {
+		rules = append(rules, "db="+strconv.Itoa(dbNum))
+	}
+
+	return rules
+}
+
+func (u *User) canAccessDB(db []byte) bool {
+	if u.allDBs {
+		return true
+	}
+
+	dbNum, err := strconv.Atoi(string(db))
+	if err != nil {
+		// SELECT replies with its own error
+		return true
+	}
+	_, allowed := u.dbs[dbNum]
+
+	return allowed
+}
+
+func (u *User) canAccessKey(key []byte) bool {
+	for _, pattern := range u.keyPatterns {
+		if utils.GlobMatch([]byte(pattern), key, false) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// acl holds the users, the default one always exists
+var acl = struct {
+	sync.RWMutex
+	users map[string]*User
+}{
+	users: map[string]*User{},
+}
+
+func defaultUserRules() *User {
+	user := newUser(defaultUser)
+	for _, rule := range []string{"on", "nopass", "allkeys", "alldbs", "+@all"} {
+		user.applyRule(rule)
+	}
+
+	return user
+}
+
+// parseACL reads the users of an ACL file, one "user <name> <rules>..." line each
+func parseACL(path string) (map[string]*User, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	users := map[string]*User{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 || fields[0] != "user" {
+			return nil, fmt.Errorf("%s:%d: should start with user keyword", path, line)
+		}
+		if _, exists := users[fields[1]]; exists {
+			return nil, fmt.Errorf("%s:%d: duplicate user '%s'", path, line, fields[1])
+		}
+
+		user := newUser(fields[1])
+		for _, rule := range fields[2:] {
+			if err := user.applyRule(rule); err != nil {
+				return nil, fmt.Errorf("%s:%d: %s. Error in user declaration '%s'", path, line, err, rule)
+			}
+		}
+		users[user.Name] = user
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, exists := users[defaultUser]; !exists {
+		users[defaultUser] = defaultUserRules()
+	}
+
+	return users, nil
+}
+
+// LoadACL replaces the users with the ones of the ACL file, the clients keep the users that still exist
+func LoadACL() error {
+	var users map[string]*User
+	if path := config.Config.Server.ACLFile; path != "" {
+		var err error
+		if users, err = parseACL(path); err != nil {
+			return err
+		}
+	} else {
+		users = map[string]*User{defaultUser: defaultUserRules()}
+	}
+
+	acl.Lock()
+	defer acl.Unlock()
+
+	for name, user := range acl.users {
+		if loaded, exists := users[name]; exists {
+			user.set(loaded)
+			users[name] = user
+		} else {
+			user.deleted = true
+		}
+	}
+	acl.users = users
+
+	return nil
+}
+
+// saveACL writes the users to the ACL file
+func saveACL() error {
+	path := config.Config.Server.ACLFile
+	if path == "" {
+		return errNoACLFile
+	}
+
+	acl.RLock()
+	names := make([]string, 0, len(acl.users))
+	for name := range acl.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var content strings.Builder
+	for _, name := range names {
+		content.WriteString(acl.users[name].rules() + "\n")
+	}
+	acl.RUnlock()
+
+	// the file is replaced at once so that a crash can't leave it half written
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(content.String()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// authenticate returns the user of the credentials, WRONGPASS if they don't match
+func authenticate(username []byte, password []byte) (*User, error) {
+	acl.RLock()
+	defer acl.RUnlock()
+
+	user, exists := acl.users[string(username)]
+	if !exists || !user.checkPassword(string(password)) {
+		return nil, errWrongPass
+	}
+
+	return user, nil
+}
+
+// defaultLogin is the user new clients are authenticated with, nil when the default user needs a password
+func defaultLogin() *User {
+	acl.RLock()
+	defer acl.RUnlock()
+
+	user := acl.users[defaultUser]
+	if user == nil || !user.enabled || !user.nopass {
+		return nil
+	}
+
+	return user
+}
+
+// CheckPermission tells whether the user of the client can run the command with args in the database db
+func CheckPermission(client *Client, command *Command, args [][]byte, db []byte) error {
+	user := client.User()
+
+	acl.RLock()
+	defer acl.RUnlock()
+
+	// the commands that authenticate are always allowed
+	if command.hasFlag("no_auth") {
+		return nil
+	}
+	if user == nil || user.deleted || !user.enabled {
+		return errNoAuth
+	}
+
+	if !user.commands[command.Name] {
+		return fmt.Errorf(errNoCommandPerm, user.Name, command.Name)
+	}
+
+	// only the commands touching the data need the selected database, a client can always move out of it
+	switch {
+	case command.Name == "select":
+		if !user.canAccessDB(args[0]) {
+			return fmt.Errorf(errNoDBPerm, args[0])
+		}
+	case command.Name == "flushall":
+		if !user.allDBs {
+			return fmt.Errorf(errNoDBPerm, "*")
+		}
+	case command.hasFlag("write"), command.hasFlag("readonly"):
+		if !user.canAccessDB(db) {
+			return fmt.Errorf(errNoDBPerm, db)
+		}
+	}
+
+	// with a wrong number of keys the command replies with its own error
+	positions, err := command.Keys(append([][]byte{[]byte(command.Name)}, args...))
+	if err != nil {
+		return nil
+	}
+	for _, position := range positions {
+		if !user.canAccessKey(args[position-1]) {
+			return errNoKeyPermission
+		}
+	}
+
+	return nil
+}
+
+// isCategory tells whether a category, without the @, is used by a command
+func isCategory(category string) bool {
+	for _, command := range commandTable {
+		if command.inCategory(category) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *Command) inCategory(category string) bool {
+	for _, name := range c.Categories {
+		if name[1:] == category {
+			return true
+		}
+	}
+
+	return false
+}
+
+func registerACLHandlers(m map[string]HandlerFn) {
+	m["auth"] = func(r *Request) error {
+		if len(r.Args) > 2 {
+			return utils.ErrSyntaxError
+		}
+
+		username, password := []byte(defaultUser), r.Args[0]
+		if len(r.Args) == 2 {
+			username, password = r.Args[0], r.Args[1]
+		} else if defaultLogin() != nil {
+			return errDefaultNoPassword
+		}
+
+		user, err := authenticate(username, password)
+		if err != nil {
+			return err
+		}
+		r.Client.SetUser(user)
+
+		if _, err := NewStatusReply("OK").WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["acl"] = func(r *Request) error {
+		var reply ReplyWriter
+		switch subcommand := strings.ToLower(string(r.Args[0])); subcommand {
+		case "whoami":
+			if len(r.Args) != 1 {
+				return wrongNumberArgs("acl|whoami")
+			}
+
+			reply = &BulkReply{value: []byte(r.Client.User().Name)}
+		case "users":
+			if len(r.Args) != 1 {
+				return wrongNumberArgs("acl|users")
+			}
+
+			acl.RLock()
+			names := make([]string, 0, len(acl.users))
+			for name := range acl.users {
+				names = append(names, name)
+			}
+			acl.RUnlock()
+			sort.Strings(names)
+
+			values := make([]any, len(names))
+			for i, name := range names {
+				values[i] = name
+			}
+			reply = &MultiBulkReply{values: values}
+		case "list":
+			if len(r.Args) != 1 {
+				return wrongNumberArgs("acl|list")
+			}
+
+			acl.RLock()
+			users := make([]*User, 0, len(acl.users))
+			for _, user := range acl.users {
+				users = append(users, user)
+			}
+			sort.Slice(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+
+			values := make([]any, len(users))
+			for i, user := range users {
+				values[i] = user.rules()
+			}
+			acl.RUnlock()
+
+			reply = &MultiBulkReply{values: values}
+		case "setuser":
+			if len(r.Args) < 2 {
+				return wrongNumberArgs("acl|setuser")
+			}
+
+			acl.Lock()
+			defer acl.Unlock()
+
+			name := string(r.Args[1])
+			user, exists := acl.users[name]
+			if !exists {
+				user = newUser(name)
+			}
+
+			// the rules are applied to a copy so that the user is left as it was if one fails
+			updated := user.clone()
+			for _, rule := range r.Args[2:] {
+				if len(rule) == 0 {
+					return fmt.Errorf(errSetUserModifier, rule, "Syntax error")
+				}
+				if err := updated.applyRule(string(rule)); err != nil {
+					return fmt.Errorf(errSetUserModifier, rule, err)
+				}
+			}
+			user.set(updated)
+			acl.users[name] = user
+
+			reply = NewStatusReply("OK")
+		case "getuser":
+			if len(r.Args) != 2 {
+				return wrongNumberArgs("acl|getuser")
+			}
+
+			acl.RLock()
+			user, exists := acl.users[string(r.Args[1])]
+			if !exists {
+				acl.RUnlock()
+				reply = &NullReply{Array: true}
+				break
+			}
+
+			flags := []any{"off"}
+			if user.enabled {
+				flags[0] = "on"
+			}
+			if user.nopass {
+				flags = append(flags, "nopass")
+			}
+			passwords := make([]any, len(user.passwords))
+			for i, password := range user.passwords {
+				passwords[i] = password
+			}
+			keys := make([]string, len(user.keyPatterns))
+			for i, pattern := range user.keyPatterns {
+				keys[i] = "~" + pattern
+			}
+
+			reply = &MapReply{values: []any{
+				"flags", flags,
+				"passwords", passwords,
+				"commands", strings.Join(user.commandRules, " "),
+				"keys", []byte(strings.Join(keys, " ")),
+				"dbs", strings.Join(user.dbRules(), " "),
+			}}
+			acl.RUnlock()
+		case "deluser":
+			if len(r.Args) < 2 {
+				return wrongNumberArgs("acl|deluser")
+			}
+
+			acl.Lock()
+			defer acl.Unlock()
+
+			for _, name := range r.Args[1:] {
+				if string(name) == defaultUser {
+					return errDeleteDefault
+				}
+			}
+
+			var deleted int
+			for _, name := range r.Args[1:] {
+				if user, exists := acl.users[string(name)]; exists {
+					user.deleted = true
+					delete(acl.users, string(name))
+					deleted++
+				}
+			}
+
+			reply = &IntegerReply{number: deleted}
+		case "cat":
+			if len(r.Args) > 2 {
+				return wrongNumberArgs("acl|cat")
+			}
+
+			values := []any{}
+			if len(r.Args) == 1 {
+				categories := map[string]struct{}{}
+				for _, command := range commandTable {
+					for _, category := range command.Categories {
+						categories[category[1:]] = struct{}{}
+					}
+				}
+				for category := range categories {
+					values = append(values, category)
+				}
+			} else {
+				category := strings.ToLower(string(r.Args[1]))
+				if !isCategory(category) {
+					return fmt.Errorf("ERR Unknown category '%s'", r.Args[1])
+				}
+				for _, command := range commandTable {
+					if command.inCategory(category) {
+						values = append(values, command.Name)
+					}
+				}
+			}
+			sort.Slice(values, func(i, j int) bool { return values[i].(string) < values[j].(string) })
+
+			reply = &MultiBulkReply{values: values}
+		case "load":
+			if len(r.Args) != 1 {
+				return wrongNumberArgs("acl|load")
+			}
+			if config.Config.Server.ACLFile == "" {
+				return errNoACLFile
+			}
+			if err := LoadACL(); err != nil {
+				return fmt.Errorf("ERR %s", err)
+			}
+
+			reply = NewStatusReply("OK")
+		case "save":
+			if len(r.Args) != 1 {
+				return wrongNumberArgs("acl|save")
+			}
+			if err := saveACL(); err != nil {
+				if err == errNoACLFile {
+					return err
+				}
+				return fmt.Errorf("ERR There was an error trying to save the ACLs. Please check the server logs for more information")
+			}
+
+			reply = NewStatusReply("OK")
+		default:
+			return fmt.Errorf("ERR unknown subcommand '%s'. Try ACL HELP.", r.Args[0])
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
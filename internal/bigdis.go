@@ -0,0 +1,195 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"bigdis/storage"
+	"bigdis/utils"
+)
+
+// bigdisHelp is the reply of BIGDIS HELP, a status reply per line as Redis answers HELP
+var bigdisHelp = []string{
+	"BIGDIS <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+	"IMPORT-RDB <path> [FLUSH]",
+	"    Load the keys of a Redis RDB file, FLUSH empties all the databases first.",
+	"EXPORT-RDB <path>",
+	"    Write the keys to a Redis RDB file.",
+	"REPLICA <port>",
+	"    Mark the connection as a replica listening on port.",
+	"CHANGES <replid> <offset> <count> <block-ms>",
+	"    Return the changes following offset, null when a full resync is needed.",
+	"SNAPSHOT",
+	"    Return the replication ID, the offset and the RDB snapshot of the keys at that offset.",
+	"HELP",
+	"    Print this help.",
+}
+
+// registerBigdisHandlers registers BIGDIS, the commands that only exist in Bigdis
+func registerBigdisHandlers(m map[string]HandlerFn) {
+	m["bigdis"] = func(r *Request) error {
+		var keys int
+		var err error
+		switch strings.ToLower(string(r.Args[0])) {
+		case "help":
+			if len(r.Args) != 1 {
+				return wrongNumberArgs("bigdis|help")
+			}
+
+			lines := make([]interface{}, len(bigdisHelp))
+			for i, line := range bigdisHelp {
+				lines[i] = NewStatusReply(line)
+			}
+
+			_, err := (&MultiBulkReply{values: lines}).WriteTo(r.Conn)
+			return err
+		case "import-rdb":
+			if len(r.Args) < 2 || len(r.Args) > 3 {
+				return wrongNumberArgs("bigdis|import-rdb")
+			}
+
+			flush := false
+			if len(r.Args) == 3 {
+				if strings.ToLower(string(r.Args[2])) != "flush" {
+					return utils.ErrSyntaxError
+				}
+				flush = true
+			}
+
+			keys, err = storage.ImportRDBFile(string(r.Args[1]), flush)
+			if err != nil {
+				return fmt.Errorf("ERR Importing RDB file: %s", err)
+			}
+		case "export-rdb":
+			if len(r.Args) != 2 {
+				return wrongNumberArgs("bigdis|export-rdb")
+			}
+
+			keys, err = storage.ExportRDBFile(string(r.Args[1]), RedisVersion)
+			if err != nil {
+				return fmt.Errorf("ERR Exporting RDB file: %s", err)
+			}
+		case "replica", "changes", "snapshot":
+			return replicationSubcommand(r)
+		default:
+			return fmt.Errorf("ERR unknown subcommand '%s'. Try BIGDIS HELP.", r.Args[0])
+		}
+
+		reply := &IntegerReply{
+			number: keys,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
+
+// replicationSubcommand runs the subcommands of BIGDIS the replicas call:
+//
+//	BIGDIS REPLICA port marks the client as a replica listening on port
+//	BIGDIS CHANGES replid offset count block-ms returns the changes following offset, null when a full resync is needed
+//	BIGDIS SNAPSHOT returns the replication ID, the offset and the RDB snapshot of the keys at that offset
+func replicationSubcommand(r *Request) error {
+	var reply ReplyWriter
+	switch strings.ToLower(string(r.Args[0])) {
+	case "replica":
+		if len(r.Args) != 2 {
+			return wrongNumberArgs("bigdis|replica")
+		}
+
+		port, err := strconv.Atoi(string(r.Args[1]))
+		if err != nil || port < 0 || port > 65535 {
+			return errInvalidReplicaPort
+		}
+		r.Client.SetReplica(port)
+
+		reply = NewStatusReply("OK")
+	case "changes":
+		if len(r.Args) != 5 {
+			return wrongNumberArgs("bigdis|changes")
+		}
+
+		offset, err1 := strconv.ParseInt(string(r.Args[2]), 10, 64)
+		count, err2 := strconv.Atoi(string(r.Args[3]))
+		block, err3 := strconv.Atoi(string(r.Args[4]))
+		if err1 != nil || err2 != nil || err3 != nil || count < 1 || block < 0 {
+			return utils.ErrWrongSyntax
+		}
+		r.Client.AckReplica(offset)
+
+		changes, err := storage.Changes(string(r.Args[1]), offset, count)
+		if len(changes) == 0 && block > 0 && err == nil {
+			if err := storage.WaitChanges(offset, time.Duration(block)*time.Millisecond); err != nil {
+				return err
+			}
+			changes, err = storage.Changes(string(r.Args[1]), offset, count)
+		}
+		if err == storage.ErrChangesUnavailable {
+			reply = &NullReply{Array: true}
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		values := make([]any, len(changes))
+		for i, change := range changes {
+			args := make([]any, len(change.Args))
+			for j, arg := range change.Args {
+				args[j] = arg
+			}
+			values[i] = []any{int(change.Offset), change.DB, args}
+		}
+		reply = &MultiBulkReply{
+			values: values,
+		}
+	case "snapshot":
+		if len(r.Args) != 1 {
+			return wrongNumberArgs("bigdis|snapshot")
+		}
+
+		snapshot, err := storage.SnapshotRDB(RedisVersion)
+		if err != nil {
+			return err
+		}
+		defer snapshot.Close()
+
+		reply = &snapshotReply{snapshot: snapshot}
+	}
+
+	if _, err := reply.WriteTo(r.Conn); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// snapshotReply is the reply of BIGDIS SNAPSHOT: the replication ID, the offset and the RDB file,
+// copied from the disk to the client
+type snapshotReply struct {
+	snapshot *storage.RDBSnapshot
+}
+
+func (r *snapshotReply) WriteTo(w io.Writer) (int64, error) {
+	header := fmt.Sprintf("*3\r\n$%d\r\n%s\r\n:%d\r\n$%d\r\n", len(r.snapshot.ReplID), r.snapshot.ReplID, r.snapshot.Offset, r.snapshot.Size)
+	n, err := io.WriteString(w, header)
+	wrote := int64(n)
+	if err != nil {
+		return wrote, err
+	}
+
+	copied, err := io.Copy(w, r.snapshot)
+	wrote += copied
+	if err != nil {
+		return wrote, err
+	}
+
+	n, err = io.WriteString(w, "\r\n")
+	return wrote + int64(n), err
+}
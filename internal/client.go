@@ -0,0 +1,715 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errNoProto          = errors.New("NOPROTO unsupported protocol version")
+	errProtoNotInteger  = errors.New("ERR Protocol version is not an integer or out of range")
+	errWrongPass        = errors.New("WRONGPASS invalid username-password pair or user is disabled.")
+	errInvalidName      = errors.New("ERR Client names cannot contain spaces, newlines or special characters.")
+	errHelloSyntaxError = "ERR Syntax error in HELLO option '%s'"
+	errNoSuchClient     = errors.New("ERR No such client")
+	errClientSyntax     = errors.New("ERR syntax error")
+	errTimeoutNegative  = errors.New("ERR timeout is negative")
+	errTimeoutInvalid   = errors.New("ERR timeout is not an integer or out of range")
+	errClientID         = "ERR Invalid client ID"
+)
+
+// replyMode is set by CLIENT REPLY, a skip only lasts for the next command
+type replyMode int
+
+const (
+	replyOn replyMode = iota
+	replyOff
+	replySkip
+)
+
+// lastClientID is the ID of the last client connected, IDs are never reused
+var lastClientID atomic.Int64
+
+// Client is a connection along with the state negotiated by the client
+type Client struct {
+	net.Conn
+	ID         int64
+	Created    time.Time
+	Subscriber *Subscriber
+
+	protocol atomic.Int32
+	closing  atomic.Bool // killed by its own CLIENT KILL, closed once the reply is written
+
+	lock        sync.Mutex
+	name        string
+	user        *User // nil until the client authenticates
+	db          string
+	lastCommand string
+	lastActive  time.Time
+	multi       int // number of commands queued by MULTI, -1 outside of it
+	noEvict     bool
+	reply       replyMode
+
+	// a replica following the server gives its listening port, then acknowledges the offsets it reached
+	replica       bool
+	replicaPort   int
+	replicaOffset int64
+	replicaAck    time.Time
+}
+
+func NewClient(conn net.Conn) *Client {
+	now := time.Now()
+	client := &Client{
+		Conn:        conn,
+		ID:          lastClientID.Add(1),
+		Created:     now,
+		db:          "0",
+		lastCommand: "NULL",
+		lastActive:  now,
+		multi:       -1,
+	}
+	client.protocol.Store(2)
+	client.user = defaultLogin()
+
+	return client
+}
+
+// clients are the connected clients by ID
+var clients = struct {
+	sync.RWMutex
+	byID map[int64]*Client
+}{
+	byID: map[int64]*Client{},
+}
+
+// AddClient makes a client visible to CLIENT LIST and CLIENT KILL
+func AddClient(client *Client) {
+	clients.Lock()
+	clients.byID[client.ID] = client
+	clients.Unlock()
+}
+
+func RemoveClient(client *Client) {
+	clients.Lock()
+	delete(clients.byID, client.ID)
+	clients.Unlock()
+}
+
+// sortedClients returns the connected clients ordered by ID
+func sortedClients() []*Client {
+	clients.RLock()
+	list := make([]*Client, 0, len(clients.byID))
+	for _, client := range clients.byID {
+		list = append(list, client)
+	}
+	clients.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	return list
+}
+
+// Executed records the command the client is running and the database it runs in
+func (c *Client) Executed(request *Request, db []byte) {
+	name := request.Name
+	if command, exists := commandTable[name]; exists && command.hasSubcommands() && len(request.Args) > 0 {
+		name += "|" + strings.ToLower(string(request.Args[0]))
+	}
+
+	c.lock.Lock()
+	c.db = string(db)
+	c.lastCommand = name
+	c.lastActive = time.Now()
+	c.lock.Unlock()
+}
+
+// Selected records the database the client switched to
+func (c *Client) Selected(db []byte) {
+	c.lock.Lock()
+	c.db = string(db)
+	c.lock.Unlock()
+}
+
+// SetQueued records the number of commands queued by MULTI, -1 outside of it
+func (c *Client) SetQueued(queued int) {
+	c.lock.Lock()
+	c.multi = queued
+	c.lock.Unlock()
+}
+
+// Muted tells whether the reply to the next command must be dropped, it consumes a CLIENT REPLY SKIP
+func (c *Client) Muted() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	switch c.reply {
+	case replyOff:
+		return true
+	case replySkip:
+		c.reply = replyOn
+		return true
+	}
+
+	return false
+}
+
+// info describes the client the way CLIENT LIST does
+func (c *Client) info() string {
+	now := time.Now()
+	channels, patterns := 0, 0
+	if c.Subscriber != nil {
+		channels, patterns = c.Subscriber.subscriptions()
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var flags string
+	if c.lastCommand == "monitor" {
+		// a monitor never runs another command
+		flags += "O"
+	}
+	if channels+patterns > 0 {
+		flags += "P"
+	}
+	if c.multi >= 0 {
+		flags += "x"
+	}
+	if c.replica {
+		flags += "S"
+	}
+	if c.noEvict {
+		flags += "e"
+	}
+	if flags == "" {
+		flags = "N"
+	}
+
+	user := ""
+	if c.user != nil {
+		user = c.user.Name
+	}
+
+	return fmt.Sprintf("id=%d addr=%s laddr=%s fd=-1 name=%s age=%d idle=%d flags=%s db=%s sub=%d psub=%d ssub=0 multi=%d user=%s resp=%d cmd=%s",
+		c.ID, c.Addr(), c.localAddr(), c.name, int(now.Sub(c.Created).Seconds()), int(now.Sub(c.lastActive).Seconds()),
+		flags, c.db, channels, patterns, c.multi, user, c.Protocol(), c.lastCommand)
+}
+
+// localAddr is the address the client connected to, the path of the socket for the unix socket
+func (c *Client) localAddr() string {
+	if c.RemoteAddr().Network() == "unix" {
+		return "unix:" + c.LocalAddr().String()
+	}
+
+	return c.LocalAddr().String()
+}
+
+// Addr is the address of the client the way Redis shows it, unix:<path> for the clients of the unix socket
+func (c *Client) Addr() string {
+	if c.RemoteAddr().Network() == "unix" {
+		return "unix:" + c.LocalAddr().String()
+	}
+
+	return c.RemoteAddr().String()
+}
+
+// Closing tells whether the connection must be closed after the reply of the current command
+func (c *Client) Closing() bool {
+	return c.closing.Load()
+}
+
+// Protocol is the RESP version the replies are written with
+func (c *Client) Protocol() int {
+	return int(c.protocol.Load())
+}
+
+func (c *Client) Name() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.name
+}
+
+func (c *Client) SetName(name []byte) error {
+	for _, char := range name {
+		if char < '!' || char > '~' {
+			return errInvalidName
+		}
+	}
+
+	c.lock.Lock()
+	c.name = string(name)
+	c.lock.Unlock()
+
+	return nil
+}
+
+// User is the user the client is authenticated with, nil if it isn't
+func (c *Client) User() *User {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.user
+}
+
+func (c *Client) SetUser(user *User) {
+	c.lock.Lock()
+	c.user = user
+	c.lock.Unlock()
+}
+
+// authenticated tells whether the user of the client still exists and is enabled
+func (c *Client) authenticated() bool {
+	user := c.User()
+
+	acl.RLock()
+	defer acl.RUnlock()
+
+	return user != nil && !user.deleted && user.enabled
+}
+
+func registerClientHandlers(m map[string]HandlerFn) {
+	m["hello"] = func(r *Request) error {
+		protocol := r.Client.Protocol()
+		var username, password, name []byte
+		if len(r.Args) > 0 {
+			version, err := strconv.Atoi(string(r.Args[0]))
+			if err != nil {
+				return errProtoNotInteger
+			}
+			if version != 2 && version != 3 {
+				return errNoProto
+			}
+			protocol = version
+
+			// the options are all checked before any of them is applied
+			for i := 1; i < len(r.Args); i++ {
+				switch option := strings.ToLower(string(r.Args[i])); {
+				case option == "auth" && i+2 < len(r.Args):
+					username, password = r.Args[i+1], r.Args[i+2]
+					i += 2
+				case option == "setname" && i+1 < len(r.Args):
+					name = r.Args[i+1]
+					i++
+				default:
+					return fmt.Errorf(errHelloSyntaxError, r.Args[i])
+				}
+			}
+		}
+
+		var user *User
+		if username != nil {
+			var err error
+			if user, err = authenticate(username, password); err != nil {
+				return err
+			}
+		} else if !r.Client.authenticated() {
+			return errHelloNoAuth
+		}
+		if name != nil {
+			if err := r.Client.SetName(name); err != nil {
+				return err
+			}
+		}
+		if user != nil {
+			r.Client.SetUser(user)
+		}
+		r.Client.protocol.Store(int32(protocol))
+
+		reply := &MapReply{
+			values: []any{
+				"server", "bigdis",
+				"version", RedisVersion,
+				"proto", protocol,
+				"id", int(r.Client.ID),
+				"mode", "standalone",
+				"role", role(),
+				"modules", []any{},
+			},
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["client"] = func(r *Request) error {
+		var reply ReplyWriter
+		switch subcommand := strings.ToLower(string(r.Args[0])); subcommand {
+		case "id":
+			if len(r.Args) != 1 {
+				return wrongNumberArgs("client|id")
+			}
+
+			reply = &IntegerReply{number: int(r.Client.ID)}
+		case "setname":
+			if len(r.Args) != 2 {
+				return wrongNumberArgs("client|setname")
+			}
+			if err := r.Client.SetName(r.Args[1]); err != nil {
+				return err
+			}
+
+			reply = NewStatusReply("OK")
+		case "getname":
+			if len(r.Args) != 1 {
+				return wrongNumberArgs("client|getname")
+			}
+
+			var name []byte
+			if value := r.Client.Name(); value != "" {
+				name = []byte(value)
+			}
+			reply = &BulkReply{value: name}
+		case "info":
+			if len(r.Args) != 1 {
+				return wrongNumberArgs("client|info")
+			}
+
+			reply = &VerbatimReply{format: "txt", value: []byte(r.Client.info() + "\n")}
+		case "list":
+			list, err := listClients(r.Args[1:])
+			if err != nil {
+				return err
+			}
+
+			var lines strings.Builder
+			for _, client := range list {
+				lines.WriteString(client.info() + "\n")
+			}
+			reply = &VerbatimReply{format: "txt", value: []byte(lines.String())}
+		case "kill":
+			killed, err := killClients(r.Client, r.Args[1:])
+			if err != nil {
+				return err
+			}
+
+			// the old form with only an address replies OK
+			if len(r.Args) == 2 {
+				reply = NewStatusReply("OK")
+			} else {
+				reply = &IntegerReply{number: killed}
+			}
+		case "pause":
+			if len(r.Args) != 2 && len(r.Args) != 3 {
+				return wrongNumberArgs("client|pause")
+			}
+
+			timeout, err := strconv.ParseInt(string(r.Args[1]), 10, 64)
+			if err != nil {
+				return errTimeoutInvalid
+			}
+			if timeout < 0 {
+				return errTimeoutNegative
+			}
+			writes := false
+			if len(r.Args) == 3 {
+				switch strings.ToLower(string(r.Args[2])) {
+				case "write":
+					writes = true
+				case "all":
+				default:
+					return errClientSyntax
+				}
+			}
+			pauseClients(time.Duration(timeout)*time.Millisecond, writes)
+
+			reply = NewStatusReply("OK")
+		case "unpause":
+			if len(r.Args) != 1 {
+				return wrongNumberArgs("client|unpause")
+			}
+			unpauseClients()
+
+			reply = NewStatusReply("OK")
+		case "no-evict":
+			if len(r.Args) != 2 {
+				return wrongNumberArgs("client|no-evict")
+			}
+
+			// nothing is ever evicted, the flag is only kept for CLIENT LIST
+			var noEvict bool
+			switch strings.ToLower(string(r.Args[1])) {
+			case "on":
+				noEvict = true
+			case "off":
+			default:
+				return errClientSyntax
+			}
+			r.Client.lock.Lock()
+			r.Client.noEvict = noEvict
+			r.Client.lock.Unlock()
+
+			reply = NewStatusReply("OK")
+		case "reply":
+			if len(r.Args) != 2 {
+				return wrongNumberArgs("client|reply")
+			}
+
+			mode := replyOn
+			switch strings.ToLower(string(r.Args[1])) {
+			case "on":
+			case "off":
+				mode = replyOff
+			case "skip":
+				mode = replySkip
+			default:
+				return errClientSyntax
+			}
+			r.Client.lock.Lock()
+			r.Client.reply = mode
+			r.Client.lock.Unlock()
+
+			// only ON is confirmed, and even when the replies were off
+			if mode != replyOn {
+				return nil
+			}
+			return r.Subscriber.Reply(NewStatusReply("OK"))
+		default:
+			return fmt.Errorf("ERR unknown subcommand '%s'. Try CLIENT HELP.", r.Args[0])
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
+
+// listClients returns the clients selected by the TYPE and ID filters of CLIENT LIST
+func listClients(args [][]byte) ([]*Client, error) {
+	var kind string
+	var ids map[int64]struct{}
+	switch {
+	case len(args) == 0:
+	case len(args) == 2 && strings.EqualFold(string(args[0]), "type"):
+		kind = strings.ToLower(string(args[1]))
+		if kind != "normal" && kind != "pubsub" && kind != "master" && kind != "replica" {
+			return nil, fmt.Errorf("ERR Unknown client type '%s'", args[1])
+		}
+	case len(args) > 1 && strings.EqualFold(string(args[0]), "id"):
+		ids = map[int64]struct{}{}
+		for _, arg := range args[1:] {
+			id, err := strconv.ParseInt(string(arg), 10, 64)
+			if err != nil || id <= 0 {
+				return nil, fmt.Errorf(errClientID+" '%s'", arg)
+			}
+			ids[id] = struct{}{}
+		}
+	default:
+		return nil, errClientSyntax
+	}
+
+	var list []*Client
+	for _, client := range sortedClients() {
+		if ids != nil {
+			if _, selected := ids[client.ID]; !selected {
+				continue
+			}
+		}
+		if kind != "" && client.kind() != kind {
+			continue
+		}
+		list = append(list, client)
+	}
+
+	return list, nil
+}
+
+// SetReplica marks the client as a replica listening on port, 0 keeps the port it already told
+func (c *Client) SetReplica(port int) {
+	c.lock.Lock()
+	c.replica = true
+	if port > 0 {
+		c.replicaPort = port
+	}
+	c.replicaAck = time.Now()
+	c.lock.Unlock()
+}
+
+// AckReplica records the offset a replica reached
+func (c *Client) AckReplica(offset int64) {
+	c.lock.Lock()
+	c.replicaOffset = offset
+	c.replicaAck = time.Now()
+	c.lock.Unlock()
+}
+
+// replicaInfo returns the listening port, the offset and the time of the last acknowledgement of a replica,
+// ok is false for the other clients
+func (c *Client) replicaInfo() (port int, offset int64, ack time.Time, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.replicaPort, c.replicaOffset, c.replicaAck, c.replica
+}
+
+// kind is the type of the client for the TYPE filters
+func (c *Client) kind() string {
+	if _, _, _, ok := c.replicaInfo(); ok {
+		return "replica"
+	}
+	if c.Subscriber != nil {
+		if channels, patterns := c.Subscriber.subscriptions(); channels+patterns > 0 {
+			return "pubsub"
+		}
+	}
+
+	return "normal"
+}
+
+// killClients closes the connections matching the filters of CLIENT KILL, or the one at the address of the old form.
+// The clients leave the registry once their connection has noticed it is closed.
+func killClients(self *Client, args [][]byte) (int, error) {
+	if len(args) == 1 {
+		for _, client := range sortedClients() {
+			if client.Addr() == string(args[0]) {
+				client.Conn.Close()
+				return 1, nil
+			}
+		}
+
+		return 0, errNoSuchClient
+	}
+	if len(args)%2 != 0 {
+		return 0, errClientSyntax
+	}
+
+	var id int64
+	var addr, laddr, user, kind string
+	skipMe := true
+	for i := 0; i < len(args); i += 2 {
+		value := string(args[i+1])
+		switch strings.ToLower(string(args[i])) {
+		case "id":
+			var err error
+			if id, err = strconv.ParseInt(value, 10, 64); err != nil || id <= 0 {
+				return 0, fmt.Errorf(errClientID+" '%s'", value)
+			}
+		case "addr":
+			addr = value
+		case "laddr":
+			laddr = value
+		case "user":
+			user = value
+		case "type":
+			kind = strings.ToLower(value)
+			if kind != "normal" && kind != "pubsub" && kind != "master" && kind != "replica" {
+				return 0, fmt.Errorf("ERR Unknown client type '%s'", value)
+			}
+		case "skipme":
+			switch strings.ToLower(value) {
+			case "yes":
+				skipMe = true
+			case "no":
+				skipMe = false
+			default:
+				return 0, errClientSyntax
+			}
+		default:
+			return 0, errClientSyntax
+		}
+	}
+
+	var killed int
+	for _, client := range sortedClients() {
+		switch {
+		case id != 0 && client.ID != id,
+			addr != "" && client.Addr() != addr,
+			laddr != "" && client.localAddr() != laddr,
+			user != "" && (client.User() == nil || client.User().Name != user),
+			kind != "" && client.kind() != kind,
+			skipMe && client == self:
+			continue
+		}
+
+		// like Redis, a client killing itself gets the reply first
+		if client == self {
+			self.closing.Store(true)
+		} else {
+			client.Conn.Close()
+		}
+		killed++
+	}
+
+	return killed, nil
+}
+
+// pause is the state of CLIENT PAUSE, resume is closed when the clients can run their commands again
+var pause = struct {
+	sync.Mutex
+	until  time.Time
+	writes bool // only the write commands wait
+	resume chan struct{}
+}{}
+
+func pauseClients(timeout time.Duration, writes bool) {
+	pause.Lock()
+	defer pause.Unlock()
+
+	until := time.Now().Add(timeout)
+	if pause.resume == nil {
+		pause.resume = make(chan struct{})
+		pause.until, pause.writes = until, writes
+		return
+	}
+
+	// like Redis, a new pause can only extend the current one or make it stricter
+	if until.After(pause.until) {
+		pause.until = until
+	}
+	pause.writes = pause.writes && writes
+}
+
+func unpauseClients() {
+	pause.Lock()
+	defer pause.Unlock()
+
+	if pause.resume != nil {
+		close(pause.resume)
+		pause.resume = nil
+	}
+}
+
+// WaitPause blocks a command while the clients are paused, EXEC is given along with the commands it runs.
+// CLIENT itself is never paused, so that CLIENT UNPAUSE can always be run
+func WaitPause(commands ...*Command) {
+	write := false
+	for _, command := range commands {
+		if command.Name == "client" {
+			return
+		}
+		write = write || command.hasFlag("write")
+	}
+
+	for {
+		pause.Lock()
+		if pause.resume != nil && !time.Now().Before(pause.until) {
+			close(pause.resume)
+			pause.resume = nil
+		}
+		resume, until, writes := pause.resume, pause.until, pause.writes
+		pause.Unlock()
+
+		if resume == nil || (writes && !write) {
+			return
+		}
+
+		timer := time.NewTimer(time.Until(until))
+		select {
+		case <-resume:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
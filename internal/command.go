@@ -0,0 +1,489 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"bigdis/utils"
+)
+
+/*
+Command describes a command the way Redis' command table does.
+
+Arity counts the command name too, a negative arity -N means at least N.
+The keys are the arguments from FirstKey to LastKey, every Step of them,
+LastKey being negative when it counts from the end. Commands taking
+a number of keys followed by the keys have NumKeys set to the position of the number.
+*/
+type Command struct {
+	Name       string
+	Handler    HandlerFn // nil for the commands run by the server itself, as MULTI or MONITOR
+	Arity      int
+	Flags      []string
+	FirstKey   int
+	LastKey    int
+	Step       int
+	NumKeys    int
+	Group      string
+	Summary    string
+	Categories []string
+}
+
+// commandTable holds the metadata of every command, NewV1Handler attaches the handlers to it
+var commandTable = map[string]*Command{
+	// connection
+	"ping":   {Arity: -1, Flags: []string{"fast"}, Group: "connection", Summary: "Returns the server's liveliness response."},
+	"select": {Arity: 2, Flags: []string{"loading", "stale", "fast"}, Group: "connection", Summary: "Changes the selected database."},
+	"auth":   {Arity: -2, Flags: []string{"noscript", "loading", "stale", "fast", "no_auth"}, Group: "connection", Summary: "Authenticates the connection."},
+	"client": {Arity: -2, Flags: []string{"noscript", "loading", "stale"}, Group: "connection", Summary: "Inspects, names, kills or pauses the client connections."},
+	"hello":  {Arity: -1, Flags: []string{"noscript", "loading", "stale", "fast", "no_auth"}, Group: "connection", Summary: "Handshakes with the Redis server."},
+	"quit":   {Arity: -1, Flags: []string{"loading", "stale", "fast", "no_auth"}, Group: "connection", Summary: "Closes the connection."},
+
+	// server
+	"acl":          {Arity: -2, Flags: []string{"admin", "noscript", "loading", "stale"}, Group: "server", Summary: "Manages the users, their passwords and permissions."},
+	"command":      {Arity: -1, Flags: []string{"loading", "stale"}, Group: "server", Summary: "Returns detailed information about all commands."},
+	"config":       {Arity: -2, Flags: []string{"admin", "noscript", "loading", "stale"}, Group: "server", Summary: "Gets, sets, resets the statistics or rewrites the configuration."},
+	"info":         {Arity: -1, Flags: []string{"loading", "stale"}, Group: "server", Summary: "Returns information and statistics about the server."},
+	"save":         {Arity: 1, Flags: []string{"admin", "noscript", "no_multi"}, Group: "server", Summary: "Synchronously saves a snapshot of the database to the dump path."},
+	"bgsave":       {Arity: -1, Flags: []string{"admin", "noscript"}, Group: "server", Summary: "Asynchronously saves a snapshot of the database to the dump path."},
+	"bgrewriteaof": {Arity: 1, Flags: []string{"admin", "noscript"}, Group: "server", Summary: "Asynchronously rewrites the append-only file to a compact base of the keys."},
+	"bigdis":       {Arity: -2, Flags: []string{"admin", "noscript", "no_multi"}, Group: "server", Summary: "Imports or exports the keys as a Redis RDB file, and serves the changes to the replicas."},
+	"replicaof":    {Arity: 3, Flags: []string{"admin", "noscript", "stale"}, Group: "server", Summary: "Configures a server as replica of another, or promotes it to a primary."},
+	"psync":        {Arity: -3, Flags: []string{"admin", "noscript", "no_multi"}, Group: "server", Summary: "An internal command used in replication."},
+	"sync":         {Arity: 1, Flags: []string{"admin", "noscript", "no_multi"}, Group: "server", Summary: "An internal command used in replication."},
+	"replconf":     {Arity: -1, Flags: []string{"admin", "noscript", "loading", "stale"}, Group: "server", Summary: "An internal command for configuring the replication stream."},
+	"role":         {Arity: 1, Flags: []string{"noscript", "loading", "stale", "fast"}, Group: "server", Summary: "Returns the replication role."},
+	"lastsave":     {Arity: 1, Flags: []string{"loading", "stale", "fast"}, Group: "server", Summary: "Returns the Unix timestamp of the last successful snapshot."},
+	"shutdown":     {Arity: -1, Flags: []string{"admin", "noscript", "loading", "stale", "no_multi"}, Group: "server", Summary: "Synchronously checkpoints the database and shuts down the server."},
+	"monitor":      {Arity: 1, Flags: []string{"admin", "noscript", "loading", "stale"}, Group: "server", Summary: "Listens for all requests received by the server in real-time."},
+	"flushdb":      {Arity: -1, Flags: []string{"write"}, Group: "server", Summary: "Removes all keys from the current database."},
+	"flushall":     {Arity: -1, Flags: []string{"write"}, Group: "server", Summary: "Removes all keys from all databases."},
+
+	// generic
+	"del":         {Arity: -2, Flags: []string{"write"}, FirstKey: 1, LastKey: -1, Step: 1, Group: "generic", Summary: "Deletes one or more keys."},
+	"exists":      {Arity: -2, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: -1, Step: 1, Group: "generic", Summary: "Determines whether one or more keys exist."},
+	"keys":        {Arity: 2, Flags: []string{"readonly"}, Group: "generic", Summary: "Returns all key names that match a pattern."},
+	"scan":        {Arity: -2, Flags: []string{"readonly"}, Group: "generic", Summary: "Iterates over the key names in the database."},
+	"type":        {Arity: 2, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "generic", Summary: "Determines the type of value stored at a key."},
+	"expire":      {Arity: -3, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "generic", Summary: "Sets the expiration time of a key in seconds."},
+	"pexpire":     {Arity: -3, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "generic", Summary: "Sets the expiration time of a key in milliseconds."},
+	"expireat":    {Arity: -3, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "generic", Summary: "Sets the expiration time of a key to a Unix timestamp."},
+	"pexpireat":   {Arity: -3, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "generic", Summary: "Sets the expiration time of a key to a Unix milliseconds timestamp."},
+	"ttl":         {Arity: 2, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "generic", Summary: "Returns the expiration time in seconds of a key."},
+	"pttl":        {Arity: 2, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "generic", Summary: "Returns the expiration time in milliseconds of a key."},
+	"expiretime":  {Arity: 2, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "generic", Summary: "Returns the expiration time of a key as a Unix timestamp."},
+	"pexpiretime": {Arity: 2, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "generic", Summary: "Returns the expiration time of a key as a Unix milliseconds timestamp."},
+	"persist":     {Arity: 2, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "generic", Summary: "Removes the expiration time of a key."},
+
+	// string
+	"get":    {Arity: 2, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "string", Summary: "Returns the string value of a key."},
+	"set":    {Arity: -3, Flags: []string{"write", "denyoom"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "string", Summary: "Sets the string value of a key, ignoring its type. The key is created if it doesn't exist."},
+	"getdel": {Arity: 2, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "string", Summary: "Returns the string value of a key after deleting the key."},
+	"getset": {Arity: 3, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "string", Summary: "Returns the previous string value of a key after setting it to a new value."},
+	"setnx":  {Arity: 3, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "string", Summary: "Set the string value of a key only when the key doesn't exist."},
+	"strlen": {Arity: 2, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "string", Summary: "Returns the length of a string value."},
+	"append": {Arity: 3, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "string", Summary: "Appends a string to the value of a key. Creates the key if it doesn't exist."},
+	"incr":   {Arity: 2, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "string", Summary: "Increments the integer value of a key by one."},
+	"incrby": {Arity: 3, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "string", Summary: "Increments the integer value of a key by a number."},
+	"decr":   {Arity: 2, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "string", Summary: "Decrements the integer value of a key by one."},
+	"decrby": {Arity: 3, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "string", Summary: "Decrements a number from the integer value of a key."},
+	"mget":   {Arity: -2, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: -1, Step: 1, Group: "string", Summary: "Atomically returns the string values of one or more keys."},
+	"mset":   {Arity: -3, Flags: []string{"write", "denyoom"}, FirstKey: 1, LastKey: -1, Step: 2, Group: "string", Summary: "Atomically creates or modifies the string values of one or more keys."},
+	"msetnx": {Arity: -3, Flags: []string{"write", "denyoom"}, FirstKey: 1, LastKey: -1, Step: 2, Group: "string", Summary: "Atomically modifies the string values of one or more keys only when all keys don't exist."},
+
+	// hash
+	"hset":         {Arity: -4, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "hash", Summary: "Creates or modifies the value of a field in a hash."},
+	"hmset":        {Arity: -4, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "hash", Summary: "Sets the values of multiple fields."},
+	"hsetnx":       {Arity: 4, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "hash", Summary: "Sets the value of a field in a hash only when the field doesn't exist."},
+	"hget":         {Arity: 3, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "hash", Summary: "Returns the value of a field in a hash."},
+	"hmget":        {Arity: -3, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "hash", Summary: "Returns the values of all fields in a hash."},
+	"hdel":         {Arity: -3, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "hash", Summary: "Deletes one or more fields and their values from a hash. Deletes the hash if no fields remain."},
+	"hgetall":      {Arity: 2, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "hash", Summary: "Returns all fields and values in a hash."},
+	"hkeys":        {Arity: 2, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "hash", Summary: "Returns all fields in a hash."},
+	"hvals":        {Arity: 2, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "hash", Summary: "Returns all values in a hash."},
+	"hlen":         {Arity: 2, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "hash", Summary: "Returns the number of fields in a hash."},
+	"hexists":      {Arity: 3, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "hash", Summary: "Determines whether a field exists in a hash."},
+	"hstrlen":      {Arity: 3, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "hash", Summary: "Returns the length of the value of a field."},
+	"hincrby":      {Arity: 4, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "hash", Summary: "Increments the integer value of a field in a hash by a number."},
+	"hincrbyfloat": {Arity: 4, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "hash", Summary: "Increments the floating point value of a field by a number."},
+	"hrandfield":   {Arity: -2, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "hash", Summary: "Returns one or more random fields from a hash."},
+	"hscan":        {Arity: -3, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "hash", Summary: "Iterates over fields and values of a hash."},
+
+	// list
+	"lpush":     {Arity: -3, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "list", Summary: "Prepends one or more elements to a list. Creates the key if it doesn't exist."},
+	"rpush":     {Arity: -3, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "list", Summary: "Appends one or more elements to a list. Creates the key if it doesn't exist."},
+	"lpushx":    {Arity: -3, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "list", Summary: "Prepends one or more elements to a list only when the list exists."},
+	"rpushx":    {Arity: -3, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "list", Summary: "Appends an element to a list only when the list exists."},
+	"lpop":      {Arity: -2, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "list", Summary: "Returns the first elements in a list after removing it. Deletes the list if the last element was popped."},
+	"rpop":      {Arity: -2, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "list", Summary: "Returns and removes the last elements of a list. Deletes the list if the last element was popped."},
+	"llen":      {Arity: 2, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "list", Summary: "Returns the length of a list."},
+	"lrange":    {Arity: 4, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "list", Summary: "Returns a range of elements from a list."},
+	"lindex":    {Arity: 3, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "list", Summary: "Returns an element from a list by its index."},
+	"lset":      {Arity: 4, Flags: []string{"write", "denyoom"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "list", Summary: "Sets the value of an element in a list by its index."},
+	"linsert":   {Arity: 5, Flags: []string{"write", "denyoom"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "list", Summary: "Inserts an element before or after another element in a list."},
+	"lrem":      {Arity: 4, Flags: []string{"write"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "list", Summary: "Removes elements from a list. Deletes the list if the last element was removed."},
+	"ltrim":     {Arity: 4, Flags: []string{"write"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "list", Summary: "Removes elements from both ends a list. Deletes the list if all elements were trimmed."},
+	"lpos":      {Arity: -3, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "list", Summary: "Returns the index of matching elements in a list."},
+	"lmove":     {Arity: 5, Flags: []string{"write", "denyoom"}, FirstKey: 1, LastKey: 2, Step: 1, Group: "list", Summary: "Returns an element after popping it from one list and pushing it to another. Deletes the list if the last element was moved."},
+	"rpoplpush": {Arity: 3, Flags: []string{"write", "denyoom"}, FirstKey: 1, LastKey: 2, Step: 1, Group: "list", Summary: "Returns the last element of a list after removing and pushing it to another list. Deletes the list if the last element was popped."},
+
+	// set
+	"sadd":        {Arity: -3, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "set", Summary: "Adds one or more members to a set. Creates the key if it doesn't exist."},
+	"srem":        {Arity: -3, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "set", Summary: "Removes one or more members from a set. Deletes the set if the last member was removed."},
+	"smismember":  {Arity: -3, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "set", Summary: "Determines whether multiple members belong to a set."},
+	"sinter":      {Arity: -2, Flags: []string{"readonly"}, FirstKey: 1, LastKey: -1, Step: 1, Group: "set", Summary: "Returns the intersect of multiple sets."},
+	"sunion":      {Arity: -2, Flags: []string{"readonly"}, FirstKey: 1, LastKey: -1, Step: 1, Group: "set", Summary: "Returns the union of multiple sets."},
+	"sdiff":       {Arity: -2, Flags: []string{"readonly"}, FirstKey: 1, LastKey: -1, Step: 1, Group: "set", Summary: "Returns the difference of multiple sets."},
+	"sinterstore": {Arity: -3, Flags: []string{"write", "denyoom"}, FirstKey: 1, LastKey: -1, Step: 1, Group: "set", Summary: "Stores the intersect of multiple sets in a key."},
+	"sunionstore": {Arity: -3, Flags: []string{"write", "denyoom"}, FirstKey: 1, LastKey: -1, Step: 1, Group: "set", Summary: "Stores the union of multiple sets in a key."},
+	"sdiffstore":  {Arity: -3, Flags: []string{"write", "denyoom"}, FirstKey: 1, LastKey: -1, Step: 1, Group: "set", Summary: "Stores the difference of multiple sets in a key."},
+	"sintercard":  {Arity: -3, Flags: []string{"readonly"}, NumKeys: 1, Group: "set", Summary: "Returns the number of members of the intersect of multiple sets."},
+	"smembers":    {Arity: 2, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "set", Summary: "Returns all members of a set."},
+	"scard":       {Arity: 2, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "set", Summary: "Returns the number of members in a set."},
+	"sismember":   {Arity: 3, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "set", Summary: "Determines whether a member belongs to a set."},
+	"smove":       {Arity: 4, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 2, Step: 1, Group: "set", Summary: "Moves a member from one set to another."},
+	"spop":        {Arity: -2, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "set", Summary: "Returns one or more random members from a set after removing them. Deletes the set if the last member was popped."},
+	"srandmember": {Arity: -2, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "set", Summary: "Get one or multiple random members from a set."},
+	"sscan":       {Arity: -3, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "set", Summary: "Iterates over members of a set."},
+
+	// sorted set
+	"zadd":             {Arity: -4, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "sorted-set", Summary: "Adds one or more members to a sorted set, or updates their scores. Creates the key if it doesn't exist."},
+	"zincrby":          {Arity: 4, Flags: []string{"write", "denyoom", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "sorted-set", Summary: "Increments the score of a member in a sorted set."},
+	"zscore":           {Arity: 3, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "sorted-set", Summary: "Returns the score of a member in a sorted set."},
+	"zrank":            {Arity: -3, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "sorted-set", Summary: "Returns the index of a member in a sorted set ordered by ascending scores."},
+	"zrevrank":         {Arity: -3, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "sorted-set", Summary: "Returns the index of a member in a sorted set ordered by descending scores."},
+	"zrem":             {Arity: -3, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "sorted-set", Summary: "Removes one or more members from a sorted set. Deletes the sorted set if all members were removed."},
+	"zcard":            {Arity: 2, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "sorted-set", Summary: "Returns the number of members in a sorted set."},
+	"zcount":           {Arity: 4, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "sorted-set", Summary: "Returns the count of members in a sorted set that have scores within a range."},
+	"zlexcount":        {Arity: 4, Flags: []string{"readonly", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "sorted-set", Summary: "Returns the number of members in a sorted set within a lexicographical range."},
+	"zunionstore":      {Arity: -4, Flags: []string{"write", "denyoom"}, FirstKey: 1, LastKey: 1, Step: 1, NumKeys: 2, Group: "sorted-set", Summary: "Stores the union of multiple sorted sets in a key."},
+	"zinterstore":      {Arity: -4, Flags: []string{"write", "denyoom"}, FirstKey: 1, LastKey: 1, Step: 1, NumKeys: 2, Group: "sorted-set", Summary: "Stores the intersect of multiple sorted sets in a key."},
+	"zrange":           {Arity: -4, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "sorted-set", Summary: "Returns members in a sorted set within a range of indexes."},
+	"zrevrange":        {Arity: -4, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "sorted-set", Summary: "Returns members in a sorted set within a range of indexes in reverse order."},
+	"zrangebyscore":    {Arity: -4, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "sorted-set", Summary: "Returns members in a sorted set within a range of scores."},
+	"zrevrangebyscore": {Arity: -4, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "sorted-set", Summary: "Returns members in a sorted set within a range of scores in reverse order."},
+	"zpopmin":          {Arity: -2, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "sorted-set", Summary: "Returns the lowest-scoring members from a sorted set after removing them. Deletes the sorted set if the last member was popped."},
+	"zpopmax":          {Arity: -2, Flags: []string{"write", "fast"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "sorted-set", Summary: "Returns the highest-scoring members from a sorted set after removing them. Deletes the sorted set if the last member was popped."},
+	"zscan":            {Arity: -3, Flags: []string{"readonly"}, FirstKey: 1, LastKey: 1, Step: 1, Group: "sorted-set", Summary: "Iterates over members and scores of a sorted set."},
+
+	// pubsub
+	"subscribe":    {Arity: -2, Flags: []string{"pubsub", "noscript", "loading", "stale"}, Group: "pubsub", Summary: "Listens for messages published to channels."},
+	"psubscribe":   {Arity: -2, Flags: []string{"pubsub", "noscript", "loading", "stale"}, Group: "pubsub", Summary: "Listens for messages published to channels that match one or more patterns."},
+	"unsubscribe":  {Arity: -1, Flags: []string{"pubsub", "noscript", "loading", "stale"}, Group: "pubsub", Summary: "Stops listening to messages posted to channels."},
+	"punsubscribe": {Arity: -1, Flags: []string{"pubsub", "noscript", "loading", "stale"}, Group: "pubsub", Summary: "Stops listening to messages published to channels that match one or more patterns."},
+	"publish":      {Arity: 3, Flags: []string{"pubsub", "loading", "stale", "fast"}, Group: "pubsub", Summary: "Posts a message to a channel."},
+	"pubsub":       {Arity: -2, Flags: []string{"pubsub", "loading", "stale"}, Group: "pubsub", Summary: "Introspects the Pub/Sub channels and patterns."},
+
+	// transactions
+	"multi":   {Arity: 1, Flags: []string{"noscript", "loading", "stale", "fast"}, Group: "transactions", Summary: "Starts a transaction."},
+	"exec":    {Arity: 1, Flags: []string{"noscript", "loading", "stale"}, Group: "transactions", Summary: "Executes all commands in a transaction."},
+	"discard": {Arity: 1, Flags: []string{"noscript", "loading", "stale", "fast"}, Group: "transactions", Summary: "Discards a transaction."},
+	"watch":   {Arity: -2, Flags: []string{"noscript", "loading", "stale", "fast"}, FirstKey: 1, LastKey: -1, Step: 1, Group: "transactions", Summary: "Monitors changes to keys to determine the execution of a transaction."},
+	"unwatch": {Arity: 1, Flags: []string{"noscript", "loading", "stale", "fast"}, Group: "transactions", Summary: "Forgets about watched keys of a transaction."},
+}
+
+// groupCategories maps the command groups to their ACL category
+var groupCategories = map[string]string{
+	"connection":   "@connection",
+	"server":       "@admin",
+	"generic":      "@keyspace",
+	"string":       "@string",
+	"hash":         "@hash",
+	"list":         "@list",
+	"set":          "@set",
+	"sorted-set":   "@sortedset",
+	"pubsub":       "@pubsub",
+	"transactions": "@transaction",
+}
+
+// dangerousCommands can harm the server or the data when used carelessly
+var dangerousCommands = map[string]struct{}{
+	"keys":         {},
+	"flushdb":      {},
+	"flushall":     {},
+	"config":       {},
+	"monitor":      {},
+	"shutdown":     {},
+	"save":         {},
+	"bgsave":       {},
+	"bgrewriteaof": {},
+	"lastsave":     {},
+	"acl":          {},
+	"info":         {},
+	"client":       {},
+	"bigdis":       {},
+	"replicaof":    {},
+	"role":         {},
+	"psync":        {},
+	"sync":         {},
+	"replconf":     {},
+}
+
+// containerCommands are run with a subcommand, which Redis shows along with the command like config|get
+var containerCommands = map[string]struct{}{
+	"command": {},
+	"config":  {},
+	"acl":     {},
+	"client":  {},
+	"bigdis":  {},
+}
+
+// writeSubcommands write keys although their command doesn't always do, a read only replica refuses them
+var writeSubcommands = map[string]struct{}{
+	"bigdis|import-rdb": {},
+}
+
+func init() {
+	for name, command := range commandTable {
+		command.Name = name
+		command.Categories = commandCategories(command)
+	}
+}
+
+// commandCategories derives the ACL categories of a command from its flags and its group
+func commandCategories(command *Command) []string {
+	var categories []string
+	if command.hasFlag("write") {
+		categories = append(categories, "@write")
+	}
+	if command.hasFlag("readonly") {
+		categories = append(categories, "@read")
+	}
+	if command.hasFlag("fast") {
+		categories = append(categories, "@fast")
+	} else {
+		categories = append(categories, "@slow")
+	}
+	if category := groupCategories[command.Group]; category != "@admin" || command.hasFlag("admin") {
+		categories = append(categories, category)
+	}
+	if _, dangerous := dangerousCommands[command.Name]; dangerous {
+		categories = append(categories, "@dangerous")
+	}
+
+	return categories
+}
+
+func (c *Command) hasSubcommands() bool {
+	_, container := containerCommands[c.Name]
+	return container
+}
+
+func (c *Command) hasFlag(flag string) bool {
+	for _, f := range c.Flags {
+		if f == flag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// writes tells whether the command run with args writes keys
+func (c *Command) writes(args [][]byte) bool {
+	if c.hasFlag("write") {
+		return true
+	}
+	if !c.hasSubcommands() || len(args) == 0 {
+		return false
+	}
+
+	_, writes := writeSubcommands[c.Name+"|"+strings.ToLower(string(args[0]))]
+	return writes
+}
+
+// CheckArity validates the number of arguments, for every command alike
+func (c *Command) CheckArity(args [][]byte) error {
+	if (c.Arity > 0 && len(args)+1 != c.Arity) || (c.Arity < 0 && len(args)+1 < -c.Arity) {
+		return fmt.Errorf("ERR "+utils.WrongNumberArgs, c.Name)
+	}
+
+	return nil
+}
+
+// Keys returns the positions in args of the keys of the command, args starting with the command name
+func (c *Command) Keys(args [][]byte) ([]int, error) {
+	var positions []int
+	if c.FirstKey > 0 {
+		last := c.LastKey
+		if last < 0 {
+			last += len(args)
+		}
+
+		for i := c.FirstKey; i <= last && i < len(args); i += c.Step {
+			positions = append(positions, i)
+		}
+	}
+
+	if c.NumKeys > 0 {
+		var numKeys int
+		if _, err := fmt.Sscanf(string(args[c.NumKeys]), "%d", &numKeys); err != nil || numKeys < 1 || c.NumKeys+numKeys >= len(args) {
+			return nil, errors.New("ERR Invalid arguments specified for command")
+		}
+
+		for i := c.NumKeys + 1; i <= c.NumKeys+numKeys; i++ {
+			positions = append(positions, i)
+		}
+	}
+
+	return positions, nil
+}
+
+// info is the reply to COMMAND INFO for the command
+func (c *Command) info() []any {
+	flags := make([]any, len(c.Flags))
+	for i, flag := range c.Flags {
+		flags[i] = NewStatusReply(flag)
+	}
+
+	categories := make([]any, len(c.Categories))
+	for i, category := range c.Categories {
+		categories[i] = NewStatusReply(category)
+	}
+
+	return []any{c.Name, c.Arity, flags, c.FirstKey, c.LastKey, c.Step, categories, []any{}, []any{}, []any{}}
+}
+
+// docs is the reply to COMMAND DOCS for the command
+func (c *Command) docs() *MapReply {
+	return &MapReply{values: []any{"summary", c.Summary, "group", c.Group}}
+}
+
+// sortedCommands returns the commands ordered by name
+func sortedCommands() []*Command {
+	commands := make([]*Command, 0, len(commandTable))
+	for _, command := range commandTable {
+		commands = append(commands, command)
+	}
+	sort.Slice(commands, func(i, j int) bool { return commands[i].Name < commands[j].Name })
+
+	return commands
+}
+
+func registerCommandHandlers(m map[string]HandlerFn) {
+	m["command"] = func(r *Request) error {
+		var reply ReplyWriter
+
+		subcommand := ""
+		if len(r.Args) > 0 {
+			subcommand = strings.ToLower(string(r.Args[0]))
+		}
+
+		switch subcommand {
+		case "":
+			commands := []any{}
+			for _, command := range sortedCommands() {
+				commands = append(commands, command.info())
+			}
+
+			reply = &MultiBulkReply{values: commands}
+		case "count":
+			if len(r.Args) > 1 {
+				return wrongNumberArgs("command|count")
+			}
+
+			reply = &IntegerReply{number: len(commandTable)}
+		case "info", "docs":
+			var commands []*Command
+			if len(r.Args) == 1 {
+				commands = sortedCommands()
+			}
+			for _, name := range r.Args[1:] {
+				commands = append(commands, commandTable[strings.ToLower(string(name))])
+			}
+
+			values := []any{}
+			for _, command := range commands {
+				switch {
+				case subcommand == "info" && command == nil:
+					values = append(values, nil)
+				case subcommand == "info":
+					values = append(values, command.info())
+				case command != nil:
+					// unknown commands are left out of the docs
+					values = append(values, command.Name, command.docs())
+				}
+			}
+
+			if subcommand == "docs" {
+				reply = &MapReply{values: values}
+			} else {
+				reply = &MultiBulkReply{values: values}
+			}
+		case "list":
+			filter := func(command *Command) bool { return true }
+			if len(r.Args) > 1 {
+				if len(r.Args) != 4 || strings.ToLower(string(r.Args[1])) != "filterby" {
+					return utils.ErrSyntaxError
+				}
+
+				value := r.Args[3]
+				switch strings.ToLower(string(r.Args[2])) {
+				case "module":
+					filter = func(command *Command) bool { return false }
+				case "aclcat":
+					filter = func(command *Command) bool {
+						for _, category := range command.Categories {
+							if strings.EqualFold(category[1:], string(value)) {
+								return true
+							}
+						}
+						return false
+					}
+				case "pattern":
+					filter = func(command *Command) bool {
+						return utils.GlobMatch(value, []byte(command.Name), true)
+					}
+				default:
+					return utils.ErrSyntaxError
+				}
+			}
+
+			names := []any{}
+			for _, command := range sortedCommands() {
+				if filter(command) {
+					names = append(names, command.Name)
+				}
+			}
+
+			reply = &MultiBulkReply{values: names}
+		case "getkeys":
+			if len(r.Args) < 2 {
+				return wrongNumberArgs("command|getkeys")
+			}
+
+			command, exists := commandTable[strings.ToLower(string(r.Args[1]))]
+			if !exists {
+				return errors.New("ERR Invalid command specified")
+			}
+			if err := command.CheckArity(r.Args[2:]); err != nil {
+				return errors.New("ERR Invalid number of arguments specified for command")
+			}
+
+			positions, err := command.Keys(r.Args[1:])
+			if err != nil {
+				return err
+			}
+			if len(positions) == 0 {
+				return errors.New("ERR The command has no key arguments")
+			}
+
+			keys := make([]any, len(positions))
+			for i, position := range positions {
+				keys[i] = r.Args[1+position]
+			}
+
+			reply = &MultiBulkReply{values: keys}
+		default:
+			return fmt.Errorf("ERR unknown subcommand '%s'. Try COMMAND HELP.", r.Args[0])
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+
+	"bigdis/config"
+)
+
+func registerConfigHandlers(m map[string]HandlerFn) {
+	m["config"] = func(r *Request) error {
+		args := make([]string, len(r.Args)-1)
+		for i, arg := range r.Args[1:] {
+			args[i] = string(arg)
+		}
+
+		var reply ReplyWriter
+		switch strings.ToLower(string(r.Args[0])) {
+		case "get":
+			if len(args) < 1 {
+				return wrongNumberArgs("config|get")
+			}
+
+			pairs := config.Get(args)
+			values := make([]any, len(pairs))
+			for i, value := range pairs {
+				values[i] = []byte(value)
+			}
+
+			reply = &MapReply{
+				values: values,
+			}
+		case "set":
+			if err := config.Set(args); err != nil {
+				return err
+			}
+
+			reply = NewStatusReply("OK")
+		case "resetstat":
+			if len(args) > 0 {
+				return wrongNumberArgs("config|resetstat")
+			}
+			ResetStats()
+
+			reply = NewStatusReply("OK")
+		case "rewrite":
+			if len(args) > 0 {
+				return wrongNumberArgs("config|rewrite")
+			}
+			if err := config.Rewrite(); err != nil {
+				return err
+			}
+
+			reply = NewStatusReply("OK")
+		default:
+			return fmt.Errorf("ERR unknown subcommand '%s'. Try CONFIG HELP.", r.Args[0])
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,17 @@
+package internal
+
+import (
+	"bigdis/storage"
+)
+
+func registerExpireHandlers(m map[string]HandlerFn) {
+	m["expire"] = integerHandler(storage.Expire)
+	m["pexpire"] = integerHandler(storage.PExpire)
+	m["expireat"] = integerHandler(storage.ExpireAt)
+	m["pexpireat"] = integerHandler(storage.PExpireAt)
+	m["ttl"] = integerHandler(storage.TTL)
+	m["pttl"] = integerHandler(storage.PTTL)
+	m["expiretime"] = integerHandler(storage.ExpireTime)
+	m["pexpiretime"] = integerHandler(storage.PExpireTime)
+	m["persist"] = integerHandler(storage.Persist)
+}
@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"errors"
 	"fmt"
 	"strconv"
 
@@ -10,13 +11,53 @@ import (
 
 type HandlerFn func(r *Request) error
 
-func NewV1Handler() map[string]HandlerFn {
+var errDBOutOfRange = errors.New("ERR DB index is out of range")
+
+// SelectDB checks the index given to SELECT and creates its DB if needed.
+// The connection only switches to it once SELECT succeeded, EXEC creates the DBs before it runs the queued SELECTs
+func SelectDB(r *Request) error {
+	dbNum, err := strconv.Atoi(string(r.Args[0]))
+	if err != nil {
+		return utils.ErrWrongSyntax
+	}
+	if dbNum < 0 {
+		return errDBOutOfRange
+	}
+
+	// GetDBNum() will create a new DB if it doesn't exist
+	_ = (&Request{DB: r.Args, Conn: r.Conn}).GetDBNum()
+
+	return nil
+}
+
+func NewV1Handler() map[string]*Command {
 	m := make(map[string]HandlerFn)
 
 	m["ping"] = func(r *Request) error {
-		reply := &StatusReply{
+		if len(r.Args) > 1 {
+			return wrongNumberArgs("ping")
+		}
+
+		// in the subscriber mode of RESP2 the reply is a pong message
+		if r.Subscriber != nil && r.Subscriber.Active() && Protocol(r.Conn) == 2 {
+			message := []byte{}
+			if len(r.Args) > 0 {
+				message = r.Args[0]
+			}
+
+			return r.Subscriber.Reply(&MultiBulkReply{
+				values: []any{"pong", message},
+			})
+		}
+
+		var reply ReplyWriter = &StatusReply{
 			Code: "PONG",
 		}
+		if len(r.Args) > 0 {
+			reply = &BulkReply{
+				value: r.Args[0],
+			}
+		}
 
 		if _, err := reply.WriteTo(r.Conn); err != nil {
 			return err
@@ -26,28 +67,17 @@ func NewV1Handler() map[string]HandlerFn {
 	}
 
 	m["select"] = func(r *Request) error {
-		_, err := strconv.Atoi(string(r.Args[0]))
-		if err != nil {
-			return utils.ErrWrongSyntax
-		}
-
-		// GetDBNum() will create a new DB if it doesn't exist
-		_ = r.GetDBNum()
-
-		reply := &StatusReply{
-			Code: "OK",
-		}
-
-		if _, err := reply.WriteTo(r.Conn); err != nil {
+		if err := SelectDB(r); err != nil {
 			return err
 		}
 
-		return nil
-	}
+		// CLIENT LIST shows the new DB as soon as the client gets the reply
+		if r.Client != nil {
+			r.Client.Selected(r.Args[0])
+		}
 
-	m["command"] = func(r *Request) error {
 		reply := &StatusReply{
-			Code: "Welcome to bigdis",
+			Code: "OK",
 		}
 
 		if _, err := reply.WriteTo(r.Conn); err != nil {
@@ -58,11 +88,7 @@ func NewV1Handler() map[string]HandlerFn {
 	}
 
 	m["get"] = func(r *Request) error {
-		if len(r.Args) != 1 {
-			return wrongNumberArgs(r, "get")
-		}
-
-		value, err := storage.Get(r.GetDBNum(), r.Args, nil)
+		value, err := storage.Get(r.GetDBNum(), r.Args, r.DBOp)
 		if err != nil && err != utils.ErrNotFound {
 			return err
 		}
@@ -79,11 +105,7 @@ func NewV1Handler() map[string]HandlerFn {
 	}
 
 	m["set"] = func(r *Request) error {
-		if len(r.Args) < 2 {
-			return wrongNumberArgs(r, "set")
-		}
-
-		replyBytes, err := storage.Set(r.GetDBNum(), r.Args, nil)
+		replyBytes, bulk, err := storage.Set(r.GetDBNum(), r.Args, r.DBOp)
 		if err != nil {
 			if err == utils.ErrSyntaxError {
 				reply := &ErrorReply{
@@ -100,11 +122,7 @@ func NewV1Handler() map[string]HandlerFn {
 		}
 
 		var reply ReplyWriter
-		if replyBytes != nil {
-			if len(replyBytes) == 0 {
-				replyBytes = nil
-			}
-
+		if bulk {
 			reply = &BulkReply{
 				value: replyBytes,
 			}
@@ -123,10 +141,10 @@ func NewV1Handler() map[string]HandlerFn {
 
 	m["flushdb"] = func(r *Request) error {
 		if len(r.Args) > 1 {
-			return wrongNumberArgs(r, "flushdb")
+			return wrongNumberArgs("flushdb")
 		}
 
-		if err := storage.FlushDB(r.GetDBNum(), r.Args); err != nil {
+		if err := storage.FlushDB(r.GetDBNum(), r.Args, r.DBOp); err != nil {
 			return err
 		}
 
@@ -142,41 +160,20 @@ func NewV1Handler() map[string]HandlerFn {
 	}
 
 	m["del"] = func(r *Request) error {
-		if len(r.Args) < 1 {
-			return wrongNumberArgs(r, "del")
-		}
-
-		deleted, err := storage.Del(r.GetDBNum(), r.Args, nil)
+		deleted, err := storage.Del(r.GetDBNum(), r.Args, r.DBOp)
 		if err != nil {
 			return err
 		}
 
-		reply := IntegerReply{
-			number: deleted,
-		}
-
-		if _, err := reply.WriteTo(r.Conn); err != nil {
-			return err
+		// deleting keys that don't exist changes nothing, there is nothing to replicate
+		if deleted == 0 {
+			r.Propagate = [][][]byte{}
 		}
 
-		return nil
-	}
-
-	m["config"] = func(r *Request) error {
-		reply := BulkReply{
-			value: []byte(""),
+		reply := IntegerReply{
+			number: deleted,
 		}
 
-		// fmt.Println(string(r.Args[1]))
-
-		// switch string(r.Args[0]) {
-		// case "get":
-		// 	switch string(r.Args[1]) {
-		// 	case "save":
-		// 		reply.value = ""
-		// 	}
-		// }
-
 		if _, err := reply.WriteTo(r.Conn); err != nil {
 			return err
 		}
@@ -185,11 +182,7 @@ func NewV1Handler() map[string]HandlerFn {
 	}
 
 	m["getdel"] = func(r *Request) error {
-		if len(r.Args) != 1 {
-			return wrongNumberArgs(r, "getdel")
-		}
-
-		value, err := storage.GetDel(r.GetDBNum(), r.Args)
+		value, err := storage.GetDel(r.GetDBNum(), r.Args, r.DBOp)
 		if err != nil {
 			return err
 		}
@@ -206,11 +199,7 @@ func NewV1Handler() map[string]HandlerFn {
 	}
 
 	m["exists"] = func(r *Request) error {
-		if len(r.Args) < 1 {
-			return wrongNumberArgs(r, "exists")
-		}
-
-		count, err := storage.Exists(r.GetDBNum(), r.Args, nil)
+		count, err := storage.Exists(r.GetDBNum(), r.Args, r.DBOp)
 		if err != nil {
 			return err
 		}
@@ -227,11 +216,7 @@ func NewV1Handler() map[string]HandlerFn {
 	}
 
 	m["incr"] = func(r *Request) error {
-		if len(r.Args) != 1 {
-			return wrongNumberArgs(r, "incr")
-		}
-
-		value, err := storage.Incr(r.GetDBNum(), r.Args)
+		value, err := storage.Incr(r.GetDBNum(), r.Args, r.DBOp)
 		if err != nil {
 			return err
 		}
@@ -248,11 +233,7 @@ func NewV1Handler() map[string]HandlerFn {
 	}
 
 	m["incrby"] = func(r *Request) error {
-		if len(r.Args) != 2 {
-			return wrongNumberArgs(r, "incrby")
-		}
-
-		value, err := storage.IncrBy(r.GetDBNum(), r.Args, nil)
+		value, err := storage.IncrBy(r.GetDBNum(), r.Args, r.DBOp)
 		if err != nil {
 			return err
 		}
@@ -269,11 +250,7 @@ func NewV1Handler() map[string]HandlerFn {
 	}
 
 	m["getset"] = func(r *Request) error {
-		if len(r.Args) != 2 {
-			return wrongNumberArgs(r, "getset")
-		}
-
-		value, err := storage.GetSet(r.GetDBNum(), r.Args, nil)
+		value, err := storage.GetSet(r.GetDBNum(), r.Args, r.DBOp)
 		if err != nil {
 			return err
 		}
@@ -291,10 +268,10 @@ func NewV1Handler() map[string]HandlerFn {
 
 	m["flushall"] = func(r *Request) error {
 		if len(r.Args) > 1 {
-			return wrongNumberArgs(r, "flushall")
+			return wrongNumberArgs("flushall")
 		}
 
-		if err := storage.FlushAll(r.Args); err != nil {
+		if err := storage.FlushAll(r.Args, r.DBOp); err != nil {
 			return err
 		}
 
@@ -310,11 +287,7 @@ func NewV1Handler() map[string]HandlerFn {
 	}
 
 	m["strlen"] = func(r *Request) error {
-		if len(r.Args) != 1 {
-			return wrongNumberArgs(r, "strlen")
-		}
-
-		value, err := storage.Strlen(r.GetDBNum(), r.Args)
+		value, err := storage.Strlen(r.GetDBNum(), r.Args, r.DBOp)
 		if err != nil {
 			return err
 		}
@@ -331,11 +304,7 @@ func NewV1Handler() map[string]HandlerFn {
 	}
 
 	m["append"] = func(r *Request) error {
-		if len(r.Args) != 2 {
-			return wrongNumberArgs(r, "append")
-		}
-
-		value, err := storage.Append(r.GetDBNum(), r.Args)
+		value, err := storage.Append(r.GetDBNum(), r.Args, r.DBOp)
 		if err != nil {
 			return err
 		}
@@ -352,11 +321,7 @@ func NewV1Handler() map[string]HandlerFn {
 	}
 
 	m["decr"] = func(r *Request) error {
-		if len(r.Args) != 1 {
-			return wrongNumberArgs(r, "decr")
-		}
-
-		value, err := storage.Decr(r.GetDBNum(), r.Args)
+		value, err := storage.Decr(r.GetDBNum(), r.Args, r.DBOp)
 		if err != nil {
 			return err
 		}
@@ -373,11 +338,7 @@ func NewV1Handler() map[string]HandlerFn {
 	}
 
 	m["decrby"] = func(r *Request) error {
-		if len(r.Args) != 2 {
-			return wrongNumberArgs(r, "decrby")
-		}
-
-		value, err := storage.DecrBy(r.GetDBNum(), r.Args)
+		value, err := storage.DecrBy(r.GetDBNum(), r.Args, r.DBOp)
 		if err != nil {
 			return err
 		}
@@ -394,11 +355,7 @@ func NewV1Handler() map[string]HandlerFn {
 	}
 
 	m["mget"] = func(r *Request) error {
-		if len(r.Args) < 1 {
-			return wrongNumberArgs(r, "mget")
-		}
-
-		values, err := storage.MGet(r.GetDBNum(), r.Args)
+		values, err := storage.MGet(r.GetDBNum(), r.Args, r.DBOp)
 		if err != nil {
 			return err
 		}
@@ -415,11 +372,11 @@ func NewV1Handler() map[string]HandlerFn {
 	}
 
 	m["mset"] = func(r *Request) error {
-		if len(r.Args) < 2 || len(r.Args)%2 != 0 {
-			return wrongNumberArgs(r, "mset")
+		if len(r.Args)%2 != 0 {
+			return wrongNumberArgs("mset")
 		}
 
-		if err := storage.MSet(r.GetDBNum(), r.Args, nil); err != nil {
+		if err := storage.MSet(r.GetDBNum(), r.Args, r.DBOp); err != nil {
 			return err
 		}
 
@@ -435,11 +392,11 @@ func NewV1Handler() map[string]HandlerFn {
 	}
 
 	m["msetnx"] = func(r *Request) error {
-		if len(r.Args) < 2 || len(r.Args)%2 != 0 {
-			return wrongNumberArgs(r, "msetnx")
+		if len(r.Args)%2 != 0 {
+			return wrongNumberArgs("msetnx")
 		}
 
-		result, err := storage.MSetNX(r.GetDBNum(), r.Args)
+		result, err := storage.MSetNX(r.GetDBNum(), r.Args, r.DBOp)
 		if err != nil {
 			return err
 		}
@@ -456,11 +413,54 @@ func NewV1Handler() map[string]HandlerFn {
 	}
 
 	m["setnx"] = func(r *Request) error {
-		if len(r.Args) != 2 {
-			return wrongNumberArgs(r, "setnx")
+		result, err := storage.SetNX(r.GetDBNum(), r.Args, r.DBOp)
+		if err != nil {
+			return err
+		}
+
+		reply := &IntegerReply{
+			number: result,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
 		}
 
-		result, err := storage.SetNX(r.GetDBNum(), r.Args)
+		return nil
+	}
+
+	registerHashHandlers(m)
+	registerListHandlers(m)
+	registerSetHandlers(m)
+	registerSortedSetHandlers(m)
+	registerExpireHandlers(m)
+	registerKeyHandlers(m)
+	registerPubSubHandlers(m)
+	registerConfigHandlers(m)
+	registerInfoHandlers(m)
+	registerCommandHandlers(m)
+	registerClientHandlers(m)
+	registerACLHandlers(m)
+	registerSnapshotHandlers(m)
+	registerBigdisHandlers(m)
+	registerReplicationHandlers(m)
+
+	// every handler must be described in the command table
+	for name, handler := range m {
+		command, exists := commandTable[name]
+		if !exists {
+			panic(fmt.Sprintf("command %s is missing from the command table", name))
+		}
+		command.Handler = handler
+	}
+
+	return commandTable
+}
+
+// integerHandler builds the handler of a command replying with the integer returned by fn
+func integerHandler(fn func(dbNum int, args [][]byte, dbOp *storage.DBOperation) (int, error)) HandlerFn {
+	return func(r *Request) error {
+		result, err := fn(r.GetDBNum(), r.Args, r.DBOp)
 		if err != nil {
 			return err
 		}
@@ -475,20 +475,99 @@ func NewV1Handler() map[string]HandlerFn {
 
 		return nil
 	}
+}
+
+// bulkHandler builds the handler of a command replying with the string returned by fn, nil for a null
+func bulkHandler(fn func(dbNum int, args [][]byte, dbOp *storage.DBOperation) ([]byte, error)) HandlerFn {
+	return func(r *Request) error {
+		value, err := fn(r.GetDBNum(), r.Args, r.DBOp)
+		if err != nil {
+			return err
+		}
+
+		reply := &BulkReply{
+			value: value,
+		}
 
-	return m
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
+
+// multiBulkHandler builds the handler of a command replying with the values returned by fn
+func multiBulkHandler(fn func(dbNum int, args [][]byte, dbOp *storage.DBOperation) ([]any, error)) HandlerFn {
+	return aggregateHandler(fn, func(values []any) ReplyWriter { return &MultiBulkReply{values: values} })
 }
 
-func wrongNumberArgs(r *Request, cmd string) error {
-	value := fmt.Sprintf(utils.WrongNumberArgs, cmd)
+// mapHandler builds the handler of a command replying with the keys and values alternated returned by fn
+func mapHandler(fn func(dbNum int, args [][]byte, dbOp *storage.DBOperation) ([]any, error)) HandlerFn {
+	return aggregateHandler(fn, func(values []any) ReplyWriter { return &MapReply{values: values} })
+}
 
-	reply := &ErrorReply{
-		value: value,
+// setHandler builds the handler of a command replying with the members returned by fn
+func setHandler(fn func(dbNum int, args [][]byte, dbOp *storage.DBOperation) ([]any, error)) HandlerFn {
+	return aggregateHandler(fn, func(values []any) ReplyWriter { return &SetReply{values: values} })
+}
+
+// popHandler builds the handler of a command popping the elements returned by fn,
+// a single element is returned as a bulk reply when no count is given
+func popHandler(cmd string, fn func(dbNum int, args [][]byte, dbOp *storage.DBOperation) ([]any, error)) HandlerFn {
+	return func(r *Request) error {
+		if len(r.Args) > 2 {
+			return wrongNumberArgs(cmd)
+		}
+
+		values, err := fn(r.GetDBNum(), r.Args, r.DBOp)
+		if err != nil {
+			return err
+		}
+
+		var reply ReplyWriter
+		if len(r.Args) == 1 || values == nil {
+			var value []byte
+			if len(values) > 0 {
+				value = values[0].([]byte)
+			}
+
+			reply = &BulkReply{
+				value: value,
+			}
+		} else {
+			reply = &MultiBulkReply{
+				values: values,
+			}
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
 	}
+}
+
+func aggregateHandler(fn func(dbNum int, args [][]byte, dbOp *storage.DBOperation) ([]any, error), newReply func(values []any) ReplyWriter) HandlerFn {
+	return func(r *Request) error {
+		values, err := fn(r.GetDBNum(), r.Args, r.DBOp)
+		if err != nil {
+			return err
+		}
 
-	if _, err := reply.WriteTo(r.Conn); err != nil {
-		return err
+		reply := newReply(values)
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
 	}
+}
 
-	return nil
+// wrongNumberArgs is the error of the commands whose arguments don't fit their arity,
+// the arity itself is checked by the server against the command table
+func wrongNumberArgs(cmd string) error {
+	return fmt.Errorf("ERR "+utils.WrongNumberArgs, cmd)
 }
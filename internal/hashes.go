@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"strconv"
+
+	"bigdis/storage"
+)
+
+func registerHashHandlers(m map[string]HandlerFn) {
+	hset := integerHandler(storage.HSet)
+	m["hset"] = func(r *Request) error {
+		if len(r.Args)%2 != 1 {
+			return wrongNumberArgs("hset")
+		}
+
+		return hset(r)
+	}
+
+	m["hmset"] = func(r *Request) error {
+		if len(r.Args)%2 != 1 {
+			return wrongNumberArgs("hmset")
+		}
+
+		if _, err := storage.HSet(r.GetDBNum(), r.Args, r.DBOp); err != nil {
+			return err
+		}
+
+		reply := &StatusReply{
+			Code: "OK",
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["hsetnx"] = integerHandler(storage.HSetNX)
+	m["hget"] = bulkHandler(storage.HGet)
+	m["hmget"] = multiBulkHandler(storage.HMGet)
+	m["hdel"] = integerHandler(storage.HDel)
+	m["hgetall"] = mapHandler(storage.HGetAll)
+	m["hkeys"] = multiBulkHandler(storage.HKeys)
+	m["hvals"] = multiBulkHandler(storage.HVals)
+
+	m["hlen"] = integerHandler(storage.HLen)
+	m["hexists"] = integerHandler(storage.HExists)
+	m["hstrlen"] = integerHandler(storage.HStrlen)
+	m["hincrby"] = integerHandler(storage.HIncrBy)
+	m["hincrbyfloat"] = bulkHandler(storage.HIncrByFloat)
+
+	m["hrandfield"] = func(r *Request) error {
+		if len(r.Args) > 3 {
+			return wrongNumberArgs("hrandfield")
+		}
+
+		values, err := storage.HRandField(r.GetDBNum(), r.Args, r.DBOp)
+		if err != nil {
+			return err
+		}
+
+		// without count a single field is returned as a bulk reply
+		var reply ReplyWriter
+		if len(r.Args) == 1 {
+			var value []byte
+			if len(values) > 0 {
+				value = values[0].([]byte)
+			}
+
+			reply = &BulkReply{
+				value: value,
+			}
+		} else {
+			reply = &MultiBulkReply{
+				values: values,
+			}
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["hscan"] = func(r *Request) error {
+		cursor, values, err := storage.HScan(r.GetDBNum(), r.Args, r.DBOp)
+		if err != nil {
+			return err
+		}
+
+		reply := &MultiBulkReply{
+			values: []any{[]byte(strconv.FormatInt(cursor, 10)), values},
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
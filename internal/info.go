@@ -0,0 +1,204 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"bigdis/config"
+	"bigdis/storage"
+)
+
+// RedisVersion is the Redis version whose commands Bigdis follows, clients look at it to pick the features they use
+// and the exported RDB files claim to come from it
+const RedisVersion = "7.2.0"
+
+// infoSection is a part of the INFO reply
+type infoSection struct {
+	name   string
+	fields func() ([][2]string, error)
+}
+
+// infoSections are the default sections, in the order Redis sends them
+var infoSections = []infoSection{
+	{"server", serverInfo},
+	{"clients", clientsInfo},
+	{"persistence", persistenceInfo},
+	{"stats", statsInfo},
+	{"replication", replicationInfo},
+	{"keyspace", keyspaceInfo},
+	{"sqlite", sqliteInfo},
+}
+
+func serverInfo() ([][2]string, error) {
+	uptime := int64(time.Since(startTime).Seconds())
+
+	executable, _ := os.Executable()
+
+	config.Lock.RLock()
+	port := config.Config.Server.Port
+	config.Lock.RUnlock()
+
+	return [][2]string{
+		{"redis_version", RedisVersion},
+		{"redis_mode", "standalone"},
+		{"os", runtime.GOOS + " " + runtime.GOARCH},
+		{"arch_bits", strconv.Itoa(strconv.IntSize)},
+		{"go_version", runtime.Version()},
+		{"process_id", strconv.Itoa(os.Getpid())},
+		{"tcp_port", strconv.Itoa(port)},
+		{"server_time_usec", strconv.FormatInt(time.Now().UnixMicro(), 10)},
+		{"uptime_in_seconds", strconv.FormatInt(uptime, 10)},
+		{"uptime_in_days", strconv.FormatInt(uptime/86400, 10)},
+		{"executable", executable},
+		{"config_file", config.File()},
+	}, nil
+}
+
+func clientsInfo() ([][2]string, error) {
+	return [][2]string{
+		{"connected_clients", strconv.FormatInt(Stats.ConnectedClients.Load(), 10)},
+	}, nil
+}
+
+func persistenceInfo() ([][2]string, error) {
+	// every write is committed to SQLite before being acknowledged, the snapshots are copies made on demand
+	snapshot := storage.Snapshot()
+
+	inProgress, currentTime := "0", "-1"
+	if snapshot.InProgress {
+		inProgress = "1"
+		currentTime = strconv.Itoa(int(time.Since(snapshot.Started).Seconds()))
+	}
+	lastDuration := "-1"
+	if snapshot.LastDuration >= 0 {
+		lastDuration = strconv.Itoa(int(snapshot.LastDuration.Seconds()))
+	}
+
+	fields := [][2]string{
+		{"loading", "0"},
+		{"async_loading", "0"},
+		{"rdb_bgsave_in_progress", inProgress},
+		{"rdb_last_save_time", strconv.FormatInt(snapshot.LastSave.Unix(), 10)},
+		{"rdb_last_bgsave_status", snapshot.LastStatus},
+		{"rdb_last_bgsave_time_sec", lastDuration},
+		{"rdb_current_bgsave_time_sec", currentTime},
+		{"rdb_saves", strconv.Itoa(snapshot.Saves)},
+		{"current_save_pages_processed", strconv.Itoa(snapshot.PagesDone)},
+		{"current_save_pages_total", strconv.Itoa(snapshot.PagesTotal)},
+	}
+
+	journal := storage.Journal()
+	rewriteTime, lastRewriteTime := "-1", "-1"
+	if journal.RewriteInProgress {
+		rewriteTime = strconv.Itoa(int(time.Since(journal.RewriteStarted).Seconds()))
+	}
+	if journal.LastRewriteDuration >= 0 {
+		lastRewriteTime = strconv.Itoa(int(journal.LastRewriteDuration.Seconds()))
+	}
+	fields = append(fields,
+		[2]string{"aof_enabled", boolInfo(journal.Enabled)},
+		[2]string{"aof_rewrite_in_progress", boolInfo(journal.RewriteInProgress)},
+		[2]string{"aof_rewrite_scheduled", boolInfo(journal.RewriteScheduled)},
+		[2]string{"aof_last_rewrite_time_sec", lastRewriteTime},
+		[2]string{"aof_current_rewrite_time_sec", rewriteTime},
+		[2]string{"aof_last_bgrewrite_status", journal.LastRewriteStatus},
+		[2]string{"aof_rewrites", strconv.Itoa(journal.Rewrites)},
+		[2]string{"aof_last_write_status", journal.LastWriteStatus},
+	)
+	if journal.Enabled {
+		fields = append(fields,
+			[2]string{"aof_current_size", strconv.FormatInt(journal.Size, 10)},
+			[2]string{"aof_base_size", strconv.FormatInt(journal.BaseSize, 10)},
+		)
+	}
+
+	return fields, nil
+}
+
+func statsInfo() ([][2]string, error) {
+	return [][2]string{
+		{"total_connections_received", strconv.FormatInt(Stats.ConnectionsReceived.Load(), 10)},
+		{"total_commands_processed", strconv.FormatInt(Stats.CommandsProcessed.Load(), 10)},
+		{"expired_keys", strconv.FormatInt(storage.Stats.ExpiredKeys.Load(), 10)},
+	}, nil
+}
+
+func keyspaceInfo() ([][2]string, error) {
+	keyspace, err := storage.Keyspace()
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make([][2]string, len(keyspace))
+	for i, db := range keyspace {
+		fields[i] = [2]string{
+			"db" + strconv.Itoa(db.DBNum),
+			fmt.Sprintf("keys=%d,expires=%d,avg_ttl=%d", db.Keys, db.Expires, db.AvgTTL),
+		}
+	}
+
+	return fields, nil
+}
+
+func sqliteInfo() ([][2]string, error) {
+	stats, err := storage.SQLiteInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	return [][2]string{
+		{"sqlite_version", stats.Version},
+		{"sqlite_page_size", strconv.FormatInt(stats.PageSize, 10)},
+		{"sqlite_page_count", strconv.FormatInt(stats.PageCount, 10)},
+		{"sqlite_freelist_count", strconv.FormatInt(stats.FreelistCount, 10)},
+		{"sqlite_db_size", strconv.FormatInt(stats.PageSize*stats.PageCount, 10)},
+		{"sqlite_journal_mode", stats.JournalMode},
+		{"sqlite_wal_size", strconv.FormatInt(stats.WALSize, 10)},
+	}, nil
+}
+
+func registerInfoHandlers(m map[string]HandlerFn) {
+	m["info"] = func(r *Request) error {
+		// no argument, "default", "all" and "everything" all mean every section
+		selected := map[string]bool{}
+		for _, arg := range r.Args {
+			selected[strings.ToLower(string(arg))] = true
+		}
+		all := len(selected) == 0 || selected["default"] || selected["all"] || selected["everything"]
+
+		var info strings.Builder
+		for _, section := range infoSections {
+			if !all && !selected[section.name] {
+				continue
+			}
+
+			fields, err := section.fields()
+			if err != nil {
+				return err
+			}
+
+			if info.Len() > 0 {
+				info.WriteString("\r\n")
+			}
+			fmt.Fprintf(&info, "# %s\r\n", strings.ToUpper(section.name[:1])+section.name[1:])
+			for _, field := range fields {
+				fmt.Fprintf(&info, "%s:%s\r\n", field[0], field[1])
+			}
+		}
+
+		reply := &VerbatimReply{
+			format: "txt",
+			value:  []byte(info.String()),
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,45 @@
+package internal
+
+import (
+	"strconv"
+
+	"bigdis/storage"
+)
+
+func registerKeyHandlers(m map[string]HandlerFn) {
+	m["keys"] = multiBulkHandler(storage.Keys)
+
+	m["scan"] = func(r *Request) error {
+		cursor, keys, err := storage.Scan(r.GetDBNum(), r.Args, r.DBOp)
+		if err != nil {
+			return err
+		}
+
+		reply := &MultiBulkReply{
+			values: []any{[]byte(strconv.FormatInt(cursor, 10)), keys},
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["type"] = func(r *Request) error {
+		name, err := storage.Type(r.GetDBNum(), r.Args, r.DBOp)
+		if err != nil {
+			return err
+		}
+
+		reply := &StatusReply{
+			Code: name,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,192 @@
+package internal
+
+import (
+	"bigdis/storage"
+)
+
+func registerListHandlers(m map[string]HandlerFn) {
+	m["lpush"] = integerHandler(storage.LPush)
+	m["rpush"] = integerHandler(storage.RPush)
+	m["lpushx"] = integerHandler(storage.LPushX)
+	m["rpushx"] = integerHandler(storage.RPushX)
+
+	m["lpop"] = popHandler("lpop", storage.LPop)
+	m["rpop"] = popHandler("rpop", storage.RPop)
+
+	m["llen"] = func(r *Request) error {
+		length, err := storage.LLen(r.GetDBNum(), r.Args, r.DBOp)
+		if err != nil {
+			return err
+		}
+
+		reply := &IntegerReply{
+			number: length,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["lrange"] = func(r *Request) error {
+		values, err := storage.LRange(r.GetDBNum(), r.Args, r.DBOp)
+		if err != nil {
+			return err
+		}
+
+		reply := &MultiBulkReply{
+			values: values,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["lindex"] = func(r *Request) error {
+		value, err := storage.LIndex(r.GetDBNum(), r.Args, r.DBOp)
+		if err != nil {
+			return err
+		}
+
+		reply := &BulkReply{
+			value: value,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["lset"] = func(r *Request) error {
+		if err := storage.LSet(r.GetDBNum(), r.Args, r.DBOp); err != nil {
+			return err
+		}
+
+		reply := &StatusReply{
+			Code: "OK",
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["linsert"] = func(r *Request) error {
+		length, err := storage.LInsert(r.GetDBNum(), r.Args, r.DBOp)
+		if err != nil {
+			return err
+		}
+
+		reply := &IntegerReply{
+			number: length,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["lrem"] = func(r *Request) error {
+		removed, err := storage.LRem(r.GetDBNum(), r.Args, r.DBOp)
+		if err != nil {
+			return err
+		}
+
+		reply := &IntegerReply{
+			number: removed,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["ltrim"] = func(r *Request) error {
+		if err := storage.LTrim(r.GetDBNum(), r.Args, r.DBOp); err != nil {
+			return err
+		}
+
+		reply := &StatusReply{
+			Code: "OK",
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["lpos"] = func(r *Request) error {
+		positions, single, err := storage.LPos(r.GetDBNum(), r.Args, r.DBOp)
+		if err != nil {
+			return err
+		}
+
+		var reply ReplyWriter
+		if !single {
+			reply = &MultiBulkReply{
+				values: positions,
+			}
+		} else if len(positions) > 0 {
+			reply = &IntegerReply{
+				number: positions[0].(int),
+			}
+		} else {
+			reply = &BulkReply{}
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["lmove"] = func(r *Request) error {
+		value, err := storage.LMove(r.GetDBNum(), r.Args, r.DBOp)
+		if err != nil {
+			return err
+		}
+
+		reply := &BulkReply{
+			value: value,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["rpoplpush"] = func(r *Request) error {
+		value, err := storage.RPopLPush(r.GetDBNum(), r.Args, r.DBOp)
+		if err != nil {
+			return err
+		}
+
+		reply := &BulkReply{
+			value: value,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,353 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"bigdis/storage"
+	"bigdis/utils"
+)
+
+/*
+Pub/Sub is served in process, messages are never stored.
+
+Once a client subscribes, everything it is sent goes through a ChannelWriter
+running in its own goroutine: published messages as well as the replies to
+its own commands, so that they never interleave on the connection.
+A subscriber too slow to consume its messages is disconnected, as Redis does
+when the pubsub output buffer limit is reached.
+*/
+
+// subscriberBufferSize is the number of messages a subscriber can lag behind before being dropped
+const subscriberBufferSize = 1024
+
+// subscriberFlushTimeout bounds the time spent writing the pending messages of a closing connection
+const subscriberFlushTimeout = time.Second
+
+var errSubscriberGone = errors.New("subscriber connection is closed")
+
+// Subscriber is the Pub/Sub state of a client connection
+type Subscriber struct {
+	conn     net.Conn
+	writer   *ChannelWriter
+	done     chan struct{} // closed when the writer returns
+	channels map[string]struct{}
+	patterns map[string]struct{}
+}
+
+func NewSubscriber(conn net.Conn) *Subscriber {
+	return &Subscriber{
+		conn:     conn,
+		channels: map[string]struct{}{},
+		patterns: map[string]struct{}{},
+	}
+}
+
+// Active reports whether the connection is in subscriber mode
+func (s *Subscriber) Active() bool {
+	return s.writer != nil
+}
+
+// enter starts the writer of the subscriber mode, it must run before any subscription is registered
+func (s *Subscriber) enter() {
+	if s.writer != nil {
+		return
+	}
+
+	s.writer = &ChannelWriter{
+		Channel:    make(chan ReplyWriter, subscriberBufferSize),
+		clientChan: make(chan struct{}),
+	}
+	s.done = make(chan struct{})
+
+	go func(writer *ChannelWriter, done chan struct{}) {
+		defer close(done)
+		if _, err := writer.WriteTo(s.conn); err != nil {
+			s.conn.Close()
+		}
+	}(s.writer, s.done)
+}
+
+// send queues a reply to the writer
+func (s *Subscriber) send(reply ReplyWriter) error {
+	select {
+	case s.writer.Channel <- reply:
+		return nil
+	case <-s.done:
+		return errSubscriberGone
+	}
+}
+
+// Reply writes a reply to the client, through the writer when in subscriber mode
+func (s *Subscriber) Reply(reply ReplyWriter) error {
+	if s.Active() {
+		return s.send(reply)
+	}
+
+	_, err := reply.WriteTo(s.conn)
+	return err
+}
+
+// deliver queues a published message without waiting, the subscriber is dropped if it lags behind
+func (s *Subscriber) deliver(message []any) {
+	select {
+	case s.writer.Channel <- &PushReply{values: message}:
+	case <-s.done:
+	default:
+		utils.Print("Dropping slow subscriber %s\n", s.conn.RemoteAddr())
+		s.conn.Close()
+	}
+}
+
+// leave exits subscriber mode once all the queued replies have been written
+func (s *Subscriber) leave() {
+	select {
+	case s.writer.Channel <- nil:
+	case <-s.done:
+	}
+	<-s.done
+
+	s.writer = nil
+}
+
+// Close removes all the subscriptions of a client that is going away
+// and gives the writer a little time to send the pending replies
+func (s *Subscriber) Close() {
+	broker.Lock()
+	for channel := range s.channels {
+		broker.remove(broker.channels, channel, s)
+	}
+	for pattern := range s.patterns {
+		broker.remove(broker.patterns, pattern, s)
+	}
+	broker.Unlock()
+
+	if s.writer == nil {
+		return
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(subscriberFlushTimeout))
+	select {
+	case s.writer.Channel <- nil:
+	default:
+		close(s.writer.clientChan)
+	}
+	<-s.done
+
+	s.writer = nil
+}
+
+// subscriptions counts the channels and patterns of a subscriber from any goroutine
+func (s *Subscriber) subscriptions() (int, int) {
+	broker.Lock()
+	defer broker.Unlock()
+
+	return len(s.channels), len(s.patterns)
+}
+
+func (s *Subscriber) count() int {
+	return len(s.channels) + len(s.patterns)
+}
+
+// subscribe adds the channels or patterns to the subscriptions and confirms each one
+func (s *Subscriber) subscribe(kind string, names [][]byte) error {
+	subscriptions, registry := s.channels, broker.channels
+	if kind == "psubscribe" {
+		subscriptions, registry = s.patterns, broker.patterns
+	}
+
+	s.enter()
+	for _, name := range names {
+		broker.Lock()
+		if _, exists := subscriptions[string(name)]; !exists {
+			subscriptions[string(name)] = struct{}{}
+			if registry[string(name)] == nil {
+				registry[string(name)] = map[*Subscriber]struct{}{}
+			}
+			registry[string(name)][s] = struct{}{}
+		}
+		broker.Unlock()
+
+		if err := s.send(&PushReply{values: []any{kind, name, s.count()}}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unsubscribe removes the channels or patterns from the subscriptions, all of them if names is empty
+func (s *Subscriber) unsubscribe(kind string, names [][]byte) error {
+	subscriptions, registry := s.channels, broker.channels
+	if kind == "punsubscribe" {
+		subscriptions, registry = s.patterns, broker.patterns
+	}
+
+	if len(names) == 0 {
+		for name := range subscriptions {
+			names = append(names, []byte(name))
+		}
+		sort.Slice(names, func(i, j int) bool { return string(names[i]) < string(names[j]) })
+	}
+
+	// nothing to unsubscribe from is confirmed anyway
+	if len(names) == 0 {
+		if err := s.Reply(&PushReply{values: []any{kind, nil, 0}}); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range names {
+		broker.Lock()
+		if _, exists := subscriptions[string(name)]; exists {
+			delete(subscriptions, string(name))
+			broker.remove(registry, string(name), s)
+		}
+		broker.Unlock()
+
+		if err := s.Reply(&PushReply{values: []any{kind, name, s.count()}}); err != nil {
+			return err
+		}
+	}
+
+	if s.Active() && s.count() == 0 {
+		s.leave()
+	}
+
+	return nil
+}
+
+type pubSub struct {
+	sync.RWMutex
+	channels map[string]map[*Subscriber]struct{}
+	patterns map[string]map[*Subscriber]struct{}
+}
+
+var broker = &pubSub{
+	channels: map[string]map[*Subscriber]struct{}{},
+	patterns: map[string]map[*Subscriber]struct{}{},
+}
+
+// remove must be called with the lock held
+func (ps *pubSub) remove(registry map[string]map[*Subscriber]struct{}, name string, s *Subscriber) {
+	delete(registry[name], s)
+	if len(registry[name]) == 0 {
+		delete(registry, name)
+	}
+}
+
+// publish sends a message to the subscribers of a channel and of the patterns matching it,
+// it returns the number of clients that received it
+func (ps *pubSub) publish(channel []byte, message []byte) int {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	var receivers int
+	for s := range ps.channels[string(channel)] {
+		s.deliver([]any{"message", channel, message})
+		receivers++
+	}
+
+	for pattern, subscribers := range ps.patterns {
+		if !utils.GlobMatch([]byte(pattern), channel, false) {
+			continue
+		}
+
+		for s := range subscribers {
+			s.deliver([]any{"pmessage", pattern, channel, message})
+			receivers++
+		}
+	}
+
+	return receivers
+}
+
+func registerPubSubHandlers(m map[string]HandlerFn) {
+	// the keyspace notifications go to the subscribers of the __keyspace@ and __keyevent@ channels
+	storage.OnKeyspaceEvent(func(channel, message []byte) {
+		broker.publish(channel, message)
+	})
+
+	subscribeHandler := func(cmd string) HandlerFn {
+		return func(r *Request) error {
+			return r.Subscriber.subscribe(cmd, r.Args)
+		}
+	}
+
+	m["subscribe"] = subscribeHandler("subscribe")
+	m["psubscribe"] = subscribeHandler("psubscribe")
+
+	m["unsubscribe"] = func(r *Request) error {
+		return r.Subscriber.unsubscribe("unsubscribe", r.Args)
+	}
+
+	m["punsubscribe"] = func(r *Request) error {
+		return r.Subscriber.unsubscribe("punsubscribe", r.Args)
+	}
+
+	m["publish"] = func(r *Request) error {
+		reply := &IntegerReply{
+			number: broker.publish(r.Args[0], r.Args[1]),
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["pubsub"] = func(r *Request) error {
+		broker.RLock()
+		defer broker.RUnlock()
+
+		var reply ReplyWriter
+		switch strings.ToLower(string(r.Args[0])) {
+		case "channels":
+			if len(r.Args) > 2 {
+				return wrongNumberArgs("pubsub|channels")
+			}
+
+			channels := []any{}
+			for channel := range broker.channels {
+				if len(r.Args) == 1 || utils.GlobMatch(r.Args[1], []byte(channel), false) {
+					channels = append(channels, []byte(channel))
+				}
+			}
+
+			reply = &MultiBulkReply{
+				values: channels,
+			}
+		case "numsub":
+			counts := []any{}
+			for _, channel := range r.Args[1:] {
+				counts = append(counts, channel, len(broker.channels[string(channel)]))
+			}
+
+			reply = &MultiBulkReply{
+				values: counts,
+			}
+		case "numpat":
+			if len(r.Args) > 1 {
+				return wrongNumberArgs("pubsub|numpat")
+			}
+
+			reply = &IntegerReply{
+				number: len(broker.patterns),
+			}
+		default:
+			return fmt.Errorf("ERR unknown subcommand '%s'. Try PUBSUB HELP.", r.Args[0])
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,775 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bigdis/config"
+	"bigdis/storage"
+	"bigdis/utils"
+)
+
+/*
+A replica pulls the changes from its primary with BIGDIS CHANGES, the primary holding each call
+until there are new changes or a second went by. The offset the replica asks for is its acknowledgement.
+When the primary doesn't have the changes following that offset anymore, or when the replica followed
+another history, the replica loads a BIGDIS SNAPSHOT of the primary and resumes from its offset.
+
+The replica applies the changes with the command handlers, in batches each committed
+in one transaction along with the offsets, so that it resumes at the right place after a crash.
+*/
+
+const (
+	// changesBatch is the number of changes a replica asks for at once
+	changesBatch = 1000
+	// changesBlock is how long the primary holds BIGDIS CHANGES when there is nothing new
+	changesBlock = time.Second
+	// replicaTimeout is how long a replica waits for the primary before reconnecting
+	replicaTimeout = 30 * time.Second
+)
+
+var (
+	errReadOnly           = errors.New("READONLY You can't write against a read only replica.")
+	errInvalidReplicaPort = errors.New("ERR Invalid master port")
+)
+
+// the states of the replica link, as ROLE shows them
+const (
+	replicaConnect    = "connect"
+	replicaConnecting = "connecting"
+	replicaSync       = "sync"
+	replicaConnected  = "connected"
+)
+
+// replica is the state of the link with the primary, stop is nil when the server is a primary
+var replica = struct {
+	sync.Mutex
+	host   string
+	port   int
+	state  string
+	lastIO time.Time
+	stop   chan struct{}
+	done   chan struct{}
+}{}
+
+// IsReplica reports whether the server follows a primary
+func IsReplica() bool {
+	replica.Lock()
+	defer replica.Unlock()
+
+	return replica.stop != nil
+}
+
+// Logged reports whether the command goes to the change log: the writes made on a primary
+func (c *Command) Logged() bool {
+	return c.hasFlag("write") && !IsReplica()
+}
+
+// CheckReadOnly refuses the writes of the clients of a read only replica
+func CheckReadOnly(command *Command, args [][]byte) error {
+	if !command.writes(args) || !IsReplica() {
+		return nil
+	}
+
+	config.Lock.RLock()
+	defer config.Lock.RUnlock()
+
+	if config.Config.Replication.ReplicaReadOnly {
+		return errReadOnly
+	}
+
+	return nil
+}
+
+// replicaOf serializes the changes of primary, the replication stops without replica locked
+var replicaOf sync.Mutex
+
+// StartReplication follows the primary of the config, unless the server already does
+func StartReplication() error {
+	replicaOf.Lock()
+	defer replicaOf.Unlock()
+
+	config.Lock.RLock()
+	replicaOfConfig := config.Config.Replication.ReplicaOf
+	config.Lock.RUnlock()
+
+	if replicaOfConfig == "" || IsReplica() {
+		return nil
+	}
+
+	host, port, err := parseReplicaOf(replicaOfConfig)
+	if err != nil {
+		return fmt.Errorf("invalid replicaof %q", replicaOfConfig)
+	}
+	startReplica(host, port)
+
+	return nil
+}
+
+// StopReplication disconnects from the primary once the changes being applied are committed
+func StopReplication() {
+	replicaOf.Lock()
+	defer replicaOf.Unlock()
+
+	stopReplica()
+}
+
+func parseReplicaOf(value string) (string, int, error) {
+	host, portValue, found := strings.Cut(value, " ")
+	if !found {
+		return "", 0, utils.ErrSyntaxError
+	}
+
+	port, err := strconv.Atoi(portValue)
+	if err != nil || port < 1 || port > 65535 {
+		return "", 0, errInvalidReplicaPort
+	}
+
+	return host, port, nil
+}
+
+// startReplica runs the replication from host:port, it is called with replicaOf locked
+func startReplica(host string, port int) {
+	replica.Lock()
+	defer replica.Unlock()
+
+	replica.host = host
+	replica.port = port
+	replica.state = replicaConnect
+	replica.lastIO = time.Time{}
+	replica.stop = make(chan struct{})
+	replica.done = make(chan struct{})
+
+	go replicate(fmt.Sprintf("%s:%d", host, port), replica.stop, replica.done)
+}
+
+// stopReplica stops the replication, it is called with replicaOf locked.
+// The server is a replica until the changes being applied are committed, so that no write is logged meanwhile
+func stopReplica() {
+	replica.Lock()
+	stop, done := replica.stop, replica.done
+	replica.Unlock()
+	if stop == nil {
+		return
+	}
+
+	close(stop)
+	<-done
+
+	replica.Lock()
+	replica.host = ""
+	replica.port = 0
+	replica.stop = nil
+	replica.done = nil
+	replica.Unlock()
+}
+
+// setReplicaState updates the state of the link, unless the replication it comes from was stopped
+func setReplicaState(stop chan struct{}, state string) {
+	replica.Lock()
+	defer replica.Unlock()
+
+	if replica.stop != stop {
+		return
+	}
+	replica.state = state
+	if state == replicaConnected {
+		replica.lastIO = time.Now()
+	}
+}
+
+// replicate follows the primary at address until stop is closed, reconnecting every second when the link fails
+func replicate(address string, stop, done chan struct{}) {
+	defer close(done)
+
+	for {
+		err := syncWith(address, stop)
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		log.Printf("Replication from %s failed: %s\n", address, err)
+		setReplicaState(stop, replicaConnect)
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// syncWith applies the changes of the primary at address until the link fails
+func syncWith(address string, stop chan struct{}) error {
+	setReplicaState(stop, replicaConnecting)
+
+	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+	if err != nil {
+		return err
+	}
+
+	// closing the connection interrupts the call in progress when the replication stops
+	closed := make(chan struct{})
+	defer close(closed)
+	go func() {
+		select {
+		case <-stop:
+		case <-closed:
+		}
+		conn.Close()
+	}()
+
+	primary := &primaryLink{conn: conn, reader: bufio.NewReader(conn)}
+
+	config.Lock.RLock()
+	user, auth := config.Config.Replication.MasterUser, config.Config.Replication.MasterAuth
+	port := config.Config.Server.Port
+	config.Lock.RUnlock()
+
+	if auth != "" {
+		args := []string{"auth", auth}
+		if user != "" {
+			args = []string{"auth", user, auth}
+		}
+		if _, err := primary.call(args...); err != nil {
+			return err
+		}
+	}
+
+	if _, err := primary.call("bigdis", "replica", strconv.Itoa(port)); err != nil {
+		return err
+	}
+
+	for {
+		replid, offset, err := storage.Replication()
+		if err != nil {
+			return err
+		}
+
+		reply, err := primary.call("bigdis", "changes", replid, strconv.FormatInt(offset, 10),
+			strconv.Itoa(changesBatch), strconv.Itoa(int(changesBlock.Milliseconds())))
+		if err != nil {
+			return err
+		}
+
+		// the primary can't give the changes, the replica starts over from a snapshot
+		if reply == nil {
+			setReplicaState(stop, replicaSync)
+			if err := fullSync(primary); err != nil {
+				return err
+			}
+			continue
+		}
+
+		setReplicaState(stop, replicaConnected)
+
+		changes, err := parseChanges(reply, offset)
+		if err != nil {
+			return err
+		}
+		if err := applyChanges(changes); err != nil {
+			return err
+		}
+	}
+}
+
+// fullSync replaces all the keys of the replica with a snapshot of the primary
+func fullSync(primary *primaryLink) error {
+	// the snapshot can take longer than any other call
+	reply, err := primary.callWithTimeout(0, "bigdis", "snapshot")
+	if err != nil {
+		return err
+	}
+
+	values, ok := reply.([]any)
+	if !ok || len(values) != 3 {
+		return errors.New("invalid snapshot")
+	}
+	replid, ok1 := values[0].([]byte)
+	offset, ok2 := values[1].(int64)
+	snapshot, ok3 := values[2].([]byte)
+	if !ok1 || !ok2 || !ok3 {
+		return errors.New("invalid snapshot")
+	}
+
+	if err := storage.LoadSnapshot(bytes.NewReader(snapshot), string(replid), offset); err != nil {
+		return err
+	}
+	log.Printf("Full resync done, replication ID %s at offset %d\n", replid, offset)
+
+	return nil
+}
+
+// parseChanges reads the reply of BIGDIS CHANGES, the changes must follow the offset after
+func parseChanges(reply any, after int64) ([]*storage.Change, error) {
+	entries, ok := reply.([]any)
+	if !ok {
+		return nil, errors.New("invalid changes")
+	}
+
+	changes := make([]*storage.Change, len(entries))
+	for i, entry := range entries {
+		fields, ok := entry.([]any)
+		if !ok || len(fields) != 3 {
+			return nil, errors.New("invalid change")
+		}
+		offset, ok1 := fields[0].(int64)
+		dbNum, ok2 := fields[1].(int64)
+		command, ok3 := fields[2].([]any)
+		if !ok1 || !ok2 || !ok3 || len(command) == 0 || offset != after+int64(i)+1 {
+			return nil, errors.New("invalid change")
+		}
+
+		change := &storage.Change{Offset: offset, DB: int(dbNum), Args: make([][]byte, len(command))}
+		for j, arg := range command {
+			if change.Args[j], ok = arg.([]byte); !ok {
+				return nil, errors.New("invalid change")
+			}
+		}
+		changes[i] = change
+	}
+
+	return changes, nil
+}
+
+// discardConn is the connection of the changes applied by a replica, nobody reads their replies
+type discardConn struct {
+	net.Conn
+}
+
+func (c discardConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// applyChanges runs the changes of the primary and logs them in a single transaction.
+// The commands failing with an error reply are logged anyway, the primary logged them because they succeeded there
+func applyChanges(changes []*storage.Change) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	// the tables of the DBs must be created before the write connection is taken
+	for _, change := range changes {
+		if !storage.IsAvailableDB(change.DB) {
+			if err := storage.NewDB(change.DB); err != nil {
+				return err
+			}
+		}
+	}
+
+	dbOp, err := storage.BeginTransaction()
+	if err != nil {
+		return err
+	}
+	defer storage.RollbackOnPanic(dbOp)
+
+	for _, change := range changes {
+		if err := ApplyCommand(dbOp, change.DB, change.Args); err != nil {
+			if !utils.IsReplyError(err) {
+				storage.EndTransaction(dbOp, false)
+				return err
+			}
+			log.Printf("Replicated command %s at offset %d failed: %s\n", change.Args[0], change.Offset, err)
+		}
+
+		if err := storage.LogReplicatedChange(dbOp, change); err != nil {
+			storage.EndTransaction(dbOp, false)
+			return err
+		}
+	}
+
+	return storage.EndTransaction(dbOp, true)
+}
+
+// ApplyCommand runs a logged write command as part of a transaction, discarding its reply.
+// The changes it made are undone when it fails, the reply errors are returned as is
+func ApplyCommand(dbOp *storage.DBOperation, dbNum int, args [][]byte) error {
+	name := strings.ToLower(string(args[0]))
+	command, exists := commandTable[name]
+	if !exists || command.Handler == nil {
+		return fmt.Errorf("ERR unknown command '%s'", args[0])
+	}
+
+	request := &Request{
+		DB:   [][]byte{[]byte(strconv.Itoa(dbNum))},
+		Name: name,
+		Args: args[1:],
+		Conn: discardConn{},
+		DBOp: dbOp,
+	}
+
+	return dbOp.Savepoint(func() error {
+		return command.Handler(request)
+	})
+}
+
+// primaryLink is the connection of a replica to its primary
+type primaryLink struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// call sends a command to the primary and returns its reply
+func (p *primaryLink) call(args ...string) (any, error) {
+	return p.callWithTimeout(replicaTimeout, args...)
+}
+
+// callWithTimeout is call giving up after timeout, or never when it is 0
+func (p *primaryLink) callWithTimeout(timeout time.Duration, args ...string) (any, error) {
+	deadline := time.Time{}
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if err := p.conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	command := make([][]byte, len(args))
+	for i, arg := range args {
+		command[i] = []byte(arg)
+	}
+	if _, err := p.conn.Write(storage.EncodeCommand(command)); err != nil {
+		return nil, err
+	}
+
+	return readReply(p.reader)
+}
+
+// readReply reads a RESP2 reply, the error replies are returned as errors
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("invalid reply %q", line)
+	}
+	kind, value := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return value, nil
+	case '-':
+		return nil, errors.New(value)
+	case ':':
+		return strconv.ParseInt(value, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+
+		bulk := make([]byte, size+2)
+		if _, err := io.ReadFull(r, bulk); err != nil {
+			return nil, err
+		}
+
+		return bulk[:size], nil
+	case '*':
+		count, err := strconv.Atoi(value)
+		if err != nil || count < 0 {
+			return nil, err
+		}
+
+		values := make([]any, count)
+		for i := range values {
+			if values[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+
+		return values, nil
+	}
+
+	return nil, fmt.Errorf("invalid reply %q", line)
+}
+
+// Propagated returns the commands the change log records for a request. The relative expirations become
+// absolute so that a replica applying them later expires the keys at the same time as the primary
+func Propagated(r *Request) [][][]byte {
+	if r.Propagate != nil {
+		return r.Propagate
+	}
+
+	now := time.Now()
+	switch r.Name {
+	case "set":
+		args := [][]byte{[]byte("set"), r.Args[0], r.Args[1]}
+		for i := 2; i < len(r.Args); i++ {
+			option := strings.ToLower(string(r.Args[i]))
+			if (option == "ex" || option == "px" || option == "exat") && i+1 < len(r.Args) {
+				if at, ok := absoluteExpiration(option, r.Args[i+1], now); ok {
+					args = append(args, []byte("pxat"), at)
+					i++
+					continue
+				}
+			}
+			args = append(args, r.Args[i])
+		}
+
+		return [][][]byte{args}
+	case "expire", "pexpire", "expireat":
+		if at, ok := absoluteExpiration(r.Name, r.Args[1], now); ok {
+			args := append([][]byte{[]byte("pexpireat"), r.Args[0], at}, r.Args[2:]...)
+			return [][][]byte{args}
+		}
+	}
+
+	return [][][]byte{append([][]byte{[]byte(r.Name)}, r.Args...)}
+}
+
+// absoluteExpiration turns the time of an EX, PX, EXAT option or of an EXPIRE command into a unix time in milliseconds
+func absoluteExpiration(unit string, value []byte, now time.Time) ([]byte, bool) {
+	number, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return nil, false
+	}
+
+	var at int64
+	switch unit {
+	case "ex", "expire":
+		at = now.UnixMilli() + number*1000
+	case "px", "pexpire":
+		at = now.UnixMilli() + number
+	case "exat", "expireat":
+		at = number * 1000
+	}
+
+	return strconv.AppendInt(nil, at, 10), true
+}
+
+// connectedReplicas returns the clients following the server
+func connectedReplicas() []*Client {
+	var replicas []*Client
+	for _, client := range sortedClients() {
+		if _, _, _, ok := client.replicaInfo(); ok {
+			replicas = append(replicas, client)
+		}
+	}
+
+	return replicas
+}
+
+func replicationInfo() ([][2]string, error) {
+	replid, offset, err := storage.Replication()
+	if err != nil {
+		return nil, err
+	}
+	first, last, err := storage.ChangeLogRange()
+	if err != nil {
+		return nil, err
+	}
+	histlen := int64(0)
+	if first > 0 {
+		histlen = last - first + 1
+	}
+
+	var fields [][2]string
+
+	replica.Lock()
+	if replica.stop != nil {
+		linkStatus, lastIO := "down", "-1"
+		if replica.state == replicaConnected {
+			linkStatus = "up"
+		}
+		if !replica.lastIO.IsZero() {
+			lastIO = strconv.Itoa(int(time.Since(replica.lastIO).Seconds()))
+		}
+		syncing := "0"
+		if replica.state == replicaSync {
+			syncing = "1"
+		}
+
+		config.Lock.RLock()
+		readOnly := config.Config.Replication.ReplicaReadOnly
+		config.Lock.RUnlock()
+
+		fields = [][2]string{
+			{"role", "slave"},
+			{"master_host", replica.host},
+			{"master_port", strconv.Itoa(replica.port)},
+			{"master_link_status", linkStatus},
+			{"master_last_io_seconds_ago", lastIO},
+			{"master_sync_in_progress", syncing},
+			{"slave_repl_offset", strconv.FormatInt(offset, 10)},
+			{"slave_read_only", boolInfo(readOnly)},
+		}
+	} else {
+		fields = [][2]string{{"role", "master"}}
+	}
+	replica.Unlock()
+
+	replicas := connectedReplicas()
+	fields = append(fields, [2]string{"connected_slaves", strconv.Itoa(len(replicas))})
+	for i, client := range replicas {
+		port, ackOffset, ack, _ := client.replicaInfo()
+		host, _, _ := net.SplitHostPort(client.RemoteAddr().String())
+		fields = append(fields, [2]string{
+			"slave" + strconv.Itoa(i),
+			fmt.Sprintf("ip=%s,port=%d,state=online,offset=%d,lag=%d", host, port, ackOffset, int(time.Since(ack).Seconds())),
+		})
+	}
+
+	fields = append(fields,
+		[2]string{"master_replid", replid},
+		[2]string{"master_repl_offset", strconv.FormatInt(offset, 10)},
+		[2]string{"repl_backlog_active", "1"},
+		[2]string{"repl_backlog_size", strconv.Itoa(changeLogSize())},
+		[2]string{"repl_backlog_first_byte_offset", strconv.FormatInt(first, 10)},
+		[2]string{"repl_backlog_histlen", strconv.FormatInt(histlen, 10)},
+	)
+
+	return fields, nil
+}
+
+func changeLogSize() int {
+	config.Lock.RLock()
+	defer config.Lock.RUnlock()
+
+	return config.Config.Replication.ChangeLogSize
+}
+
+func boolInfo(value bool) string {
+	if value {
+		return "1"
+	}
+
+	return "0"
+}
+
+// role is the role of the server for HELLO
+func role() string {
+	if IsReplica() {
+		return "replica"
+	}
+
+	return "master"
+}
+
+func registerReplicationHandlers(m map[string]HandlerFn) {
+	m["replicaof"] = func(r *Request) error {
+		host, portValue := string(r.Args[0]), string(r.Args[1])
+
+		replicaOf.Lock()
+		defer replicaOf.Unlock()
+
+		status := "OK"
+		if strings.ToLower(host) == "no" && strings.ToLower(portValue) == "one" {
+			if IsReplica() {
+				stopReplica()
+				// the server starts its own history, the other replicas of its primary must resync from it
+				if err := storage.NewReplicationID(); err != nil {
+					return err
+				}
+				log.Println("Replication stopped, the server is now a primary")
+			}
+
+			config.Lock.Lock()
+			config.Config.Replication.ReplicaOf = ""
+			config.Lock.Unlock()
+		} else {
+			_, port, err := parseReplicaOf(host + " " + portValue)
+			if err != nil {
+				return err
+			}
+
+			replica.Lock()
+			following := replica.stop != nil && replica.host == host && replica.port == port
+			replica.Unlock()
+
+			if following {
+				status = "OK Already connected to specified master"
+			} else {
+				stopReplica()
+				startReplica(host, port)
+				log.Printf("Replicating from %s:%d\n", host, port)
+			}
+
+			config.Lock.Lock()
+			config.Config.Replication.ReplicaOf = fmt.Sprintf("%s %d", host, port)
+			config.Lock.Unlock()
+		}
+
+		if _, err := NewStatusReply(status).WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	// the replicas speaking the Redis protocol configure their stream before PSYNC, then send their acknowledgements
+	m["replconf"] = func(r *Request) error {
+		if len(r.Args)%2 != 0 {
+			return utils.ErrSyntaxError
+		}
+
+		for i := 0; i < len(r.Args); i += 2 {
+			switch strings.ToLower(string(r.Args[i])) {
+			case "listening-port":
+				port, err := strconv.Atoi(string(r.Args[i+1]))
+				if err != nil || port < 0 || port > 65535 {
+					return errInvalidReplicaPort
+				}
+				r.Client.SetReplica(port)
+			case "ack", "getack":
+				// the acknowledgements are never replied to, they only matter once the stream started
+				return nil
+			case "capa", "ip-address", "rdb-only", "rdb-filter-only":
+			default:
+				return fmt.Errorf("ERR Unrecognized REPLCONF option: %s", r.Args[i])
+			}
+		}
+
+		if _, err := NewStatusReply("OK").WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["role"] = func(r *Request) error {
+		_, offset, err := storage.Replication()
+		if err != nil {
+			return err
+		}
+
+		var values []any
+		replica.Lock()
+		if replica.stop != nil {
+			values = []any{"slave", replica.host, replica.port, replica.state, int(offset)}
+		}
+		replica.Unlock()
+
+		if values == nil {
+			replicas := []any{}
+			for _, client := range connectedReplicas() {
+				port, ackOffset, _, _ := client.replicaInfo()
+				host, _, _ := net.SplitHostPort(client.RemoteAddr().String())
+				replicas = append(replicas, []any{host, strconv.Itoa(port), strconv.FormatInt(ackOffset, 10)})
+			}
+			values = []any{"master", int(offset), replicas}
+		}
+
+		reply := &MultiBulkReply{
+			values: values,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
@@ -11,6 +11,31 @@ import (
 
 type ReplyWriter io.WriterTo
 
+// protocolWriter is implemented by the writers knowing the protocol negotiated by the client
+type protocolWriter interface {
+	Protocol() int
+}
+
+// Protocol returns the RESP version replies are written with to w, RESP2 unless HELLO asked for RESP3
+func Protocol(w io.Writer) int {
+	if p, ok := w.(protocolWriter); ok {
+		return p.Protocol()
+	}
+
+	return 2
+}
+
+// writeNull writes the null of RESP3, or the null bulk string of RESP2
+func writeNull(w io.Writer) (int64, error) {
+	null := "$-1\r\n"
+	if Protocol(w) == 3 {
+		null = "_\r\n"
+	}
+
+	n, err := w.Write([]byte(null))
+	return int64(n), err
+}
+
 type StatusReply struct {
 	Code string
 }
@@ -40,8 +65,7 @@ type BulkReply struct {
 func writeBytes(value interface{}, w io.Writer) (int64, error) {
 	//it's a NullBulkReply
 	if value == nil {
-		n, err := w.Write([]byte("$-1\r\n"))
-		return int64(n), err
+		return writeNull(w)
 	}
 	switch v := value.(type) {
 	case []interface{}:
@@ -53,10 +77,6 @@ func writeBytes(value interface{}, w io.Writer) (int64, error) {
 		return int64(wrote), err
 
 	case string:
-		if len(v) == 0 {
-			n, err := w.Write([]byte("$-1\r\n"))
-			return int64(n), err
-		}
 		wrote, err := w.Write([]byte("$" + strconv.Itoa(len(v)) + "\r\n"))
 		if err != nil {
 			return int64(wrote), err
@@ -68,9 +88,9 @@ func writeBytes(value interface{}, w io.Writer) (int64, error) {
 		wroteCrLf, err := w.Write([]byte("\r\n"))
 		return int64(wrote + wroteBytes + wroteCrLf), err
 	case []byte:
-		if len(v) == 0 {
-			n, err := w.Write([]byte("$-1\r\n"))
-			return int64(n), err
+		// a nil slice is the null bulk string, an empty one the empty string
+		if v == nil {
+			return writeNull(w)
 		}
 		wrote, err := w.Write([]byte("$" + strconv.Itoa(len(v)) + "\r\n"))
 		if err != nil {
@@ -82,6 +102,8 @@ func writeBytes(value interface{}, w io.Writer) (int64, error) {
 		}
 		wroteCrLf, err := w.Write([]byte("\r\n"))
 		return int64(wrote + wroteBytes + wroteCrLf), err
+	case ReplyWriter:
+		return v.WriteTo(w)
 	case int:
 		wrote, err := w.Write([]byte(":" + strconv.Itoa(v) + "\r\n"))
 		if err != nil {
@@ -102,6 +124,10 @@ type ErrorReply struct {
 	value string
 }
 
+func NewErrorReply(value string) *ErrorReply {
+	return &ErrorReply{value}
+}
+
 func (r *ErrorReply) WriteTo(w io.Writer) (int64, error) {
 	n, err := w.Write([]byte("-" + r.value + "\r\n"))
 
@@ -122,6 +148,10 @@ type MonitorReply struct {
 	c <-chan string
 }
 
+func NewMonitorReply(c <-chan string) *MonitorReply {
+	return &MonitorReply{c}
+}
+
 func (r *MonitorReply) WriteTo(w io.Writer) (int64, error) {
 	statusReply := &StatusReply{}
 	totalBytes := int64(0)
@@ -161,10 +191,15 @@ func MultiBulkFromMap(m map[string]interface{}) *MultiBulkReply {
 }
 
 func writeMultiBytes(values []interface{}, w io.Writer) (int64, error) {
+	return writeAggregate('*', len(values), values, w)
+}
+
+// writeAggregate writes the header of an aggregate of count elements followed by its values
+func writeAggregate(kind byte, count int, values []interface{}, w io.Writer) (int64, error) {
 	if values == nil {
 		return 0, errors.New("nil in multi bulk replies are not ok")
 	}
-	wrote, err := w.Write([]byte("*" + strconv.Itoa(len(values)) + "\r\n"))
+	wrote, err := w.Write([]byte(string(kind) + strconv.Itoa(count) + "\r\n"))
 	if err != nil {
 		return int64(wrote), err
 	}
@@ -183,6 +218,156 @@ func (r *MultiBulkReply) WriteTo(w io.Writer) (int64, error) {
 	return writeMultiBytes(r.values, w)
 }
 
+/*
+The RESP3 replies below fall back to their RESP2 equivalent
+when the client didn't switch to RESP3 with HELLO.
+*/
+
+// MapReply holds the keys and the values alternated, it is a flat multi bulk in RESP2
+type MapReply struct {
+	values []interface{}
+}
+
+func (r *MapReply) WriteTo(w io.Writer) (int64, error) {
+	if Protocol(w) == 3 {
+		return writeAggregate('%', len(r.values)/2, r.values, w)
+	}
+
+	return writeMultiBytes(r.values, w)
+}
+
+// SetReply is a multi bulk in RESP2
+type SetReply struct {
+	values []interface{}
+}
+
+func (r *SetReply) WriteTo(w io.Writer) (int64, error) {
+	if Protocol(w) == 3 {
+		return writeAggregate('~', len(r.values), r.values, w)
+	}
+
+	return writeMultiBytes(r.values, w)
+}
+
+// PushReply is out of band data as the Pub/Sub messages, it is a multi bulk in RESP2
+type PushReply struct {
+	values []interface{}
+}
+
+func (r *PushReply) WriteTo(w io.Writer) (int64, error) {
+	if Protocol(w) == 3 {
+		return writeAggregate('>', len(r.values), r.values, w)
+	}
+
+	return writeMultiBytes(r.values, w)
+}
+
+// DoubleReply holds a formatted floating point number, nil for a null, it is a bulk string in RESP2
+type DoubleReply struct {
+	value []byte
+}
+
+func (r *DoubleReply) WriteTo(w io.Writer) (int64, error) {
+	if Protocol(w) == 3 && r.value != nil {
+		n, err := w.Write([]byte("," + string(r.value) + "\r\n"))
+		return int64(n), err
+	}
+
+	return writeBytes(r.value, w)
+}
+
+// ScoresReply holds the members of a sorted set and their formatted scores alternated, it is a flat multi bulk in RESP2.
+// RESP3 replies with an array of [member, double] pairs, or with a single flat pair when flat is set
+type ScoresReply struct {
+	values []interface{}
+	flat   bool
+}
+
+func (r *ScoresReply) WriteTo(w io.Writer) (int64, error) {
+	if Protocol(w) != 3 {
+		return writeMultiBytes(r.values, w)
+	}
+
+	values := make([]interface{}, 0, len(r.values))
+	for i := 0; i+1 < len(r.values); i += 2 {
+		pair := []interface{}{r.values[i], &DoubleReply{value: r.values[i+1].([]byte)}}
+		if r.flat {
+			values = append(values, pair...)
+		} else {
+			values = append(values, pair)
+		}
+	}
+
+	return writeMultiBytes(values, w)
+}
+
+// BooleanReply is the integer 1 or 0 in RESP2
+type BooleanReply struct {
+	value bool
+}
+
+func (r *BooleanReply) WriteTo(w io.Writer) (int64, error) {
+	if Protocol(w) == 3 {
+		value := "#f\r\n"
+		if r.value {
+			value = "#t\r\n"
+		}
+
+		n, err := w.Write([]byte(value))
+		return int64(n), err
+	}
+
+	number := 0
+	if r.value {
+		number = 1
+	}
+
+	return writeBytes(number, w)
+}
+
+// NullReply is the null of RESP3, RESP2 has a null bulk string and a null multi bulk
+type NullReply struct {
+	Array bool
+}
+
+func (r *NullReply) WriteTo(w io.Writer) (int64, error) {
+	if r.Array && Protocol(w) == 2 {
+		n, err := w.Write([]byte("*-1\r\n"))
+		return int64(n), err
+	}
+
+	return writeNull(w)
+}
+
+// BigNumberReply holds an integer of any size, it is a bulk string in RESP2
+type BigNumberReply struct {
+	value []byte
+}
+
+func (r *BigNumberReply) WriteTo(w io.Writer) (int64, error) {
+	if Protocol(w) == 3 {
+		n, err := w.Write([]byte("(" + string(r.value) + "\r\n"))
+		return int64(n), err
+	}
+
+	return writeBytes(r.value, w)
+}
+
+// VerbatimReply is a text meant to be shown as is, with its format as txt or mkd, it is a bulk string in RESP2
+type VerbatimReply struct {
+	format string
+	value  []byte
+}
+
+func (r *VerbatimReply) WriteTo(w io.Writer) (int64, error) {
+	if Protocol(w) == 3 {
+		n, err := w.Write([]byte("=" + strconv.Itoa(len(r.format)+1+len(r.value)) + "\r\n" + r.format + ":" + string(r.value) + "\r\n"))
+		return int64(n), err
+	}
+
+	return writeBytes(r.value, w)
+}
+
 func ReplyToString(r ReplyWriter) (string, error) {
 	var b bytes.Buffer
 
@@ -219,31 +404,34 @@ func (c *MultiChannelWriter) WriteTo(w io.Writer) (n int64, err error) {
 
 type ChannelWriter struct {
 	FirstReply []interface{}
-	Channel    chan []interface{}
+	Channel    chan ReplyWriter
 	clientChan chan struct{}
 }
 
+// WriteTo writes the replies sent to Channel until a nil one is received or clientChan is closed
 func (c *ChannelWriter) WriteTo(w io.Writer) (int64, error) {
-	totalBytes, err := writeMultiBytes(c.FirstReply, w)
-	if err != nil {
-		return totalBytes, err
+	var totalBytes int64
+	if c.FirstReply != nil {
+		wroteBytes, err := writeMultiBytes(c.FirstReply, w)
+		totalBytes += wroteBytes
+		if err != nil {
+			return totalBytes, err
+		}
 	}
 
 	for {
 		select {
 		case <-c.clientChan:
-			return totalBytes, err
+			return totalBytes, nil
 		case reply := <-c.Channel:
 			if reply == nil {
 				return totalBytes, nil
-			} else {
-				wroteBytes, err := writeMultiBytes(reply, w)
-				// FIXME: obvious overflow here,
-				// Just ignore? Who cares?
-				totalBytes += wroteBytes
-				if err != nil {
-					return totalBytes, err
-				}
+			}
+
+			wroteBytes, err := reply.WriteTo(w)
+			totalBytes += wroteBytes
+			if err != nil {
+				return totalBytes, err
 			}
 		}
 	}
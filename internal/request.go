@@ -11,6 +11,18 @@ type Request struct {
 	Name string
 	Args [][]byte
 	Conn net.Conn
+
+	// DBOp is the transaction the request runs in, nil when it runs on its own
+	DBOp *storage.DBOperation
+
+	// Client is the connection the request comes from, Conn may be a buffer in front of it
+	Client *Client
+
+	// Subscriber is the Pub/Sub state of the connection
+	Subscriber *Subscriber
+
+	// Propagate replaces the request in the change log, for the commands whose effect can't be replayed as is
+	Propagate [][][]byte
 }
 
 func (r *Request) GetDBNum() int {
@@ -23,8 +35,7 @@ func (r *Request) GetDBNum() int {
 		return 0
 	}
 
-	_, exists := storage.AvailableDBs[dbNum]
-	if !exists {
+	if !storage.IsAvailableDB(dbNum) {
 		if err := storage.NewDB(dbNum); err != nil {
 			reply := &StatusReply{
 				Code: err.Error(),
@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"strconv"
+
+	"bigdis/storage"
+)
+
+func registerSetHandlers(m map[string]HandlerFn) {
+	m["sadd"] = integerHandler(storage.SAdd)
+	m["srem"] = integerHandler(storage.SRem)
+	m["smismember"] = multiBulkHandler(storage.SMIsMember)
+	m["sinter"] = setHandler(storage.SInter)
+	m["sunion"] = setHandler(storage.SUnion)
+	m["sdiff"] = setHandler(storage.SDiff)
+	m["sinterstore"] = integerHandler(storage.SInterStore)
+	m["sunionstore"] = integerHandler(storage.SUnionStore)
+	m["sdiffstore"] = integerHandler(storage.SDiffStore)
+	m["sintercard"] = integerHandler(storage.SInterCard)
+	m["smembers"] = setHandler(storage.SMembers)
+	m["scard"] = integerHandler(storage.SCard)
+	m["sismember"] = integerHandler(storage.SIsMember)
+	m["smove"] = integerHandler(storage.SMove)
+
+	// the members are picked at random, the replicas remove the same ones
+	m["spop"] = func(r *Request) error {
+		return popHandler("spop", func(dbNum int, args [][]byte, dbOp *storage.DBOperation) ([]any, error) {
+			members, err := storage.SPop(dbNum, args, dbOp)
+			if err != nil {
+				return nil, err
+			}
+			// unlike the lists, a count of a missing set replies with an empty array
+			if members == nil {
+				members = []any{}
+			}
+
+			r.Propagate = [][][]byte{}
+			if len(members) > 0 {
+				srem := [][]byte{[]byte("srem"), args[0]}
+				for _, member := range members {
+					srem = append(srem, member.([]byte))
+				}
+				r.Propagate = append(r.Propagate, srem)
+			}
+
+			return members, nil
+		})(r)
+	}
+
+	m["srandmember"] = func(r *Request) error {
+		if len(r.Args) > 2 {
+			return wrongNumberArgs("srandmember")
+		}
+
+		members, err := storage.SRandMember(r.GetDBNum(), r.Args, r.DBOp)
+		if err != nil {
+			return err
+		}
+
+		// a single member is returned as a bulk reply when no count is given
+		var reply ReplyWriter
+		if len(r.Args) == 1 {
+			var member []byte
+			if len(members) > 0 {
+				member = members[0].([]byte)
+			}
+
+			reply = &BulkReply{
+				value: member,
+			}
+		} else {
+			reply = &MultiBulkReply{
+				values: members,
+			}
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["sscan"] = func(r *Request) error {
+		cursor, members, err := storage.SScan(r.GetDBNum(), r.Args, r.DBOp)
+		if err != nil {
+			return err
+		}
+
+		reply := &MultiBulkReply{
+			values: []any{[]byte(strconv.FormatInt(cursor, 10)), members},
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"strings"
+
+	"bigdis/storage"
+	"bigdis/utils"
+)
+
+func registerSnapshotHandlers(m map[string]HandlerFn) {
+	m["save"] = func(r *Request) error {
+		if err := storage.Save(); err != nil {
+			return err
+		}
+
+		if _, err := NewStatusReply("OK").WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["bgsave"] = func(r *Request) error {
+		schedule := false
+		if len(r.Args) > 0 {
+			if strings.ToLower(string(r.Args[0])) != "schedule" {
+				return utils.ErrSyntaxError
+			}
+			schedule = true
+		}
+
+		scheduled, err := storage.BGSave(schedule)
+		if err != nil {
+			return err
+		}
+
+		status := "Background saving started"
+		if scheduled {
+			status = "Background saving scheduled"
+		}
+		if _, err := NewStatusReply(status).WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["bgrewriteaof"] = func(r *Request) error {
+		if err := storage.RewriteJournal(); err != nil {
+			return err
+		}
+
+		if _, err := NewStatusReply("Background append only file rewriting started").WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["lastsave"] = func(r *Request) error {
+		reply := &IntegerReply{
+			number: int(storage.Snapshot().LastSave.Unix()),
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,189 @@
+package internal
+
+import (
+	"strconv"
+	"strings"
+
+	"bigdis/storage"
+)
+
+func registerSortedSetHandlers(m map[string]HandlerFn) {
+	m["zadd"] = func(r *Request) error {
+		result, err := storage.ZAdd(r.GetDBNum(), r.Args, r.DBOp)
+		if err != nil {
+			return err
+		}
+
+		// INCR replies with the new score, nil if the member was not updated
+		var reply ReplyWriter
+		switch v := result.(type) {
+		case int:
+			reply = &IntegerReply{
+				number: v,
+			}
+		case []byte:
+			reply = &BulkReply{
+				value: v,
+			}
+		default:
+			reply = &BulkReply{}
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["zincrby"] = func(r *Request) error {
+		score, err := storage.ZIncrBy(r.GetDBNum(), r.Args, r.DBOp)
+		if err != nil {
+			return err
+		}
+
+		reply := &DoubleReply{
+			value: score,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	m["zscore"] = func(r *Request) error {
+		score, err := storage.ZScore(r.GetDBNum(), r.Args, r.DBOp)
+		if err != nil {
+			return err
+		}
+
+		reply := &DoubleReply{
+			value: score,
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+
+	rankHandler := func(cmd string, fn func(dbNum int, args [][]byte, dbOp *storage.DBOperation) ([]any, error)) HandlerFn {
+		return func(r *Request) error {
+			if len(r.Args) > 3 {
+				return wrongNumberArgs(cmd)
+			}
+
+			result, err := fn(r.GetDBNum(), r.Args, r.DBOp)
+			if err != nil {
+				return err
+			}
+
+			// WITHSCORE replies with both the rank and the score
+			var reply ReplyWriter
+			switch {
+			case result == nil:
+				reply = &BulkReply{}
+			case len(r.Args) == 3:
+				reply = &MultiBulkReply{
+					values: []any{result[0], &DoubleReply{value: result[1].([]byte)}},
+				}
+			default:
+				reply = &IntegerReply{
+					number: result[0].(int),
+				}
+			}
+
+			if _, err := reply.WriteTo(r.Conn); err != nil {
+				return err
+			}
+
+			return nil
+		}
+	}
+
+	m["zrank"] = rankHandler("zrank", storage.ZRank)
+	m["zrevrank"] = rankHandler("zrevrank", storage.ZRevRank)
+
+	m["zrem"] = integerHandler(storage.ZRem)
+	m["zcard"] = integerHandler(storage.ZCard)
+	m["zcount"] = integerHandler(storage.ZCount)
+	m["zlexcount"] = integerHandler(storage.ZLexCount)
+	m["zunionstore"] = integerHandler(storage.ZUnionStore)
+	m["zinterstore"] = integerHandler(storage.ZInterStore)
+
+	// WITHSCORES pairs the members with their scores in RESP3
+	rangeHandler := func(fn func(dbNum int, args [][]byte, dbOp *storage.DBOperation) ([]any, error)) HandlerFn {
+		return func(r *Request) error {
+			values, err := fn(r.GetDBNum(), r.Args, r.DBOp)
+			if err != nil {
+				return err
+			}
+
+			var reply ReplyWriter = &MultiBulkReply{
+				values: values,
+			}
+			for _, arg := range r.Args[3:] {
+				if strings.ToLower(string(arg)) == "withscores" {
+					reply = &ScoresReply{
+						values: values,
+					}
+				}
+			}
+
+			if _, err := reply.WriteTo(r.Conn); err != nil {
+				return err
+			}
+
+			return nil
+		}
+	}
+
+	m["zrange"] = rangeHandler(storage.ZRange)
+	m["zrevrange"] = rangeHandler(storage.ZRevRange)
+	m["zrangebyscore"] = rangeHandler(storage.ZRangeByScore)
+	m["zrevrangebyscore"] = rangeHandler(storage.ZRevRangeByScore)
+
+	// without a count the member and its score aren't nested in RESP3
+	scoredPopHandler := func(fn func(dbNum int, args [][]byte, dbOp *storage.DBOperation) ([]any, error)) HandlerFn {
+		return func(r *Request) error {
+			values, err := fn(r.GetDBNum(), r.Args, r.DBOp)
+			if err != nil {
+				return err
+			}
+
+			reply := &ScoresReply{
+				values: values,
+				flat:   len(r.Args) == 1,
+			}
+
+			if _, err := reply.WriteTo(r.Conn); err != nil {
+				return err
+			}
+
+			return nil
+		}
+	}
+
+	m["zpopmin"] = scoredPopHandler(storage.ZPopMin)
+	m["zpopmax"] = scoredPopHandler(storage.ZPopMax)
+
+	m["zscan"] = func(r *Request) error {
+		cursor, values, err := storage.ZScan(r.GetDBNum(), r.Args, r.DBOp)
+		if err != nil {
+			return err
+		}
+
+		reply := &MultiBulkReply{
+			values: []any{[]byte(strconv.FormatInt(cursor, 10)), values},
+		}
+
+		if _, err := reply.WriteTo(r.Conn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
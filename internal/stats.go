@@ -0,0 +1,26 @@
+package internal
+
+import (
+	"sync/atomic"
+	"time"
+
+	"bigdis/storage"
+)
+
+// startTime is when the server started, for the uptime
+var startTime = time.Now()
+
+// Stats are the counters reported by INFO, CONFIG RESETSTAT sets them back to zero
+var Stats struct {
+	ConnectionsReceived atomic.Int64
+	CommandsProcessed   atomic.Int64
+
+	// ConnectedClients is a gauge, it is not reset
+	ConnectedClients atomic.Int64
+}
+
+func ResetStats() {
+	Stats.ConnectionsReceived.Store(0)
+	Stats.CommandsProcessed.Store(0)
+	storage.Stats.ExpiredKeys.Store(0)
+}
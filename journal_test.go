@@ -0,0 +1,27 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestJournalReplay builds a new database from the journal, the commands rewriting their arguments included
+func TestJournalReplay(t *testing.T) {
+	dir := t.TempDir()
+	journal := filepath.Join(dir, "appendonly.aof")
+	srv := startServer(t, map[string]map[string]any{"storage": {"appendonly": true, "appendfsync": "always", "appendfilename": journal}})
+	c := srv.client()
+
+	writeCounters(c, "1")
+	if reply := str(c.ok("info", "persistence")); !strings.Contains(reply, "aof_last_write_status:ok") {
+		t.Errorf("info persistence:\n%s", reply)
+	}
+	srv.stop()
+
+	replayed := filepath.Join(dir, "replayed.db")
+	t.Log(runMain(t, "replay", "-config", srv.configPath, "-aof", journal, replayed))
+
+	restored := startServer(t, map[string]map[string]any{"storage": {"path": replayed}})
+	checkCounters(t, restored.client(), "1")
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// scanAll iterates over a SCAN until the cursor is 0 and returns the keys found, sorted
+func scanAll(t *testing.T, c *testClient, options ...string) []string {
+	t.Helper()
+
+	var keys []string
+	cursor := "0"
+	for calls := 0; ; calls++ {
+		if calls > 1000 {
+			t.Fatal("the scan doesn't end")
+		}
+		reply := c.ok(append([]string{"scan", cursor}, options...)...).([]any)
+		cursor = str(reply[0])
+		for _, key := range reply[1].([]any) {
+			keys = append(keys, str(key))
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func TestKeys(t *testing.T) {
+	c := startServer(t, nil).client()
+	for _, key := range []string{"hello", "hallo", "hxllo", "heeeello", "hillo", "*star", "Hello"} {
+		c.ok("set", key, "v")
+	}
+	c.ok("set", "expired", "v", "px", "1")
+	time.Sleep(10 * time.Millisecond)
+
+	tests := []struct {
+		pattern  string
+		expected []string
+	}{
+		{"*", []string{"*star", "Hello", "hallo", "heeeello", "hello", "hillo", "hxllo"}},
+		{"h?llo", []string{"hallo", "hello", "hillo", "hxllo"}},
+		{"h*llo", []string{"hallo", "heeeello", "hello", "hillo", "hxllo"}},
+		{"h[ae]llo", []string{"hallo", "hello"}},
+		{"h[^e]llo", []string{"hallo", "hillo", "hxllo"}},
+		{"h[a-i]llo", []string{"hallo", "hello", "hillo"}},
+		{`\*star`, []string{"*star"}},
+		{"hello", []string{"hello"}},
+		{"nothere*", []string{}},
+	}
+	for _, test := range tests {
+		got := []string{}
+		for _, key := range c.ok("keys", test.pattern).([]any) {
+			got = append(got, str(key))
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("keys %s = %q, expected %q", test.pattern, got, test.expected)
+		}
+	}
+
+	// the keys of the other DBs aren't listed
+	c.ok("select", "1")
+	if got := c.ok("keys", "*"); !reflect.DeepEqual(got, []any{}) {
+		t.Errorf("keys * of DB 1 = %q", got)
+	}
+}
+
+func TestScan(t *testing.T) {
+	c := startServer(t, nil).client()
+	var all []string
+	for i := 0; i < 25; i++ {
+		key := "key:" + strconv.Itoa(i)
+		c.ok("set", key, "v")
+		all = append(all, key)
+	}
+	c.ok("rpush", "list", "a")
+	c.ok("sadd", "set", "a")
+	all = append(all, "list", "set")
+	sort.Strings(all)
+
+	if got := scanAll(t, c); !reflect.DeepEqual(got, all) {
+		t.Errorf("scan = %q, expected %q", got, all)
+	}
+	if got := scanAll(t, c, "count", "3"); !reflect.DeepEqual(got, all) {
+		t.Errorf("scan count 3 = %q, expected %q", got, all)
+	}
+	if got := scanAll(t, c, "match", "key:1*", "count", "4"); !reflect.DeepEqual(got, []string{"key:1", "key:10", "key:11", "key:12", "key:13", "key:14", "key:15", "key:16", "key:17", "key:18", "key:19"}) {
+		t.Errorf("scan match key:1* = %q", got)
+	}
+	if got := scanAll(t, c, "type", "list"); !reflect.DeepEqual(got, []string{"list"}) {
+		t.Errorf("scan type list = %q", got)
+	}
+	if got := scanAll(t, c, "TYPE", "SET", "MATCH", "s*"); !reflect.DeepEqual(got, []string{"set"}) {
+		t.Errorf("scan type set match s* = %q", got)
+	}
+
+	// the keys there from the start to the end of the iteration are returned once
+	reply := c.ok("scan", "0", "count", "10").([]any)
+	seen := map[string]int{}
+	for _, key := range reply[1].([]any) {
+		seen[str(key)]++
+	}
+	c.ok("del", "key:24")
+	c.ok("set", "key:0", "updated")
+	for cursor := str(reply[0]); cursor != "0"; cursor = str(reply[0]) {
+		reply = c.ok("scan", cursor, "count", "10").([]any)
+		for _, key := range reply[1].([]any) {
+			seen[str(key)]++
+		}
+	}
+	for _, key := range all {
+		if key != "key:24" && seen[key] != 1 {
+			t.Errorf("%s returned %d times", key, seen[key])
+		}
+	}
+
+	checkReplies(t, c, []replyTest{
+		{[]string{"scan", "-1"}, replyError("ERR invalid cursor")},
+		{[]string{"scan", "abc"}, replyError("ERR invalid cursor")},
+		{[]string{"scan", "0", "count", "0"}, replyError("ERR syntax error")},
+		{[]string{"scan", "0", "count", "x"}, replyError("ERR value is not an integer or out of range")},
+		{[]string{"scan", "0", "match"}, replyError("ERR syntax error")},
+		{[]string{"scan", "0", "type", "nosuch"}, replyError("ERR unknown type name 'nosuch'")},
+	})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestLists(t *testing.T) {
+	c := startServer(t, nil).client()
+	wrongType := replyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+	c.ok("set", "string", "v")
+
+	checkReplies(t, c, []replyTest{
+		{[]string{"rpush", "l", "b", "c"}, int64(2)},
+		{[]string{"lpush", "l", "a", "z"}, int64(4)},
+		{[]string{"lrange", "l", "0", "-1"}, bulks("z", "a", "b", "c")},
+		{[]string{"lpushx", "missing", "a"}, int64(0)},
+		{[]string{"rpushx", "l", "d"}, int64(5)},
+		{[]string{"exists", "missing"}, int64(0)},
+		{[]string{"llen", "l"}, int64(5)},
+		{[]string{"llen", "missing"}, int64(0)},
+		{[]string{"lrange", "l", "1", "2"}, bulks("a", "b")},
+		{[]string{"lrange", "l", "-2", "100"}, bulks("c", "d")},
+		{[]string{"lrange", "l", "3", "1"}, []any{}},
+		{[]string{"lrange", "missing", "0", "-1"}, []any{}},
+		{[]string{"lindex", "l", "0"}, []byte("z")},
+		{[]string{"lindex", "l", "-1"}, []byte("d")},
+		{[]string{"lindex", "l", "5"}, nil},
+		{[]string{"lset", "l", "0", "y"}, "OK"},
+		{[]string{"lset", "l", "-1", "e"}, "OK"},
+		{[]string{"lset", "l", "5", "x"}, replyError("ERR index out of range")},
+		{[]string{"lset", "missing", "0", "x"}, replyError("ERR no such key")},
+		{[]string{"lrange", "l", "0", "-1"}, bulks("y", "a", "b", "c", "e")},
+
+		{[]string{"linsert", "l", "before", "b", "b0"}, int64(6)},
+		{[]string{"linsert", "l", "AFTER", "e", "f"}, int64(7)},
+		{[]string{"linsert", "l", "after", "nothere", "x"}, int64(-1)},
+		{[]string{"linsert", "missing", "after", "a", "x"}, int64(0)},
+		{[]string{"linsert", "l", "middle", "a", "x"}, replyError("ERR syntax error")},
+		{[]string{"lrange", "l", "0", "-1"}, bulks("y", "a", "b0", "b", "c", "e", "f")},
+
+		{[]string{"lpop", "l"}, []byte("y")},
+		{[]string{"rpop", "l"}, []byte("f")},
+		{[]string{"lpop", "l", "2"}, bulks("a", "b0")},
+		{[]string{"rpop", "l", "0"}, []any{}},
+		{[]string{"lpop", "missing"}, nil},
+		{[]string{"lrange", "l", "0", "-1"}, bulks("b", "c", "e")},
+		{[]string{"rpop", "l", "10"}, bulks("e", "c", "b")},
+		{[]string{"exists", "l"}, int64(0)},
+
+		{[]string{"rpush", "l", "string", "v"}, int64(2)},
+		{[]string{"lpush", "string", "a"}, wrongType},
+		{[]string{"lrange", "string", "0", "-1"}, wrongType},
+		{[]string{"get", "l"}, wrongType},
+		{[]string{"type", "l"}, "list"},
+	})
+}
+
+func TestListRemoveAndTrim(t *testing.T) {
+	c := startServer(t, nil).client()
+	c.ok("rpush", "l", "a", "b", "a", "c", "a", "b")
+
+	checkReplies(t, c, []replyTest{
+		{[]string{"lrem", "l", "1", "a"}, int64(1)},
+		{[]string{"lrange", "l", "0", "-1"}, bulks("b", "a", "c", "a", "b")},
+		{[]string{"lrem", "l", "-1", "b"}, int64(1)},
+		{[]string{"lrange", "l", "0", "-1"}, bulks("b", "a", "c", "a")},
+		{[]string{"lrem", "l", "0", "a"}, int64(2)},
+		{[]string{"lrange", "l", "0", "-1"}, bulks("b", "c")},
+		{[]string{"lrem", "l", "0", "nothere"}, int64(0)},
+		{[]string{"lrem", "missing", "0", "a"}, int64(0)},
+
+		{[]string{"rpush", "t", "0", "1", "2", "3", "4", "5"}, int64(6)},
+		{[]string{"ltrim", "t", "1", "-2"}, "OK"},
+		{[]string{"lrange", "t", "0", "-1"}, bulks("1", "2", "3", "4")},
+		{[]string{"ltrim", "t", "-100", "1"}, "OK"},
+		{[]string{"lrange", "t", "0", "-1"}, bulks("1", "2")},
+		// an empty range deletes the list
+		{[]string{"ltrim", "t", "5", "10"}, "OK"},
+		{[]string{"exists", "t"}, int64(0)},
+		{[]string{"ltrim", "missing", "0", "1"}, "OK"},
+	})
+}
+
+func TestListPositions(t *testing.T) {
+	c := startServer(t, nil).client()
+	c.ok("rpush", "l", "a", "b", "c", "1", "2", "3", "c", "c")
+
+	checkReplies(t, c, []replyTest{
+		{[]string{"lpos", "l", "c"}, int64(2)},
+		{[]string{"lpos", "l", "nothere"}, nil},
+		{[]string{"lpos", "missing", "a"}, nil},
+		{[]string{"lpos", "l", "c", "rank", "2"}, int64(6)},
+		{[]string{"lpos", "l", "c", "rank", "-1"}, int64(7)},
+		{[]string{"lpos", "l", "c", "rank", "4"}, nil},
+		{[]string{"lpos", "l", "c", "count", "0"}, []any{int64(2), int64(6), int64(7)}},
+		{[]string{"lpos", "l", "c", "count", "2"}, []any{int64(2), int64(6)}},
+		{[]string{"lpos", "l", "c", "rank", "-1", "count", "2"}, []any{int64(7), int64(6)}},
+		{[]string{"lpos", "l", "nothere", "count", "2"}, []any{}},
+		{[]string{"lpos", "l", "c", "count", "0", "maxlen", "3"}, []any{int64(2)}},
+		{[]string{"lpos", "l", "c", "rank", "0"}, replyError("ERR RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list")},
+		{[]string{"lpos", "l", "c", "count", "-1"}, replyError("ERR COUNT can't be negative")},
+	})
+}
+
+func TestListMove(t *testing.T) {
+	c := startServer(t, nil).client()
+	c.ok("rpush", "src", "a", "b", "c")
+
+	checkReplies(t, c, []replyTest{
+		{[]string{"lmove", "src", "dst", "left", "right"}, []byte("a")},
+		{[]string{"lmove", "src", "dst", "RIGHT", "LEFT"}, []byte("c")},
+		{[]string{"lrange", "src", "0", "-1"}, bulks("b")},
+		{[]string{"lrange", "dst", "0", "-1"}, bulks("c", "a")},
+		{[]string{"rpoplpush", "dst", "src"}, []byte("a")},
+		{[]string{"lrange", "src", "0", "-1"}, bulks("a", "b")},
+		// a rotation of the same list
+		{[]string{"lmove", "src", "src", "left", "right"}, []byte("a")},
+		{[]string{"lrange", "src", "0", "-1"}, bulks("b", "a")},
+		{[]string{"lmove", "missing", "dst", "left", "left"}, nil},
+		{[]string{"lmove", "src", "dst", "up", "left"}, replyError("ERR syntax error")},
+		{[]string{"lmove", "dst", "src", "left", "left"}, []byte("c")},
+		{[]string{"exists", "dst"}, int64(0)},
+	})
+}
+
+// TestLongList checks the positions of a list growing on both ends, as a queue does
+func TestLongList(t *testing.T) {
+	c := startServer(t, nil).client()
+
+	args := []string{"rpush", "l"}
+	for i := 0; i < 1000; i++ {
+		args = append(args, strconv.Itoa(i))
+	}
+	c.ok(args...)
+	for i := 1; i <= 500; i++ {
+		c.ok("lpush", "l", strconv.Itoa(-i))
+		c.ok("lpop", "l", "2")
+	}
+
+	checkReplies(t, c, []replyTest{
+		{[]string{"llen", "l"}, int64(500)},
+		{[]string{"lindex", "l", "0"}, []byte("500")},
+		{[]string{"lindex", "l", "-1"}, []byte("999")},
+		{[]string{"lrange", "l", "250", "252"}, bulks("750", "751", "752")},
+		{[]string{"lpos", "l", "900"}, int64(400)},
+	})
+}
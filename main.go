@@ -2,12 +2,16 @@ package main
 
 import (
 	"bigdis/config"
+	"bigdis/internal"
 	"bigdis/server"
 	"bigdis/storage"
+	"bigdis/utils"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
@@ -15,6 +19,18 @@ import (
 )
 
 func main() {
+	// the subcommands run against the database and exit, without starting the server
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "import-rdb", "export-rdb":
+			rdbCommand(os.Args[1], os.Args[2:])
+			return
+		case "replay":
+			replayCommand(os.Args[2:])
+			return
+		}
+	}
+
 	configPath := flag.String("config", "", "path to config file")
 	flag.Parse()
 
@@ -33,11 +49,12 @@ func main() {
 	sigterm := make(chan os.Signal, 1)
 	signal.Notify(sigterm, syscall.SIGTERM, syscall.SIGINT)
 	go func() {
-		<-sigterm
-		fmt.Println("\nStopping...")
-		// Perform cleanup here
-		daemon.SdNotify(false, daemon.SdNotifyStopping)
-		os.Exit(0)
+		for range sigterm {
+			fmt.Println("\nStopping...")
+			if err := server.Shutdown(); err != nil {
+				fmt.Println(err)
+			}
+		}
 	}()
 
 	// Start server
@@ -46,6 +63,156 @@ func main() {
 	}
 }
 
+// rdbCommand runs bigdis import-rdb [-config path] [-flush] file and bigdis export-rdb [-config path] file
+func rdbCommand(name string, args []string) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	configPath := flags.String("config", "", "path to config file")
+	flush := false
+	if name == "import-rdb" {
+		flags.BoolVar(&flush, "flush", false, "empty all the databases before importing")
+	}
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: bigdis %s [options] file\n", name)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	config.Init(*configPath)
+	storage.Init()
+
+	var keys int
+	var err error
+	if name == "import-rdb" {
+		keys, err = storage.ImportRDBFile(flags.Arg(0), flush)
+	} else {
+		keys, err = storage.ExportRDBFile(flags.Arg(0), internal.RedisVersion)
+	}
+	if err == nil {
+		err = storage.Checkpoint()
+	}
+	if closeErr := storage.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("%d keys\n", keys)
+}
+
+// replayCommand runs bigdis replay [-config path] [-snapshot file] [-aof file] [-until timestamp] database,
+// which builds a new database from a snapshot and the journal, up to a point in time
+func replayCommand(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	configPath := flags.String("config", "", "path to config file")
+	snapshotPath := flags.String("snapshot", "", "snapshot to start from, made by SAVE or BGSAVE (default none, only the journal)")
+	journalPath := flags.String("aof", "", "journal to replay (default the appendfilename of the config)")
+	untilFlag := flags.String("until", "", "replay the changes up to this time, as Unix seconds or RFC 3339 (default all of them)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: bigdis replay [options] database")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	fail := func(err error) {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var until time.Time
+	if *untilFlag != "" {
+		if seconds, err := strconv.ParseInt(*untilFlag, 10, 64); err == nil {
+			until = time.Unix(seconds, 0)
+		} else if until, err = time.Parse(time.RFC3339, *untilFlag); err != nil {
+			fail(fmt.Errorf("invalid -until %q, expected Unix seconds or RFC 3339", *untilFlag))
+		}
+	}
+
+	config.Init(*configPath)
+	if *journalPath == "" {
+		*journalPath = config.Config.Storage.AppendFile
+	}
+	journal, err := os.Open(*journalPath)
+	if err != nil {
+		fail(err)
+	}
+	defer journal.Close()
+
+	// the database is built from scratch, an existing one is never overwritten
+	path := flags.Arg(0)
+	if _, err := os.Stat(path); err == nil {
+		fail(fmt.Errorf("%s already exists", path))
+	}
+	if *snapshotPath != "" {
+		if err := copyFile(*snapshotPath, path); err != nil {
+			fail(err)
+		}
+	}
+	config.Config.Storage.Path = path
+	config.Config.Storage.AppendOnly = false
+	config.Config.CDC.Sink = ""
+
+	storage.Init()
+	internal.NewV1Handler()
+
+	stats, err := storage.ReplayJournal(journal, until, func(dbOp *storage.DBOperation, dbNum int, args [][]byte) error {
+		err := internal.ApplyCommand(dbOp, dbNum, args)
+		if err != nil && utils.IsReplyError(err) {
+			// the command failed the same way when it was first run
+			fmt.Fprintf(os.Stderr, "%s failed: %s\n", args[0], err)
+			return nil
+		}
+		return err
+	})
+	if err == nil {
+		err = storage.Checkpoint()
+	}
+	if closeErr := storage.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fail(err)
+	}
+
+	if stats.Truncated {
+		fmt.Fprintln(os.Stderr, "The journal ends with an incomplete command, ignored")
+	}
+	if stats.Time.IsZero() {
+		fmt.Printf("%d commands, at offset %d\n", stats.Commands, stats.Offset)
+	} else {
+		fmt.Printf("%d commands, at offset %d of %s\n", stats.Commands, stats.Offset, stats.Time.Format(time.RFC3339))
+	}
+}
+
+// copyFile copies the file at src to a new file at dst
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
 func systemdNotify() {
 	for {
 		daemon.SdNotify(false, daemon.SdNotifyWatchdog)
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+/*
+The tests run real servers: the test binary started with BIGDIS_TEST_CONFIG set
+runs main with that config instead of the tests, so that every server has its own process,
+its own database and its own config, as the storage and the config are global.
+With BIGDIS_TEST_ARGS set, main runs with those arguments, one per line, as the subcommands do.
+*/
+
+func TestMain(m *testing.M) {
+	if path := os.Getenv("BIGDIS_TEST_CONFIG"); path != "" {
+		os.Args = []string{os.Args[0], "-config", path}
+		main()
+		return
+	}
+	if args := os.Getenv("BIGDIS_TEST_ARGS"); args != "" {
+		os.Args = append([]string{os.Args[0]}, strings.Split(args, "\n")...)
+		main()
+		return
+	}
+
+	os.Exit(m.Run())
+}
+
+// runMain runs main with args in a child process and returns what it printed
+func runMain(t *testing.T, args ...string) string {
+	t.Helper()
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "BIGDIS_TEST_ARGS="+strings.Join(args, "\n"))
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s: %s\n%s", strings.Join(args, " "), err, output)
+	}
+
+	return string(output)
+}
+
+// testServer is a server running in a child process
+type testServer struct {
+	t          *testing.T
+	dir        string
+	port       int
+	configPath string
+	cmd        *exec.Cmd
+	log        *os.File
+}
+
+// freePort returns a TCP port nothing listens on
+func freePort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// startServer starts a server with its database in a temporary directory. The sections of config
+// are merged into the default ones, it is stopped at the end of the test
+func startServer(t *testing.T, config map[string]map[string]any) *testServer {
+	t.Helper()
+
+	srv := &testServer{t: t, dir: t.TempDir(), port: freePort(t)}
+	sections := map[string]map[string]any{
+		"server":  {"host": "localhost", "port": srv.port, "shutdown_timeout": 2},
+		"storage": {"path": filepath.Join(srv.dir, "test.db"), "dump_path": filepath.Join(srv.dir, "dump.db"), "journal_mode": "wal", "synchronous": "normal", "gc_interval": 1},
+	}
+	for name, section := range config {
+		if sections[name] == nil {
+			sections[name] = map[string]any{}
+		}
+		for key, value := range section {
+			sections[name][key] = value
+		}
+	}
+	if port, ok := sections["server"]["port"].(int); ok {
+		srv.port = port
+	}
+
+	content, err := json.Marshal(sections)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(srv.dir, "config.json")
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.configPath = path
+	srv.start()
+
+	return srv
+}
+
+// restartServer starts a stopped server again, with its database and its config
+func restartServer(t *testing.T, stopped *testServer) *testServer {
+	t.Helper()
+
+	srv := &testServer{t: t, dir: stopped.dir, port: stopped.port, configPath: stopped.configPath}
+	srv.start()
+
+	return srv
+}
+
+func (srv *testServer) start() {
+	srv.t.Helper()
+
+	var err error
+	if srv.log, err = os.OpenFile(filepath.Join(srv.dir, "server.log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600); err != nil {
+		srv.t.Fatal(err)
+	}
+	srv.cmd = exec.Command(os.Args[0])
+	srv.cmd.Env = append(os.Environ(), "BIGDIS_TEST_CONFIG="+srv.configPath)
+	srv.cmd.Stdout, srv.cmd.Stderr = srv.log, srv.log
+	if err := srv.cmd.Start(); err != nil {
+		srv.t.Fatal(err)
+	}
+	srv.t.Cleanup(srv.stop)
+
+	// the port is open once the database is ready
+	if srv.port == 0 {
+		return
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", srv.addr())
+		if err == nil {
+			conn.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			srv.t.Fatalf("server didn't start: %s\n%s", err, srv.output())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func (srv *testServer) addr() string {
+	return net.JoinHostPort("localhost", strconv.Itoa(srv.port))
+}
+
+// output returns what the server printed
+func (srv *testServer) output() string {
+	content, _ := os.ReadFile(srv.log.Name())
+	return string(content)
+}
+
+// stop stops the server with SIGTERM, as systemd does
+func (srv *testServer) stop() {
+	if srv.cmd.ProcessState == nil {
+		srv.cmd.Process.Signal(syscall.SIGTERM)
+		done := make(chan struct{})
+		go func() {
+			srv.cmd.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			srv.cmd.Process.Kill()
+			<-done
+		}
+	}
+	srv.log.Close()
+}
+
+// client connects to the server, the connection is closed at the end of the test
+func (srv *testServer) client() *testClient {
+	srv.t.Helper()
+	conn, err := net.Dial("tcp", srv.addr())
+	if err != nil {
+		srv.t.Fatal(err)
+	}
+	srv.t.Cleanup(func() { conn.Close() })
+
+	return newTestClient(srv.t, conn)
+}
+
+// testClient sends commands and reads the replies, in RESP2 unless it sent HELLO 3
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// replyError is an error reply
+type replyError string
+
+// replyDouble is a RESP3 double reply
+type replyDouble string
+
+func newTestClient(t *testing.T, conn net.Conn) *testClient {
+	return &testClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// do sends a command and returns its reply: a string for a status, a replyError,
+// an int64, a []byte or a []any, nil for the null replies. After HELLO 3 a double
+// is a replyDouble, a verbatim string is a []byte without its format, and the maps,
+// with their keys and values alternated, the sets and the pushes are []any too
+func (c *testClient) do(args ...string) any {
+	c.t.Helper()
+
+	command := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		command += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	c.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.WriteString(c.conn, command); err != nil {
+		c.t.Fatalf("%s: %s", args[0], err)
+	}
+
+	reply, err := readReply(c.reader)
+	if err != nil {
+		c.t.Fatalf("%s: %s", args[0], err)
+	}
+
+	return reply
+}
+
+// read returns the next reply of the connection, as a message of Pub/Sub that no command asked for
+func (c *testClient) read() any {
+	c.t.Helper()
+
+	c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reply, err := readReply(c.reader)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	return reply
+}
+
+// ok sends a command that must succeed
+func (c *testClient) ok(args ...string) any {
+	c.t.Helper()
+
+	reply := c.do(args...)
+	if err, failed := reply.(replyError); failed {
+		c.t.Fatalf("%s: %s", strings.Join(args, " "), err)
+	}
+
+	return reply
+}
+
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("malformed reply %q", line)
+	}
+	kind, value := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return value, nil
+	case '-':
+		return replyError(value), nil
+	case ':':
+		return strconv.ParseInt(value, 10, 64)
+	case '$', '=':
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		// a verbatim string starts with its format, as txt:
+		if kind == '=' {
+			return data[4:size], nil
+		}
+		return data[:size], nil
+	case ',':
+		return replyDouble(value), nil
+	case '_':
+		return nil, nil
+	case '*', '%', '~', '>':
+		count, err := strconv.Atoi(value)
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		if kind == '%' {
+			count *= 2
+		}
+		values := make([]any, count)
+		for i := range values {
+			if values[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+
+	return nil, fmt.Errorf("unknown reply %q", line)
+}
+
+// str returns a status or a bulk string reply as a string
+func str(reply any) string {
+	switch v := reply.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case replyError:
+		return string(v)
+	case replyDouble:
+		return string(v)
+	}
+
+	return fmt.Sprint(reply)
+}
+
+// bulks returns the bulk strings of an array reply
+func bulks(values ...string) []any {
+	reply := make([]any, len(values))
+	for i, value := range values {
+		reply[i] = []byte(value)
+	}
+
+	return reply
+}
+
+// replyTest is a command with the reply it expects
+type replyTest struct {
+	args     []string
+	expected any
+}
+
+// checkReplies runs the commands in order and compares their replies with the expected ones
+func checkReplies(t *testing.T, c *testClient, tests []replyTest) {
+	t.Helper()
+
+	for _, test := range tests {
+		if got := c.do(test.args...); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%q = %#v, expected %#v", test.args, got, test.expected)
+		}
+	}
+}
+
+// eventually retries check until it returns true or the timeout elapses
+func eventually(t *testing.T, timeout time.Duration, check func() bool) bool {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !check() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	return true
+}
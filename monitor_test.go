@@ -0,0 +1,143 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// monitorCommand reads the next line of a monitor and returns the command after the timestamp, the DB and the address
+func monitorCommand(t *testing.T, monitor *testClient) string {
+	t.Helper()
+
+	reply := monitor.read()
+	line, ok := reply.(string)
+	if !ok {
+		t.Fatalf("monitor line %q isn't a status", reply)
+	}
+	_, command, found := strings.Cut(line, "] ")
+	if !found {
+		t.Fatalf("malformed monitor line %q", line)
+	}
+
+	return command
+}
+
+// TestMonitorSubscriber checks that the commands refused in subscriber mode aren't shown
+func TestMonitorSubscriber(t *testing.T) {
+	srv := startServer(t, nil)
+	monitor := srv.client()
+	monitor.ok("monitor")
+
+	c := srv.client()
+	c.ok("subscribe", "channel")
+	if reply, ok := c.do("get", "k").(replyError); !ok {
+		t.Fatalf("get while subscribed = %q", reply)
+	}
+	c.ok("ping")
+
+	for _, expected := range []string{`"subscribe" "channel"`, `"ping"`} {
+		if got := monitorCommand(t, monitor); got != expected {
+			t.Errorf("monitor = %s, expected %s", got, expected)
+		}
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	srv := startServer(t, nil)
+	monitor := srv.client()
+	monitor.ok("monitor")
+	c := srv.client()
+
+	// the line has the time, the DB and the address of the client before the quoted arguments
+	c.ok("set", "k", "v")
+	line := str(monitor.read())
+	format := regexp.MustCompile(`^\d+\.\d{6} \[0 127\.0\.0\.1:\d+\] "set" "k" "v"$`)
+	if !format.MatchString(line) {
+		t.Errorf("monitor line %q", line)
+	}
+
+	c.ok("set", "quote\"d\\", "line\nbreak\x01\xff")
+	c.do("nosuchcommand")
+	c.ok("select", "2")
+	c.ok("get", "k")
+	c.ok("multi")
+	c.ok("incr", "n")
+	c.ok("exec")
+	c.do("auth", "secret")
+	c.ok("ping")
+
+	for _, expected := range []string{
+		`"set" "quote\"d\\" "line\nbreak\x01\xff"`,
+		// the unknown commands aren't shown, SELECT runs in the DB it leaves
+		`"select" "2"`,
+		`"get" "k"`,
+		`"multi"`,
+		// the queued commands show when EXEC runs them
+		`"incr" "n"`,
+		`"exec"`,
+		`"auth" (redacted)`,
+		`"ping"`,
+	} {
+		if got := monitorCommand(t, monitor); got != expected {
+			t.Errorf("monitor = %s, expected %s", got, expected)
+		}
+	}
+
+	// the DB of the commands following SELECT
+	c.ok("get", "k")
+	if line := str(monitor.read()); !strings.Contains(line, " [2 127.0.0.1:") {
+		t.Errorf("monitor line %q doesn't show DB 2", line)
+	}
+
+	// QUIT ends the monitor
+	monitor.ok("quit")
+	if _, err := readReply(monitor.reader); err == nil {
+		t.Error("the monitor connection is open after QUIT")
+	}
+}
+
+// TestSlowMonitor checks that a monitor not reading its lines is dropped instead of holding the clients back
+func TestSlowMonitor(t *testing.T) {
+	srv := startServer(t, nil)
+	monitor := srv.client()
+	monitor.ok("monitor")
+
+	// the commands are pipelined, the replies read meanwhile
+	c := srv.client()
+	const commands = 200000
+	done := make(chan error, 1)
+	go func() {
+		c.conn.SetDeadline(time.Now().Add(60 * time.Second))
+		for i := 0; i < commands; i++ {
+			if _, err := readReply(c.reader); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	ping := []byte(strings.Repeat("*1\r\n$4\r\nPING\r\n", 1000))
+	for i := 0; i < commands/1000; i++ {
+		if _, err := c.conn.Write(ping); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// the monitor gets the lines sent before it was dropped, then the connection is closed
+	monitor.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	lines := 0
+	for {
+		if _, err := readReply(monitor.reader); err != nil {
+			break
+		}
+		lines++
+	}
+	if lines >= commands {
+		t.Errorf("the monitor got all the %d lines", lines)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// keyspaceEvents returns the notifications received by a subscriber of __key*, as "<channel> <message>",
+// until the reply of a PING it sends: the events published before were all delivered
+func keyspaceEvents(t *testing.T, subscriber *testClient) []string {
+	t.Helper()
+
+	events := []string{}
+	for reply := subscriber.do("ping"); ; reply = subscriber.read() {
+		values, ok := reply.([]any)
+		if !ok || len(values) == 0 {
+			t.Fatalf("unexpected reply %q", reply)
+		}
+		switch str(values[0]) {
+		case "pong":
+			return events
+		case "pmessage":
+			events = append(events, str(values[2])+" "+str(values[3]))
+		default:
+			t.Fatalf("unexpected reply %q", reply)
+		}
+	}
+}
+
+func TestKeyspaceEvents(t *testing.T) {
+	srv := startServer(t, nil)
+	c := srv.client()
+	subscriber := srv.client()
+	subscriber.ok("psubscribe", "__key*")
+	c.ok("config", "set", "notify-keyspace-events", "EA")
+
+	tests := []struct {
+		args     []string
+		expected []string
+	}{
+		{[]string{"set", "s", "v"}, []string{"__keyevent@0__:set s"}},
+		{[]string{"expire", "s", "100"}, []string{"__keyevent@0__:expire s"}},
+		{[]string{"persist", "s"}, []string{"__keyevent@0__:persist s"}},
+		{[]string{"del", "s"}, []string{"__keyevent@0__:del s"}},
+		{[]string{"del", "s"}, []string{}},
+		{[]string{"lpush", "l", "a", "b"}, []string{"__keyevent@0__:lpush l"}},
+		{[]string{"rpop", "l", "2"}, []string{"__keyevent@0__:rpop l", "__keyevent@0__:del l"}},
+		{[]string{"sadd", "st", "a"}, []string{"__keyevent@0__:sadd st"}},
+		{[]string{"srem", "st", "a"}, []string{"__keyevent@0__:srem st", "__keyevent@0__:del st"}},
+		{[]string{"hset", "h", "f", "v"}, []string{"__keyevent@0__:hset h"}},
+		{[]string{"hdel", "h", "f"}, []string{"__keyevent@0__:hdel h", "__keyevent@0__:del h"}},
+		{[]string{"zadd", "z", "1", "a"}, []string{"__keyevent@0__:zadd z"}},
+		{[]string{"zincrby", "z", "1", "a"}, []string{"__keyevent@0__:zincr z"}},
+		{[]string{"zpopmin", "z"}, []string{"__keyevent@0__:zpopmin z", "__keyevent@0__:del z"}},
+		// the reads and the failed writes announce nothing
+		{[]string{"get", "s"}, []string{}},
+		{[]string{"set", "s", "v", "xx"}, []string{}},
+		{[]string{"select", "1"}, []string{}},
+		{[]string{"set", "k", "v"}, []string{"__keyevent@1__:set k"}},
+	}
+	for _, test := range tests {
+		c.ok(test.args...)
+		if got := keyspaceEvents(t, subscriber); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%q published %q, expected %q", test.args, got, test.expected)
+		}
+	}
+
+	// a transaction rolled back, here by a failed EXEC, publishes nothing
+	c.ok("multi")
+	c.ok("set", "k", "v")
+	c.do("nosuchcommand")
+	c.do("exec")
+	if got := keyspaceEvents(t, subscriber); len(got) != 0 {
+		t.Errorf("an aborted transaction published %q", got)
+	}
+}
+
+func TestKeyspaceEventClasses(t *testing.T) {
+	srv := startServer(t, nil)
+	c := srv.client()
+	subscriber := srv.client()
+	subscriber.ok("psubscribe", "__key*")
+
+	tests := []struct {
+		classes  string
+		expected []string
+	}{
+		{"", []string{}},
+		// a class without K or E is published nowhere
+		{"A", []string{}},
+		{"E$", []string{"__keyevent@0__:set s"}},
+		{"K$", []string{"__keyspace@0__:s set"}},
+		{"KEl", []string{"__keyspace@0__:l lpush", "__keyevent@0__:lpush l"}},
+		{"Eg", []string{"__keyevent@0__:del s", "__keyevent@0__:del l"}},
+		{"En", []string{"__keyevent@0__:new s", "__keyevent@0__:new l"}},
+		// A leaves the new keys out
+		{"EA", []string{"__keyevent@0__:set s", "__keyevent@0__:lpush l", "__keyevent@0__:del s", "__keyevent@0__:del l"}},
+	}
+	for _, test := range tests {
+		c.ok("config", "set", "notify-keyspace-events", test.classes)
+		c.ok("set", "s", "v")
+		c.ok("lpush", "l", "a")
+		c.ok("del", "s", "l")
+		if got := keyspaceEvents(t, subscriber); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%s published %q, expected %q", test.classes, got, test.expected)
+		}
+	}
+
+	reply, ok := c.do("config", "set", "notify-keyspace-events", "Ey").(replyError)
+	if !ok {
+		t.Errorf("config set notify-keyspace-events Ey = %q, expected an error", reply)
+	}
+}
+
+// TestExpiredEvents checks that an expired key is announced once, by the read finding it expired or by the garbage collection
+func TestExpiredEvents(t *testing.T) {
+	// the garbage collection only runs once the reads are done
+	srv := startServer(t, map[string]map[string]any{"storage": {"gc_interval": 3600}})
+	c := srv.client()
+	subscriber := srv.client()
+	subscriber.ok("psubscribe", "__key*")
+	c.ok("config", "set", "notify-keyspace-events", "Exn")
+
+	c.ok("set", "read", "v", "px", "50")
+	c.ok("set", "rewritten", "v", "px", "50")
+	c.ok("set", "collected", "v", "px", "50")
+	c.ok("set", "kept", "v")
+	if got, expected := keyspaceEvents(t, subscriber), []string{
+		"__keyevent@0__:new read", "__keyevent@0__:new rewritten", "__keyevent@0__:new collected", "__keyevent@0__:new kept",
+	}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("the new keys published %q, expected %q", got, expected)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	c.do("get", "read")
+	c.do("get", "read")
+	// the key still there but expired is announced before the new one
+	c.ok("set", "rewritten", "v")
+	if got, expected := keyspaceEvents(t, subscriber), []string{
+		"__keyevent@0__:expired read", "__keyevent@0__:expired rewritten", "__keyevent@0__:new rewritten",
+	}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("the expired keys published %q, expected %q", got, expected)
+	}
+
+	// the garbage collection only announces the key no read found
+	c.ok("config", "set", "gc_interval", "1")
+	if got, expected := subscriber.read(), message("pmessage", "__key*", "__keyevent@0__:expired", "collected"); !reflect.DeepEqual(got, expected) {
+		t.Errorf("the garbage collection published %q, expected %q", got, expected)
+	}
+	// another collection runs meanwhile
+	time.Sleep(1500 * time.Millisecond)
+	if got := keyspaceEvents(t, subscriber); len(got) != 0 {
+		t.Errorf("the garbage collection published %q after the expired keys", got)
+	}
+}
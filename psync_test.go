@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestPSync follows the server as a Redis replica does: the RDB snapshot then the stream of commands
+func TestPSync(t *testing.T) {
+	srv := startServer(t, nil)
+	c := srv.client()
+	value := strings.Repeat("v", 1000)
+	for i := 0; i < 1000; i++ {
+		c.ok("set", "key"+strconv.Itoa(i), value)
+	}
+
+	conn, err := net.Dial("tcp", srv.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.WriteString(conn, "*3\r\n$5\r\nPSYNC\r\n$1\r\n?\r\n$2\r\n-1\r\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "+FULLRESYNC ") {
+		t.Fatalf("psync = %q, %v", line, err)
+	}
+	line, err = reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "$") {
+		t.Fatalf("snapshot header = %q, %v", line, err)
+	}
+	size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := make([]byte, size)
+	if _, err := io.ReadFull(reader, snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(snapshot, []byte("REDIS")) || !bytes.Contains(snapshot, []byte("key999")) {
+		t.Errorf("snapshot of %d bytes isn't an RDB file of the keys", size)
+	}
+
+	// the temporary file of the snapshot is gone once sent
+	removed := eventually(t, time.Second, func() bool {
+		files, _ := filepath.Glob(filepath.Join(srv.dir, "bigdis-snapshot-*"))
+		return len(files) == 0
+	})
+	if !removed {
+		t.Error("snapshot file left behind")
+	}
+
+	c.ok("set", "after", "1")
+	var stream []byte
+	for !bytes.Contains(stream, []byte("after")) {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("stream %q: %s", stream, err)
+		}
+		stream = append(stream, line...)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// message returns the array of a Pub/Sub message, its elements as strings and the counts as int64
+func message(values ...any) []any {
+	reply := make([]any, len(values))
+	for i, value := range values {
+		if s, ok := value.(string); ok {
+			reply[i] = []byte(s)
+		} else {
+			reply[i] = value
+		}
+	}
+
+	return reply
+}
+
+func TestPubSub(t *testing.T) {
+	srv := startServer(t, nil)
+	subscriber := srv.client()
+	publisher := srv.client()
+
+	expect := func(what string, got, expected any) {
+		t.Helper()
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s = %q, expected %q", what, got, expected)
+		}
+	}
+
+	// every channel is confirmed with the number of subscriptions of the connection
+	expect("subscribe", subscriber.do("subscribe", "ch1", "ch2"), message("subscribe", "ch1", int64(1)))
+	expect("subscribe", subscriber.read(), message("subscribe", "ch2", int64(2)))
+	expect("psubscribe", subscriber.do("psubscribe", "news.*"), message("psubscribe", "news.*", int64(3)))
+
+	checkReplies(t, publisher, []replyTest{
+		{[]string{"publish", "ch1", "hello"}, int64(1)},
+		{[]string{"publish", "news.art", "painting"}, int64(1)},
+		{[]string{"publish", "nobody", "lost"}, int64(0)},
+		{[]string{"pubsub", "numsub", "ch1", "nobody"}, message("ch1", int64(1), "nobody", int64(0))},
+		{[]string{"pubsub", "numpat"}, int64(1)},
+		{[]string{"pubsub", "channels", "*2"}, bulks("ch2")},
+		{[]string{"pubsub", "nosuch"}, replyError("ERR unknown subcommand 'nosuch'. Try PUBSUB HELP.")},
+	})
+	if got := members(t, publisher.ok("pubsub", "channels")); !reflect.DeepEqual(got, []string{"ch1", "ch2"}) {
+		t.Errorf("pubsub channels = %q", got)
+	}
+	expect("message", subscriber.read(), message("message", "ch1", "hello"))
+	expect("pmessage", subscriber.read(), message("pmessage", "news.*", "news.art", "painting"))
+
+	// a RESP2 subscriber can only manage its subscriptions
+	expect("get", subscriber.do("get", "k"), replyError("ERR Can't execute 'get': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context"))
+	expect("ping", subscriber.do("ping"), message("pong", ""))
+	expect("ping", subscriber.do("ping", "hi"), message("pong", "hi"))
+
+	expect("unsubscribe", subscriber.do("unsubscribe", "ch1"), message("unsubscribe", "ch1", int64(2)))
+	expect("publish", publisher.ok("publish", "ch1", "gone"), int64(0))
+	// without arguments every subscription ends
+	expect("unsubscribe", subscriber.do("unsubscribe"), message("unsubscribe", "ch2", int64(1)))
+	expect("punsubscribe", subscriber.do("punsubscribe"), message("punsubscribe", "news.*", int64(0)))
+	expect("unsubscribe", subscriber.do("unsubscribe"), []any{[]byte("unsubscribe"), nil, int64(0)})
+	expect("get", subscriber.do("get", "k"), nil)
+
+	// the subscriptions of a closed connection are dropped
+	gone := srv.client()
+	gone.ok("subscribe", "ch3")
+	gone.conn.Close()
+	if !eventually(t, 5*time.Second, func() bool {
+		return reflect.DeepEqual(publisher.ok("pubsub", "numsub", "ch3"), message("ch3", int64(0)))
+	}) {
+		t.Error("the subscription of a closed connection is kept")
+	}
+}
+
+func TestPubSubPatterns(t *testing.T) {
+	srv := startServer(t, nil)
+	subscriber := srv.client()
+	publisher := srv.client()
+
+	subscriber.ok("psubscribe", "h?llo", "h[ae]llo")
+	subscriber.read()
+	subscriber.ok("subscribe", "hello")
+
+	// a message goes once to each subscription matching it
+	if got := publisher.ok("publish", "hello", "m"); got != int64(3) {
+		t.Errorf("publish hello = %d receivers, expected 3", got)
+	}
+	var got []string
+	for i := 0; i < 3; i++ {
+		reply := subscriber.read().([]any)
+		if str(reply[0]) == "pmessage" {
+			got = append(got, str(reply[1]))
+		} else {
+			got = append(got, str(reply[0]))
+		}
+	}
+	sort.Strings(got)
+	if expected := []string{"h?llo", "h[ae]llo", "message"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("messages from %q, expected %q", got, expected)
+	}
+
+	if got := publisher.ok("publish", "hxllo", "m"); got != int64(1) {
+		t.Errorf("publish hxllo = %d receivers, expected 1", got)
+	}
+	if got := subscriber.read(); !reflect.DeepEqual(got, message("pmessage", "h?llo", "hxllo", "m")) {
+		t.Errorf("pmessage = %q", got)
+	}
+}
+
+func TestPubSubRESP3(t *testing.T) {
+	srv := startServer(t, nil)
+	subscriber := srv.client()
+	subscriber.ok("hello", "3")
+	subscriber.ok("subscribe", "ch")
+
+	// a RESP3 connection runs any command while subscribed, the messages are pushed in between
+	subscriber.ok("set", "k", "v")
+	srv.client().ok("publish", "ch", "m")
+	subscriber.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if kind, err := subscriber.reader.Peek(1); err != nil || kind[0] != '>' {
+		t.Errorf("message of type %q, expected a push: %v", kind, err)
+	}
+	if got := subscriber.read(); !reflect.DeepEqual(got, message("message", "ch", "m")) {
+		t.Errorf("message = %q", got)
+	}
+	if got := subscriber.ok("get", "k"); str(got) != "v" {
+		t.Errorf("get while subscribed = %q", got)
+	}
+}
@@ -0,0 +1,28 @@
+package rdb
+
+// Redis checksums its files with the Jones CRC-64, reflected and without the inversions of hash/crc64
+const crc64Poly = 0x95ac9329ac4bc9b5
+
+var crc64Table = func() (table [256]uint64) {
+	for i := range table {
+		crc := uint64(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 == 1 {
+				crc = crc>>1 ^ crc64Poly
+			} else {
+				crc >>= 1
+			}
+		}
+		table[i] = crc
+	}
+
+	return table
+}()
+
+func crc64(crc uint64, p []byte) uint64 {
+	for _, b := range p {
+		crc = crc64Table[byte(crc)^b] ^ crc>>8
+	}
+
+	return crc
+}
@@ -0,0 +1,312 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"strconv"
+)
+
+/*
+The small aggregates are saved in the compact encodings Redis keeps them in memory:
+ziplists and zipmaps up to version 9, listpacks since version 10, and intsets for the sets of integers.
+The decoders below turn them into their elements, the integers as their decimal text.
+*/
+
+// ziplistEntries decodes a ziplist: <zlbytes u32><zltail u32><zllen u16><entry>...<0xFF>
+func ziplistEntries(blob []byte) ([][]byte, error) {
+	if len(blob) < 11 {
+		return nil, errCorrupted
+	}
+
+	var entries [][]byte
+	for pos := 10; ; {
+		if pos >= len(blob) {
+			return nil, errCorrupted
+		}
+		if blob[pos] == 0xFF {
+			return entries, nil
+		}
+
+		// the length of the previous entry takes 1 byte, or 5 when it is 254 or more
+		if blob[pos] < 254 {
+			pos++
+		} else {
+			pos += 5
+		}
+		if pos >= len(blob) {
+			return nil, errCorrupted
+		}
+
+		encoding := blob[pos]
+		var size int
+		switch {
+		case encoding>>6 == 0:
+			size = int(encoding & 0x3F)
+			pos++
+		case encoding>>6 == 1:
+			if pos+1 >= len(blob) {
+				return nil, errCorrupted
+			}
+			size = int(encoding&0x3F)<<8 | int(blob[pos+1])
+			pos += 2
+		case encoding>>6 == 2:
+			if pos+5 > len(blob) {
+				return nil, errCorrupted
+			}
+			size = int(binary.BigEndian.Uint32(blob[pos+1 : pos+5]))
+			pos += 5
+		default:
+			var number int64
+			var width int
+			switch {
+			case encoding == 0xC0:
+				width = 2
+			case encoding == 0xD0:
+				width = 4
+			case encoding == 0xE0:
+				width = 8
+			case encoding == 0xF0:
+				width = 3
+			case encoding == 0xFE:
+				width = 1
+			case encoding >= 0xF1 && encoding <= 0xFD:
+				// immediate values from 0 to 12
+				number = int64(encoding&0x0F) - 1
+			default:
+				return nil, errCorrupted
+			}
+			pos++
+			if pos+width > len(blob) {
+				return nil, errCorrupted
+			}
+			if width > 0 {
+				number = littleEndianInt(blob[pos : pos+width])
+				pos += width
+			}
+
+			entries = append(entries, strconv.AppendInt(nil, number, 10))
+			continue
+		}
+
+		if pos+size > len(blob) {
+			return nil, errCorrupted
+		}
+		entries = append(entries, blob[pos:pos+size])
+		pos += size
+	}
+}
+
+// listpackEntries decodes a listpack: <total bytes u32><count u16><entry><backlen>...<0xFF>
+func listpackEntries(blob []byte) ([][]byte, error) {
+	if len(blob) < 7 {
+		return nil, errCorrupted
+	}
+
+	var entries [][]byte
+	for pos := 6; ; {
+		if pos >= len(blob) {
+			return nil, errCorrupted
+		}
+
+		encoding := blob[pos]
+		if encoding == 0xFF {
+			return entries, nil
+		}
+
+		var header, size int
+		var number int64
+		isNumber := true
+		switch {
+		case encoding>>7 == 0:
+			// 7 bit unsigned integer
+			header, number = 1, int64(encoding&0x7F)
+		case encoding>>6 == 2:
+			// string of up to 63 bytes
+			header, size, isNumber = 1, int(encoding&0x3F), false
+		case encoding>>5 == 6:
+			// 13 bit signed integer
+			if pos+1 >= len(blob) {
+				return nil, errCorrupted
+			}
+			header = 2
+			number = int64(encoding&0x1F)<<8 | int64(blob[pos+1])
+			if number >= 1<<12 {
+				number -= 1 << 13
+			}
+		case encoding>>4 == 14:
+			// string of up to 4095 bytes
+			if pos+1 >= len(blob) {
+				return nil, errCorrupted
+			}
+			header, size, isNumber = 2, int(encoding&0x0F)<<8|int(blob[pos+1]), false
+		case encoding == 0xF0:
+			if pos+5 > len(blob) {
+				return nil, errCorrupted
+			}
+			header, size, isNumber = 5, int(binary.LittleEndian.Uint32(blob[pos+1:pos+5])), false
+		case encoding >= 0xF1 && encoding <= 0xF4:
+			width := [...]int{2, 3, 4, 8}[encoding-0xF1]
+			if pos+1+width > len(blob) {
+				return nil, errCorrupted
+			}
+			header = 1 + width
+			number = littleEndianInt(blob[pos+1 : pos+1+width])
+		default:
+			return nil, errCorrupted
+		}
+
+		length := header + size
+		if pos+length > len(blob) {
+			return nil, errCorrupted
+		}
+		if isNumber {
+			entries = append(entries, strconv.AppendInt(nil, number, 10))
+		} else {
+			entries = append(entries, blob[pos+header:pos+length])
+		}
+
+		// the entry is followed by its length, to walk the listpack backwards
+		pos += length + backlenSize(length)
+	}
+}
+
+// backlenSize is the number of bytes the length of a listpack entry takes, 7 bits each
+func backlenSize(length int) int {
+	switch {
+	case length <= 127:
+		return 1
+	case length < 16383:
+		return 2
+	case length < 2097151:
+		return 3
+	case length < 268435455:
+		return 4
+	default:
+		return 5
+	}
+}
+
+// intsetEntries decodes an intset: <width u32><count u32><integers>...
+func intsetEntries(blob []byte) ([][]byte, error) {
+	if len(blob) < 8 {
+		return nil, errCorrupted
+	}
+
+	width := int(binary.LittleEndian.Uint32(blob[0:4]))
+	count := int(binary.LittleEndian.Uint32(blob[4:8]))
+	if (width != 2 && width != 4 && width != 8) || len(blob) < 8+width*count {
+		return nil, errCorrupted
+	}
+
+	entries := make([][]byte, count)
+	for i := range entries {
+		start := 8 + i*width
+		entries[i] = strconv.AppendInt(nil, littleEndianInt(blob[start:start+width]), 10)
+	}
+
+	return entries, nil
+}
+
+// zipmapEntries decodes the zipmaps of the old hashes: <count><len><field><len><free><value><free bytes>...<0xFF>
+func zipmapEntries(blob []byte) ([][]byte, error) {
+	var entries [][]byte
+	for pos := 1; ; {
+		if pos >= len(blob) {
+			return nil, errCorrupted
+		}
+		if blob[pos] == 0xFF {
+			if len(entries)%2 != 0 {
+				return nil, errCorrupted
+			}
+			return entries, nil
+		}
+
+		// lengths take 1 byte, or 5 when they are 254 or more
+		size := int(blob[pos])
+		pos++
+		if size == 254 {
+			if pos+4 > len(blob) {
+				return nil, errCorrupted
+			}
+			size = int(binary.LittleEndian.Uint32(blob[pos : pos+4]))
+			pos += 4
+		} else if size == 255 {
+			return nil, errCorrupted
+		}
+
+		// values are followed by some unused bytes
+		free := 0
+		if len(entries)%2 == 1 {
+			if pos >= len(blob) {
+				return nil, errCorrupted
+			}
+			free = int(blob[pos])
+			pos++
+		}
+
+		if pos+size+free > len(blob) {
+			return nil, errCorrupted
+		}
+		entries = append(entries, blob[pos:pos+size])
+		pos += size + free
+	}
+}
+
+// littleEndianInt reads a signed integer of 1 to 8 bytes
+func littleEndianInt(buf []byte) int64 {
+	var number uint64
+	for i := len(buf) - 1; i >= 0; i-- {
+		number = number<<8 | uint64(buf[i])
+	}
+
+	// sign extension
+	shift := 64 - 8*uint(len(buf))
+	return int64(number<<shift) >> shift
+}
+
+// lzfDecompress expands the strings Redis compressed with LZF
+func lzfDecompress(in []byte, length int) ([]byte, error) {
+	out := make([]byte, 0, length)
+	for pos := 0; pos < len(in); {
+		ctrl := int(in[pos])
+		pos++
+
+		if ctrl < 32 {
+			// literal run of ctrl+1 bytes
+			if pos+ctrl+1 > len(in) {
+				return nil, errCorrupted
+			}
+			out = append(out, in[pos:pos+ctrl+1]...)
+			pos += ctrl + 1
+			continue
+		}
+
+		// back reference of size+2 bytes
+		size := ctrl >> 5
+		if size == 7 {
+			if pos >= len(in) {
+				return nil, errCorrupted
+			}
+			size += int(in[pos])
+			pos++
+		}
+		if pos >= len(in) {
+			return nil, errCorrupted
+		}
+		ref := len(out) - (ctrl&0x1F)<<8 - int(in[pos]) - 1
+		pos++
+		if ref < 0 {
+			return nil, errCorrupted
+		}
+
+		// the reference can overlap the bytes being written
+		for i := 0; i < size+2; i++ {
+			out = append(out, out[ref+i])
+		}
+	}
+
+	if len(out) != length {
+		return nil, errCorrupted
+	}
+
+	return out, nil
+}
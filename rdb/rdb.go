@@ -0,0 +1,110 @@
+// Package rdb reads and writes the RDB files of Redis, the format of its snapshots
+package rdb
+
+import (
+	"errors"
+	"time"
+)
+
+// The versions of the format that can be read, Redis 7.2 writes version 11
+const (
+	minVersion = 1
+	maxVersion = 11
+)
+
+// maxStringLength is the largest string read, the largest Redis accepts by default (proto-max-bulk-len)
+const maxStringLength = 512 << 20
+
+// readChunk is the size of the reads of the long strings, their buffer only grows as they are read
+const readChunk = 1 << 20
+
+// lzfMaxRatio bounds the size of a compressed string once expanded
+const lzfMaxRatio = 88
+
+// writeVersion is the version of the files written, every Redis since 6.0 can load it
+const writeVersion = 9
+
+// Type is the Redis type of a key
+type Type int
+
+const (
+	TypeString Type = iota
+	TypeList
+	TypeSet
+	TypeZSet
+	TypeHash
+)
+
+// Entry is a key along with its value. Only the field of its type is set
+type Entry struct {
+	DB       int
+	Key      []byte
+	Type     Type
+	ExpireAt time.Time // zero when the key doesn't expire
+
+	Value    []byte      // string
+	Elements [][]byte    // list and set
+	Fields   [][2][]byte // hash, field and value
+	Members  []ZMember   // sorted set
+}
+
+type ZMember struct {
+	Member []byte
+	Score  float64
+}
+
+// the opcodes that precede the keys
+const (
+	opSlotInfo     = 0xF4
+	opFunction2    = 0xF5
+	opFunctionPre  = 0xF6
+	opFreq         = 0xF7
+	opIdle         = 0xF8
+	opModuleAux    = 0xF9
+	opAux          = 0xFA
+	opResizeDB     = 0xFB
+	opExpireTimeMs = 0xFC
+	opExpireTime   = 0xFD
+	opSelectDB     = 0xFE
+	opEOF          = 0xFF
+)
+
+// the encodings of the values
+const (
+	typeString          = 0
+	typeList            = 1
+	typeSet             = 2
+	typeZSet            = 3
+	typeHash            = 4
+	typeZSet2           = 5
+	typeModule          = 6
+	typeModule2         = 7
+	typeHashZipmap      = 9
+	typeListZiplist     = 10
+	typeSetIntset       = 11
+	typeZSetZiplist     = 12
+	typeHashZiplist     = 13
+	typeListQuicklist   = 14
+	typeStreamListpacks = 15
+	typeHashListpack    = 16
+	typeZSetListpack    = 17
+	typeListQuicklist2  = 18
+	typeStream2         = 19
+	typeSetListpack     = 20
+	typeStream3         = 21
+)
+
+// the lengths whose two most significant bits are 11 are special encodings of the strings
+const (
+	encInt8  = 0
+	encInt16 = 1
+	encInt32 = 2
+	encLZF   = 3
+)
+
+var (
+	errNotRDB      = errors.New("rdb: not an RDB file")
+	errChecksum    = errors.New("rdb: wrong checksum, the file is corrupted")
+	errCorrupted   = errors.New("rdb: corrupted file")
+	errUnsupported = "rdb: %s are not supported"
+)
@@ -0,0 +1,525 @@
+package rdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Reader returns the keys of an RDB file one at a time, so that huge files never have to fit in memory
+type Reader struct {
+	r       *bufio.Reader
+	crc     uint64
+	version int
+	db      int
+}
+
+func NewReader(r io.Reader) (*Reader, error) {
+	reader := &Reader{r: bufio.NewReader(r)}
+
+	header := make([]byte, 9)
+	if err := reader.readFull(header); err != nil {
+		return nil, errNotRDB
+	}
+	if string(header[:5]) != "REDIS" {
+		return nil, errNotRDB
+	}
+
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil {
+		return nil, errNotRDB
+	}
+	if version < minVersion || version > maxVersion {
+		return nil, fmt.Errorf("rdb: version %d is not supported, up to %d is", version, maxVersion)
+	}
+	reader.version = version
+
+	return reader, nil
+}
+
+// Next returns the next key, io.EOF once the file is over and its checksum verified
+func (r *Reader) Next() (*Entry, error) {
+	var expireAt time.Time
+	for {
+		opcode, err := r.readByte()
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case opAux:
+			if _, err := r.readString(); err != nil {
+				return nil, err
+			}
+			if _, err := r.readString(); err != nil {
+				return nil, err
+			}
+		case opResizeDB:
+			if _, err := r.readLength(); err != nil {
+				return nil, err
+			}
+			if _, err := r.readLength(); err != nil {
+				return nil, err
+			}
+		case opSlotInfo:
+			for i := 0; i < 3; i++ {
+				if _, err := r.readLength(); err != nil {
+					return nil, err
+				}
+			}
+		case opExpireTimeMs:
+			buf := make([]byte, 8)
+			if err := r.readFull(buf); err != nil {
+				return nil, err
+			}
+			expireAt = time.UnixMilli(int64(binary.LittleEndian.Uint64(buf)))
+		case opExpireTime:
+			buf := make([]byte, 4)
+			if err := r.readFull(buf); err != nil {
+				return nil, err
+			}
+			expireAt = time.Unix(int64(binary.LittleEndian.Uint32(buf)), 0)
+		case opSelectDB:
+			db, err := r.readLength()
+			if err != nil {
+				return nil, err
+			}
+			r.db = int(db)
+		case opIdle:
+			if _, err := r.readLength(); err != nil {
+				return nil, err
+			}
+		case opFreq:
+			if _, err := r.readByte(); err != nil {
+				return nil, err
+			}
+		case opFunction2:
+			// the functions have no place in Bigdis, their code is skipped
+			if _, err := r.readString(); err != nil {
+				return nil, err
+			}
+		case opFunctionPre:
+			return nil, fmt.Errorf(errUnsupported, "functions")
+		case opModuleAux:
+			return nil, fmt.Errorf(errUnsupported, "modules")
+		case opEOF:
+			return nil, r.verifyChecksum()
+		default:
+			entry, err := r.readEntry(opcode)
+			if err != nil {
+				return nil, err
+			}
+			entry.ExpireAt = expireAt
+
+			return entry, nil
+		}
+	}
+}
+
+// verifyChecksum reads the checksum ending the file, 0 means it was disabled when writing
+func (r *Reader) verifyChecksum() error {
+	if r.version < 5 {
+		return io.EOF
+	}
+
+	expected := r.crc
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		return errCorrupted
+	}
+	if checksum := binary.LittleEndian.Uint64(buf); checksum != 0 && checksum != expected {
+		return errChecksum
+	}
+
+	return io.EOF
+}
+
+func (r *Reader) readEntry(valueType byte) (*Entry, error) {
+	key, err := r.readString()
+	if err != nil {
+		return nil, err
+	}
+	entry := &Entry{DB: r.db, Key: key}
+
+	switch valueType {
+	case typeString:
+		entry.Type = TypeString
+		entry.Value, err = r.readString()
+	case typeList, typeSet:
+		entry.Type = TypeList
+		if valueType == typeSet {
+			entry.Type = TypeSet
+		}
+		entry.Elements, err = r.readStrings(1)
+	case typeZSet, typeZSet2:
+		entry.Type = TypeZSet
+		entry.Members, err = r.readZSet(valueType == typeZSet2)
+	case typeHash:
+		entry.Type = TypeHash
+		var values [][]byte
+		if values, err = r.readStrings(2); err == nil {
+			entry.Fields = pairs(values)
+		}
+	case typeHashZipmap:
+		entry.Type = TypeHash
+		var values [][]byte
+		if values, err = r.readEncoded(zipmapEntries); err == nil {
+			entry.Fields = pairs(values)
+		}
+	case typeListZiplist:
+		entry.Type = TypeList
+		entry.Elements, err = r.readEncoded(ziplistEntries)
+	case typeSetIntset:
+		entry.Type = TypeSet
+		entry.Elements, err = r.readEncoded(intsetEntries)
+	case typeSetListpack:
+		entry.Type = TypeSet
+		entry.Elements, err = r.readEncoded(listpackEntries)
+	case typeZSetZiplist, typeZSetListpack:
+		entry.Type = TypeZSet
+		decode := ziplistEntries
+		if valueType == typeZSetListpack {
+			decode = listpackEntries
+		}
+		var values [][]byte
+		if values, err = r.readEncoded(decode); err == nil {
+			entry.Members, err = zmembers(values)
+		}
+	case typeHashZiplist, typeHashListpack:
+		entry.Type = TypeHash
+		decode := ziplistEntries
+		if valueType == typeHashListpack {
+			decode = listpackEntries
+		}
+		var values [][]byte
+		if values, err = r.readEncoded(decode); err == nil {
+			if len(values)%2 != 0 {
+				return nil, errCorrupted
+			}
+			entry.Fields = pairs(values)
+		}
+	case typeListQuicklist, typeListQuicklist2:
+		entry.Type = TypeList
+		entry.Elements, err = r.readQuicklist(valueType == typeListQuicklist2)
+	case typeStreamListpacks, typeStream2, typeStream3:
+		return nil, fmt.Errorf(errUnsupported, "streams")
+	case typeModule, typeModule2:
+		return nil, fmt.Errorf(errUnsupported, "modules")
+	default:
+		return nil, errCorrupted
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// readStrings reads a length followed by length*n strings
+func (r *Reader) readStrings(n int) ([][]byte, error) {
+	length, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([][]byte, 0, min(length*uint64(n), 1024))
+	for i := uint64(0); i < length*uint64(n); i++ {
+		value, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+
+	return values, nil
+}
+
+func (r *Reader) readZSet(binaryScores bool) ([]ZMember, error) {
+	length, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+
+	members := make([]ZMember, 0, min(length, 1024))
+	for i := uint64(0); i < length; i++ {
+		member, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+
+		var score float64
+		if binaryScores {
+			buf := make([]byte, 8)
+			if err := r.readFull(buf); err != nil {
+				return nil, err
+			}
+			score = math.Float64frombits(binary.LittleEndian.Uint64(buf))
+		} else if score, err = r.readOldScore(); err != nil {
+			return nil, err
+		}
+
+		members = append(members, ZMember{Member: member, Score: score})
+	}
+
+	return members, nil
+}
+
+// readOldScore reads a score written as text, preceded by its length or by one of the special values
+func (r *Reader) readOldScore() (float64, error) {
+	length, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+
+	switch length {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+
+	buf := make([]byte, length)
+	if err := r.readFull(buf); err != nil {
+		return 0, err
+	}
+	score, err := strconv.ParseFloat(string(buf), 64)
+	if err != nil {
+		return 0, errCorrupted
+	}
+
+	return score, nil
+}
+
+// readQuicklist reads the nodes of a list, ziplists for version 1 and listpacks or plain elements for version 2
+func (r *Reader) readQuicklist(version2 bool) ([][]byte, error) {
+	nodes, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+
+	var elements [][]byte
+	for i := uint64(0); i < nodes; i++ {
+		container := uint64(2)
+		if version2 {
+			if container, err = r.readLength(); err != nil {
+				return nil, err
+			}
+		}
+
+		node, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+
+		var values [][]byte
+		switch {
+		case !version2:
+			values, err = ziplistEntries(node)
+		case container == 1:
+			// a plain node holds a single element too big to be packed
+			values = [][]byte{node}
+		case container == 2:
+			values, err = listpackEntries(node)
+		default:
+			return nil, errCorrupted
+		}
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, values...)
+	}
+
+	return elements, nil
+}
+
+// readEncoded reads a string holding a compact encoding of the elements and decodes it
+func (r *Reader) readEncoded(decode func([]byte) ([][]byte, error)) ([][]byte, error) {
+	blob, err := r.readString()
+	if err != nil {
+		return nil, err
+	}
+
+	return decode(blob)
+}
+
+// readLength reads a length, the special encodings of the strings are refused
+func (r *Reader) readLength() (uint64, error) {
+	length, encoded, err := r.readLengthOrEncoding()
+	if err != nil {
+		return 0, err
+	}
+	if encoded {
+		return 0, errCorrupted
+	}
+
+	return length, nil
+}
+
+// readLengthOrEncoding reads a length, or the special encoding of a string when encoded is true
+func (r *Reader) readLengthOrEncoding() (length uint64, encoded bool, err error) {
+	first, err := r.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+
+	switch first >> 6 {
+	case 0:
+		return uint64(first & 0x3F), false, nil
+	case 1:
+		next, err := r.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(first&0x3F)<<8 | uint64(next), false, nil
+	case 2:
+		switch first {
+		case 0x80:
+			buf := make([]byte, 4)
+			if err := r.readFull(buf); err != nil {
+				return 0, false, err
+			}
+			return uint64(binary.BigEndian.Uint32(buf)), false, nil
+		case 0x81:
+			buf := make([]byte, 8)
+			if err := r.readFull(buf); err != nil {
+				return 0, false, err
+			}
+			return binary.BigEndian.Uint64(buf), false, nil
+		}
+		return 0, false, errCorrupted
+	default:
+		return uint64(first & 0x3F), true, nil
+	}
+}
+
+func (r *Reader) readString() ([]byte, error) {
+	length, encoded, err := r.readLengthOrEncoding()
+	if err != nil {
+		return nil, err
+	}
+
+	if !encoded {
+		return r.readBytes(length)
+	}
+
+	switch length {
+	case encInt8, encInt16, encInt32:
+		buf := make([]byte, 1<<length)
+		if err := r.readFull(buf); err != nil {
+			return nil, err
+		}
+
+		var number int64
+		switch length {
+		case encInt8:
+			number = int64(int8(buf[0]))
+		case encInt16:
+			number = int64(int16(binary.LittleEndian.Uint16(buf)))
+		case encInt32:
+			number = int64(int32(binary.LittleEndian.Uint32(buf)))
+		}
+		return strconv.AppendInt(nil, number, 10), nil
+	case encLZF:
+		compressedLength, err := r.readLength()
+		if err != nil {
+			return nil, err
+		}
+		length, err := r.readLength()
+		if err != nil {
+			return nil, err
+		}
+
+		compressed, err := r.readBytes(compressedLength)
+		if err != nil {
+			return nil, err
+		}
+		// a back reference of 3 bytes expands to 264 at most
+		if length > maxStringLength || length > uint64(len(compressed))*lzfMaxRatio {
+			return nil, errCorrupted
+		}
+		return lzfDecompress(compressed, int(length))
+	}
+
+	return nil, errCorrupted
+}
+
+// the reads go through readByte and readFull, which keep the checksum up to date
+
+// readBytes reads a string of length bytes. The buffer grows with the bytes actually read,
+// so that a corrupted length fails at the end of the file instead of allocating it
+func (r *Reader) readBytes(length uint64) ([]byte, error) {
+	if length > maxStringLength {
+		return nil, errCorrupted
+	}
+
+	buf := make([]byte, 0, min(length, readChunk))
+	for uint64(len(buf)) < length {
+		start := len(buf)
+		size := int(min(length-uint64(start), readChunk))
+		buf = slices.Grow(buf, size)[:start+size]
+		if err := r.readFull(buf[start:]); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf, nil
+}
+
+func (r *Reader) readByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	r.crc = crc64(r.crc, []byte{b})
+
+	return b, nil
+}
+
+func (r *Reader) readFull(buf []byte) error {
+	if _, err := io.ReadFull(r.r, buf); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	r.crc = crc64(r.crc, buf)
+
+	return nil
+}
+
+func pairs(values [][]byte) [][2][]byte {
+	fields := make([][2][]byte, len(values)/2)
+	for i := range fields {
+		fields[i] = [2][]byte{values[2*i], values[2*i+1]}
+	}
+
+	return fields
+}
+
+// zmembers pairs the members of a packed sorted set with their scores, written as text or integers
+func zmembers(values [][]byte) ([]ZMember, error) {
+	if len(values)%2 != 0 {
+		return nil, errCorrupted
+	}
+
+	members := make([]ZMember, len(values)/2)
+	for i := range members {
+		score, err := strconv.ParseFloat(string(values[2*i+1]), 64)
+		if err != nil {
+			return nil, errCorrupted
+		}
+		members[i] = ZMember{Member: values[2*i], Score: score}
+	}
+
+	return members, nil
+}
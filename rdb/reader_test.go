@@ -0,0 +1,324 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rdbFile returns an RDB file of the given version holding body, followed by its checksum
+func rdbFile(version string, body ...[]byte) []byte {
+	file := append([]byte("REDIS"+version), bytes.Join(body, nil)...)
+	file = append(file, opEOF)
+
+	return binary.LittleEndian.AppendUint64(file, crc64(0, file))
+}
+
+// readAll reads the entries of a file until its end or an error
+func readAll(file []byte) ([]*Entry, error) {
+	reader, err := NewReader(bytes.NewReader(file))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*Entry
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return entries, err
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// TestHostileLengths checks that the lengths read from the file can't make the reader allocate more than the file holds
+func TestHostileLengths(t *testing.T) {
+	for name, body := range map[string][]byte{
+		// a string of 2^40 bytes
+		"64 bit length": {typeString, 0x01, 'k', 0x81, 0, 0, 0x01, 0, 0, 0, 0, 0},
+		// a string of 400MB, below the limit, in a file of a few bytes
+		"32 bit length": {typeString, 0x01, 'k', 0x80, 0x18, 0, 0, 0, 'v'},
+		// 2 bytes expanding to 256MB
+		"lzf length": {typeString, 0x01, 'k', 0xC3, 0x02, 0x80, 0x10, 0, 0, 0, 0x00, 'a'},
+		// a list announcing 2^32 elements
+		"element count": {typeList, 0x01, 'k', 0x80, 0xFF, 0xFF, 0xFF, 0xFF, 0x01, 'a'},
+	} {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+
+		_, err := readAll(rdbFile("0011", body))
+
+		runtime.ReadMemStats(&after)
+		if err == nil {
+			t.Errorf("%s: the file was read", name)
+		}
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 16<<20 {
+			t.Errorf("%s: %d bytes allocated", name, allocated)
+		}
+	}
+
+	if _, err := readAll(rdbFile("0011", []byte{typeString, 0x01, 'k', 0x81, 0, 0, 0x01, 0, 0, 0, 0, 0})); !errors.Is(err, errCorrupted) {
+		t.Errorf("string longer than the limit: %v, expected %v", err, errCorrupted)
+	}
+}
+
+// hexBytes decodes the hexadecimal dumps of the fixtures, the white space is ignored
+func hexBytes(t *testing.T, dump string) []byte {
+	t.Helper()
+	decoded, err := hex.DecodeString(strings.Join(strings.Fields(dump), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return decoded
+}
+
+func strs(values ...string) [][]byte {
+	result := make([][]byte, len(values))
+	for i, value := range values {
+		result[i] = []byte(value)
+	}
+
+	return result
+}
+
+/*
+The fixtures are the values as Redis encodes them: the value type, the key "k" and the value,
+in hexadecimal, laid out as the ziplist.c, listpack.c, intset.c, zipmap.c and lzf_c.c of Redis write them.
+*/
+var decoderFixtures = []struct {
+	name     string
+	value    string
+	expected Entry
+}{
+	{
+		name:     "int8 encoded string",
+		value:    "00 016b c07b",
+		expected: Entry{Type: TypeString, Value: []byte("123")},
+	},
+	{
+		name:     "int16 encoded string",
+		value:    "00 016b c13930",
+		expected: Entry{Type: TypeString, Value: []byte("12345")},
+	},
+	{
+		name:     "int32 encoded string",
+		value:    "00 016b c2ffffffff",
+		expected: Entry{Type: TypeString, Value: []byte("-1")},
+	},
+	{
+		// a literal run "abc", a back reference of 9 bytes 3 bytes back, a literal run "X"
+		name:     "LZF",
+		value:    "00 016b c3 09 0d 02616263 e00002 0058",
+		expected: Entry{Type: TypeString, Value: []byte("abcabcabcabcX")},
+	},
+	{
+		name:     "list",
+		value:    "01 016b 02 0161 026263",
+		expected: Entry{Type: TypeList, Elements: strs("a", "bc")},
+	},
+	{
+		name:     "sorted set with scores as text",
+		value:    "03 016b 02 0161 03312e35 0162 fe",
+		expected: Entry{Type: TypeZSet, Members: []ZMember{{[]byte("a"), 1.5}, {[]byte("b"), math.Inf(1)}}},
+	},
+	{
+		name:     "sorted set with binary scores",
+		value:    "05 016b 01 0161 000000000000f83f",
+		expected: Entry{Type: TypeZSet, Members: []ZMember{{[]byte("a"), 1.5}}},
+	},
+	{
+		name:     "hash",
+		value:    "04 016b 01 0166 0176",
+		expected: Entry{Type: TypeHash, Fields: [][2][]byte{{[]byte("f"), []byte("v")}}},
+	},
+	{
+		// f1 => v1 followed by a free byte, f2 => x
+		name:     "zipmap",
+		value:    "09 016b 10 02 02 6631 02 01 7631 00 02 6632 01 00 78 ff",
+		expected: Entry{Type: TypeHash, Fields: [][2][]byte{{[]byte("f1"), []byte("v1")}, {[]byte("f2"), []byte("x")}}},
+	},
+	{
+		// "a", "bc", 5 as an immediate, 300 as int16, -2 as int8
+		name:     "ziplist",
+		value:    "0a 016b 1b 1b000000 17000000 0500 000161 03026263 04f6 02c02c01 04fefe ff",
+		expected: Entry{Type: TypeList, Elements: strs("a", "bc", "5", "300", "-2")},
+	},
+	{
+		name:     "intset",
+		value:    "0b 016b 0e 02000000 03000000 fdff 0100 0200",
+		expected: Entry{Type: TypeSet, Elements: strs("-3", "1", "2")},
+	},
+	{
+		name:     "intset of 64 bit integers",
+		value:    "0b 016b 10 08000000 01000000 0000000000000080",
+		expected: Entry{Type: TypeSet, Elements: strs("-9223372036854775808")},
+	},
+	{
+		name:     "sorted set ziplist",
+		value:    "0c 016b 10 10000000 0d000000 0200 000161 03f4 ff",
+		expected: Entry{Type: TypeZSet, Members: []ZMember{{[]byte("a"), 3}}},
+	},
+	{
+		name:     "hash ziplist",
+		value:    "0d 016b 11 11000000 0d000000 0200 000166 030176 ff",
+		expected: Entry{Type: TypeHash, Fields: [][2][]byte{{[]byte("f"), []byte("v")}}},
+	},
+	{
+		// a ziplist holding "a", another holding 7
+		name:     "quicklist",
+		value:    "0e 016b 02 0e 0e000000 0a000000 0100 000161 ff 0d 0d000000 0a000000 0100 00f8 ff",
+		expected: Entry{Type: TypeList, Elements: strs("a", "7")},
+	},
+	{
+		name:     "hash listpack",
+		value:    "10 016b 12 12000000 0400 816602 817602 816e02 0101 ff",
+		expected: Entry{Type: TypeHash, Fields: [][2][]byte{{[]byte("f"), []byte("v")}, {[]byte("n"), []byte("1")}}},
+	},
+	{
+		name:     "sorted set listpack",
+		value:    "11 016b 14 14000000 0400 816102 83312e3504 816202 0201 ff",
+		expected: Entry{Type: TypeZSet, Members: []ZMember{{[]byte("a"), 1.5}, {[]byte("b"), 2}}},
+	},
+	{
+		// a packed node holding "x", a plain node holding "big"
+		name:     "quicklist 2",
+		value:    "12 016b 02 02 0a 0a000000 0100 817802 ff 01 03 626967",
+		expected: Entry{Type: TypeList, Elements: strs("x", "big")},
+	},
+	{
+		// "a", 5 as 7 bit integer, -100 as 13 bit integer, 1000 as 16 bit integer, "hello" as 12 bit string
+		name:     "set listpack",
+		value:    "14 016b 1b 1b000000 0500 816102 0501 df9c02 f1e80303 e00568656c6c6f07 ff",
+		expected: Entry{Type: TypeSet, Elements: strs("a", "5", "-100", "1000", "hello")},
+	},
+}
+
+func TestDecoders(t *testing.T) {
+	for _, fixture := range decoderFixtures {
+		entries, err := readAll(rdbFile("0011", hexBytes(t, fixture.value)))
+		if err != nil {
+			t.Errorf("%s: %s", fixture.name, err)
+			continue
+		}
+
+		expected := fixture.expected
+		expected.Key = []byte("k")
+		if len(entries) != 1 || !reflect.DeepEqual(*entries[0], expected) {
+			t.Errorf("%s: read %+v, expected %+v", fixture.name, entries, expected)
+		}
+	}
+}
+
+// TestOpcodes checks the metadata preceding the keys: the DB, the expiration and the ignored ones
+func TestOpcodes(t *testing.T) {
+	file := rdbFile("0011", hexBytes(t, `
+		fa 0972656469732d766572 05372e322e30
+		fe 00 fb 01 00
+		00 0161 0131
+		fe 03
+		fc 00d8c32cbb030000
+		f8 05
+		00 0162 0132`))
+
+	entries, err := readAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("read %d entries", len(entries))
+	}
+	if entries[0].DB != 0 || !entries[0].ExpireAt.IsZero() {
+		t.Errorf("first key in DB %d expiring at %s", entries[0].DB, entries[0].ExpireAt)
+	}
+	if entries[1].DB != 3 || entries[1].ExpireAt.UnixMilli() != 4102444800000 {
+		t.Errorf("second key in DB %d expiring at %s", entries[1].DB, entries[1].ExpireAt)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	// the check value of the CRC-64 of Redis, given by its crc64.c
+	if crc := crc64(0, []byte("123456789")); crc != 0xe9c6d914c4b8d9ca {
+		t.Errorf("crc64 = %x", crc)
+	}
+
+	file := rdbFile("0011", hexBytes(t, "00 0161 0131"))
+	if _, err := readAll(file); err != nil {
+		t.Errorf("valid checksum: %s", err)
+	}
+
+	corrupted := append([]byte(nil), file...)
+	corrupted[len(corrupted)-10] = '2'
+	if _, err := readAll(corrupted); !errors.Is(err, errChecksum) {
+		t.Errorf("corrupted file: %v, expected %v", err, errChecksum)
+	}
+
+	// a checksum of 0 means that Redis was told not to compute it
+	disabled := append([]byte(nil), corrupted[:len(corrupted)-8]...)
+	disabled = append(disabled, 0, 0, 0, 0, 0, 0, 0, 0)
+	if _, err := readAll(disabled); err != nil {
+		t.Errorf("disabled checksum: %s", err)
+	}
+
+	// the files before version 5 have no checksum
+	old := append([]byte("REDIS0004"), hexBytes(t, "00 0161 0131 ff")...)
+	if entries, err := readAll(old); err != nil || len(entries) != 1 {
+		t.Errorf("version 4 file: %d entries, %v", len(entries), err)
+	}
+}
+
+// TestRoundTrip checks that the files written are read back as they were
+func TestRoundTrip(t *testing.T) {
+	expire := time.UnixMilli(4102444800000)
+	entries := []*Entry{
+		{DB: 0, Key: []byte("s"), Type: TypeString, Value: []byte("value")},
+		{DB: 0, Key: []byte("empty"), Type: TypeString, Value: []byte{}, ExpireAt: expire},
+		{DB: 0, Key: []byte("l"), Type: TypeList, Elements: strs("a", "", "c")},
+		{DB: 2, Key: []byte("S"), Type: TypeSet, Elements: strs("x", "y")},
+		{DB: 2, Key: []byte("z"), Type: TypeZSet, Members: []ZMember{{[]byte("a"), -1.5}, {[]byte("b"), math.Inf(1)}}},
+		{DB: 5, Key: []byte("h"), Type: TypeHash, Fields: [][2][]byte{{[]byte("f"), []byte(strings.Repeat("v", 100000))}}},
+	}
+
+	var buf bytes.Buffer
+	writer, err := NewWriter(&buf, "7.2.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if err := writer.Write(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := readAll(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != len(entries) {
+		t.Fatalf("read %d entries, wrote %d", len(read), len(entries))
+	}
+	for i, entry := range read {
+		if !entry.ExpireAt.Equal(entries[i].ExpireAt) {
+			t.Errorf("%s expires at %s, expected %s", entry.Key, entry.ExpireAt, entries[i].ExpireAt)
+		}
+		entry.ExpireAt = entries[i].ExpireAt
+		if !reflect.DeepEqual(entry, entries[i]) {
+			t.Errorf("read %+v, wrote %+v", entry, entries[i])
+		}
+	}
+}
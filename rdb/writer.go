@@ -0,0 +1,142 @@
+package rdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Writer writes an RDB file of version 9 with the plain encodings only, which any Redis can load
+type Writer struct {
+	w   *bufio.Writer
+	crc uint64
+	db  int
+}
+
+// NewWriter writes the header of the file, the version of Redis it claims to come from is redisVersion
+func NewWriter(w io.Writer, redisVersion string) (*Writer, error) {
+	writer := &Writer{w: bufio.NewWriter(w), db: -1}
+
+	writer.write([]byte(fmt.Sprintf("REDIS%04d", writeVersion)))
+	for _, aux := range [][2]string{
+		{"redis-ver", redisVersion},
+		{"redis-bits", strconv.Itoa(strconv.IntSize)},
+		{"ctime", strconv.FormatInt(time.Now().Unix(), 10)},
+	} {
+		writer.write([]byte{opAux})
+		writer.writeString([]byte(aux[0]))
+		writer.writeString([]byte(aux[1]))
+	}
+
+	return writer, writer.flushError()
+}
+
+// Write appends a key, the entries of a DB must be written together
+func (w *Writer) Write(entry *Entry) error {
+	if entry.DB != w.db {
+		w.write([]byte{opSelectDB})
+		w.writeLength(uint64(entry.DB))
+		w.db = entry.DB
+	}
+
+	if !entry.ExpireAt.IsZero() {
+		buf := make([]byte, 9)
+		buf[0] = opExpireTimeMs
+		binary.LittleEndian.PutUint64(buf[1:], uint64(entry.ExpireAt.UnixMilli()))
+		w.write(buf)
+	}
+
+	switch entry.Type {
+	case TypeString:
+		w.write([]byte{typeString})
+		w.writeString(entry.Key)
+		w.writeString(entry.Value)
+	case TypeList, TypeSet:
+		valueType := byte(typeList)
+		if entry.Type == TypeSet {
+			valueType = typeSet
+		}
+		w.write([]byte{valueType})
+		w.writeString(entry.Key)
+		w.writeLength(uint64(len(entry.Elements)))
+		for _, element := range entry.Elements {
+			w.writeString(element)
+		}
+	case TypeHash:
+		w.write([]byte{typeHash})
+		w.writeString(entry.Key)
+		w.writeLength(uint64(len(entry.Fields)))
+		for _, field := range entry.Fields {
+			w.writeString(field[0])
+			w.writeString(field[1])
+		}
+	case TypeZSet:
+		w.write([]byte{typeZSet2})
+		w.writeString(entry.Key)
+		w.writeLength(uint64(len(entry.Members)))
+		score := make([]byte, 8)
+		for _, member := range entry.Members {
+			w.writeString(member.Member)
+			binary.LittleEndian.PutUint64(score, math.Float64bits(member.Score))
+			w.write(score)
+		}
+	default:
+		return fmt.Errorf("rdb: unknown type %d", entry.Type)
+	}
+
+	return w.flushError()
+}
+
+// Close ends the file with its checksum, it doesn't close the underlying writer
+func (w *Writer) Close() error {
+	w.write([]byte{opEOF})
+
+	checksum := make([]byte, 8)
+	binary.LittleEndian.PutUint64(checksum, w.crc)
+	if _, err := w.w.Write(checksum); err != nil {
+		return err
+	}
+
+	return w.w.Flush()
+}
+
+// write buffers the bytes and updates the checksum, the errors are kept by the bufio.Writer until the next flushError
+func (w *Writer) write(p []byte) {
+	w.crc = crc64(w.crc, p)
+	w.w.Write(p)
+}
+
+func (w *Writer) writeLength(length uint64) {
+	switch {
+	case length < 1<<6:
+		w.write([]byte{byte(length)})
+	case length < 1<<14:
+		w.write([]byte{byte(length>>8) | 0x40, byte(length)})
+	case length <= math.MaxUint32:
+		buf := make([]byte, 5)
+		buf[0] = 0x80
+		binary.BigEndian.PutUint32(buf[1:], uint32(length))
+		w.write(buf)
+	default:
+		buf := make([]byte, 9)
+		buf[0] = 0x81
+		binary.BigEndian.PutUint64(buf[1:], length)
+		w.write(buf)
+	}
+}
+
+func (w *Writer) writeString(value []byte) {
+	w.writeLength(uint64(len(value)))
+	w.write(value)
+}
+
+// flushError returns the first error met by the buffered writes, without flushing
+func (w *Writer) flushError() error {
+	// an empty write reports the sticky error of the bufio.Writer
+	_, err := w.w.Write(nil)
+	return err
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// dumpKeys returns the keys of the DBs 0 and 3 with their type, value and time to live
+func dumpKeys(c *testClient) map[string]string {
+	dump := map[string]string{}
+	for _, db := range []string{"0", "3"} {
+		c.ok("select", db)
+		for _, key := range c.ok("keys", "*").([]any) {
+			key := str(key)
+			var value any
+			switch keyType := str(c.ok("type", key)); keyType {
+			case "string":
+				value = str(c.ok("get", key))
+			case "list":
+				value = c.ok("lrange", key, "0", "-1")
+			case "set":
+				members := c.ok("smembers", key).([]any)
+				sort.Slice(members, func(i, j int) bool { return str(members[i]) < str(members[j]) })
+				value = members
+			case "zset":
+				value = c.ok("zrange", key, "0", "-1", "withscores")
+			case "hash":
+				value = c.ok("hgetall", key)
+			}
+			// the time to live is rounded, the export and import take a few milliseconds
+			ttl := c.ok("ttl", key).(int64)
+			if ttl > 0 {
+				ttl = (ttl + 50) / 100
+			}
+			dump[db+":"+key] = fmt.Sprintf("%q ttl %d", value, ttl)
+		}
+	}
+	c.ok("select", "0")
+
+	return dump
+}
+
+// TestRDBRoundTrip exports the keys of every type to an RDB file and imports it in another server
+func TestRDBRoundTrip(t *testing.T) {
+	source := startServer(t, nil)
+	c := source.client()
+	c.ok("set", "s", "value")
+	c.ok("set", "empty", "")
+	c.ok("set", "n", "12345")
+	c.ok("set", "expiring", "v", "ex", "1000")
+	c.ok("rpush", "l", "a", "", "100")
+	c.ok("sadd", "S", "x", "y", "1")
+	c.ok("zadd", "z", "1.5", "a", "-2", "b", "+inf", "c")
+	c.ok("hset", "h", "f", "v", "n", "1")
+	c.ok("select", "3")
+	c.ok("set", "in3", "v")
+	c.ok("select", "0")
+
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	if got := c.ok("bigdis", "export-rdb", path); got != int64(9) {
+		t.Errorf("export-rdb = %v keys, expected 9", got)
+	}
+
+	target := startServer(t, nil)
+	d := target.client()
+	d.ok("set", "s", "replaced")
+	d.ok("set", "other", "kept")
+	if got := d.ok("bigdis", "import-rdb", path); got != int64(9) {
+		t.Errorf("import-rdb = %v keys, expected 9", got)
+	}
+
+	expected := dumpKeys(c)
+	if len(expected) != 9 {
+		t.Fatalf("source keys: %v", expected)
+	}
+	expected["0:other"] = fmt.Sprintf("%q ttl -1", "kept")
+	if got := dumpKeys(d); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("imported keys:\n%v\nexpected:\n%v", got, expected)
+	}
+
+	// FLUSH empties the DBs first
+	if got := d.ok("bigdis", "import-rdb", path, "flush"); got != int64(9) {
+		t.Errorf("import-rdb flush = %v keys, expected 9", got)
+	}
+	delete(expected, "0:other")
+	if got := dumpKeys(d); fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("imported keys after a flush:\n%v\nexpected:\n%v", got, expected)
+	}
+}
+
+func TestBigdisHelp(t *testing.T) {
+	c := startServer(t, nil).client()
+
+	help := c.ok("bigdis", "help").([]any)
+	var lines []string
+	for _, line := range help {
+		// the lines are status replies
+		if _, ok := line.(string); !ok {
+			t.Fatalf("help line %q isn't a status", line)
+		}
+		lines = append(lines, line.(string))
+	}
+	for _, subcommand := range []string{"IMPORT-RDB", "EXPORT-RDB", "REPLICA", "CHANGES", "SNAPSHOT", "HELP"} {
+		if !strings.Contains(strings.Join(lines, "\n"), "\n"+subcommand) {
+			t.Errorf("%s missing from the help:\n%s", subcommand, strings.Join(lines, "\n"))
+		}
+	}
+
+	if reply, ok := c.do("bigdis", "nosuch").(replyError); !ok || !strings.Contains(string(reply), "Try BIGDIS HELP") {
+		t.Errorf("unknown subcommand = %q", reply)
+	}
+}
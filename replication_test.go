@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCounters runs the commands whose arguments the storage functions used to overwrite
+func writeCounters(c *testClient, suffix string) {
+	c.ok("set", "cnt"+suffix, "10")
+	c.ok("incrby", "cnt"+suffix, "5")
+	c.ok("decrby", "cnt"+suffix, "3")
+	c.ok("incr", "cnt"+suffix)
+	c.ok("decr", "cnt"+suffix)
+	c.ok("set", "ap"+suffix, "ab")
+	c.ok("append", "ap"+suffix, "cd")
+	c.ok("append", "ap"+suffix, "XY")
+	c.ok("rpush", "list"+suffix, "a", "b", "c")
+	c.ok("hset", "hash"+suffix, "f", "1")
+	c.ok("hincrby", "hash"+suffix, "f", "4")
+	c.ok("multi")
+	c.ok("incrby", "tx"+suffix, "7")
+	c.ok("append", "txap"+suffix, "x")
+	c.ok("append", "txap"+suffix, "y")
+	c.ok("exec")
+}
+
+// checkCounters checks the keys written by writeCounters
+func checkCounters(t *testing.T, c *testClient, suffix string) {
+	t.Helper()
+
+	expected := map[string]string{"cnt": "12", "ap": "abcdXY", "tx": "7", "txap": "xy"}
+	for key, value := range expected {
+		if got := c.ok("get", key+suffix); str(got) != value {
+			t.Errorf("get %s%s = %q, expected %q", key, suffix, got, value)
+		}
+	}
+	if got := c.ok("lrange", "list"+suffix, "0", "-1"); !reflect.DeepEqual(got, []any{[]byte("a"), []byte("b"), []byte("c")}) {
+		t.Errorf("lrange list%s = %q", suffix, got)
+	}
+	if got := c.ok("hget", "hash"+suffix, "f"); str(got) != "5" {
+		t.Errorf("hget hash%s f = %q, expected 5", suffix, got)
+	}
+}
+
+// offset returns the offset of the change log given by ROLE
+func offset(c *testClient) int64 {
+	role := c.ok("role").([]any)
+	if str(role[0]) == "master" {
+		return role[1].(int64)
+	}
+
+	return role[4].(int64)
+}
+
+func TestReplication(t *testing.T) {
+	primary := startServer(t, nil)
+	replica := startServer(t, nil)
+	p, r := primary.client(), replica.client()
+
+	// the writes before REPLICAOF come with the full resync, the next ones are streamed
+	writeCounters(p, "1")
+
+	if reply := r.ok("replicaof", "localhost", strconv.Itoa(primary.port)); str(reply) != "OK" {
+		t.Fatalf("replicaof = %q", reply)
+	}
+
+	connected := eventually(t, 10*time.Second, func() bool {
+		role := r.ok("role").([]any)
+		return str(role[0]) == "slave" && str(role[3]) == "connected"
+	})
+	if !connected {
+		t.Fatalf("replica not connected: %q\n%s", r.ok("role"), replica.output())
+	}
+	role := r.ok("role").([]any)
+	if str(role[1]) != "localhost" || role[2].(int64) != int64(primary.port) {
+		t.Errorf("role = %q", role)
+	}
+
+	writeCounters(p, "2")
+
+	if !eventually(t, 10*time.Second, func() bool { return offset(r) == offset(p) }) {
+		t.Fatalf("replica at offset %d, primary at %d", offset(r), offset(p))
+	}
+	checkCounters(t, r, "1")
+	checkCounters(t, r, "2")
+
+	role = p.ok("role").([]any)
+	if str(role[0]) != "master" || len(role[2].([]any)) != 1 {
+		t.Errorf("role of the primary = %q", role)
+	}
+
+	// a replica is read only by default, the keys can be exported but not imported
+	if reply, ok := r.do("set", "cnt1", "0").(replyError); !ok {
+		t.Errorf("set on the replica = %q, expected an error", reply)
+	}
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	r.ok("bigdis", "export-rdb", path)
+	if reply, ok := r.do("bigdis", "import-rdb", path).(replyError); !ok || !strings.HasPrefix(string(reply), "READONLY ") {
+		t.Errorf("bigdis import-rdb on the replica = %q, expected a READONLY error", reply)
+	}
+
+	if reply := r.ok("replicaof", "no", "one"); str(reply) != "OK" {
+		t.Fatalf("replicaof no one = %q", reply)
+	}
+	if role := r.ok("role").([]any); str(role[0]) != "master" {
+		t.Errorf("role after replicaof no one = %q", role)
+	}
+	r.ok("set", "cnt1", "0")
+}
+
+// TestReplicationCatchUp restarts a replica that missed writes, it gets them from the change log
+func TestReplicationCatchUp(t *testing.T) {
+	primary := startServer(t, nil)
+	replicaOf := fmt.Sprintf("localhost %d", primary.port)
+	replica := startServer(t, map[string]map[string]any{"replication": {"replicaof": replicaOf}})
+	p := primary.client()
+
+	writeCounters(p, "1")
+	r := replica.client()
+	if !eventually(t, 10*time.Second, func() bool { return offset(r) == offset(p) }) {
+		t.Fatalf("replica at offset %d, primary at %d", offset(r), offset(p))
+	}
+
+	replica.stop()
+	writeCounters(p, "2")
+
+	// the database of the replica is kept, it starts from where it stopped
+	replica = restartServer(t, replica)
+	r = replica.client()
+	if !eventually(t, 10*time.Second, func() bool { return offset(r) == offset(p) }) {
+		t.Fatalf("replica at offset %d, primary at %d", offset(r), offset(p))
+	}
+	checkCounters(t, r, "1")
+	checkCounters(t, r, "2")
+}
+
+// TestChangeLogSize checks that the change log never holds more than change_log_size changes, between the garbage collections too
+func TestChangeLogSize(t *testing.T) {
+	srv := startServer(t, map[string]map[string]any{
+		"storage":     {"gc_interval": 3600},
+		"replication": {"change_log_size": 5},
+	})
+	c := srv.client()
+
+	var replid string
+	for _, line := range strings.Split(str(c.ok("info", "replication")), "\r\n") {
+		if value, found := strings.CutPrefix(line, "master_replid:"); found {
+			replid = value
+		}
+	}
+
+	// changes returns the number of changes following after, -1 when they are not all in the change log anymore
+	changes := func(after int64) int {
+		reply := c.ok("bigdis", "changes", replid, strconv.FormatInt(after, 10), "100", "0")
+		if reply == nil {
+			return -1
+		}
+		return len(reply.([]any))
+	}
+
+	for i := 0; i < 12; i++ {
+		c.ok("set", "k", strconv.Itoa(i))
+	}
+	last := offset(c)
+	if got := changes(last - 5); got != 5 {
+		t.Errorf("changes after %d = %d, expected the last 5", last-5, got)
+	}
+	if got := changes(last - 6); got != -1 {
+		t.Errorf("changes after %d = %d, expected them trimmed", last-6, got)
+	}
+
+	// a lower size applies to the next write
+	c.ok("config", "set", "change_log_size", "2")
+	c.ok("set", "k", "v")
+	last = offset(c)
+	if got := changes(last - 2); got != 2 {
+		t.Errorf("changes after %d = %d, expected the last 2", last-2, got)
+	}
+	if got := changes(last - 3); got != -1 {
+		t.Errorf("changes after %d = %d, expected them trimmed", last-3, got)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestEmptyStringReplies checks that an empty string is replied as $0, and a missing value as the null bulk string
+func TestEmptyStringReplies(t *testing.T) {
+	srv := startServer(t, nil)
+	c := srv.client()
+
+	c.ok("set", "empty", "")
+	c.ok("rpush", "list", "", "a")
+	c.ok("hset", "hash", "f", "")
+
+	tests := []struct {
+		args     []string
+		expected any
+	}{
+		{[]string{"get", "empty"}, []byte{}},
+		{[]string{"get", "missing"}, nil},
+		{[]string{"lrange", "list", "0", "-1"}, []any{[]byte{}, []byte("a")}},
+		{[]string{"lindex", "list", "0"}, []byte{}},
+		{[]string{"hget", "hash", "f"}, []byte{}},
+		{[]string{"hmget", "hash", "f", "missing"}, []any{[]byte{}, nil}},
+		{[]string{"mget", "empty", "missing"}, []any{[]byte{}, nil}},
+		{[]string{"set", "empty", "x", "get"}, []byte{}},
+		{[]string{"set", "new", "y", "get"}, nil},
+		{[]string{"set", "new", "z", "nx"}, nil},
+		{[]string{"set", "new", "", "xx"}, "OK"},
+		{[]string{"getdel", "new"}, []byte{}},
+		{[]string{"client", "getname"}, nil},
+	}
+	for _, test := range tests {
+		reply := c.ok(test.args...)
+		if !reflect.DeepEqual(reply, test.expected) {
+			t.Errorf("%q = %#v, expected %#v", test.args, reply, test.expected)
+		}
+	}
+}
+
+// TestScoreReplies checks that the scores are doubles paired with their members in RESP3, and alternated in RESP2
+func TestScoreReplies(t *testing.T) {
+	srv := startServer(t, nil)
+	resp2 := srv.client()
+	resp3 := srv.client()
+	resp3.ok("hello", "3")
+
+	b := func(s string) []byte { return []byte(s) }
+	pair := func(member, score string) []any { return []any{b(member), replyDouble(score)} }
+
+	tests := []struct {
+		args  []string
+		resp2 any
+		resp3 any
+	}{
+		{[]string{"zrange", "z", "0", "-1", "withscores"},
+			[]any{b("a"), b("1.5"), b("b"), b("2"), b("c"), b("inf")},
+			[]any{pair("a", "1.5"), pair("b", "2"), pair("c", "inf")}},
+		{[]string{"zrange", "z", "0", "0", "WITHSCORES", "rev"},
+			[]any{b("c"), b("inf")},
+			[]any{pair("c", "inf")}},
+		{[]string{"zrange", "z", "0", "-1"},
+			[]any{b("a"), b("b"), b("c")},
+			[]any{b("a"), b("b"), b("c")}},
+		{[]string{"zrevrange", "z", "0", "0", "withscores"},
+			[]any{b("c"), b("inf")},
+			[]any{pair("c", "inf")}},
+		{[]string{"zrangebyscore", "z", "2", "+inf", "withscores", "limit", "0", "1"},
+			[]any{b("b"), b("2")},
+			[]any{pair("b", "2")}},
+		{[]string{"zrevrangebyscore", "z", "2", "-inf", "withscores"},
+			[]any{b("b"), b("2"), b("a"), b("1.5")},
+			[]any{pair("b", "2"), pair("a", "1.5")}},
+		{[]string{"zrank", "z", "b", "withscore"},
+			[]any{int64(1), b("2")},
+			[]any{int64(1), replyDouble("2")}},
+		{[]string{"zrange", "missing", "0", "-1", "withscores"}, []any{}, []any{}},
+	}
+	for _, test := range tests {
+		resp2.ok("zadd", "z", "1.5", "a", "2", "b", "+inf", "c")
+		if got := resp2.ok(test.args...); !reflect.DeepEqual(got, test.resp2) {
+			t.Errorf("RESP2 %q = %#v, expected %#v", test.args, got, test.resp2)
+		}
+		if got := resp3.ok(test.args...); !reflect.DeepEqual(got, test.resp3) {
+			t.Errorf("RESP3 %q = %#v, expected %#v", test.args, got, test.resp3)
+		}
+	}
+
+	// a single pop isn't nested, a count is
+	pops := []struct {
+		args  []string
+		resp2 any
+		resp3 any
+	}{
+		{[]string{"zpopmin", "z"}, []any{b("a"), b("1.5")}, pair("a", "1.5")},
+		{[]string{"zpopmax", "z"}, []any{b("c"), b("inf")}, pair("c", "inf")},
+		{[]string{"zpopmin", "z", "2"}, []any{b("a"), b("1.5"), b("b"), b("2")}, []any{pair("a", "1.5"), pair("b", "2")}},
+		{[]string{"zpopmax", "z", "1"}, []any{b("c"), b("inf")}, []any{pair("c", "inf")}},
+		{[]string{"zpopmin", "missing"}, []any{}, []any{}},
+	}
+	for _, test := range pops {
+		for _, c := range []*testClient{resp2, resp3} {
+			resp2.ok("del", "z")
+			resp2.ok("zadd", "z", "1.5", "a", "2", "b", "+inf", "c")
+			expected := test.resp2
+			if c == resp3 {
+				expected = test.resp3
+			}
+			if got := c.ok(test.args...); !reflect.DeepEqual(got, expected) {
+				t.Errorf("%q = %#v, expected %#v", test.args, got, expected)
+			}
+		}
+	}
+
+	// EXEC writes the replies with the protocol of the client
+	resp3.ok("multi")
+	resp3.ok("zrange", "z", "0", "0", "withscores")
+	if got, expected := resp3.ok("exec"), []any{[]any{pair("a", "1.5")}}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("RESP3 exec = %#v, expected %#v", got, expected)
+	}
+}
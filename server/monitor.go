@@ -0,0 +1,152 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"bigdis/internal"
+	"bigdis/utils"
+)
+
+// monitorBufferSize is the number of lines a monitor can lag behind before being dropped
+const monitorBufferSize = 1024
+
+// startMonitor turns the connection into a monitor, the lines are written
+// by a goroutine until the monitor is removed. The returned done channel is closed
+// once the goroutine is done with the connection.
+func (srv *server) startMonitor(conn net.Conn) (chan string, chan struct{}, error) {
+	if err := writeStatus(conn, "OK"); err != nil {
+		return nil, nil, err
+	}
+
+	lines := make(chan string, monitorBufferSize)
+	srv.monitorLock.Lock()
+	srv.monitorChans = append(srv.monitorChans, lines)
+	srv.monitorLock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := internal.NewMonitorReply(lines).WriteTo(conn); err != nil {
+			srv.removeMonitor(lines)
+		}
+
+		// a dropped monitor must not wait for its next command to be disconnected
+		conn.SetReadDeadline(time.Now())
+	}()
+
+	return lines, done, nil
+}
+
+// removeMonitor stops sending lines to a monitor, it does nothing if the monitor is already gone
+func (srv *server) removeMonitor(lines chan string) {
+	srv.monitorLock.Lock()
+	defer srv.monitorLock.Unlock()
+
+	for i, c := range srv.monitorChans {
+		if c == lines {
+			srv.monitorChans = append(srv.monitorChans[:i], srv.monitorChans[i+1:]...)
+			close(lines)
+			return
+		}
+	}
+}
+
+// feedMonitors sends a request to every monitor without waiting,
+// a monitor that lags behind is dropped rather than slowing down the clients
+func (srv *server) feedMonitors(db [][]byte, request *internal.Request) {
+	srv.monitorLock.Lock()
+	defer srv.monitorLock.Unlock()
+
+	if len(srv.monitorChans) == 0 {
+		return
+	}
+
+	line := monitorLine(time.Now(), db, request)
+	monitors := srv.monitorChans[:0]
+	for _, c := range srv.monitorChans {
+		select {
+		case c <- line:
+			monitors = append(monitors, c)
+		default:
+			utils.Print("Dropping slow monitor\n")
+			close(c)
+		}
+	}
+	srv.monitorChans = monitors
+}
+
+// monitorLine formats a request as Redis does:
+// 1339518083.107412 [0 127.0.0.1:60866] "keys" "*"
+func monitorLine(now time.Time, db [][]byte, request *internal.Request) string {
+	var line strings.Builder
+
+	dbNum := "0"
+	if len(db) > 0 {
+		dbNum = string(db[0])
+	}
+
+	fmt.Fprintf(&line, "%d.%06d [%s %s] %s", now.Unix(), now.Nanosecond()/1000, dbNum, request.Client.Addr(), quoteArg([]byte(request.Name)))
+	visible := visibleArgs(request)
+	for i, arg := range request.Args {
+		line.WriteByte(' ')
+		if i < visible {
+			line.WriteString(quoteArg(arg))
+		} else {
+			line.WriteString("(redacted)")
+		}
+	}
+
+	return line.String()
+}
+
+// visibleArgs is the number of arguments shown before the ones that may hold passwords
+func visibleArgs(request *internal.Request) int {
+	switch request.Name {
+	case "auth":
+		return 0
+	case "hello":
+		return 1
+	case "acl":
+		if len(request.Args) > 0 && strings.EqualFold(string(request.Args[0]), "setuser") {
+			return 2
+		}
+	}
+
+	return len(request.Args)
+}
+
+// quoteArg quotes an argument the way sdscatrepr does
+func quoteArg(arg []byte) string {
+	var quoted strings.Builder
+
+	quoted.WriteByte('"')
+	for _, c := range arg {
+		switch c {
+		case '\\', '"':
+			quoted.WriteByte('\\')
+			quoted.WriteByte(c)
+		case '\n':
+			quoted.WriteString("\\n")
+		case '\r':
+			quoted.WriteString("\\r")
+		case '\t':
+			quoted.WriteString("\\t")
+		case '\a':
+			quoted.WriteString("\\a")
+		case '\b':
+			quoted.WriteString("\\b")
+		default:
+			if c < ' ' || c > '~' {
+				fmt.Fprintf(&quoted, "\\x%02x", c)
+			} else {
+				quoted.WriteByte(c)
+			}
+		}
+	}
+	quoted.WriteByte('"')
+
+	return quoted.String()
+}
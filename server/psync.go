@@ -0,0 +1,174 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bigdis/internal"
+	"bigdis/storage"
+)
+
+/*
+The replicas speaking the Redis protocol, Redis itself or tools like redis-shake, follow the server with PSYNC or SYNC.
+
+They always get a full resynchronization: the RDB snapshot of the keys at an offset of the change log,
+then the changes following it as the commands of the replication stream, with a SELECT whenever the database
+changes and a PING after replicaPingPeriod of silence. Redis counts the offsets of the stream in bytes
+from the offset given by FULLRESYNC, the acknowledgements are mapped back to the offsets of the change log
+for ROLE and INFO. A replica that falls behind the change log is disconnected, it reconnects and resyncs.
+*/
+
+const (
+	// replicaPingPeriod is how often an idle replication stream is sent a PING, as repl-ping-replica-period
+	replicaPingPeriod = 10 * time.Second
+	// streamBatch is the number of changes read from the change log at once
+	streamBatch = 1000
+)
+
+// replicaStream sends the changes to a replica from its own goroutine
+type replicaStream struct {
+	client *internal.Client
+	replid string
+	stop   chan struct{}
+	done   chan struct{}
+
+	lock      sync.Mutex
+	sent      int64            // offset of the stream in bytes
+	positions []streamPosition // where the changes sent end in the stream, until the replica acknowledges them
+	acked     int64
+}
+
+type streamPosition struct {
+	bytes  int64
+	offset int64
+}
+
+// startReplicaStream sends a snapshot to the replica then streams the changes following it until stopped
+func startReplicaStream(client *internal.Client, request *internal.Request) (*replicaStream, error) {
+	// the size of the snapshot comes first, it is only known once the file is complete
+	snapshot, err := storage.SnapshotRDB(internal.RedisVersion)
+	if err != nil {
+		return nil, err
+	}
+	defer snapshot.Close()
+	replid, offset := snapshot.ReplID, snapshot.Offset
+
+	// SYNC is the handshake of the replicas older than PSYNC, it gets the snapshot alone
+	header := fmt.Sprintf("$%d\r\n", snapshot.Size)
+	if request.Name == "psync" {
+		header = fmt.Sprintf("+FULLRESYNC %s %d\r\n", replid, offset) + header
+	}
+	if _, err := client.Write([]byte(header)); err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(client, snapshot); err != nil {
+		return nil, err
+	}
+
+	client.SetReplica(0)
+	client.AckReplica(offset)
+	log.Printf("Replica %s synchronized at offset %d\n", client.Addr(), offset)
+
+	stream := &replicaStream{
+		client: client,
+		replid: replid,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		sent:   offset,
+		acked:  offset,
+	}
+	go stream.run(offset)
+
+	return stream, nil
+}
+
+// run writes the changes following the offset after to the replica, the replica is disconnected when it returns
+func (s *replicaStream) run(after int64) {
+	defer close(s.done)
+	// the connection is closed by the client goroutine, which must not wait for the next acknowledgement to notice
+	defer s.client.SetReadDeadline(time.Now())
+
+	dbNum := -1
+	lastWrite := time.Now()
+	for {
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+
+		changes, err := storage.Changes(s.replid, after, streamBatch)
+		if err != nil {
+			log.Printf("Replica %s disconnected: %s\n", s.client.Addr(), err)
+			return
+		}
+
+		var buf bytes.Buffer
+		s.lock.Lock()
+		for _, change := range changes {
+			if change.DB != dbNum {
+				dbNum = change.DB
+				buf.Write(storage.EncodeCommand([][]byte{[]byte("SELECT"), []byte(strconv.Itoa(dbNum))}))
+			}
+			buf.Write(storage.EncodeCommand(change.Args))
+			s.positions = append(s.positions, streamPosition{bytes: s.sent + int64(buf.Len()), offset: change.Offset})
+			after = change.Offset
+		}
+		if len(changes) == 0 && time.Since(lastWrite) >= replicaPingPeriod {
+			buf.Write(storage.EncodeCommand([][]byte{[]byte("PING")}))
+		}
+		s.sent += int64(buf.Len())
+		s.lock.Unlock()
+
+		if buf.Len() > 0 {
+			if _, err := buf.WriteTo(s.client); err != nil {
+				return
+			}
+			lastWrite = time.Now()
+		}
+
+		if len(changes) == 0 {
+			if err := storage.WaitChanges(after, time.Second); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// ack handles REPLCONF ACK <offset>, the offset in bytes of the stream the replica processed
+func (s *replicaStream) ack(args [][]byte) {
+	if len(args) < 2 || !strings.EqualFold(string(args[0]), "ack") {
+		return
+	}
+	processed, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return
+	}
+
+	s.lock.Lock()
+	acknowledged := 0
+	for _, position := range s.positions {
+		if position.bytes > processed {
+			break
+		}
+		s.acked = position.offset
+		acknowledged++
+	}
+	s.positions = s.positions[acknowledged:]
+	acked := s.acked
+	s.lock.Unlock()
+
+	s.client.AckReplica(acked)
+}
+
+// close stops the stream and waits for its goroutine
+func (s *replicaStream) close() {
+	close(s.stop)
+	<-s.done
+}
@@ -2,21 +2,45 @@ package server
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"strings"
+	"sync"
 
 	"bigdis/config"
 	"bigdis/internal"
+	"bigdis/storage"
+	"bigdis/utils"
 )
 
+// subscriberCommands are the only commands a client can run in subscriber mode
+var subscriberCommands = map[string]struct{}{
+	"subscribe":    {},
+	"psubscribe":   {},
+	"unsubscribe":  {},
+	"punsubscribe": {},
+	"ping":         {},
+	"quit":         {},
+}
+
+const errNotSubscriberCommand = "ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context"
+
 type server struct {
 	host         string
 	port         int
 	monitorChans []chan string
-	methods      map[string]internal.HandlerFn
-	listener     *net.TCPListener
+	monitorLock  sync.Mutex
+	methods      map[string]*internal.Command
+	listeners    []net.Listener
+	errs         chan error // the server stops with the first listener that fails
+
+	// every command runs with commands read locked, the shutdown write locks it to wait for them
+	commands      sync.RWMutex
+	shutdownLock  sync.Mutex
+	shuttingDown  bool
+	abortShutdown chan struct{} // closed by SHUTDOWN ABORT, nil once the shutdown can't be aborted
 }
 
 func StartServer() error {
@@ -24,33 +48,118 @@ func StartServer() error {
 		host:         config.Config.Server.Host,
 		port:         config.Config.Server.Port,
 		monitorChans: []chan string{},
+		errs:         make(chan error, 1),
 	}
 
 	srv.methods = internal.NewV1Handler()
 
-	listener, err := net.ListenTCP("tcp", &net.TCPAddr{
-		IP:   net.ParseIP(srv.host),
-		Port: srv.port,
-	})
-	if err != nil {
+	if err := internal.LoadACL(); err != nil {
 		return err
 	}
-	defer listener.Close()
 
-	srv.listener = listener
+	if err := internal.StartReplication(); err != nil {
+		return err
+	}
+
+	if err := srv.listen(); err != nil {
+		srv.closeListeners()
+		return err
+	}
+
+	running.Store(srv)
+	srv.serveListeners()
+
+	err := <-srv.errs
+	srv.shutdownLock.Lock()
+	srv.closeListeners()
+	srv.shutdownLock.Unlock()
+
+	return err
+}
+
+// serveListeners accepts the clients of every listener, a listener closed by the shutdown just stops
+func (srv *server) serveListeners() {
+	for _, listener := range srv.listeners {
+		go func(listener net.Listener) {
+			if err := srv.serve(listener); !errors.Is(err, net.ErrClosed) {
+				select {
+				case srv.errs <- err:
+				default:
+				}
+			}
+		}(listener)
+	}
+}
+
+// listen opens the TCP port, the TLS port and the unix socket that are configured
+func (srv *server) listen() error {
+	if srv.port != 0 {
+		listener, err := net.ListenTCP("tcp", &net.TCPAddr{
+			IP:   net.ParseIP(srv.host),
+			Port: srv.port,
+		})
+		if err != nil {
+			return err
+		}
+		srv.listeners = append(srv.listeners, listener)
+	}
+
+	if config.Config.TLS.Port != 0 {
+		listener, err := listenTLS(srv.host, config.Config.TLS.Port)
+		if err != nil {
+			return err
+		}
+		srv.listeners = append(srv.listeners, listener)
+	}
 
+	if config.Config.Server.UnixSocket != "" {
+		listener, err := listenUnix(config.Config.Server.UnixSocket, config.Config.Server.UnixSocketPerm)
+		if err != nil {
+			return err
+		}
+		srv.listeners = append(srv.listeners, listener)
+	}
+
+	if len(srv.listeners) == 0 {
+		return errors.New("no port nor unixsocket to listen on")
+	}
+
+	return nil
+}
+
+// serve accepts the clients of a listener until it fails
+func (srv *server) serve(listener net.Listener) error {
 	for {
-		conn, err := srv.listener.AcceptTCP()
+		conn, err := listener.Accept()
 		if err != nil {
 			return err
 		}
 
+		internal.Stats.ConnectionsReceived.Add(1)
 		go srv.serveClient(conn)
 	}
 }
 
+func (srv *server) closeListeners() {
+	for _, listener := range srv.listeners {
+		listener.Close()
+	}
+	srv.listeners = nil
+}
+
 func (srv *server) serveClient(conn net.Conn) {
+	internal.Stats.ConnectedClients.Add(1)
+	defer internal.Stats.ConnectedClients.Add(-1)
+
+	client := internal.NewClient(conn)
+	subscriber := internal.NewSubscriber(client)
+	client.Subscriber = subscriber
+	internal.AddClient(client)
+	defer internal.RemoveClient(client)
 	defer func() {
+		// pending messages are written before anything else
+		subscriber.Close()
+
 		if err := recover(); err != nil {
 			fmt.Fprintf(conn, "-%s\r\n", err)
 		}
@@ -59,46 +168,295 @@ func (srv *server) serveClient(conn net.Conn) {
 		}
 	}()
 
+	var monitor chan string
+	var monitorDone chan struct{}
+	defer func() {
+		if monitor != nil {
+			srv.removeMonitor(monitor)
+			<-monitorDone
+		}
+	}()
+
+	var stream *replicaStream
+	defer func() {
+		if stream != nil {
+			stream.close()
+		}
+	}()
+
 	reader := bufio.NewReader(conn)
 	dbNum := [][]byte{[]byte("0")}
+	tx := &transaction{}
+	defer tx.reset()
 	for {
 		request, err := parseRequest(reader)
 		if err != nil {
 			panic(err)
 		}
-		request.Conn = conn
+		request.Conn = client
+		request.Client = client
+		request.Subscriber = subscriber
+
+		// the connection only streams the monitor lines until the client quits
+		if monitor != nil {
+			if request.Name == "quit" {
+				srv.removeMonitor(monitor)
+				<-monitorDone
+				monitor = nil
 
-		if request.Name == "select" {
-			dbNum = request.Args
+				subscriber.Reply(internal.NewStatusReply("OK"))
+				return
+			}
+			continue
+		}
+
+		// once the replication stream started, the replica only sends its acknowledgements
+		if stream != nil {
+			if request.Name == "replconf" {
+				stream.ack(request.Args)
+			}
+			continue
 		}
+
+		// CLIENT REPLY OFF and SKIP drop the replies, errors included
+		muted := client.Muted()
+		sendError := func(err error) {
+			if !muted {
+				replyError(subscriber, err)
+			}
+		}
+
+		// unknown commands, wrong numbers of arguments and missing permissions are refused first, they make EXEC fail
+		command, err := srv.lookupCommand(request)
+		if err == nil {
+			err = internal.CheckPermission(client, command, request.Args, dbNum[0])
+		}
+		if err == nil {
+			err = internal.CheckReadOnly(command, request.Args)
+		}
+		if err != nil {
+			if tx.active {
+				tx.aborted = true
+			}
+			sendError(err)
+			continue
+		}
+
+		// a subscribed RESP2 client can only manage its subscriptions
+		if subscriber.Active() && client.Protocol() == 2 {
+			if _, allowed := subscriberCommands[request.Name]; !allowed {
+				sendError(fmt.Errorf(errNotSubscriberCommand, request.Name))
+				continue
+			}
+		}
+
+		// the monitors only see the commands accepted for execution
+		if !tx.active && request.Name != "monitor" {
+			srv.feedMonitors(dbNum, request)
+		}
+
 		request.DB = dbNum
 
 		if request.Name == "quit" {
-			fmt.Fprint(conn, "+OK\r\n")
+			subscriber.Reply(internal.NewStatusReply("OK"))
 			return
 		}
 
-		// check existence of command
-		if _, exists := srv.methods[request.Name]; !exists {
-			// build args string to respect redis protocol
-			args := ""
-			for _, arg := range request.Args {
-				args += fmt.Sprintf("'%s' ", arg)
+		client.Executed(request, dbNum[0])
+
+		if request.Name == "monitor" && !tx.active {
+			if monitor, monitorDone, err = srv.startMonitor(client); err != nil {
+				panic(err)
 			}
-			args = strings.TrimRight(args, " ")
+			continue
+		}
 
-			reply := &internal.StatusReply{
-				Code: fmt.Sprintf("ERR unknown command '%s', with args beginning with: %s", request.Name, args),
+		if (request.Name == "psync" || request.Name == "sync") && !tx.active {
+			if stream, err = startReplicaStream(client, request); err != nil {
+				sendError(err)
 			}
+			continue
+		}
 
-			if _, err := reply.WriteTo(conn); err != nil {
-				panic(err)
+		// the server exits once SHUTDOWN succeeds, the client only gets a reply when it fails
+		if request.Name == "shutdown" && !tx.active {
+			options, abort, err := parseShutdown(request.Args)
+			if err == nil && abort {
+				err = srv.abort()
+				if err == nil {
+					err = writeStatus(request.Conn, "OK")
+				}
+			} else if err == nil {
+				err = srv.shutdown(options)
+			}
+			if err != nil {
+				sendError(err)
 			}
 			continue
 		}
 
-		if err := srv.methods[request.Name](request); err != nil {
-			panic(err)
+		// CLIENT PAUSE holds the commands when they run, not when MULTI queues them
+		if request.Name == "exec" && tx.active {
+			commands := []*internal.Command{command}
+			for _, queued := range tx.queued {
+				commands = append(commands, srv.methods[queued.Name])
+			}
+			internal.WaitPause(commands...)
+		} else if !tx.active {
+			internal.WaitPause(command)
+		}
+
+		internal.Stats.CommandsProcessed.Add(1)
+
+		// MULTI queues the commands until EXEC
+		// while subscribed the replies are queued behind the messages
+		var buffer *replyBuffer
+		if muted {
+			request.Conn = mutedConn{Conn: client}
+		} else if subscriber.Active() {
+			buffer = &replyBuffer{Conn: client}
+			request.Conn = buffer
+		}
+
+		err = srv.execute(tx, request, command)
+
+		// the connection moves to the DB of a SELECT once it ran, on its own or as the last one EXEC ran
+		if err == nil && !tx.active && (request.Name == "select" || request.Name == "exec") {
+			if request.Name == "select" {
+				dbNum = request.Args
+			} else {
+				dbNum = request.DB
+			}
+		}
+
+		queued := -1
+		if tx.active {
+			queued = len(tx.queued)
+		}
+		client.SetQueued(queued)
+
+		if buffer != nil && buffer.replies.Len() > 0 {
+			if err := subscriber.Reply(&buffer.replies); err != nil {
+				panic(err)
+			}
+		}
+
+		if err != nil {
+			sendError(err)
+		}
+		if client.Closing() {
+			return
+		}
+	}
+}
+
+// execute runs a command, or handles it as part of a transaction. The shutdown waits for it to finish
+func (srv *server) execute(tx *transaction, request *internal.Request, command *internal.Command) error {
+	srv.commands.RLock()
+	defer srv.commands.RUnlock()
+
+	handled, err := srv.handleTransaction(tx, request)
+	if !handled {
+		if command.Logged() {
+			err = executeLogged(request, command)
+		} else {
+			err = command.Handler(request)
+		}
+	}
+
+	return err
+}
+
+// executeLogged runs a write command in a transaction that also appends it to the change log.
+// The reply is held until the transaction is committed
+func executeLogged(request *internal.Request, command *internal.Command) error {
+	// the tables of the DB must be created before the write connection is taken
+	request.GetDBNum()
+
+	dbOp, err := storage.BeginTransaction()
+	if err != nil {
+		return err
+	}
+	defer storage.RollbackOnPanic(dbOp)
+
+	conn := request.Conn
+	buffer := &replyBuffer{Conn: conn}
+	request.Conn = buffer
+	request.DBOp = dbOp
+
+	// the change log records the arguments as received, whatever the handler does with them
+	args := append([][]byte(nil), request.Args...)
+	if err := command.Handler(request); err != nil {
+		storage.EndTransaction(dbOp, false)
+		return err
+	}
+	request.Args = args
+
+	if err := logChanges(dbOp, request); err != nil {
+		storage.EndTransaction(dbOp, false)
+		return err
+	}
+
+	if err := storage.EndTransaction(dbOp, true); err != nil {
+		return err
+	}
+
+	_, err = buffer.replies.WriteTo(conn)
+	return err
+}
+
+// logChanges appends what a write request changed to the change log
+func logChanges(dbOp *storage.DBOperation, request *internal.Request) error {
+	for _, args := range internal.Propagated(request) {
+		if err := storage.LogChange(dbOp, request.GetDBNum(), args); err != nil {
+			return err
 		}
 	}
+
+	return nil
+}
+
+// mutedConn drops the replies of a client that turned them off with CLIENT REPLY
+type mutedConn struct {
+	net.Conn
+}
+
+func (c mutedConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (c mutedConn) Protocol() int {
+	return internal.Protocol(c.Conn)
+}
+
+// lookupCommand finds the command of a request and checks its number of arguments
+func (srv *server) lookupCommand(request *internal.Request) (*internal.Command, error) {
+	command, exists := srv.methods[request.Name]
+	if !exists {
+		return nil, unknownCommand(request)
+	}
+
+	return command, command.CheckArity(request.Args)
+}
+
+// replyError sends the errors meant for the client, the others drop the connection
+func replyError(subscriber *internal.Subscriber, err error) {
+	if !utils.IsReplyError(err) {
+		panic(err)
+	}
+
+	if err := subscriber.Reply(internal.NewErrorReply(err.Error())); err != nil {
+		panic(err)
+	}
+}
+
+func unknownCommand(request *internal.Request) error {
+	// build args string to respect redis protocol
+	args := ""
+	for _, arg := range request.Args {
+		args += fmt.Sprintf("'%s' ", arg)
+	}
+	args = strings.TrimRight(args, " ")
+
+	return fmt.Errorf("ERR unknown command '%s', with args beginning with: %s", request.Name, args)
 }
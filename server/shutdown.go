@@ -0,0 +1,228 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"bigdis/config"
+	"bigdis/internal"
+	"bigdis/storage"
+
+	"github.com/coreos/go-systemd/v22/daemon"
+)
+
+var (
+	errShutdownInProgress = errors.New("ERR A shutdown is already in progress")
+	errNoShutdown         = errors.New("ERR No shutdown in progress.")
+	errShutdownFailed     = errors.New("ERR Errors trying to SHUTDOWN. Check logs.")
+	errShutdownSyntax     = errors.New("ERR syntax error")
+)
+
+// running is the server SIGTERM shuts down
+var running atomic.Pointer[server]
+
+// shutdownOptions are the modifiers of SHUTDOWN
+type shutdownOptions struct {
+	noSave bool // skip the WAL checkpoint
+	now    bool // don't wait for the running commands
+	force  bool // exit even if the checkpoint fails
+}
+
+// parseShutdown reads the modifiers of SHUTDOWN, abort tells whether it is SHUTDOWN ABORT
+func parseShutdown(args [][]byte) (options shutdownOptions, abort bool, err error) {
+	var save bool
+	for _, arg := range args {
+		switch strings.ToLower(string(arg)) {
+		case "nosave":
+			options.noSave = true
+		case "save":
+			save = true
+		case "now":
+			options.now = true
+		case "force":
+			options.force = true
+		case "abort":
+			abort = true
+		default:
+			return options, false, errShutdownSyntax
+		}
+	}
+
+	if (save && options.noSave) || (abort && len(args) > 1) {
+		return options, false, errShutdownSyntax
+	}
+
+	return options, abort, nil
+}
+
+/*
+shutdown stops the server without abandoning the work in progress:
+
+ 1. the listeners are closed, the connected clients stay but their new commands wait
+ 2. the running commands get shutdown_timeout seconds to finish, SHUTDOWN ABORT can still cancel everything here
+ 3. a replica stops following its primary, the WAL is checkpointed into the database file
+ 4. the garbage collector and the asynchronous flushes are stopped and both pools are closed
+
+A command still running after the timeout keeps the write connection, so the checkpoint and the close
+get shutdown_timeout seconds too: past them the process exits without closing the database,
+SQLite recovers the WAL at the next start.
+The process exits once done, shutdown only returns when the shutdown was aborted or failed.
+*/
+func (srv *server) shutdown(options shutdownOptions) error {
+	srv.shutdownLock.Lock()
+	if srv.shuttingDown {
+		srv.shutdownLock.Unlock()
+		return errShutdownInProgress
+	}
+	srv.shuttingDown = true
+	abort := make(chan struct{})
+	srv.abortShutdown = abort
+	srv.closeListeners()
+	srv.shutdownLock.Unlock()
+
+	// the pending write lock holds the new commands back while the running ones finish
+	drained := make(chan struct{})
+	go func() {
+		srv.commands.Lock()
+		close(drained)
+	}()
+
+	config.Lock.RLock()
+	timeout := time.Duration(config.Config.Server.ShutdownTimeout) * time.Second
+	config.Lock.RUnlock()
+
+	if !options.now {
+		timer := time.NewTimer(timeout)
+		select {
+		case <-drained:
+		case <-timer.C:
+			log.Printf("Commands still running after %s, shutting down anyway\n", timeout)
+		case <-abort:
+			timer.Stop()
+			log.Println("Shutdown aborted")
+			return srv.cancelShutdown(drained, errShutdownFailed)
+		}
+		timer.Stop()
+	}
+
+	// past this point the shutdown can't be aborted anymore
+	srv.shutdownLock.Lock()
+	srv.abortShutdown = nil
+	srv.shutdownLock.Unlock()
+
+	// a replica commits the changes it is applying and disconnects from its primary
+	internal.StopReplication()
+
+	deadline := time.Now().Add(timeout)
+	if !options.noSave {
+		finished, err := runUntil(deadline, storage.Checkpoint)
+		if !finished {
+			exitBusy(timeout)
+		}
+		if err != nil {
+			log.Printf("Error while checkpointing the WAL: %s\n", err)
+			if !options.force {
+				return srv.cancelShutdown(drained, errShutdownFailed)
+			}
+		}
+	}
+
+	finished, err := runUntil(deadline, storage.Close)
+	if !finished {
+		exitBusy(timeout)
+	}
+	if err != nil {
+		log.Printf("Error while closing the database: %s\n", err)
+	}
+
+	daemon.SdNotify(false, daemon.SdNotifyStopping)
+	os.Exit(0)
+
+	return nil
+}
+
+// runUntil runs fn, it stops waiting for it at the deadline and then returns false
+func runUntil(deadline time.Time, fn func() error) (bool, error) {
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return true, err
+	case <-timer.C:
+		return false, nil
+	}
+}
+
+// exitBusy ends a shutdown that couldn't close the database in time
+func exitBusy(timeout time.Duration) {
+	log.Printf("Database still busy after %s, exiting without closing it\n", timeout)
+	daemon.SdNotify(false, daemon.SdNotifyStopping)
+	os.Exit(1)
+}
+
+// cancelShutdown lets the commands run again and reopens the listeners, err is what the shutdown returns
+func (srv *server) cancelShutdown(drained chan struct{}, err error) error {
+	go func() {
+		<-drained
+		srv.commands.Unlock()
+	}()
+
+	srv.shutdownLock.Lock()
+	defer srv.shutdownLock.Unlock()
+
+	srv.shuttingDown = false
+	srv.abortShutdown = nil
+	if err := internal.StartReplication(); err != nil {
+		log.Println(err)
+	}
+	if err := srv.listen(); err != nil {
+		// the server can't serve anymore, it stops as when a listener fails
+		srv.closeListeners()
+		srv.errs <- err
+	} else {
+		srv.serveListeners()
+	}
+
+	return err
+}
+
+// abort cancels a shutdown waiting for the running commands
+func (srv *server) abort() error {
+	srv.shutdownLock.Lock()
+	defer srv.shutdownLock.Unlock()
+
+	if srv.abortShutdown == nil {
+		return errNoShutdown
+	}
+	close(srv.abortShutdown)
+	srv.abortShutdown = nil
+
+	return nil
+}
+
+// Shutdown stops the server as SHUTDOWN does, it is what SIGTERM triggers
+func Shutdown() error {
+	srv := running.Load()
+	if srv == nil {
+		// the server isn't serving yet, there is nothing to wait for
+		if err := storage.Checkpoint(); err != nil {
+			log.Printf("Error while checkpointing the WAL: %s\n", err)
+		}
+		if err := storage.Close(); err != nil {
+			log.Printf("Error while closing the database: %s\n", err)
+		}
+		daemon.SdNotify(false, daemon.SdNotifyStopping)
+		os.Exit(0)
+	}
+
+	return srv.shutdown(shutdownOptions{})
+}
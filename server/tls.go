@@ -0,0 +1,85 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"bigdis/config"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsConfig builds the settings of the TLS listener from the tls section of the config
+func tlsConfig() (*tls.Config, error) {
+	settings := config.Config.TLS
+	if settings.CertFile == "" || settings.KeyFile == "" {
+		return nil, errors.New("tls: cert_file and key_file are required to listen on tls port")
+	}
+
+	certificate, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("tls: %w", err)
+	}
+
+	minVersion, ok := tlsVersions[settings.MinVersion]
+	if !ok {
+		return nil, fmt.Errorf("tls: unsupported min_version %q, must be 1.2 or 1.3", settings.MinVersion)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   minVersion,
+	}
+
+	switch settings.AuthClients {
+	case "yes":
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case "no":
+		tlsConfig.ClientAuth = tls.NoClientCert
+	default:
+		return nil, fmt.Errorf("tls: auth_clients must be yes, optional or no, not %q", settings.AuthClients)
+	}
+
+	if settings.CACertFile != "" {
+		pem, err := os.ReadFile(settings.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls: no certificate found in %s", settings.CACertFile)
+		}
+	} else if tlsConfig.ClientAuth != tls.NoClientCert {
+		return nil, errors.New("tls: ca_cert_file is required to verify the client certificates, or set auth_clients to no")
+	}
+
+	return tlsConfig, nil
+}
+
+// listenTLS listens on the TLS port, the handshake happens with the first read of each client
+func listenTLS(host string, port int) (net.Listener, error) {
+	tlsConfig, err := tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{
+		IP:   net.ParseIP(host),
+		Port: port,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return tls.NewListener(listener, tlsConfig), nil
+}
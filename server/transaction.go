@@ -0,0 +1,260 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+
+	"bigdis/internal"
+	"bigdis/storage"
+	"bigdis/utils"
+)
+
+var (
+	errMultiNested       = errors.New("ERR MULTI calls can not be nested")
+	errExecWithoutMulti  = errors.New("ERR EXEC without MULTI")
+	errDiscardNoMulti    = errors.New("ERR DISCARD without MULTI")
+	errWatchInsideMulti  = errors.New("ERR WATCH inside MULTI is not allowed")
+	errExecAbort         = errors.New("EXECABORT Transaction discarded because of previous errors.")
+	errNotAllowedInMulti = errors.New("ERR Command not allowed inside a transaction")
+)
+
+/*
+transaction is the MULTI/EXEC state of a client connection.
+
+The queued commands are run by EXEC in a single transaction on the write pool,
+each one inside a savepoint so that a failing command doesn't undo the others,
+exactly as Redis doesn't roll back a transaction when one of its commands fails.
+*/
+type transaction struct {
+	active  bool
+	aborted bool // a command could not be queued, EXEC must fail
+	queued  []*internal.Request
+	watched []watchedKey
+}
+
+// watchedKey is a key along with its version at the time WATCH was called
+type watchedKey struct {
+	dbNum   int
+	key     []byte
+	version int64
+}
+
+func (tx *transaction) reset() {
+	tx.active = false
+	tx.aborted = false
+	tx.queued = nil
+	tx.unwatch()
+}
+
+// watch records the version of a key, the storage keeps the versions of the deleted keys while keys are watched
+func (tx *transaction) watch(dbNum int, key []byte) error {
+	if len(tx.watched) == 0 {
+		storage.StartWatching()
+	}
+	version, err := storage.KeyVersion(dbNum, [][]byte{key}, nil)
+	if err == nil {
+		tx.watched = append(tx.watched, watchedKey{
+			dbNum:   dbNum,
+			key:     key,
+			version: version,
+		})
+	}
+	if len(tx.watched) == 0 {
+		storage.StopWatching()
+	}
+
+	return err
+}
+
+func (tx *transaction) unwatch() {
+	if len(tx.watched) > 0 {
+		storage.StopWatching()
+	}
+	tx.watched = nil
+}
+
+// replyBuffer collects the replies of the queued commands until EXEC can send them all
+type replyBuffer struct {
+	net.Conn
+	replies bytes.Buffer
+}
+
+func (b *replyBuffer) Write(p []byte) (int, error) {
+	return b.replies.Write(p)
+}
+
+// Protocol is the one of the client, the replies are buffered as they will be sent
+func (b *replyBuffer) Protocol() int {
+	return internal.Protocol(b.Conn)
+}
+
+// handleTransaction runs the transaction commands and queues the other commands inside MULTI.
+// It returns false when the request is not part of a transaction and must be run right away.
+func (srv *server) handleTransaction(tx *transaction, request *internal.Request) (bool, error) {
+	switch request.Name {
+	case "multi":
+		if tx.active {
+			return true, errMultiNested
+		}
+		tx.active = true
+
+		return true, writeStatus(request.Conn, "OK")
+	case "exec":
+		if !tx.active {
+			return true, errExecWithoutMulti
+		}
+		defer tx.reset()
+
+		if tx.aborted {
+			return true, errExecAbort
+		}
+		// monitors see EXEC after the commands it ran
+		defer srv.feedMonitors(request.DB, request)
+
+		return true, srv.exec(tx, request)
+	case "discard":
+		if !tx.active {
+			return true, errDiscardNoMulti
+		}
+		tx.reset()
+		srv.feedMonitors(request.DB, request)
+
+		return true, writeStatus(request.Conn, "OK")
+	case "watch":
+		if tx.active {
+			return true, errWatchInsideMulti
+		}
+
+		dbNum := request.GetDBNum()
+		for _, key := range request.Args {
+			if err := tx.watch(dbNum, key); err != nil {
+				return true, err
+			}
+		}
+
+		return true, writeStatus(request.Conn, "OK")
+	case "unwatch":
+		// inside MULTI it is queued, the keys are checked by EXEC anyway
+		if !tx.active {
+			tx.unwatch()
+
+			return true, writeStatus(request.Conn, "OK")
+		}
+	}
+
+	if !tx.active {
+		return false, nil
+	}
+
+	// the replies of subscriber and monitor modes can't be part of the EXEC reply, nor can the server stop in the middle,
+	// and the commands opening their own write transaction would wait for the one of EXEC,
+	// as CONFIG SET does when it applies the pragmas
+	switch request.Name {
+	case "subscribe", "psubscribe", "unsubscribe", "punsubscribe", "monitor", "shutdown", "save", "bigdis", "replicaof", "psync", "sync", "config":
+		tx.aborted = true
+
+		return true, errNotAllowedInMulti
+	}
+
+	tx.queued = append(tx.queued, request)
+
+	return true, writeStatus(request.Conn, "QUEUED")
+}
+
+// exec runs the queued commands atomically, unless one of the watched keys changed.
+// The queued commands run in the DB the SELECTs before them moved to, the one EXEC leaves in request.DB
+func (srv *server) exec(tx *transaction, exec *internal.Request) error {
+	conn := exec.Conn
+
+	// the tables of the DBs must be created before the write connection is taken
+	db := exec.DB
+	for _, request := range tx.queued {
+		request.DB = db
+		request.GetDBNum()
+		if request.Name == "select" && internal.SelectDB(request) == nil {
+			db = request.Args
+		}
+	}
+
+	dbOp, err := storage.BeginTransaction()
+	if err != nil {
+		return err
+	}
+	defer storage.RollbackOnPanic(dbOp)
+
+	for _, watched := range tx.watched {
+		version, err := storage.KeyVersion(watched.dbNum, [][]byte{watched.key}, dbOp)
+		if err != nil {
+			storage.EndTransaction(dbOp, false)
+			return err
+		}
+
+		if version != watched.version {
+			if err := storage.EndTransaction(dbOp, false); err != nil {
+				return err
+			}
+
+			_, err := (&internal.NullReply{Array: true}).WriteTo(conn)
+			return err
+		}
+	}
+
+	buffer := &replyBuffer{Conn: conn}
+	for _, request := range tx.queued {
+		srv.feedMonitors(request.DB, request)
+		request.Conn = buffer
+		request.DBOp = dbOp
+
+		if request.Name == "unwatch" {
+			if err := writeStatus(buffer, "OK"); err != nil {
+				return err
+			}
+			continue
+		}
+
+		command := srv.methods[request.Name]
+		err := dbOp.Savepoint(func() error {
+			// the change log records the arguments as received, whatever the handler does with them
+			args := append([][]byte(nil), request.Args...)
+			if err := command.Handler(request); err != nil {
+				return err
+			}
+			request.Args = args
+			if command.Logged() {
+				return logChanges(dbOp, request)
+			}
+
+			return nil
+		})
+		if err != nil {
+			if !utils.IsReplyError(err) {
+				storage.EndTransaction(dbOp, false)
+				return err
+			}
+
+			if _, err := internal.NewErrorReply(err.Error()).WriteTo(buffer); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := storage.EndTransaction(dbOp, true); err != nil {
+		return err
+	}
+	exec.DB = db
+
+	if _, err := fmt.Fprintf(conn, "*%d\r\n", len(tx.queued)); err != nil {
+		return err
+	}
+
+	_, err = buffer.replies.WriteTo(conn)
+	return err
+}
+
+func writeStatus(conn net.Conn, code string) error {
+	_, err := internal.NewStatusReply(code).WriteTo(conn)
+
+	return err
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenUnix listens on a unix socket, perm is the octal mode of the socket file like "770"
+func listenUnix(path string, perm string) (net.Listener, error) {
+	var mode uint64
+	if perm != "" {
+		var err error
+		if mode, err = strconv.ParseUint(perm, 8, 32); err != nil || mode > 0o777 {
+			return nil, fmt.Errorf("invalid unixsocketperm %q", perm)
+		}
+	}
+
+	// the socket left by a server that didn't stop cleanly would make the listen fail
+	if info, err := os.Lstat(path); err == nil && info.Mode().Type() == fs.ModeSocket {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+
+	if perm != "" {
+		if err := os.Chmod(path, fs.FileMode(mode)); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+
+	return listener, nil
+}
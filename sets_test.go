@@ -0,0 +1,169 @@
+package main
+
+import (
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+// members returns the members of a set reply sorted, their order is undefined
+func members(t *testing.T, reply any) []string {
+	t.Helper()
+
+	values, ok := reply.([]any)
+	if !ok {
+		t.Fatalf("set reply %#v isn't an array", reply)
+	}
+	sorted := make([]string, len(values))
+	for i, value := range values {
+		sorted[i] = str(value)
+	}
+	sort.Strings(sorted)
+
+	return sorted
+}
+
+func TestSets(t *testing.T) {
+	c := startServer(t, nil).client()
+	c.ok("set", "string", "v")
+
+	checkReplies(t, c, []replyTest{
+		{[]string{"sadd", "s", "a", "b", "c", "a"}, int64(3)},
+		{[]string{"sadd", "s", "c", "d"}, int64(1)},
+		{[]string{"scard", "s"}, int64(4)},
+		{[]string{"scard", "missing"}, int64(0)},
+		{[]string{"sismember", "s", "a"}, int64(1)},
+		{[]string{"sismember", "s", "z"}, int64(0)},
+		{[]string{"sismember", "missing", "a"}, int64(0)},
+		{[]string{"smismember", "s", "a", "z", "d"}, []any{int64(1), int64(0), int64(1)}},
+		{[]string{"srem", "s", "a", "z"}, int64(1)},
+		{[]string{"srem", "missing", "a"}, int64(0)},
+		{[]string{"smembers", "missing"}, []any{}},
+		{[]string{"sadd", "string", "a"}, replyError("WRONGTYPE Operation against a key holding the wrong kind of value")},
+		{[]string{"type", "s"}, "set"},
+		// removing the last member deletes the set
+		{[]string{"sadd", "one", "a"}, int64(1)},
+		{[]string{"srem", "one", "a"}, int64(1)},
+		{[]string{"exists", "one"}, int64(0)},
+	})
+	if got := members(t, c.ok("smembers", "s")); !reflect.DeepEqual(got, []string{"b", "c", "d"}) {
+		t.Errorf("smembers s = %q", got)
+	}
+
+	checkReplies(t, c, []replyTest{
+		{[]string{"smove", "s", "dst", "b"}, int64(1)},
+		{[]string{"smove", "s", "dst", "nothere"}, int64(0)},
+		{[]string{"smove", "missing", "dst", "a"}, int64(0)},
+		{[]string{"smove", "s", "string", "c"}, replyError("WRONGTYPE Operation against a key holding the wrong kind of value")},
+		{[]string{"sismember", "dst", "b"}, int64(1)},
+		{[]string{"scard", "s"}, int64(2)},
+	})
+}
+
+func TestSetRandomMembers(t *testing.T) {
+	c := startServer(t, nil).client()
+	var all []string
+	args := []string{"sadd", "s"}
+	for i := 0; i < 10; i++ {
+		args = append(args, strconv.Itoa(i))
+		all = append(all, strconv.Itoa(i))
+	}
+	c.ok(args...)
+	sort.Strings(all)
+
+	checkReplies(t, c, []replyTest{
+		{[]string{"srandmember", "missing"}, nil},
+		{[]string{"srandmember", "missing", "3"}, []any{}},
+		{[]string{"spop", "missing"}, nil},
+		{[]string{"spop", "missing", "3"}, []any{}},
+		{[]string{"srandmember", "s", "0"}, []any{}},
+	})
+
+	// a positive count picks distinct members, up to the whole set
+	if got := members(t, c.ok("srandmember", "s", "20")); !reflect.DeepEqual(got, all) {
+		t.Errorf("srandmember s 20 = %q", got)
+	}
+	if got := members(t, c.ok("srandmember", "s", "5")); len(got) != 5 || len(slices.Compact(got)) != 5 {
+		t.Errorf("srandmember s 5 = %q", got)
+	}
+	// a negative one may repeat them
+	if got := c.ok("srandmember", "s", "-30").([]any); len(got) != 30 {
+		t.Errorf("srandmember s -30 = %d members", len(got))
+	}
+	if got := str(c.ok("srandmember", "s")); c.ok("sismember", "s", got) != int64(1) {
+		t.Errorf("srandmember s = %q", got)
+	}
+
+	popped := []string{str(c.ok("spop", "s"))}
+	popped = append(popped, members(t, c.ok("spop", "s", "4"))...)
+	if c.ok("scard", "s") != int64(5) {
+		t.Errorf("scard after 5 pops = %v", c.ok("scard", "s"))
+	}
+	popped = append(popped, members(t, c.ok("spop", "s", "10"))...)
+	sort.Strings(popped)
+	if !reflect.DeepEqual(popped, all) {
+		t.Errorf("popped %q, expected every member once", popped)
+	}
+	if c.ok("exists", "s") != int64(0) {
+		t.Error("the set is kept once empty")
+	}
+}
+
+func TestSetAlgebra(t *testing.T) {
+	c := startServer(t, nil).client()
+	c.ok("sadd", "s1", "a", "b", "c", "d")
+	c.ok("sadd", "s2", "c", "d", "e")
+	c.ok("sadd", "s3", "a", "c", "e", "f")
+	c.ok("set", "string", "v")
+
+	tests := []struct {
+		args     []string
+		expected []string
+	}{
+		{[]string{"sinter", "s1", "s2"}, []string{"c", "d"}},
+		{[]string{"sinter", "s1", "s2", "s3"}, []string{"c"}},
+		{[]string{"sinter", "s1", "missing"}, []string{}},
+		{[]string{"sunion", "s1", "s2"}, []string{"a", "b", "c", "d", "e"}},
+		{[]string{"sunion", "s2", "missing"}, []string{"c", "d", "e"}},
+		{[]string{"sdiff", "s1", "s2"}, []string{"a", "b"}},
+		{[]string{"sdiff", "s1", "s2", "s3"}, []string{"b"}},
+		{[]string{"sdiff", "missing", "s1"}, []string{}},
+		{[]string{"sdiff", "s1", "missing"}, []string{"a", "b", "c", "d"}},
+	}
+	for _, test := range tests {
+		if got := members(t, c.ok(test.args...)); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%q = %q, expected %q", test.args, got, test.expected)
+		}
+	}
+
+	checkReplies(t, c, []replyTest{
+		{[]string{"sinter", "s1", "string"}, replyError("WRONGTYPE Operation against a key holding the wrong kind of value")},
+		{[]string{"sinterstore", "dst", "s1", "s2"}, int64(2)},
+		{[]string{"sunionstore", "union", "s1", "s2", "s3"}, int64(6)},
+		{[]string{"sdiffstore", "diff", "s1", "s2"}, int64(2)},
+		// the destination is replaced, whatever its type
+		{[]string{"sinterstore", "string", "s1", "s3"}, int64(2)},
+		{[]string{"type", "string"}, "set"},
+		// an empty result deletes it
+		{[]string{"sinterstore", "dst", "s1", "missing"}, int64(0)},
+		{[]string{"exists", "dst"}, int64(0)},
+		// the destination can be one of the sources
+		{[]string{"sdiffstore", "s1", "s1", "s2"}, int64(2)},
+
+		{[]string{"sintercard", "2", "union", "s3"}, int64(4)},
+		{[]string{"sintercard", "2", "union", "s3", "limit", "2"}, int64(2)},
+		{[]string{"sintercard", "2", "union", "s3", "limit", "0"}, int64(4)},
+		{[]string{"sintercard", "2", "union", "missing"}, int64(0)},
+		{[]string{"sintercard", "0", "union"}, replyError("ERR numkeys should be greater than 0")},
+		{[]string{"sintercard", "3", "union", "s3"}, replyError("ERR Number of keys can't be greater than number of args")},
+		{[]string{"sintercard", "1", "union", "limit", "-1"}, replyError("ERR LIMIT can't be negative")},
+	})
+	if got := members(t, c.ok("smembers", "s1")); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("smembers s1 = %q", got)
+	}
+	if got := members(t, c.ok("smembers", "union")); !reflect.DeepEqual(got, []string{"a", "b", "c", "d", "e", "f"}) {
+		t.Errorf("smembers union = %q", got)
+	}
+}
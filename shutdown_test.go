@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"net"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// TestShutdownStuckCommand checks that SIGTERM stops the server even when a command keeps the write connection:
+// another process holds the write lock of the database, so a SET waits on the busy timeout of SQLite
+func TestShutdownStuckCommand(t *testing.T) {
+	srv := startServer(t, map[string]map[string]any{"server": {"shutdown_timeout": 1}})
+	srv.client().ok("set", "k", "v")
+
+	db, err := sql.Open("sqlite3", filepath.Join(srv.dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	lock, err := db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Close()
+	if _, err := lock.ExecContext(context.Background(), "BEGIN IMMEDIATE"); err != nil {
+		t.Fatal(err)
+	}
+	defer lock.ExecContext(context.Background(), "ROLLBACK")
+
+	conn, err := net.Dial("tcp", srv.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "*3\r\n$3\r\nset\r\n$1\r\nk\r\n$1\r\nw\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	start := time.Now()
+	srv.cmd.Process.Signal(syscall.SIGTERM)
+	exited := make(chan error, 1)
+	go func() {
+		exited <- srv.cmd.Wait()
+	}()
+
+	// one second for the commands, one for the checkpoint and the close, far from the 20s of the busy timeout
+	select {
+	case <-exited:
+		t.Logf("exited after %s", time.Since(start))
+	case <-time.After(10 * time.Second):
+		srv.cmd.Process.Kill()
+		<-exited
+		t.Fatalf("server still running 10s after SIGTERM\n%s", srv.output())
+	}
+}
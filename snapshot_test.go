@@ -0,0 +1,77 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// TestSaveUnderWrites checks that a snapshot completes while another client keeps writing
+func TestSaveUnderWrites(t *testing.T) {
+	srv := startServer(t, nil)
+	c := srv.client()
+
+	value := strings.Repeat("v", 1000)
+	for i := 0; i < 5000; i++ {
+		c.ok("set", "key"+strconv.Itoa(i), value)
+	}
+
+	stop := make(chan struct{})
+	var writer sync.WaitGroup
+	writer.Add(1)
+	go func() {
+		defer writer.Done()
+		w := srv.client()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+				w.do("set", "key"+strconv.Itoa(i%5000), value)
+			}
+		}
+	}()
+
+	start := time.Now()
+	reply := c.do("save")
+	close(stop)
+	writer.Wait()
+	if str(reply) != "OK" {
+		t.Fatalf("save = %q\n%s", reply, srv.output())
+	}
+	t.Logf("saved in %s", time.Since(start))
+
+	db, err := sql.Open("sqlite3", filepath.Join(srv.dir, "dump.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var keys int
+	if err := db.QueryRow("SELECT count(*) FROM bigdis_0").Scan(&keys); err != nil {
+		t.Fatal(err)
+	}
+	if keys != 5000 {
+		t.Errorf("%d keys in the snapshot, expected 5000", keys)
+	}
+}
+
+// TestSaveFailureLogged checks that a failed snapshot is reported in the log, which the error reply points to
+func TestSaveFailureLogged(t *testing.T) {
+	srv := startServer(t, nil)
+	c := srv.client()
+	c.ok("set", "k", "v")
+	c.ok("config", "set", "dump_path", filepath.Join(srv.dir, "missing", "dump.db"))
+
+	if reply, ok := c.do("save").(replyError); !ok {
+		t.Fatalf("save into a missing directory = %q, expected an error", reply)
+	}
+	if !strings.Contains(srv.output(), "Error while writing the snapshot") {
+		t.Errorf("snapshot failure not logged:\n%s", srv.output())
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSortedSets(t *testing.T) {
+	c := startServer(t, nil).client()
+	c.ok("set", "string", "v")
+
+	checkReplies(t, c, []replyTest{
+		{[]string{"zadd", "z", "1", "a", "2", "b", "3", "c"}, int64(3)},
+		{[]string{"zadd", "z", "2.5", "b", "4", "d"}, int64(1)},
+		{[]string{"zcard", "z"}, int64(4)},
+		{[]string{"zscore", "z", "b"}, []byte("2.5")},
+		{[]string{"zscore", "z", "nothere"}, nil},
+		{[]string{"zscore", "missing", "a"}, nil},
+
+		// NX adds only, XX updates only, CH counts the changes
+		{[]string{"zadd", "z", "nx", "10", "a", "5", "e"}, int64(1)},
+		{[]string{"zadd", "z", "xx", "10", "a", "6", "f"}, int64(0)},
+		{[]string{"zadd", "z", "xx", "ch", "1", "a", "2.5", "b"}, int64(1)},
+		{[]string{"zscore", "z", "f"}, nil},
+		// GT and LT only move the scores in one direction
+		{[]string{"zadd", "z", "gt", "ch", "0", "a", "3", "b"}, int64(1)},
+		{[]string{"zadd", "z", "lt", "ch", "2", "a", "4", "b"}, int64(0)},
+		{[]string{"zrange", "z", "0", "-1", "withscores"}, bulks("a", "1", "b", "3", "c", "3", "d", "4", "e", "5")},
+		// INCR replies with the new score, null when the member isn't updated
+		{[]string{"zadd", "z", "incr", "2", "a"}, []byte("3")},
+		{[]string{"zadd", "z", "nx", "incr", "1", "a"}, nil},
+		{[]string{"zincrby", "z", "-0.5", "a"}, []byte("2.5")},
+		{[]string{"zincrby", "new", "2", "a"}, []byte("2")},
+
+		{[]string{"zadd", "z", "nx", "xx", "1", "a"}, replyError("ERR XX and NX options at the same time are not compatible")},
+		{[]string{"zadd", "z", "nx", "gt", "1", "a"}, replyError("ERR GT, LT, and/or NX options at the same time are not compatible")},
+		{[]string{"zadd", "z", "incr", "1", "a", "2", "b"}, replyError("ERR INCR option supports a single increment-element pair")},
+		{[]string{"zadd", "z", "one", "a"}, replyError("ERR value is not a valid float")},
+		{[]string{"zadd", "z", "1", "a", "2"}, replyError("ERR syntax error")},
+		{[]string{"zadd", "z", "nan", "a"}, replyError("ERR value is not a valid float")},
+		{[]string{"zincrby", "z", "+inf", "a"}, []byte("inf")},
+		{[]string{"zincrby", "z", "-inf", "a"}, replyError("ERR resulting score is not a number (NaN)")},
+		{[]string{"zadd", "string", "1", "a"}, replyError("WRONGTYPE Operation against a key holding the wrong kind of value")},
+		{[]string{"type", "z"}, "zset"},
+
+		{[]string{"zrem", "z", "a", "nothere"}, int64(1)},
+		{[]string{"zrem", "missing", "a"}, int64(0)},
+		{[]string{"zrank", "z", "b"}, int64(0)},
+		{[]string{"zrank", "z", "e"}, int64(3)},
+		{[]string{"zrevrank", "z", "e"}, int64(0)},
+		{[]string{"zrank", "z", "nothere"}, nil},
+		{[]string{"zrank", "z", "d", "withscore"}, []any{int64(2), []byte("4")}},
+		{[]string{"zcount", "z", "3", "4"}, int64(3)},
+		{[]string{"zcount", "z", "(3", "+inf"}, int64(2)},
+		{[]string{"zcount", "z", "-inf", "(3"}, int64(0)},
+		{[]string{"zcount", "z", "x", "4"}, replyError("ERR min or max is not a float")},
+	})
+}
+
+func TestSortedSetRanges(t *testing.T) {
+	c := startServer(t, nil).client()
+	c.ok("zadd", "z", "1", "a", "2", "b", "3", "c", "4", "d", "5", "e")
+	c.ok("zadd", "lex", "0", "a", "0", "b", "0", "c", "0", "d", "0", "e")
+
+	checkReplies(t, c, []replyTest{
+		{[]string{"zrange", "z", "0", "-1"}, bulks("a", "b", "c", "d", "e")},
+		{[]string{"zrange", "z", "-2", "-1"}, bulks("d", "e")},
+		{[]string{"zrange", "z", "0", "1", "rev"}, bulks("e", "d")},
+		{[]string{"zrange", "z", "3", "1"}, []any{}},
+		{[]string{"zrange", "missing", "0", "-1"}, []any{}},
+		{[]string{"zrevrange", "z", "0", "1", "withscores"}, bulks("e", "5", "d", "4")},
+
+		{[]string{"zrange", "z", "2", "4", "byscore"}, bulks("b", "c", "d")},
+		{[]string{"zrange", "z", "(2", "(4", "byscore"}, bulks("c")},
+		{[]string{"zrange", "z", "-inf", "+inf", "byscore", "limit", "1", "2"}, bulks("b", "c")},
+		{[]string{"zrange", "z", "4", "2", "byscore", "rev"}, bulks("d", "c", "b")},
+		{[]string{"zrange", "z", "+inf", "-inf", "byscore", "rev", "limit", "0", "1", "withscores"}, bulks("e", "5")},
+		{[]string{"zrangebyscore", "z", "4", "+inf", "withscores"}, bulks("d", "4", "e", "5")},
+		{[]string{"zrangebyscore", "z", "-inf", "+inf", "limit", "3", "-1"}, bulks("d", "e")},
+		{[]string{"zrevrangebyscore", "z", "+inf", "4"}, bulks("e", "d")},
+		{[]string{"zrange", "z", "0", "1", "limit", "0", "1"}, replyError("ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")},
+		{[]string{"zrange", "z", "x", "1", "byscore"}, replyError("ERR min or max is not a float")},
+
+		{[]string{"zrange", "lex", "[b", "(d", "bylex"}, bulks("b", "c")},
+		{[]string{"zrange", "lex", "-", "+", "bylex", "limit", "3", "10"}, bulks("d", "e")},
+		{[]string{"zrange", "lex", "+", "(c", "bylex", "rev"}, bulks("e", "d")},
+		{[]string{"zrange", "lex", "b", "d", "bylex"}, replyError("ERR min or max not valid string range item")},
+		{[]string{"zrange", "lex", "-", "+", "bylex", "withscores"}, replyError("ERR syntax error, WITHSCORES not supported in combination with BYLEX")},
+		{[]string{"zlexcount", "lex", "(a", "[c"}, int64(2)},
+		{[]string{"zlexcount", "lex", "-", "+"}, int64(5)},
+	})
+}
+
+func TestSortedSetPops(t *testing.T) {
+	c := startServer(t, nil).client()
+	c.ok("zadd", "z", "1", "a", "2", "b", "3", "c", "4", "d")
+
+	checkReplies(t, c, []replyTest{
+		{[]string{"zpopmin", "z"}, bulks("a", "1")},
+		{[]string{"zpopmax", "z"}, bulks("d", "4")},
+		{[]string{"zpopmin", "z", "0"}, []any{}},
+		{[]string{"zpopmax", "missing"}, []any{}},
+		{[]string{"zpopmin", "z", "-1"}, replyError("ERR value is out of range, must be positive")},
+		{[]string{"zpopmin", "z", "10"}, bulks("b", "2", "c", "3")},
+		{[]string{"exists", "z"}, int64(0)},
+	})
+}
+
+func TestSortedSetStores(t *testing.T) {
+	c := startServer(t, nil).client()
+	c.ok("zadd", "z1", "1", "a", "2", "b", "3", "c")
+	c.ok("zadd", "z2", "10", "b", "20", "c", "30", "d")
+	c.ok("sadd", "s", "a", "d")
+
+	checkReplies(t, c, []replyTest{
+		{[]string{"zunionstore", "u", "2", "z1", "z2"}, int64(4)},
+		{[]string{"zrange", "u", "0", "-1", "withscores"}, bulks("a", "1", "b", "12", "c", "23", "d", "30")},
+		{[]string{"zinterstore", "i", "2", "z1", "z2"}, int64(2)},
+		{[]string{"zrange", "i", "0", "-1", "withscores"}, bulks("b", "12", "c", "23")},
+		{[]string{"zunionstore", "u", "2", "z1", "z2", "weights", "2", "0.5"}, int64(4)},
+		{[]string{"zrange", "u", "0", "-1", "withscores"}, bulks("a", "2", "b", "9", "d", "15", "c", "16")},
+		{[]string{"zinterstore", "i", "2", "z1", "z2", "aggregate", "max"}, int64(2)},
+		{[]string{"zrange", "i", "0", "-1", "withscores"}, bulks("b", "10", "c", "20")},
+		{[]string{"zunionstore", "u", "2", "z1", "z2", "aggregate", "min"}, int64(4)},
+		{[]string{"zrange", "u", "0", "-1", "withscores"}, bulks("a", "1", "b", "2", "c", "3", "d", "30")},
+		// the members of a set have the score 1
+		{[]string{"zunionstore", "u", "2", "z1", "s"}, int64(4)},
+		{[]string{"zrange", "u", "0", "-1", "withscores"}, bulks("d", "1", "a", "2", "b", "2", "c", "3")},
+		// an empty result deletes the destination
+		{[]string{"zinterstore", "i", "2", "z1", "missing"}, int64(0)},
+		{[]string{"exists", "i"}, int64(0)},
+		{[]string{"zunionstore", "u", "0", "z1"}, replyError("ERR at least 1 input key is needed for this command")},
+		{[]string{"zunionstore", "u", "2", "z1", "z2", "weights", "1", "x"}, replyError("ERR weight value is not a float")},
+		{[]string{"zunionstore", "u", "2", "z1", "z2", "aggregate", "avg"}, replyError("ERR syntax error")},
+	})
+}
@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"bigdis/cdc"
+	"bigdis/config"
+)
+
+/*
+The change data capture feed records an event for every key set, deleted or expired and every DB flushed,
+in the transaction that makes the change. The strings are recorded by the functions writing them,
+the aggregates where their elements are written: touchKey, deleteKeyIfEmpty and createKeyID. A dispatcher sends the events in order to the sink of the config,
+a batch at a time: once the sink acknowledged a batch, the cursor in cdc_cursor moves past it
+and its events are deleted. A crash in between sends the batch again, the consumers
+recognize the events they already have by their id.
+*/
+
+// cdcRetryInterval is how long the dispatcher waits after a failed delivery, and between checks when idle
+const cdcRetryInterval = time.Second
+
+// the event ops
+const (
+	eventSet     = "set"
+	eventDel     = "del"
+	eventExpired = "expired"
+	eventExpire  = "expire"  // a time to live was set
+	eventPersist = "persist" // the time to live was removed
+	eventFlushDB = "flushdb"
+)
+
+// cdcEnabled is set at startup when the config has a sink, the events are only recorded then
+var cdcEnabled bool
+
+var (
+	// cdcRecorded wakes the dispatcher up when a transaction recording events commits
+	cdcRecorded = make(chan struct{}, 1)
+	stopCDC     = make(chan struct{})
+	cdcDone     = make(chan struct{})
+)
+
+// initCDC starts the dispatcher when a sink is configured
+func initCDC() {
+	if config.Config.CDC.Sink == "" {
+		return
+	}
+
+	sink, err := cdc.Open(config.Config.CDC.Sink)
+	if err != nil {
+		panic(err)
+	}
+	cdcEnabled = true
+
+	go dispatchEvents(sink)
+}
+
+// stopDispatcher stops the dispatcher, the events it didn't send yet are sent after the next start
+func stopDispatcher() {
+	if !cdcEnabled {
+		return
+	}
+
+	close(stopCDC)
+	<-cdcDone
+}
+
+func notifyEvents() {
+	select {
+	case cdcRecorded <- struct{}{}:
+	default:
+	}
+}
+
+// recordEvent records a change of a key. old and new are the previous and the new value of a string,
+// nil when there is none. keyType is the type letter of the key, key is nil when a DB is flushed
+func (dbOp *dbOperation) recordEvent(dbNum int, key []byte, op string, keyType string, old, new []byte) error {
+	if !cdcEnabled {
+		return nil
+	}
+
+	var oldHash, newHash sql.NullString
+	if old != nil {
+		oldHash = sql.NullString{String: cdc.Hash(old), Valid: true}
+	}
+	if new != nil {
+		newHash = sql.NullString{String: cdc.Hash(new), Valid: true}
+	}
+
+	if _, err := dbOp.Txn.Exec("INSERT INTO cdc_event (db, key, op, type, old_hash, new_hash, ts) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		dbNum, key, op, sql.NullString{String: keyType, Valid: keyType != ""}, oldHash, newHash, time.Now().UnixMilli()); err != nil {
+		return err
+	}
+	dbOp.events = true
+
+	return nil
+}
+
+// previousValue reads the value of a live string before it changes, for the events.
+// It is nil when the key doesn't exist or isn't a string, and when no event is recorded
+func (dbOp *dbOperation) previousValue(dbNum int, key []byte) ([]byte, error) {
+	if !cdcEnabled {
+		return nil, nil
+	}
+
+	var value []byte
+	var keyType string
+	if err := dbOp.Txn.QueryRow(fmt.Sprintf("SELECT value, type FROM bigdis_%d WHERE key = ? and %s", dbNum, liveKey), key).Scan(&value, &keyType); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+	if keyType != "s" {
+		return nil, nil
+	}
+	if value == nil {
+		value = []byte{}
+	}
+
+	return value, nil
+}
+
+// dispatchEvents sends the recorded events to the sink until stopDispatcher is called
+func dispatchEvents(sink cdc.Sink) {
+	defer close(cdcDone)
+	defer sink.Close()
+
+	failing := false
+	for {
+		config.Lock.RLock()
+		batchSize := config.Config.CDC.BatchSize
+		config.Lock.RUnlock()
+
+		batch, lastID, err := pendingEvents(batchSize)
+		if err == nil && lastID > 0 {
+			if err = sink.Send(batch, lastID); err == nil {
+				err = acknowledgeEvents(lastID)
+			}
+		}
+
+		if err != nil {
+			if !failing {
+				log.Printf("Error while sending the change events, retrying: %s\n", err)
+				failing = true
+			}
+
+			select {
+			case <-time.After(cdcRetryInterval):
+			case <-stopCDC:
+				return
+			}
+			continue
+		}
+		if failing {
+			log.Printf("Sending the change events again\n")
+			failing = false
+		}
+
+		// more events may follow the ones just sent
+		if lastID > 0 {
+			select {
+			case <-stopCDC:
+				return
+			default:
+				continue
+			}
+		}
+
+		select {
+		case <-cdcRecorded:
+		case <-time.After(cdcRetryInterval):
+		case <-stopCDC:
+			return
+		}
+	}
+}
+
+// pendingEvents returns up to count events following the cursor, as lines of JSON, and the id of the last one
+func pendingEvents(count int) ([]byte, int64, error) {
+	rows, err := DBrp.Query(`
+		SELECT cdc_event.id, db, key, op, coalesce(redis_type.description, ''), coalesce(old_hash, ''), coalesce(new_hash, ''), ts
+		FROM cdc_event LEFT JOIN redis_type ON redis_type.type = cdc_event.type
+		WHERE cdc_event.id > (SELECT event_id FROM cdc_cursor)
+		ORDER BY cdc_event.id LIMIT ?`, count)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var batch []byte
+	var lastID int64
+	for rows.Next() {
+		event := &cdc.Event{}
+		var key []byte
+		if err := rows.Scan(&event.ID, &event.DB, &key, &event.Op, &event.Type, &event.OldHash, &event.NewHash, &event.Time); err != nil {
+			return nil, 0, err
+		}
+		if key != nil {
+			event.SetKey(key)
+		}
+
+		if batch, err = event.AppendJSON(batch); err != nil {
+			return nil, 0, err
+		}
+		lastID = event.ID
+	}
+
+	return batch, lastID, rows.Err()
+}
+
+// acknowledgeEvents moves the cursor past the events the sink received and deletes them
+func acknowledgeEvents(lastID int64) error {
+	dbOp, err := startDBOperation(nil, true)
+	if err != nil {
+		return err
+	}
+	defer dbOp.Txn.Rollback()
+
+	if _, err := dbOp.Txn.Exec("UPDATE cdc_cursor SET event_id = ?", lastID); err != nil {
+		return err
+	}
+	if _, err := dbOp.Txn.Exec("DELETE FROM cdc_event WHERE id <= ?", lastID); err != nil {
+		return err
+	}
+
+	return dbOp.endDBOperation()
+}
@@ -0,0 +1,248 @@
+package storage
+
+import (
+	"bigdis/config"
+	"bigdis/utils"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Expirations live in the exp column of the bigdis_N table, so they apply to keys
+of any type: the elements of aggregate types are removed along with their key
+when the garbage collector deletes it.
+*/
+
+var (
+	errExpireNXAndXXGTLT = errors.New("ERR NX and XX, GT or LT options at the same time are not compatible")
+	errExpireGTAndLT     = errors.New("ERR GT and LT options at the same time are not compatible")
+)
+
+// maxExpireTime is the latest expiration the exp column holds, its datetimes have a year of 4 digits
+var maxExpireTime = time.Date(9999, time.December, 31, 23, 59, 59, int(999*time.Millisecond), time.UTC)
+
+func errInvalidExpireTime(cmd string) error {
+	return fmt.Errorf("ERR invalid expire time in '%s' command", cmd)
+}
+
+// expireTime converts a number of seconds or milliseconds, relative to now or since
+// the unix epoch, to a UTC time. It fails if the conversion overflows or if the time
+// is after maxExpireTime.
+func expireTime(value int64, unit time.Duration, absolute bool) (time.Time, bool) {
+	msPerUnit := int64(unit / time.Millisecond)
+	if value > math.MaxInt64/msPerUnit || value < math.MinInt64/msPerUnit {
+		return time.Time{}, false
+	}
+
+	ms := value * msPerUnit
+	if !absolute {
+		now := time.Now().UnixMilli()
+		if ms > math.MaxInt64-now {
+			return time.Time{}, false
+		}
+		ms += now
+	}
+
+	if ms > maxExpireTime.UnixMilli() {
+		return time.Time{}, false
+	}
+
+	return time.UnixMilli(ms).UTC(), true
+}
+
+// keyExpiration returns the id and the expiration of a live key of any type.
+// It returns 0 if the key doesn't exist or is expired.
+func keyExpiration(dbOp *dbOperation, dbNum int, key []byte) (int64, sql.NullTime, error) {
+	var id int64
+	var exp sql.NullTime
+	if err := dbOp.Txn.QueryRow(fmt.Sprintf("SELECT id, exp FROM bigdis_%d WHERE key = ?", dbNum), key).Scan(&id, &exp); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, exp, nil
+		}
+
+		return 0, exp, err
+	}
+
+	if exp.Valid && exp.Time.Before(time.Now()) {
+		dbOp.notifyLazilyExpired(dbNum, key, exp.Time)
+		return 0, sql.NullTime{}, nil
+	}
+
+	return id, exp, nil
+}
+
+func expire(dbNum int, args [][]byte, cmd string, unit time.Duration, absolute bool, dbOp *dbOperation) (int, error) {
+	var err error
+	dbOp, err = startDBOperation(dbOp, true)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	value, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return 0, utils.ErrNotInteger
+	}
+
+	var nx, xx, gt, lt bool
+	for _, arg := range args[2:] {
+		switch strings.ToLower(string(arg)) {
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		case "gt":
+			gt = true
+		case "lt":
+			lt = true
+		default:
+			return 0, fmt.Errorf("ERR Unsupported option %s", arg)
+		}
+	}
+
+	if nx && (xx || gt || lt) {
+		return 0, errExpireNXAndXXGTLT
+	}
+	if gt && lt {
+		return 0, errExpireGTAndLT
+	}
+
+	expTime, ok := expireTime(value, unit, absolute)
+	if !ok {
+		return 0, errInvalidExpireTime(cmd)
+	}
+
+	id, exp, err := keyExpiration(dbOp, dbNum, args[0])
+	if err != nil || id == 0 {
+		return 0, err
+	}
+
+	// a key without expiration has an infinite ttl for GT and LT
+	switch {
+	case nx && exp.Valid,
+		xx && !exp.Valid,
+		gt && (!exp.Valid || !expTime.After(exp.Time)),
+		lt && exp.Valid && !expTime.Before(exp.Time):
+		return 0, nil
+	}
+
+	// an expiration in the past deletes the key right away
+	if !expTime.After(time.Now()) {
+		if _, err := deleteKey(dbOp, dbNum, args[0]); err != nil {
+			return 0, err
+		}
+
+		return 1, nil
+	}
+
+	var keyType string
+	if err := dbOp.Txn.QueryRow(fmt.Sprintf("UPDATE bigdis_%d SET exp = ?, updated = current_timestamp WHERE id = ? RETURNING type", dbNum), expTime, id).Scan(&keyType); err != nil {
+		return 0, err
+	}
+	dbOp.notify(config.NotifyGeneric, "expire", dbNum, args[0])
+
+	return 1, dbOp.recordEvent(dbNum, args[0], eventExpire, keyType, nil, nil)
+}
+
+func Expire(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	return expire(dbNum, args, "expire", time.Second, false, dbOp)
+}
+
+func PExpire(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	return expire(dbNum, args, "pexpire", time.Millisecond, false, dbOp)
+}
+
+func ExpireAt(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	return expire(dbNum, args, "expireat", time.Second, true, dbOp)
+}
+
+func PExpireAt(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	return expire(dbNum, args, "pexpireat", time.Millisecond, true, dbOp)
+}
+
+// ttl replies -2 if the key doesn't exist and -1 if it has no expiration
+func ttl(dbNum int, args [][]byte, unit time.Duration, absolute bool, dbOp *dbOperation) (int, error) {
+	var err error
+	dbOp, err = startDBOperation(dbOp, false)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	id, exp, err := keyExpiration(dbOp, dbNum, args[0])
+	if err != nil {
+		return 0, err
+	}
+
+	switch {
+	case id == 0:
+		return -2, nil
+	case !exp.Valid:
+		return -1, nil
+	}
+
+	msPerUnit := int64(unit / time.Millisecond)
+	if absolute {
+		return int(exp.Time.UnixMilli() / msPerUnit), nil
+	}
+
+	// the remaining time is rounded to the nearest unit, in milliseconds since a
+	// time.Duration can't hold more than 292 years
+	remaining := exp.Time.UnixMilli() - time.Now().UnixMilli()
+	return int((remaining + msPerUnit/2) / msPerUnit), nil
+}
+
+func TTL(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	return ttl(dbNum, args, time.Second, false, dbOp)
+}
+
+func PTTL(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	return ttl(dbNum, args, time.Millisecond, false, dbOp)
+}
+
+func ExpireTime(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	return ttl(dbNum, args, time.Second, true, dbOp)
+}
+
+func PExpireTime(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	return ttl(dbNum, args, time.Millisecond, true, dbOp)
+}
+
+func Persist(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	var err error
+	dbOp, err = startDBOperation(dbOp, true)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	id, exp, err := keyExpiration(dbOp, dbNum, args[0])
+	if err != nil || id == 0 || !exp.Valid {
+		return 0, err
+	}
+
+	var keyType string
+	if err := dbOp.Txn.QueryRow(fmt.Sprintf("UPDATE bigdis_%d SET exp = NULL, updated = current_timestamp WHERE id = ? RETURNING type", dbNum), id).Scan(&keyType); err != nil {
+		return 0, err
+	}
+	dbOp.notify(config.NotifyGeneric, "persist", dbNum, args[0])
+
+	return 1, dbOp.recordEvent(dbNum, args[0], eventPersist, keyType, nil, nil)
+}
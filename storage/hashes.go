@@ -1 +1,583 @@
 package storage
+
+import (
+	"bigdis/config"
+	"bigdis/utils"
+	"database/sql"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+/*
+Hashes are stored one row per field in the bigdis_N_hash table,
+so a single field of a huge hash can be read or written without
+loading the whole hash in memory.
+*/
+
+const hashType = "h"
+
+func HSet(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	return hset(dbNum, args, "hset", dbOp)
+}
+
+// hset runs HSET on behalf of the hash commands, event is the keyspace event of the command
+func hset(dbNum int, args [][]byte, event string, dbOp *dbOperation) (int, error) {
+	var err error
+	dbOp, err = startDBOperation(dbOp, true)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	id, err := createKeyID(dbOp, dbNum, args[0], hashType)
+	if err != nil {
+		return 0, err
+	}
+
+	var added int
+	for i := 1; i < len(args); i += 2 {
+		var exists bool
+		if err := dbOp.Txn.QueryRow(fmt.Sprintf("SELECT EXISTS(SELECT 1 FROM bigdis_%d_hash WHERE key_id = ? and field = ?)", dbNum), id, args[i]).Scan(&exists); err != nil {
+			return 0, err
+		}
+
+		if _, err := dbOp.Txn.Exec(fmt.Sprintf(`
+			INSERT INTO bigdis_%d_hash (key_id, field, value) VALUES (?, ?, ?)
+			ON CONFLICT(key_id, field) DO UPDATE SET
+				value = excluded.value`, dbNum), id, args[i], args[i+1]); err != nil {
+			return 0, err
+		}
+
+		if !exists {
+			added++
+		}
+	}
+
+	if err := touchKey(dbOp, dbNum, id); err != nil {
+		return 0, err
+	}
+	dbOp.notify(config.NotifyHash, event, dbNum, args[0])
+
+	return added, nil
+}
+
+func HSetNX(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	dbOp, err := startDBOperation(dbOp, true)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	id, err := createKeyID(dbOp, dbNum, args[0], hashType)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := dbOp.Txn.Exec(fmt.Sprintf(`
+		INSERT INTO bigdis_%d_hash (key_id, field, value) VALUES (?, ?, ?)
+		ON CONFLICT(key_id, field) DO NOTHING`, dbNum), id, args[1], args[2])
+	if err != nil {
+		return 0, err
+	}
+
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	if inserted > 0 {
+		if err := touchKey(dbOp, dbNum, id); err != nil {
+			return 0, err
+		}
+		dbOp.notify(config.NotifyHash, "hset", dbNum, args[0])
+	}
+
+	return int(inserted), nil
+}
+
+func HGet(dbNum int, args [][]byte, dbOp *dbOperation) ([]byte, error) {
+	var err error
+	dbOp, err = startDBOperation(dbOp, false)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	id, err := getKeyID(dbOp, dbNum, args[0], hashType)
+	if err != nil || id == 0 {
+		return nil, err
+	}
+
+	var value []byte
+	if err := dbOp.Txn.QueryRow(fmt.Sprintf("SELECT value FROM bigdis_%d_hash WHERE key_id = ? and field = ?", dbNum), id, args[1]).Scan(&value); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return value, nil
+}
+
+func HMGet(dbNum int, args [][]byte, dbOp *dbOperation) ([]any, error) {
+	dbOp, err := startDBOperation(dbOp, false)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	values := make([]any, len(args)-1)
+
+	id, err := getKeyID(dbOp, dbNum, args[0], hashType)
+	if err != nil || id == 0 {
+		return values, err
+	}
+
+	for i, field := range args[1:] {
+		var value []byte
+		if err := dbOp.Txn.QueryRow(fmt.Sprintf("SELECT value FROM bigdis_%d_hash WHERE key_id = ? and field = ?", dbNum), id, field).Scan(&value); err != nil {
+			if err == sql.ErrNoRows {
+				continue
+			}
+
+			return nil, err
+		}
+
+		values[i] = value
+	}
+
+	return values, nil
+}
+
+func HDel(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	var err error
+	dbOp, err = startDBOperation(dbOp, true)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	id, err := getKeyID(dbOp, dbNum, args[0], hashType)
+	if err != nil || id == 0 {
+		return 0, err
+	}
+
+	var deleted int
+	for _, field := range args[1:] {
+		result, err := dbOp.Txn.Exec(fmt.Sprintf("DELETE FROM bigdis_%d_hash WHERE key_id = ? and field = ?", dbNum), id, field)
+		if err != nil {
+			return 0, err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+
+		deleted += int(rowsAffected)
+	}
+
+	if deleted > 0 {
+		dbOp.notify(config.NotifyHash, "hdel", dbNum, args[0])
+		if err := deleteKeyIfEmpty(dbOp, dbNum, id, fmt.Sprintf("bigdis_%d_hash", dbNum)); err != nil {
+			return 0, err
+		}
+	}
+
+	return deleted, nil
+}
+
+// hashColumns returns the requested columns of every field of a hash
+func hashColumns(dbNum int, key []byte, columns string, dbOp *dbOperation) ([]any, error) {
+	dbOp, err := startDBOperation(dbOp, false)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	values := []any{}
+
+	id, err := getKeyID(dbOp, dbNum, key, hashType)
+	if err != nil || id == 0 {
+		return values, err
+	}
+
+	rows, err := dbOp.Txn.Query(fmt.Sprintf("SELECT %s FROM bigdis_%d_hash WHERE key_id = ? ORDER BY id", columns, dbNum), id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	withValues := strings.Contains(columns, ",")
+	for rows.Next() {
+		if withValues {
+			var field, value []byte
+			if err := rows.Scan(&field, &value); err != nil {
+				return nil, err
+			}
+
+			values = append(values, field, value)
+		} else {
+			var column []byte
+			if err := rows.Scan(&column); err != nil {
+				return nil, err
+			}
+
+			values = append(values, column)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+func HGetAll(dbNum int, args [][]byte, dbOp *dbOperation) ([]any, error) {
+	return hashColumns(dbNum, args[0], "field, value", dbOp)
+}
+
+func HKeys(dbNum int, args [][]byte, dbOp *dbOperation) ([]any, error) {
+	return hashColumns(dbNum, args[0], "field", dbOp)
+}
+
+func HVals(dbNum int, args [][]byte, dbOp *dbOperation) ([]any, error) {
+	return hashColumns(dbNum, args[0], "value", dbOp)
+}
+
+func HLen(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	dbOp, err := startDBOperation(dbOp, false)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	id, err := getKeyID(dbOp, dbNum, args[0], hashType)
+	if err != nil || id == 0 {
+		return 0, err
+	}
+
+	var length int
+	if err := dbOp.Txn.QueryRow(fmt.Sprintf("SELECT count(*) FROM bigdis_%d_hash WHERE key_id = ?", dbNum), id).Scan(&length); err != nil {
+		return 0, err
+	}
+
+	return length, nil
+}
+
+func HExists(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	value, err := HGet(dbNum, args, dbOp)
+	if err != nil {
+		return 0, err
+	}
+
+	if value == nil {
+		return 0, nil
+	}
+
+	return 1, nil
+}
+
+func HStrlen(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	value, err := HGet(dbNum, args, dbOp)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(value), nil
+}
+
+func HIncrBy(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	var err error
+	dbOp, err = startDBOperation(dbOp, true)
+	if err != nil {
+		return 0, err
+	}
+	wasChained := dbOp.chainDBOperation()
+	defer func() {
+		if !wasChained {
+			dbOp.unchainDBOperation()
+		}
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	// check if user input is an integer
+	userIncr, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return 0, utils.ErrNotInteger
+	}
+
+	value, err := HGet(dbNum, args, dbOp)
+	if err != nil {
+		return 0, err
+	}
+
+	var newValue int64
+	if value != nil {
+		newValue, err = strconv.ParseInt(string(value), 10, 64)
+		if err != nil {
+			return 0, utils.ErrHashNotInteger
+		}
+	}
+
+	if (userIncr > 0 && newValue > math.MaxInt64-userIncr) || (userIncr < 0 && newValue < math.MinInt64-userIncr) {
+		return 0, utils.ErrOverflow
+	}
+	newValue += userIncr
+
+	if _, err := hset(dbNum, [][]byte{args[0], args[1], []byte(strconv.FormatInt(newValue, 10))}, "hincrby", dbOp); err != nil {
+		return 0, err
+	}
+
+	return int(newValue), nil
+}
+
+func HIncrByFloat(dbNum int, args [][]byte, dbOp *dbOperation) ([]byte, error) {
+	dbOp, err := startDBOperation(dbOp, true)
+	if err != nil {
+		return nil, err
+	}
+	wasChained := dbOp.chainDBOperation()
+	defer func() {
+		if !wasChained {
+			dbOp.unchainDBOperation()
+		}
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	// check if user input is a float
+	userIncr, err := strconv.ParseFloat(string(args[2]), 64)
+	if err != nil || math.IsNaN(userIncr) || math.IsInf(userIncr, 0) {
+		return nil, utils.ErrNotFloat
+	}
+
+	value, err := HGet(dbNum, args, dbOp)
+	if err != nil {
+		return nil, err
+	}
+
+	var newValue float64
+	if value != nil {
+		newValue, err = strconv.ParseFloat(string(value), 64)
+		if err != nil || math.IsNaN(newValue) || math.IsInf(newValue, 0) {
+			return nil, utils.ErrHashNotFloat
+		}
+	}
+
+	newValue += userIncr
+	if math.IsNaN(newValue) || math.IsInf(newValue, 0) {
+		return nil, utils.ErrNaNOrInfinity
+	}
+
+	newValueBytes := []byte(strconv.FormatFloat(newValue, 'f', -1, 64))
+
+	if _, err := hset(dbNum, [][]byte{args[0], args[1], newValueBytes}, "hincrbyfloat", dbOp); err != nil {
+		return nil, err
+	}
+
+	return newValueBytes, nil
+}
+
+/*
+HRandField returns random fields of a hash, with their values if WITHVALUES is given.
+
+A positive count returns distinct fields, a negative count allows the same field
+to be returned multiple times and always returns exactly -count fields.
+*/
+func HRandField(dbNum int, args [][]byte, dbOp *dbOperation) ([]any, error) {
+	count := int64(1)
+	var withValues bool
+	if len(args) > 1 {
+		var err error
+		count, err = strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil {
+			return nil, utils.ErrNotInteger
+		}
+
+		if len(args) > 2 {
+			if len(args) > 3 || strings.ToLower(string(args[2])) != "withvalues" {
+				return nil, utils.ErrSyntaxError
+			}
+			withValues = true
+		}
+	}
+
+	dbOp, err := startDBOperation(dbOp, false)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	values := []any{}
+
+	id, err := getKeyID(dbOp, dbNum, args[0], hashType)
+	if err != nil || id == 0 || count == 0 {
+		return values, err
+	}
+
+	if count < 0 {
+		// every pick is independent so the same field can show up more than once
+		var length int64
+		if err := dbOp.Txn.QueryRow(fmt.Sprintf("SELECT count(*) FROM bigdis_%d_hash WHERE key_id = ?", dbNum), id).Scan(&length); err != nil {
+			return nil, err
+		}
+
+		for i := int64(0); i < -count; i++ {
+			var field, value []byte
+			if err := dbOp.Txn.QueryRow(fmt.Sprintf("SELECT field, value FROM bigdis_%d_hash WHERE key_id = ? ORDER BY id LIMIT 1 OFFSET ?", dbNum), id, rand.Int63n(length)).Scan(&field, &value); err != nil {
+				return nil, err
+			}
+
+			values = append(values, field)
+			if withValues {
+				values = append(values, value)
+			}
+		}
+
+		return values, nil
+	}
+
+	rows, err := dbOp.Txn.Query(fmt.Sprintf("SELECT field, value FROM bigdis_%d_hash WHERE key_id = ? ORDER BY random() LIMIT ?", dbNum), id, count)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var field, value []byte
+		if err := rows.Scan(&field, &value); err != nil {
+			return nil, err
+		}
+
+		values = append(values, field)
+		if withValues {
+			values = append(values, value)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+/*
+HScan iterates over the fields of a hash.
+
+The cursor is the id of the last row returned, which is stable across
+concurrent modifications: fields added after the iteration started may
+or may not be returned, but existing fields are never returned twice.
+*/
+func HScan(dbNum int, args [][]byte, dbOp *dbOperation) (int64, []any, error) {
+	cursor, err := parseCursor(args[1])
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var noValues bool
+	pattern, count, err := parseScanArgs(args[2:], func(args [][]byte) (int, error) {
+		if strings.ToLower(string(args[0])) != "novalues" {
+			return 0, utils.ErrSyntaxError
+		}
+		noValues = true
+		return 1, nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	dbOp, err = startDBOperation(dbOp, false)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	values := []any{}
+
+	id, err := getKeyID(dbOp, dbNum, args[0], hashType)
+	if err != nil || id == 0 {
+		return 0, values, err
+	}
+
+	rows, err := dbOp.Txn.Query(fmt.Sprintf("SELECT id, field, value FROM bigdis_%d_hash WHERE key_id = ? and id > ? ORDER BY id LIMIT ?", dbNum), id, cursor, count)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	var scanned int
+	var lastID int64
+	for rows.Next() {
+		var field, value []byte
+		if err := rows.Scan(&lastID, &field, &value); err != nil {
+			return 0, nil, err
+		}
+		scanned++
+
+		if pattern != nil && !utils.GlobMatch(pattern, field, false) {
+			continue
+		}
+
+		values = append(values, field)
+		if !noValues {
+			values = append(values, value)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	// iteration is over
+	if scanned < count {
+		lastID = 0
+	}
+
+	return lastID, values, nil
+}
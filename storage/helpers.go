@@ -1,15 +1,28 @@
 package storage
 
 import (
+	"bigdis/config"
+	"bigdis/utils"
 	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type dbOperation struct {
 	Txn       *sql.Tx
 	ChainOp   bool
 	WritePool bool
+	changes   []*Change // the changes the transaction logged, written to the journal and announced to the replicas on commit
+	events    bool      // the transaction recorded change data capture events, the dispatcher is woken up on commit
+	// the keyspace notifications queued, published on commit
+	notifications []keyspaceNotification
 }
 
+// DBOperation allows the handlers to name the storage functions signature
+type DBOperation = dbOperation
+
 func startDBOperation(dbOp *dbOperation, writePool bool) (*dbOperation, error) {
 	if dbOp == nil {
 		if writePool {
@@ -41,14 +54,44 @@ func startDBOperation(dbOp *dbOperation, writePool bool) (*dbOperation, error) {
 func (dbOp *dbOperation) endDBOperation() error {
 	if !dbOp.ChainOp {
 		defer dbOp.Txn.Rollback()
-		if err := dbOp.Txn.Commit(); err != nil {
+		journalErr, err := dbOp.commit()
+		if err != nil {
 			return err
 		}
+		if len(dbOp.changes) > 0 {
+			notifyChanges()
+		}
+		if dbOp.events {
+			notifyEvents()
+		}
+		if len(dbOp.notifications) > 0 {
+			publishNotifications(dbOp.notifications)
+		}
+
+		return journalErr
 	}
 
 	return nil
 }
 
+// commit commits the transaction, writing the changes it logged to the journal.
+// The transaction is committed even when the journal fails, its error is returned apart
+func (dbOp *dbOperation) commit() (journalErr error, err error) {
+	if len(dbOp.changes) == 0 {
+		return nil, dbOp.Txn.Commit()
+	}
+
+	// the journal is held across the commit so that the changes are written in the order of their offsets
+	journal.Lock()
+	defer journal.Unlock()
+
+	if err := dbOp.Txn.Commit(); err != nil {
+		return nil, err
+	}
+
+	return journalChanges(dbOp.changes), nil
+}
+
 // returns the original bool value of ChainOp
 func (dbOp *dbOperation) chainDBOperation() bool {
 	oldChainOp := dbOp.ChainOp
@@ -59,3 +102,224 @@ func (dbOp *dbOperation) chainDBOperation() bool {
 func (dbOp *dbOperation) unchainDBOperation() {
 	dbOp.ChainOp = false
 }
+
+// BeginTransaction starts a write operation spanning several commands, as in MULTI/EXEC.
+// The storage functions it is passed to never commit it, EndTransaction does.
+func BeginTransaction() (*DBOperation, error) {
+	dbOp, err := startDBOperation(nil, true)
+	if err != nil {
+		return nil, err
+	}
+	dbOp.chainDBOperation()
+
+	return dbOp, nil
+}
+
+// EndTransaction commits a transaction started by BeginTransaction, or rolls it back
+func EndTransaction(dbOp *DBOperation, commit bool) error {
+	dbOp.unchainDBOperation()
+	if !commit {
+		return dbOp.Txn.Rollback()
+	}
+
+	return dbOp.endDBOperation()
+}
+
+// RollbackOnPanic is deferred by the callers of BeginTransaction: a command that panics rolls the transaction
+// back before the panic goes on, otherwise it would keep the write connection and every write would wait for it
+func RollbackOnPanic(dbOp *DBOperation) {
+	if err := recover(); err != nil {
+		dbOp.Txn.Rollback()
+		panic(err)
+	}
+}
+
+// Savepoint runs fn so that the changes it made are undone if it fails,
+// while the transaction it is part of goes on
+func (dbOp *dbOperation) Savepoint(fn func() error) error {
+	if _, err := dbOp.Txn.Exec("SAVEPOINT command"); err != nil {
+		return err
+	}
+
+	notifications := len(dbOp.notifications)
+	if err := fn(); err != nil {
+		dbOp.notifications = dbOp.notifications[:notifications]
+		if _, rollbackErr := dbOp.Txn.Exec("ROLLBACK TO command"); rollbackErr != nil {
+			return rollbackErr
+		}
+		if _, releaseErr := dbOp.Txn.Exec("RELEASE command"); releaseErr != nil {
+			return releaseErr
+		}
+
+		return err
+	}
+
+	_, err := dbOp.Txn.Exec("RELEASE command")
+	return err
+}
+
+/*
+Every key lives in the bigdis_N table, whatever its type.
+Aggregate types (hashes, lists, ...) keep only their metadata there and store
+their elements in a side table that references the key by its id, so that
+DEL, expiration and FLUSHDB on the main table cascade to the elements.
+*/
+
+/*
+liveKey is the SQL condition matching the keys that are not expired.
+The exp column holds UTC times, comparing them with the current time down to
+the millisecond agrees with the checks done in Go on the scanned values.
+It contains strftime verbs, so it must be passed as a Sprintf argument.
+*/
+const liveKey = "(exp IS NULL OR exp > strftime('%Y-%m-%d %H:%M:%f', 'now'))"
+
+// getKeyID returns the id of a live key of type keyType.
+// It returns 0 if the key doesn't exist or is expired.
+func getKeyID(dbOp *dbOperation, dbNum int, key []byte, keyType string) (int64, error) {
+	var id int64
+	var exp sql.NullTime
+	var currentType string
+	if err := dbOp.Txn.QueryRow(fmt.Sprintf("SELECT id, exp, type FROM bigdis_%d WHERE key = ?", dbNum), key).Scan(&id, &exp, &currentType); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+
+		return 0, err
+	}
+
+	if exp.Valid && exp.Time.Before(time.Now()) {
+		dbOp.notifyLazilyExpired(dbNum, key, exp.Time)
+		return 0, nil
+	}
+
+	if currentType != keyType {
+		return 0, utils.ErrWrongType
+	}
+
+	return id, nil
+}
+
+// createKeyID returns the id of a live key of type keyType, creating the key if needed.
+// An expired key is replaced by a brand new one. The caller records the change with touchKey
+// or deleteKeyIfEmpty once the elements are written.
+func createKeyID(dbOp *dbOperation, dbNum int, key []byte, keyType string) (int64, error) {
+	var id int64
+	var exp sql.NullTime
+	var currentType string
+	err := dbOp.Txn.QueryRow(fmt.Sprintf("SELECT id, exp, type FROM bigdis_%d WHERE key = ?", dbNum), key).Scan(&id, &exp, &currentType)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	if err == nil {
+		if !exp.Valid || !exp.Time.Before(time.Now()) {
+			if currentType != keyType {
+				return 0, utils.ErrWrongType
+			}
+
+			return id, nil
+		}
+
+		// expired but not yet garbage collected
+		if _, err := dbOp.Txn.Exec(fmt.Sprintf("DELETE FROM bigdis_%d WHERE id = ?", dbNum), id); err != nil {
+			return 0, err
+		}
+		dbOp.notifyExpired(dbNum, key, exp.Time)
+		if err := dbOp.recordEvent(dbNum, key, eventExpired, currentType, nil, nil); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := dbOp.Txn.QueryRow(fmt.Sprintf("INSERT INTO bigdis_%d (key, value, type) VALUES (?, x'', ?) RETURNING id", dbNum), key, keyType).Scan(&id); err != nil {
+		return 0, err
+	}
+	dbOp.notify(config.NotifyNew, "new", dbNum, key)
+
+	return id, nil
+}
+
+// touchKey updates the modification time of a key after its elements changed, and records the change
+func touchKey(dbOp *dbOperation, dbNum int, id int64) error {
+	var key []byte
+	var keyType string
+	if err := dbOp.Txn.QueryRow(fmt.Sprintf("UPDATE bigdis_%d SET updated = current_timestamp WHERE id = ? RETURNING key, type", dbNum), id).Scan(&key, &keyType); err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+
+		return err
+	}
+
+	return dbOp.recordEvent(dbNum, key, eventSet, keyType, nil, nil)
+}
+
+// deleteKeyIfEmpty removes an aggregate key once its last element is gone,
+// as Redis never keeps empty aggregates around.
+func deleteKeyIfEmpty(dbOp *dbOperation, dbNum int, id int64, elementsTable string) error {
+	var empty bool
+	if err := dbOp.Txn.QueryRow(fmt.Sprintf("SELECT NOT EXISTS(SELECT 1 FROM %s WHERE key_id = ?)", elementsTable), id).Scan(&empty); err != nil {
+		return err
+	}
+
+	if empty {
+		var key []byte
+		var keyType string
+		if err := dbOp.Txn.QueryRow(fmt.Sprintf("DELETE FROM bigdis_%d WHERE id = ? RETURNING key, type", dbNum), id).Scan(&key, &keyType); err != nil {
+			return err
+		}
+		dbOp.notify(config.NotifyGeneric, "del", dbNum, key)
+
+		return dbOp.recordEvent(dbNum, key, eventDel, keyType, nil, nil)
+	}
+
+	return touchKey(dbOp, dbNum, id)
+}
+
+// parseScanArgs parses the [MATCH pattern] [COUNT count] options shared by the *SCAN commands.
+// Unknown options are handed to extra, which returns how many arguments it consumed.
+func parseScanArgs(args [][]byte, extra func(args [][]byte) (int, error)) (pattern []byte, count int, err error) {
+	count = 10
+	for i := 0; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "match":
+			if i+1 >= len(args) {
+				return nil, 0, utils.ErrSyntaxError
+			}
+			pattern = args[i+1]
+			i++
+		case "count":
+			if i+1 >= len(args) {
+				return nil, 0, utils.ErrSyntaxError
+			}
+			count, err = strconv.Atoi(string(args[i+1]))
+			if err != nil {
+				return nil, 0, utils.ErrNotInteger
+			}
+			if count < 1 {
+				return nil, 0, utils.ErrSyntaxError
+			}
+			i++
+		default:
+			if extra == nil {
+				return nil, 0, utils.ErrSyntaxError
+			}
+			consumed, err := extra(args[i:])
+			if err != nil {
+				return nil, 0, err
+			}
+			i += consumed - 1
+		}
+	}
+
+	return pattern, count, nil
+}
+
+// parseCursor parses a *SCAN cursor, which is the id of the last row returned
+func parseCursor(cursor []byte) (int64, error) {
+	id, err := strconv.ParseInt(string(cursor), 10, 64)
+	if err != nil || id < 0 {
+		return 0, utils.ErrInvalidCursor
+	}
+
+	return id, nil
+}
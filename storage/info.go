@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync/atomic"
+
+	"bigdis/config"
+)
+
+// Stats are the counters of the storage reported by INFO
+var Stats struct {
+	ExpiredKeys atomic.Int64
+}
+
+// KeyspaceStats describes the live keys of a DB
+type KeyspaceStats struct {
+	DBNum   int
+	Keys    int64
+	Expires int64
+	// AvgTTL is the average time to live in milliseconds of the keys with an expiration
+	AvgTTL int64
+}
+
+// Keyspace returns the stats of the DBs holding at least a key, ordered by DB number
+func Keyspace() ([]KeyspaceStats, error) {
+	dbNums := availableDBs()
+	sort.Ints(dbNums)
+
+	var keyspace []KeyspaceStats
+	for _, dbNum := range dbNums {
+		stats := KeyspaceStats{DBNum: dbNum}
+		err := DBrp.QueryRow(fmt.Sprintf(`SELECT count(*), count(exp),
+			CAST(coalesce(avg((julianday(exp) - julianday('now')) * 86400000), 0) AS INTEGER)
+			FROM bigdis_%d WHERE %s`, dbNum, liveKey)).Scan(&stats.Keys, &stats.Expires, &stats.AvgTTL)
+		if err != nil {
+			return nil, err
+		}
+
+		if stats.Keys > 0 {
+			keyspace = append(keyspace, stats)
+		}
+	}
+
+	return keyspace, nil
+}
+
+// SQLiteStats describes the database file
+type SQLiteStats struct {
+	Version       string
+	PageSize      int64
+	PageCount     int64
+	FreelistCount int64
+	JournalMode   string
+	// WALSize is the size in bytes of the write-ahead log, 0 when there is none
+	WALSize int64
+}
+
+func SQLiteInfo() (SQLiteStats, error) {
+	var stats SQLiteStats
+
+	err := DBrp.QueryRow(`SELECT sqlite_version(),
+		(SELECT page_size FROM pragma_page_size),
+		(SELECT page_count FROM pragma_page_count),
+		(SELECT freelist_count FROM pragma_freelist_count),
+		(SELECT journal_mode FROM pragma_journal_mode)`).
+		Scan(&stats.Version, &stats.PageSize, &stats.PageCount, &stats.FreelistCount, &stats.JournalMode)
+	if err != nil {
+		return stats, err
+	}
+
+	if info, err := os.Stat(config.Config.Storage.Path + "-wal"); err == nil {
+		stats.WALSize = info.Size()
+	}
+
+	return stats, nil
+}
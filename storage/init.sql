@@ -2,4 +2,40 @@ create table if not exists redis_type(
     type text primary key,
     description text
 );
-insert into redis_type values('s', 'string') on conflict do nothing;
\ No newline at end of file
+insert into redis_type values('s', 'string') on conflict do nothing;
+insert into redis_type values('h', 'hash') on conflict do nothing;
+insert into redis_type values('l', 'list') on conflict do nothing;
+insert into redis_type values('S', 'set') on conflict do nothing;
+insert into redis_type values('z', 'zset') on conflict do nothing;
+create table if not exists key_version(
+    id integer primary key check (id = 0),
+    version integer not null
+);
+insert into key_version values(0, 0) on conflict do nothing;
+create table if not exists replication(
+    id integer primary key check (id = 0),
+    replid text not null,
+    offset integer not null
+);
+insert into replication values(0, lower(hex(randomblob(20))), 0) on conflict do nothing;
+create table if not exists change_log(
+    offset integer primary key,
+    db integer not null,
+    command blob not null,
+    created datetime not null default current_timestamp
+);
+create table if not exists cdc_event(
+    id integer primary key autoincrement,
+    db integer not null,
+    key blob,
+    op text not null,
+    type text,
+    old_hash text,
+    new_hash text,
+    ts integer not null
+);
+create table if not exists cdc_cursor(
+    id integer primary key check (id = 0),
+    event_id integer not null
+);
+insert into cdc_cursor values(0, 0) on conflict do nothing;
@@ -0,0 +1,824 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"bigdis/config"
+	"bigdis/rdb"
+)
+
+/*
+The journal is an optional append-only file of the write commands, in the format of the Redis AOF:
+the commands as the clients send them, with a SELECT whenever the DB changes.
+
+It holds the changes of the change log, appended as their transaction commits,
+and annotations that Redis skips when it loads the file:
+  - #TS:<unix time> the changes that follow were committed during that second
+  - #BASE:<offset> the commands that follow, up to the next #OFFSET, recreate the keys as they were at that change offset
+  - #OFFSET:<offset> the commands that follow are the changes from that offset on, one offset each
+
+The offsets line the journal up with the replication offset saved in the snapshots,
+so that a snapshot can be brought to any later point in time, see ReplayJournal.
+BGREWRITEAOF compacts the journal into a base of the current keys followed by the changes
+committed during the rewrite, the journal is created the same way when it is enabled.
+*/
+
+// journalItemsPerCommand is the number of elements of an aggregate per command of a base, as in Redis
+const journalItemsPerCommand = 64
+
+// replayBatchSize is the number of commands replayed per transaction
+const replayBatchSize = 10000
+
+var (
+	ErrRewriteInProgress = errors.New("ERR Background append only file rewriting already in progress")
+	ErrJournalDisabled   = errors.New("ERR Append only file is disabled, set appendonly to yes first")
+)
+
+// JournalState is the state of the journal reported by INFO persistence
+type JournalState struct {
+	Enabled           bool
+	RewriteInProgress bool
+	RewriteScheduled  bool // the keys were replaced during a rewrite, another one starts when it ends
+	RewriteStarted    time.Time
+
+	LastRewriteStatus   string
+	LastRewriteDuration time.Duration
+	LastWriteStatus     string
+	Rewrites            int
+	Size                int64
+	BaseSize            int64 // size of the journal after the last rewrite
+}
+
+// journal is held across the commits of the transactions that logged changes
+var journal = struct {
+	sync.Mutex
+	state  JournalState
+	path   string
+	fsync  string
+	writer *journalWriter // nil until the rewrite creating the file is done
+	// pending are the changes committed during a rewrite, the ones the base misses are written after it
+	pending []*Change
+	// generation changes when the journal is enabled or disabled, the rewrites of a previous one are dropped
+	generation int
+	stopSync   chan struct{}
+}{
+	state: JournalState{
+		LastRewriteStatus:   "ok",
+		LastWriteStatus:     "ok",
+		LastRewriteDuration: -1,
+	},
+}
+
+// Journal returns the state of the journal
+func Journal() JournalState {
+	journal.Lock()
+	defer journal.Unlock()
+
+	state := journal.state
+	if journal.writer != nil {
+		state.Size = journal.writer.size
+	}
+
+	return state
+}
+
+// initJournal opens the journal when appendonly is set and follows the changes of the settings
+func initJournal() {
+	config.OnSet("appendonly", func() error {
+		if config.Config.Storage.AppendOnly {
+			// like Redis, the journal enabled at runtime starts from the current keys
+			return enableJournal(true)
+		}
+
+		disableJournal()
+		return nil
+	})
+	config.OnSet("appendfsync", func() error {
+		journal.Lock()
+		journal.fsync = config.Config.Storage.AppendFsync
+		journal.Unlock()
+		return nil
+	})
+
+	if config.Config.Storage.AppendOnly {
+		if err := enableJournal(false); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// enableJournal starts writing the journal. The existing file is appended to when it is
+// up to date with the database, otherwise or with rewrite it is created again from the current keys
+func enableJournal(rewrite bool) error {
+	journal.Lock()
+	defer journal.Unlock()
+
+	if journal.state.Enabled {
+		return nil
+	}
+
+	journal.path = config.Config.Storage.AppendFile
+	journal.fsync = config.Config.Storage.AppendFsync
+	if !rewrite {
+		writer, upToDate, err := openJournal(journal.path)
+		if err != nil {
+			return err
+		}
+		journal.writer = writer
+		rewrite = !upToDate
+	}
+
+	journal.state.Enabled = true
+	journal.generation++
+	journal.stopSync = make(chan struct{})
+	go syncJournal(journal.stopSync)
+
+	if rewrite {
+		startRewrite()
+	}
+
+	return nil
+}
+
+// disableJournal stops writing the journal, the rewrite in progress is dropped
+func disableJournal() {
+	journal.Lock()
+	defer journal.Unlock()
+
+	if !journal.state.Enabled {
+		return
+	}
+
+	journal.state.Enabled = false
+	journal.state.RewriteInProgress = false
+	journal.state.RewriteScheduled = false
+	journal.generation++
+	journal.pending = nil
+	close(journal.stopSync)
+
+	if journal.writer != nil {
+		if err := journal.writer.close(); err != nil {
+			log.Printf("Error while closing the journal %s: %s\n", journal.path, err)
+		}
+		journal.writer = nil
+	}
+}
+
+// closeJournal flushes the journal to disk when the storage is closed
+func closeJournal() error {
+	journal.Lock()
+	defer journal.Unlock()
+
+	if !journal.state.Enabled {
+		return nil
+	}
+	journal.state.Enabled = false
+	close(journal.stopSync)
+
+	if journal.writer == nil {
+		return nil
+	}
+	err := journal.writer.close()
+	journal.writer = nil
+
+	return err
+}
+
+// openJournal opens an existing journal to append to it. An incomplete command at its end,
+// left by a crash, is cut. It is up to date when its last change is the last one of the database
+func openJournal(path string) (*journalWriter, bool, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0644)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	reader := newJournalReader(bufio.NewReader(file))
+	for {
+		_, err = reader.next()
+		if err != nil {
+			break
+		}
+	}
+	if err == io.ErrUnexpectedEOF {
+		fmt.Printf("The journal %s ends with an incomplete command, truncating it at %d bytes\n", path, reader.pos)
+		err = file.Truncate(reader.pos)
+	} else if err == io.EOF {
+		err = nil
+	}
+	if err != nil {
+		file.Close()
+		return nil, false, fmt.Errorf("reading the journal %s: %w", path, err)
+	}
+
+	_, offset, err := Replication()
+	if err != nil {
+		file.Close()
+		return nil, false, err
+	}
+	if reader.nextOffset-1 != offset {
+		fmt.Printf("The journal %s stops at offset %d while the database is at %d, rewriting it\n", path, reader.nextOffset-1, offset)
+		file.Close()
+		return nil, false, nil
+	}
+
+	writer := &journalWriter{
+		file:       file,
+		size:       reader.pos,
+		nextOffset: reader.nextOffset,
+		dbNum:      reader.dbNum,
+		ts:         reader.ts,
+	}
+
+	return writer, true, nil
+}
+
+// syncJournal flushes the journal to disk every second with the everysec policy
+func syncJournal(stop chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		journal.Lock()
+		if journal.writer != nil && journal.writer.dirty && journal.fsync == "everysec" {
+			if err := journal.writer.sync(); err != nil {
+				journal.state.LastWriteStatus = "err"
+				log.Printf("Error while syncing the journal %s: %s\n", journal.path, err)
+			}
+		}
+		journal.Unlock()
+	}
+}
+
+// journalChanges appends committed changes to the journal, it is called with the journal held.
+// With appendfsync always, the error is returned so that the command fails: it is committed but not durable
+func journalChanges(changes []*Change) error {
+	if !journal.state.Enabled {
+		return nil
+	}
+	if journal.state.RewriteInProgress {
+		journal.pending = append(journal.pending, changes...)
+	}
+	if journal.writer == nil {
+		return nil
+	}
+
+	writer := journal.writer
+	err := writer.write(writer.appendChanges(nil, changes))
+	if err == nil && journal.fsync == "always" {
+		err = writer.sync()
+	}
+	if err != nil {
+		journal.state.LastWriteStatus = "err"
+		log.Printf("Error while writing to the journal %s: %s\n", journal.path, err)
+		if journal.fsync == "always" {
+			return fmt.Errorf("MISCONF Errors writing to the AOF file: %w", err)
+		}
+		return nil
+	}
+	journal.state.LastWriteStatus = "ok"
+
+	return nil
+}
+
+// RewriteJournal starts compacting the journal in the background
+func RewriteJournal() error {
+	journal.Lock()
+	defer journal.Unlock()
+
+	if !journal.state.Enabled {
+		return ErrJournalDisabled
+	}
+	if journal.state.RewriteInProgress {
+		return ErrRewriteInProgress
+	}
+	startRewrite()
+
+	return nil
+}
+
+// keysReplaced rewrites the journal after the keys were replaced without going through the change log
+func keysReplaced() {
+	journal.Lock()
+	defer journal.Unlock()
+
+	if !journal.state.Enabled {
+		return
+	}
+	if journal.state.RewriteInProgress {
+		journal.state.RewriteScheduled = true
+		return
+	}
+	startRewrite()
+}
+
+// startRewrite is called with the journal held
+func startRewrite() {
+	journal.state.RewriteInProgress = true
+	journal.state.RewriteStarted = time.Now()
+	journal.pending = nil
+
+	path, generation := journal.path, journal.generation
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		runRewrite(path, generation)
+	}()
+}
+
+// runRewrite rewrites the journal and records the outcome, then starts the rewrite scheduled meanwhile
+func runRewrite(path string, generation int) {
+	err := rewriteJournal(path, generation)
+	if err != nil {
+		log.Printf("Error while rewriting the journal %s: %s\n", path, err)
+	}
+
+	journal.Lock()
+	defer journal.Unlock()
+
+	if generation != journal.generation {
+		return
+	}
+
+	journal.state.RewriteInProgress = false
+	journal.state.LastRewriteDuration = time.Since(journal.state.RewriteStarted)
+	journal.pending = nil
+	if err == nil {
+		journal.state.LastRewriteStatus = "ok"
+		journal.state.Rewrites++
+	} else {
+		journal.state.LastRewriteStatus = "err"
+	}
+
+	if journal.state.RewriteScheduled {
+		journal.state.RewriteScheduled = false
+		startRewrite()
+	}
+}
+
+// rewriteJournal writes the base of the current keys next to the journal,
+// then the changes committed meanwhile, and renames it over the journal
+func rewriteJournal(path string, generation int) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := &journalWriter{file: tmp, dbNum: -1}
+	replaced := false
+	defer func() {
+		if !replaced {
+			tmp.Close()
+		}
+	}()
+
+	offset, err := writer.writeBase()
+	if err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+
+	journal.Lock()
+	defer journal.Unlock()
+
+	if generation != journal.generation {
+		return nil
+	}
+
+	var changes []*Change
+	for _, change := range journal.pending {
+		if change.Offset > offset {
+			changes = append(changes, change)
+		}
+	}
+	if len(changes) > 0 {
+		if err := writer.write(writer.appendChanges(nil, changes)); err != nil {
+			return err
+		}
+		if err := writer.sync(); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	replaced = true
+
+	if journal.writer != nil {
+		journal.writer.close()
+	}
+	journal.writer = writer
+	journal.state.BaseSize = writer.size
+
+	return nil
+}
+
+// journalWriter appends to a journal file along with the annotations it needs
+type journalWriter struct {
+	file       *os.File
+	size       int64
+	nextOffset int64 // offset of the change that follows the last one written, the others need an #OFFSET
+	dbNum      int   // DB of the last SELECT, -1 before any
+	ts         int64 // time of the last #TS
+	dirty      bool  // written since the last fsync
+}
+
+// writeBase writes the commands recreating the live keys, all read in a single transaction.
+// It returns the offset of the last change they include
+func (w *journalWriter) writeBase() (int64, error) {
+	dbOp, err := startDBOperation(nil, false)
+	if err != nil {
+		return 0, err
+	}
+	defer dbOp.Txn.Rollback()
+
+	var offset int64
+	if err := dbOp.Txn.QueryRow("SELECT offset FROM replication").Scan(&offset); err != nil {
+		return 0, err
+	}
+
+	buffered := bufio.NewWriter(w.file)
+	w.ts = time.Now().Unix()
+	fmt.Fprintf(buffered, "#TS:%d\r\n#BASE:%d\r\n", w.ts, offset)
+
+	dbNums := availableDBs()
+	sort.Ints(dbNums)
+	for _, dbNum := range dbNums {
+		_, err := exportDB(dbOp, dbNum, func(entry *rdb.Entry) error {
+			_, err := buffered.Write(w.appendEntry(nil, entry))
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	fmt.Fprintf(buffered, "#OFFSET:%d\r\n", offset+1)
+	w.nextOffset = offset + 1
+	if err := buffered.Flush(); err != nil {
+		return 0, err
+	}
+
+	info, err := w.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	w.size = info.Size()
+
+	return offset, nil
+}
+
+// appendEntry appends the commands recreating a key, the elements of aggregates a few at a time
+func (w *journalWriter) appendEntry(buf []byte, entry *rdb.Entry) []byte {
+	buf = w.appendSelect(buf, entry.DB)
+
+	switch entry.Type {
+	case rdb.TypeString:
+		buf = append(buf, EncodeCommand([][]byte{[]byte("SET"), entry.Key, entry.Value})...)
+	case rdb.TypeList:
+		buf = appendBatches(buf, "RPUSH", entry.Key, entry.Elements, 1)
+	case rdb.TypeSet:
+		buf = appendBatches(buf, "SADD", entry.Key, entry.Elements, 1)
+	case rdb.TypeHash:
+		items := make([][]byte, 0, len(entry.Fields)*2)
+		for _, field := range entry.Fields {
+			items = append(items, field[0], field[1])
+		}
+		buf = appendBatches(buf, "HSET", entry.Key, items, 2)
+	case rdb.TypeZSet:
+		items := make([][]byte, 0, len(entry.Members)*2)
+		for _, member := range entry.Members {
+			items = append(items, formatScore(member.Score), member.Member)
+		}
+		buf = appendBatches(buf, "ZADD", entry.Key, items, 2)
+	}
+
+	if !entry.ExpireAt.IsZero() {
+		expireAt := []byte(strconv.FormatInt(entry.ExpireAt.UnixMilli(), 10))
+		buf = append(buf, EncodeCommand([][]byte{[]byte("PEXPIREAT"), entry.Key, expireAt})...)
+	}
+
+	return buf
+}
+
+// appendBatches appends name key item... commands of journalItemsPerCommand items each, made of size arguments
+func appendBatches(buf []byte, name string, key []byte, items [][]byte, size int) []byte {
+	for start := 0; start < len(items); start += journalItemsPerCommand * size {
+		end := min(start+journalItemsPerCommand*size, len(items))
+		args := append([][]byte{[]byte(name), key}, items[start:end]...)
+		buf = append(buf, EncodeCommand(args)...)
+	}
+
+	return buf
+}
+
+// appendChanges appends changes, preceded by the annotations and the SELECT they need
+func (w *journalWriter) appendChanges(buf []byte, changes []*Change) []byte {
+	for _, change := range changes {
+		if change.Offset != w.nextOffset {
+			buf = fmt.Appendf(buf, "#OFFSET:%d\r\n", change.Offset)
+		}
+		w.nextOffset = change.Offset + 1
+
+		if ts := change.Time.Unix(); ts != w.ts {
+			buf = fmt.Appendf(buf, "#TS:%d\r\n", ts)
+			w.ts = ts
+		}
+
+		buf = w.appendSelect(buf, change.DB)
+		buf = append(buf, EncodeCommand(change.Args)...)
+	}
+
+	return buf
+}
+
+func (w *journalWriter) appendSelect(buf []byte, dbNum int) []byte {
+	if dbNum != w.dbNum {
+		buf = append(buf, EncodeCommand([][]byte{[]byte("SELECT"), []byte(strconv.Itoa(dbNum))})...)
+		w.dbNum = dbNum
+	}
+
+	return buf
+}
+
+// write appends to the file. When it fails, what was partially written is cut
+// and the next changes start with all their annotations
+func (w *journalWriter) write(buf []byte) error {
+	written, err := w.file.Write(buf)
+	if err != nil {
+		if written > 0 {
+			w.file.Truncate(w.size)
+		}
+		w.nextOffset, w.dbNum, w.ts = -1, -1, 0
+		return err
+	}
+	w.size += int64(written)
+	w.dirty = true
+
+	return nil
+}
+
+func (w *journalWriter) sync() error {
+	w.dirty = false
+	return w.file.Sync()
+}
+
+func (w *journalWriter) close() error {
+	err := w.file.Sync()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// journalEntry is a command read from a journal
+type journalEntry struct {
+	Args   [][]byte // nil for the start of a base
+	DB     int
+	Offset int64 // offset of a change, the one a base is at for the commands of a base
+	Base   bool
+	Time   time.Time
+}
+
+// journalReader reads the commands of a journal, following the annotations and the SELECT
+type journalReader struct {
+	reader     *bufio.Reader
+	pos        int64 // end of the last complete entry
+	nextOffset int64
+	base       bool
+	baseOffset int64
+	dbNum      int
+	ts         int64
+}
+
+func newJournalReader(r *bufio.Reader) *journalReader {
+	return &journalReader{reader: r, nextOffset: 1, dbNum: -1}
+}
+
+// next returns the next command or start of a base. It returns io.EOF at the end of the journal,
+// and io.ErrUnexpectedEOF when it ends in the middle of an entry
+func (j *journalReader) next() (*journalEntry, error) {
+	for {
+		first, err := j.reader.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+
+		if first[0] != '#' {
+			args, size, err := decodeCommand(j.reader)
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			if err != nil {
+				return nil, err
+			}
+			j.pos += size
+
+			if len(args) == 2 && bytes.EqualFold(args[0], []byte("select")) {
+				if j.dbNum, err = strconv.Atoi(string(args[1])); err != nil {
+					return nil, fmt.Errorf("invalid SELECT at %d bytes", j.pos-size)
+				}
+				continue
+			}
+			if j.dbNum < 0 {
+				return nil, fmt.Errorf("command without SELECT at %d bytes", j.pos-size)
+			}
+
+			entry := &journalEntry{Args: args, DB: j.dbNum, Base: j.base, Time: time.Unix(j.ts, 0)}
+			if j.base {
+				entry.Offset = j.baseOffset
+			} else {
+				entry.Offset = j.nextOffset
+				j.nextOffset++
+			}
+
+			return entry, nil
+		}
+
+		line, err := j.reader.ReadBytes('\n')
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(line) < 2 || line[len(line)-2] != '\r' {
+			return nil, fmt.Errorf("invalid annotation %q at %d bytes", line, j.pos)
+		}
+		j.pos += int64(len(line))
+
+		name, value, _ := bytes.Cut(line[1:len(line)-2], []byte(":"))
+		number, err := strconv.ParseInt(string(value), 10, 64)
+		if err != nil {
+			// Redis and other tools may add their own annotations
+			continue
+		}
+		switch string(name) {
+		case "TS":
+			j.ts = number
+		case "OFFSET":
+			j.base = false
+			j.nextOffset = number
+		case "BASE":
+			j.base = true
+			j.baseOffset = number
+			j.nextOffset = number + 1
+			return &journalEntry{DB: j.dbNum, Offset: number, Base: true, Time: time.Unix(j.ts, 0)}, nil
+		}
+	}
+}
+
+// ReplayStats describes what ReplayJournal did
+type ReplayStats struct {
+	Commands  int
+	Offset    int64     // offset of the database once replayed
+	Time      time.Time // time of the last command replayed
+	Truncated bool      // the journal ends with an incomplete command, which was ignored
+}
+
+// ReplayJournal brings the database to the point in time until, or to the end of the journal when it is zero.
+// The changes the database already has, as a snapshot taken when the journal was written, are skipped.
+// A base more recent than the database replaces all its keys. apply runs a command of the journal,
+// the commands are replayed in transactions of replayBatchSize of them. The database gets a new replication ID,
+// since its history now differs from the one of the server which wrote the journal
+func ReplayJournal(r io.Reader, until time.Time, apply func(dbOp *DBOperation, dbNum int, args [][]byte) error) (ReplayStats, error) {
+	var stats ReplayStats
+	_, offset, err := Replication()
+	if err != nil {
+		return stats, err
+	}
+	stats.Offset = offset
+
+	var dbOp *dbOperation
+	defer func() {
+		if dbOp != nil {
+			dbOp.Txn.Rollback()
+		}
+	}()
+	// commit ends the current transaction, the next command starts another one
+	commit := func() error {
+		if dbOp == nil {
+			return nil
+		}
+		err := EndTransaction(dbOp, true)
+		dbOp = nil
+		return err
+	}
+
+	reader := newJournalReader(bufio.NewReader(r))
+	skipBase := false
+	batch := 0
+	for {
+		entry, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			stats.Truncated = true
+			break
+		}
+		if err != nil {
+			return stats, err
+		}
+		if !until.IsZero() && entry.Time.After(until) {
+			break
+		}
+
+		switch {
+		case entry.Args == nil:
+			if skipBase = entry.Offset <= stats.Offset; skipBase {
+				continue
+			}
+		case entry.Base:
+			if skipBase {
+				continue
+			}
+		case entry.Offset <= stats.Offset:
+			continue
+		case entry.Offset != stats.Offset+1:
+			return stats, fmt.Errorf("the journal misses the changes from offset %d to %d", stats.Offset+1, entry.Offset-1)
+		}
+
+		// the handlers create the tables of a new DB with the write connection, it must be free
+		if entry.Args != nil && !IsAvailableDB(entry.DB) {
+			if err := commit(); err != nil {
+				return stats, err
+			}
+			if err := NewDB(entry.DB); err != nil {
+				return stats, err
+			}
+		}
+		if dbOp == nil {
+			if dbOp, err = BeginTransaction(); err != nil {
+				return stats, err
+			}
+		}
+
+		switch {
+		case entry.Args == nil:
+			// the base holds all the keys of the DBs
+			for _, dbNum := range availableDBs() {
+				if err := dropDB(dbOp, dbNum); err != nil {
+					return stats, err
+				}
+			}
+			if _, err := dbOp.Txn.Exec("UPDATE replication SET offset = ?", entry.Offset); err != nil {
+				return stats, err
+			}
+		case entry.Base:
+			if err := apply(dbOp, entry.DB, entry.Args); err != nil {
+				return stats, err
+			}
+		default:
+			if err := apply(dbOp, entry.DB, entry.Args); err != nil {
+				return stats, err
+			}
+			change := &Change{Offset: entry.Offset, DB: entry.DB, Args: entry.Args, Time: entry.Time}
+			if err := LogReplicatedChange(dbOp, change); err != nil {
+				return stats, err
+			}
+		}
+		stats.Offset = entry.Offset
+		stats.Time = entry.Time
+		if entry.Args != nil {
+			stats.Commands++
+		}
+
+		if batch++; batch == replayBatchSize {
+			batch = 0
+			if err := commit(); err != nil {
+				return stats, err
+			}
+		}
+	}
+
+	if err := commit(); err != nil {
+		return stats, err
+	}
+
+	return stats, NewReplicationID()
+}
@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestJournalWriteFailure checks that a failed write of the journal fails the command with appendfsync always,
+// /dev/full refuses every write
+func TestJournalWriteFailure(t *testing.T) {
+	file, err := os.OpenFile("/dev/full", os.O_WRONLY, 0)
+	if err != nil {
+		t.Skip(err)
+	}
+
+	journal.Lock()
+	defer journal.Unlock()
+	journal.state.Enabled = true
+	journal.path = "/dev/full"
+	journal.writer = &journalWriter{file: file, nextOffset: 1, dbNum: -1}
+	defer func() {
+		file.Close()
+		journal.state.Enabled, journal.writer = false, nil
+	}()
+
+	changes := []*Change{{Offset: 1, DB: 0, Args: [][]byte{[]byte("SET"), []byte("k"), []byte("v")}, Time: time.Now()}}
+
+	journal.fsync = "always"
+	if err := journalChanges(changes); err == nil || !strings.HasPrefix(err.Error(), "MISCONF ") {
+		t.Errorf("journalChanges with appendfsync always = %v, expected a MISCONF error", err)
+	}
+	if journal.state.LastWriteStatus != "err" {
+		t.Errorf("last write status %q", journal.state.LastWriteStatus)
+	}
+
+	// the other policies don't wait for the disk, the failure is only reported in INFO and the log
+	journal.fsync = "everysec"
+	if err := journalChanges(changes); err != nil {
+		t.Errorf("journalChanges with appendfsync everysec = %v", err)
+	}
+	if journal.state.LastWriteStatus != "err" {
+		t.Errorf("last write status %q", journal.state.LastWriteStatus)
+	}
+}
@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"bigdis/utils"
+	"bytes"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+/*
+Keys are enumerated straight from the bigdis_N table.
+SCAN walks it in id order: the cursor is the id of the last key returned, so
+an iteration can be resumed at any time and each call is a short transaction.
+*/
+
+// globPrefix returns the literal prefix of a glob pattern and the smallest key
+// greater than all the keys starting with it, nil if there is no such key
+func globPrefix(pattern []byte) ([]byte, []byte) {
+	prefix := pattern
+	if i := bytes.IndexAny(pattern, `*?[\`); i >= 0 {
+		prefix = pattern[:i]
+	}
+
+	upper := bytes.TrimRight(prefix, "\xff")
+	if len(upper) == 0 {
+		return prefix, nil
+	}
+	upper = append([]byte{}, upper...)
+	upper[len(upper)-1]++
+
+	return prefix, upper
+}
+
+// typeLetter returns the type stored in the bigdis_N tables for a Redis type name
+func typeLetter(dbOp *dbOperation, name []byte) (string, error) {
+	var keyType string
+	if err := dbOp.Txn.QueryRow("SELECT type FROM redis_type WHERE description = ?", strings.ToLower(string(name))).Scan(&keyType); err != nil {
+		if err == sql.ErrNoRows {
+			return "", fmt.Errorf("ERR unknown type name '%s'", name)
+		}
+
+		return "", err
+	}
+
+	return keyType, nil
+}
+
+func Keys(dbNum int, args [][]byte, dbOp *dbOperation) ([]any, error) {
+	var err error
+	dbOp, err = startDBOperation(dbOp, false)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	// only the keys sharing the literal prefix of the pattern are read
+	query := fmt.Sprintf("SELECT key FROM bigdis_%d WHERE %s and key >= ?", dbNum, liveKey)
+	prefix, upper := globPrefix(args[0])
+	queryArgs := []any{prefix}
+	if upper != nil {
+		query += " and key < ?"
+		queryArgs = append(queryArgs, upper)
+	}
+
+	rows, err := dbOp.Txn.Query(query, queryArgs...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	matchAll := bytes.Equal(args[0], []byte("*"))
+	keys := []any{}
+	for rows.Next() {
+		var key []byte
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+
+		if matchAll || utils.GlobMatch(args[0], key, false) {
+			keys = append(keys, key)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func Scan(dbNum int, args [][]byte, dbOp *dbOperation) (int64, []any, error) {
+	cursor, err := parseCursor(args[0])
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var typeName []byte
+	pattern, count, err := parseScanArgs(args[1:], func(args [][]byte) (int, error) {
+		if strings.ToLower(string(args[0])) != "type" || len(args) < 2 {
+			return 0, utils.ErrSyntaxError
+		}
+		typeName = args[1]
+		return 2, nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	dbOp, err = startDBOperation(dbOp, false)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	var keyType string
+	if typeName != nil {
+		if keyType, err = typeLetter(dbOp, typeName); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	query := fmt.Sprintf("SELECT id, key, type FROM bigdis_%d WHERE id > ? and %s ORDER BY id LIMIT ?", dbNum, liveKey)
+	rows, err := dbOp.Txn.Query(query, cursor, count)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	keys := []any{}
+	var scanned int
+	var lastID int64
+	for rows.Next() {
+		var key []byte
+		var currentType string
+		if err := rows.Scan(&lastID, &key, &currentType); err != nil {
+			return 0, nil, err
+		}
+		scanned++
+
+		// like in Redis, filters apply after the keys are read
+		// so a call can return no keys while the iteration isn't over
+		if keyType != "" && currentType != keyType {
+			continue
+		}
+		if pattern != nil && !utils.GlobMatch(pattern, key, false) {
+			continue
+		}
+
+		keys = append(keys, key)
+	}
+
+	if err := rows.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	// iteration is over
+	if scanned < count {
+		lastID = 0
+	}
+
+	return lastID, keys, nil
+}
+
+// Type returns the Redis type name of a key, none if it doesn't exist
+func Type(dbNum int, args [][]byte, dbOp *dbOperation) (string, error) {
+	var err error
+	dbOp, err = startDBOperation(dbOp, false)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	var name string
+	if err := dbOp.Txn.QueryRow(fmt.Sprintf(`
+		SELECT redis_type.description FROM bigdis_%d
+		JOIN redis_type ON redis_type.type = bigdis_%[1]d.type
+		WHERE key = ? and %s`, dbNum, liveKey), args[0]).Scan(&name); err != nil {
+		if err == sql.ErrNoRows {
+			return "none", nil
+		}
+
+		return "", err
+	}
+
+	return name, nil
+}
+
+// watchers counts the clients watching keys, the tombstones of the deleted keys are kept while there are some
+var watchers atomic.Int64
+
+// StartWatching is called when a client starts watching keys, before it reads their versions
+func StartWatching() {
+	watchers.Add(1)
+}
+
+// StopWatching is called once the keys a client watched are forgotten
+func StopWatching() {
+	watchers.Add(-1)
+}
+
+// KeyVersion returns the version of a live key, the one of its tombstone if it was deleted,
+// 0 if it never existed. The version changes every time the key is written or deleted, WATCH relies on it.
+func KeyVersion(dbNum int, args [][]byte, dbOp *dbOperation) (int64, error) {
+	var err error
+	dbOp, err = startDBOperation(dbOp, false)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	var version int64
+	if err := dbOp.Txn.QueryRow(fmt.Sprintf(`
+		SELECT coalesce(
+			(SELECT version FROM bigdis_%[1]d WHERE key = ?1 and %[2]s),
+			(SELECT version FROM bigdis_%[1]d_deleted WHERE key = ?1),
+			0)`, dbNum, liveKey), args[0]).Scan(&version); err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
@@ -1 +1,745 @@
 package storage
+
+import (
+	"bigdis/config"
+	"bigdis/utils"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+Lists are stored one row per element in the bigdis_N_list table.
+
+Elements of a list always have contiguous positions, from head to tail:
+pushing and popping only move the head or the tail, while the commands
+that remove or insert elements in the middle shift the positions around.
+This way the element at index i is the one at position head+i,
+and LINDEX, LSET and LRANGE are index lookups no matter how long the list is.
+*/
+
+const listType = "l"
+
+var (
+	errNoSuchKey       = errors.New("ERR no such key")
+	errIndexOutOfRange = errors.New("ERR index out of range")
+)
+
+// listBounds returns the positions of the first and the last element of a list
+func listBounds(dbOp *dbOperation, dbNum int, id int64) (int64, int64, error) {
+	var head, tail int64
+	if err := dbOp.Txn.QueryRow(fmt.Sprintf("SELECT min(pos), max(pos) FROM bigdis_%d_list WHERE key_id = ?", dbNum), id).Scan(&head, &tail); err != nil {
+		return 0, 0, err
+	}
+
+	return head, tail, nil
+}
+
+// listRange converts Redis start/stop indexes, possibly negative, to positions.
+// ok is false when the range is empty.
+func listRange(head, tail, start, stop int64) (int64, int64, bool) {
+	length := tail - head + 1
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+	if start > stop || start >= length {
+		return 0, 0, false
+	}
+
+	return head + start, head + stop, true
+}
+
+func listPush(dbOp *dbOperation, dbNum int, key []byte, values [][]byte, left bool, onlyExisting bool) (int, error) {
+	var id int64
+	var err error
+	if onlyExisting {
+		id, err = getKeyID(dbOp, dbNum, key, listType)
+		if err != nil || id == 0 {
+			return 0, err
+		}
+	} else {
+		id, err = createKeyID(dbOp, dbNum, key, listType)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// a brand new list is empty between 0 and -1:
+	// left pushes start from -1 and right pushes from 0
+	var head, tail int64 = 0, -1
+	var exists bool
+	if err := dbOp.Txn.QueryRow(fmt.Sprintf("SELECT EXISTS(SELECT 1 FROM bigdis_%d_list WHERE key_id = ?)", dbNum), id).Scan(&exists); err != nil {
+		return 0, err
+	}
+	if exists {
+		if head, tail, err = listBounds(dbOp, dbNum, id); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, value := range values {
+		var pos int64
+		if left {
+			head--
+			pos = head
+		} else {
+			tail++
+			pos = tail
+		}
+
+		if _, err := dbOp.Txn.Exec(fmt.Sprintf("INSERT INTO bigdis_%d_list (key_id, pos, value) VALUES (?, ?, ?)", dbNum), id, pos, value); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := touchKey(dbOp, dbNum, id); err != nil {
+		return 0, err
+	}
+	if left {
+		dbOp.notify(config.NotifyList, "lpush", dbNum, key)
+	} else {
+		dbOp.notify(config.NotifyList, "rpush", dbNum, key)
+	}
+
+	return int(tail - head + 1), nil
+}
+
+func listPop(dbOp *dbOperation, dbNum int, key []byte, count int64, left bool) ([]any, error) {
+	id, err := getKeyID(dbOp, dbNum, key, listType)
+	if err != nil || id == 0 {
+		return nil, err
+	}
+
+	values := []any{}
+	if count == 0 {
+		return values, nil
+	}
+
+	order, condition := "ASC", "pos <= ?"
+	head, tail, err := listBounds(dbOp, dbNum, id)
+	if err != nil {
+		return nil, err
+	}
+	bound := head + count - 1
+	if !left {
+		order, condition = "DESC", "pos >= ?"
+		bound = tail - count + 1
+	}
+
+	rows, err := dbOp.Txn.Query(fmt.Sprintf("SELECT value FROM bigdis_%d_list WHERE key_id = ? and %s ORDER BY pos %s", dbNum, condition, order), id, bound)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var value []byte
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+
+		values = append(values, value)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := dbOp.Txn.Exec(fmt.Sprintf("DELETE FROM bigdis_%d_list WHERE key_id = ? and %s", dbNum, condition), id, bound); err != nil {
+		return nil, err
+	}
+	if left {
+		dbOp.notify(config.NotifyList, "lpop", dbNum, key)
+	} else {
+		dbOp.notify(config.NotifyList, "rpop", dbNum, key)
+	}
+
+	if err := deleteKeyIfEmpty(dbOp, dbNum, id, fmt.Sprintf("bigdis_%d_list", dbNum)); err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+// compactList renumbers the elements of a list after some of them were removed from the middle
+func compactList(dbOp *dbOperation, dbNum int, id int64) error {
+	_, err := dbOp.Txn.Exec(fmt.Sprintf(`
+		UPDATE bigdis_%[1]d_list SET pos = ranked.head + ranked.rank
+		FROM (
+			SELECT id,
+				min(pos) OVER () AS head,
+				row_number() OVER (ORDER BY pos) - 1 AS rank
+			FROM bigdis_%[1]d_list WHERE key_id = ?) AS ranked
+		WHERE bigdis_%[1]d_list.id = ranked.id and bigdis_%[1]d_list.pos != ranked.head + ranked.rank`, dbNum), id)
+
+	return err
+}
+
+func push(dbNum int, args [][]byte, left bool, onlyExisting bool, dbOp *dbOperation) (int, error) {
+	var err error
+	dbOp, err = startDBOperation(dbOp, true)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	return listPush(dbOp, dbNum, args[0], args[1:], left, onlyExisting)
+}
+
+func LPush(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	return push(dbNum, args, true, false, dbOp)
+}
+
+func RPush(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	return push(dbNum, args, false, false, dbOp)
+}
+
+func LPushX(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	return push(dbNum, args, true, true, dbOp)
+}
+
+func RPushX(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	return push(dbNum, args, false, true, dbOp)
+}
+
+/*
+pop returns nil if the key doesn't exist.
+
+Without the count argument at most one element is returned,
+the handler is in charge of replying with a bulk string in that case.
+*/
+func pop(dbNum int, args [][]byte, left bool, dbOp *dbOperation) ([]any, error) {
+	count := int64(1)
+	if len(args) > 1 {
+		var err error
+		count, err = strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil || count < 0 {
+			return nil, utils.ErrValueOutOfRange
+		}
+	}
+
+	var err error
+	dbOp, err = startDBOperation(dbOp, true)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	return listPop(dbOp, dbNum, args[0], count, left)
+}
+
+func LPop(dbNum int, args [][]byte, dbOp *dbOperation) ([]any, error) {
+	return pop(dbNum, args, true, dbOp)
+}
+
+func RPop(dbNum int, args [][]byte, dbOp *dbOperation) ([]any, error) {
+	return pop(dbNum, args, false, dbOp)
+}
+
+func LLen(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	var err error
+	dbOp, err = startDBOperation(dbOp, false)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	id, err := getKeyID(dbOp, dbNum, args[0], listType)
+	if err != nil || id == 0 {
+		return 0, err
+	}
+
+	head, tail, err := listBounds(dbOp, dbNum, id)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(tail - head + 1), nil
+}
+
+func LRange(dbNum int, args [][]byte, dbOp *dbOperation) ([]any, error) {
+	start, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return nil, utils.ErrNotInteger
+	}
+	stop, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return nil, utils.ErrNotInteger
+	}
+
+	dbOp, err = startDBOperation(dbOp, false)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	values := []any{}
+
+	id, err := getKeyID(dbOp, dbNum, args[0], listType)
+	if err != nil || id == 0 {
+		return values, err
+	}
+
+	head, tail, err := listBounds(dbOp, dbNum, id)
+	if err != nil {
+		return nil, err
+	}
+
+	from, to, ok := listRange(head, tail, start, stop)
+	if !ok {
+		return values, nil
+	}
+
+	rows, err := dbOp.Txn.Query(fmt.Sprintf("SELECT value FROM bigdis_%d_list WHERE key_id = ? and pos BETWEEN ? and ? ORDER BY pos", dbNum), id, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var value []byte
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+
+		values = append(values, value)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+// listIndex returns the id of the list and the position of the element at index, if any
+func listIndex(dbOp *dbOperation, dbNum int, key []byte, index int64) (int64, int64, bool, error) {
+	id, err := getKeyID(dbOp, dbNum, key, listType)
+	if err != nil || id == 0 {
+		return 0, 0, false, err
+	}
+
+	head, tail, err := listBounds(dbOp, dbNum, id)
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	if index < 0 {
+		index += tail - head + 1
+	}
+	if index < 0 || head+index > tail {
+		return id, 0, false, nil
+	}
+
+	return id, head + index, true, nil
+}
+
+func LIndex(dbNum int, args [][]byte, dbOp *dbOperation) ([]byte, error) {
+	index, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return nil, utils.ErrNotInteger
+	}
+
+	dbOp, err = startDBOperation(dbOp, false)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	id, pos, ok, err := listIndex(dbOp, dbNum, args[0], index)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	var value []byte
+	if err := dbOp.Txn.QueryRow(fmt.Sprintf("SELECT value FROM bigdis_%d_list WHERE key_id = ? and pos = ?", dbNum), id, pos).Scan(&value); err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+func LSet(dbNum int, args [][]byte, dbOp *dbOperation) error {
+	index, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return utils.ErrNotInteger
+	}
+
+	dbOp, err = startDBOperation(dbOp, true)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	id, pos, ok, err := listIndex(dbOp, dbNum, args[0], index)
+	if err != nil {
+		return err
+	}
+	if id == 0 {
+		return errNoSuchKey
+	}
+	if !ok {
+		return errIndexOutOfRange
+	}
+
+	if _, err := dbOp.Txn.Exec(fmt.Sprintf("UPDATE bigdis_%d_list SET value = ? WHERE key_id = ? and pos = ?", dbNum), args[2], id, pos); err != nil {
+		return err
+	}
+	dbOp.notify(config.NotifyList, "lset", dbNum, args[0])
+
+	return touchKey(dbOp, dbNum, id)
+}
+
+// LInsert returns the new length of the list, 0 if the key doesn't exist and -1 if the pivot is not found
+func LInsert(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	var before bool
+	switch strings.ToLower(string(args[1])) {
+	case "before":
+		before = true
+	case "after":
+	default:
+		return 0, utils.ErrSyntaxError
+	}
+
+	var err error
+	dbOp, err = startDBOperation(dbOp, true)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	id, err := getKeyID(dbOp, dbNum, args[0], listType)
+	if err != nil || id == 0 {
+		return 0, err
+	}
+
+	var pivot int64
+	if err := dbOp.Txn.QueryRow(fmt.Sprintf("SELECT pos FROM bigdis_%d_list WHERE key_id = ? and value = ? ORDER BY pos LIMIT 1", dbNum), id, args[2]).Scan(&pivot); err != nil {
+		if err == sql.ErrNoRows {
+			return -1, nil
+		}
+
+		return 0, err
+	}
+
+	head, tail, err := listBounds(dbOp, dbNum, id)
+	if err != nil {
+		return 0, err
+	}
+
+	// make room for the new element shifting the shortest side of the list
+	pos := pivot
+	if !before {
+		pos++
+	}
+	if pos-head < tail-pos+1 {
+		_, err = dbOp.Txn.Exec(fmt.Sprintf("UPDATE bigdis_%d_list SET pos = pos - 1 WHERE key_id = ? and pos < ?", dbNum), id, pos)
+		pos--
+	} else {
+		_, err = dbOp.Txn.Exec(fmt.Sprintf("UPDATE bigdis_%d_list SET pos = pos + 1 WHERE key_id = ? and pos >= ?", dbNum), id, pos)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := dbOp.Txn.Exec(fmt.Sprintf("INSERT INTO bigdis_%d_list (key_id, pos, value) VALUES (?, ?, ?)", dbNum), id, pos, args[3]); err != nil {
+		return 0, err
+	}
+	dbOp.notify(config.NotifyList, "linsert", dbNum, args[0])
+
+	if err := touchKey(dbOp, dbNum, id); err != nil {
+		return 0, err
+	}
+
+	return int(tail - head + 2), nil
+}
+
+func LRem(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	count, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return 0, utils.ErrNotInteger
+	}
+
+	dbOp, err = startDBOperation(dbOp, true)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	id, err := getKeyID(dbOp, dbNum, args[0], listType)
+	if err != nil || id == 0 {
+		return 0, err
+	}
+
+	// count > 0 removes from head to tail, count < 0 from tail to head, 0 removes all
+	order, limit := "ASC", count
+	if count < 0 {
+		order, limit = "DESC", -count
+	} else if count == 0 {
+		limit = -1
+	}
+
+	result, err := dbOp.Txn.Exec(fmt.Sprintf(`
+		DELETE FROM bigdis_%[1]d_list WHERE id IN (
+			SELECT id FROM bigdis_%[1]d_list WHERE key_id = ? and value = ? ORDER BY pos %[2]s LIMIT ?)`, dbNum, order), id, args[2], limit)
+	if err != nil {
+		return 0, err
+	}
+
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	if removed > 0 {
+		if err := compactList(dbOp, dbNum, id); err != nil {
+			return 0, err
+		}
+		dbOp.notify(config.NotifyList, "lrem", dbNum, args[0])
+
+		if err := deleteKeyIfEmpty(dbOp, dbNum, id, fmt.Sprintf("bigdis_%d_list", dbNum)); err != nil {
+			return 0, err
+		}
+	}
+
+	return int(removed), nil
+}
+
+func LTrim(dbNum int, args [][]byte, dbOp *dbOperation) error {
+	start, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return utils.ErrNotInteger
+	}
+	stop, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return utils.ErrNotInteger
+	}
+
+	dbOp, err = startDBOperation(dbOp, true)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	id, err := getKeyID(dbOp, dbNum, args[0], listType)
+	if err != nil || id == 0 {
+		return err
+	}
+
+	head, tail, err := listBounds(dbOp, dbNum, id)
+	if err != nil {
+		return err
+	}
+
+	from, to, ok := listRange(head, tail, start, stop)
+	if !ok {
+		// empty range, the whole list goes away
+		from, to = tail+1, tail
+	}
+
+	if _, err := dbOp.Txn.Exec(fmt.Sprintf("DELETE FROM bigdis_%d_list WHERE key_id = ? and (pos < ? or pos > ?)", dbNum), id, from, to); err != nil {
+		return err
+	}
+	dbOp.notify(config.NotifyList, "ltrim", dbNum, args[0])
+
+	return deleteKeyIfEmpty(dbOp, dbNum, id, fmt.Sprintf("bigdis_%d_list", dbNum))
+}
+
+/*
+LPos returns the indexes of the elements matching the given one.
+
+single is true when no COUNT option was given,
+in which case the handler must reply with a single integer (or nil).
+*/
+func LPos(dbNum int, args [][]byte, dbOp *dbOperation) (positions []any, single bool, err error) {
+	rank, count, maxLen := int64(1), int64(1), int64(0)
+	single = true
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return nil, false, utils.ErrSyntaxError
+		}
+
+		value, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+		if err != nil {
+			return nil, false, utils.ErrNotInteger
+		}
+
+		switch strings.ToLower(string(args[i])) {
+		case "rank":
+			if value == 0 {
+				return nil, false, errors.New("ERR RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list")
+			}
+			rank = value
+		case "count":
+			if value < 0 {
+				return nil, false, errors.New("ERR COUNT can't be negative")
+			}
+			count = value
+			single = false
+		case "maxlen":
+			if value < 0 {
+				return nil, false, errors.New("ERR MAXLEN can't be negative")
+			}
+			maxLen = value
+		default:
+			return nil, false, utils.ErrSyntaxError
+		}
+	}
+
+	dbOp, err = startDBOperation(dbOp, false)
+	if err != nil {
+		return nil, false, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	positions = []any{}
+
+	id, err := getKeyID(dbOp, dbNum, args[0], listType)
+	if err != nil || id == 0 {
+		return positions, single, err
+	}
+
+	head, tail, err := listBounds(dbOp, dbNum, id)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// a negative rank scans from the tail
+	order, condition, bound := "ASC", "pos <= ?", tail
+	if maxLen > 0 {
+		bound = head + maxLen - 1
+	}
+	if rank < 0 {
+		order, condition, bound = "DESC", "pos >= ?", head
+		if maxLen > 0 {
+			bound = tail - maxLen + 1
+		}
+		rank = -rank
+	}
+
+	// COUNT 0 means all the matches
+	limit := count
+	if limit == 0 {
+		limit = -1
+	}
+
+	rows, err := dbOp.Txn.Query(fmt.Sprintf(`
+		SELECT pos FROM bigdis_%d_list
+		WHERE key_id = ? and value = ? and %s
+		ORDER BY pos %s LIMIT ? OFFSET ?`, dbNum, condition, order), id, args[1], bound, limit, rank-1)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var pos int64
+		if err := rows.Scan(&pos); err != nil {
+			return nil, false, err
+		}
+
+		positions = append(positions, int(pos-head))
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	return positions, single, nil
+}
+
+func LMove(dbNum int, args [][]byte, dbOp *dbOperation) ([]byte, error) {
+	var fromLeft, toLeft bool
+	for i, where := range []*bool{&fromLeft, &toLeft} {
+		switch strings.ToLower(string(args[2+i])) {
+		case "left":
+			*where = true
+		case "right":
+		default:
+			return nil, utils.ErrSyntaxError
+		}
+	}
+
+	var err error
+	dbOp, err = startDBOperation(dbOp, true)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	// the destination must be checked before anything is popped from the source
+	if _, err := getKeyID(dbOp, dbNum, args[1], listType); err != nil {
+		return nil, err
+	}
+
+	values, err := listPop(dbOp, dbNum, args[0], 1, fromLeft)
+	if err != nil || len(values) == 0 {
+		return nil, err
+	}
+
+	value := values[0].([]byte)
+	if _, err := listPush(dbOp, dbNum, args[1], [][]byte{value}, toLeft, false); err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+func RPopLPush(dbNum int, args [][]byte, dbOp *dbOperation) ([]byte, error) {
+	return LMove(dbNum, [][]byte{args[0], args[1], []byte("right"), []byte("left")}, dbOp)
+}
@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bigdis/config"
+)
+
+/*
+Keyspace notifications are queued by the storage functions on the operation that makes the change,
+and published once it commits, so that a transaction rolled back announces nothing.
+Each event is published to __keyspace@<db>__:<key> with the event as message when the K class is enabled,
+and to __keyevent@<db>__:<event> with the key as message when the E class is.
+
+An expired key is announced once: either by the read that finds it expired first, which can't delete it,
+or by the write or the garbage collection that deletes it. lazilyExpired remembers the keys announced
+by reads until the garbage collection deleted them.
+*/
+
+// keyspaceEvents holds the classes of notify_keyspace_events
+var keyspaceEvents atomic.Int64
+
+// publishKeyspaceEvent delivers a notification to the subscribers of its channel
+var publishKeyspaceEvent func(channel, message []byte)
+
+type expiredKey struct {
+	db  int
+	key string
+	exp int64
+}
+
+var lazilyExpired = struct {
+	sync.Mutex
+	keys map[expiredKey]struct{}
+}{
+	keys: map[expiredKey]struct{}{},
+}
+
+type keyspaceNotification struct {
+	event string
+	db    int
+	key   []byte
+}
+
+// OnKeyspaceEvent registers the function publishing the keyspace notifications
+func OnKeyspaceEvent(publish func(channel, message []byte)) {
+	publishKeyspaceEvent = publish
+}
+
+func initKeyspaceEvents() {
+	apply := func() error {
+		// the value was validated when it was set
+		flags, _ := config.ParseKeyspaceEvents(config.Config.Server.NotifyKeyspaceEvents)
+		keyspaceEvents.Store(int64(flags))
+		return nil
+	}
+
+	config.OnSet("notify_keyspace_events", apply)
+	apply()
+}
+
+// notifying tells whether the events of a class are published
+func notifying(class int) bool {
+	flags := keyspaceEvents.Load()
+	return flags&int64(class) != 0 && flags&(config.NotifyKeyspace|config.NotifyKeyevent) != 0
+}
+
+// notify queues a keyspace notification, published when the operation commits
+func (dbOp *dbOperation) notify(class int, event string, dbNum int, key []byte) {
+	if !notifying(class) {
+		return
+	}
+
+	dbOp.notifications = append(dbOp.notifications, keyspaceNotification{event: event, db: dbNum, key: key})
+}
+
+// notifyExpired queues the expired event of a key, unless a read already announced it
+func (dbOp *dbOperation) notifyExpired(dbNum int, key []byte, exp time.Time) {
+	if !notifying(config.NotifyExpired) {
+		return
+	}
+
+	lazilyExpired.Lock()
+	_, announced := lazilyExpired.keys[expiredKey{db: dbNum, key: string(key), exp: exp.UnixNano()}]
+	lazilyExpired.Unlock()
+
+	if !announced {
+		dbOp.notify(config.NotifyExpired, "expired", dbNum, key)
+	}
+}
+
+// notifyLazilyExpired queues the expired event of a key found expired by a read, which leaves it to the garbage collection
+func (dbOp *dbOperation) notifyLazilyExpired(dbNum int, key []byte, exp time.Time) {
+	if !notifying(config.NotifyExpired) {
+		return
+	}
+
+	lazilyExpired.Lock()
+	defer lazilyExpired.Unlock()
+
+	expired := expiredKey{db: dbNum, key: string(key), exp: exp.UnixNano()}
+	if _, announced := lazilyExpired.keys[expired]; !announced {
+		lazilyExpired.keys[expired] = struct{}{}
+		dbOp.notify(config.NotifyExpired, "expired", dbNum, key)
+	}
+}
+
+// notifyNewKey queues the new event of a key about to be written, when it doesn't exist yet.
+// A key still there but expired is announced as expired first
+func (dbOp *dbOperation) notifyNewKey(dbNum int, key []byte) error {
+	if !notifying(config.NotifyNew) && !notifying(config.NotifyExpired) {
+		return nil
+	}
+
+	var exp sql.NullTime
+	if err := dbOp.Txn.QueryRow(fmt.Sprintf("SELECT exp FROM bigdis_%d WHERE key = ?", dbNum), key).Scan(&exp); err != nil {
+		if err != sql.ErrNoRows {
+			return err
+		}
+	} else if !exp.Valid || !exp.Time.Before(time.Now()) {
+		return nil
+	} else {
+		dbOp.notifyExpired(dbNum, key, exp.Time)
+	}
+
+	dbOp.notify(config.NotifyNew, "new", dbNum, key)
+	return nil
+}
+
+// forgetLazilyExpired drops the keys of a DB that expired before a garbage collection, it deleted them
+func forgetLazilyExpired(dbNum int, before time.Time) {
+	lazilyExpired.Lock()
+	defer lazilyExpired.Unlock()
+
+	for expired := range lazilyExpired.keys {
+		if expired.db == dbNum && expired.exp < before.UnixNano() {
+			delete(lazilyExpired.keys, expired)
+		}
+	}
+}
+
+// publishNotifications publishes the notifications of a committed operation
+func publishNotifications(notifications []keyspaceNotification) {
+	if publishKeyspaceEvent == nil {
+		return
+	}
+
+	flags := keyspaceEvents.Load()
+	for _, n := range notifications {
+		db := strconv.Itoa(n.db)
+		if flags&config.NotifyKeyspace != 0 {
+			channel := append([]byte("__keyspace@"+db+"__:"), n.key...)
+			publishKeyspaceEvent(channel, []byte(n.event))
+		}
+		if flags&config.NotifyKeyevent != 0 {
+			publishKeyspaceEvent([]byte("__keyevent@"+db+"__:"+n.event), n.key)
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package storage
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"bigdis/rdb"
+)
+
+// ImportRDBFile loads the keys of the RDB file at path, see ImportRDB
+func ImportRDBFile(path string, flush bool) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	return ImportRDB(bufio.NewReader(file), flush)
+}
+
+// ExportRDBFile writes the keys to an RDB file at path, the file is only replaced once the export is complete
+func ExportRDBFile(path string, redisVersion string) (int, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	keys, err := ExportRDB(tmp, redisVersion)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return 0, err
+	}
+
+	return keys, nil
+}
+
+// ImportRDB loads the keys of an RDB file in a single transaction, replacing the keys with the same name.
+// With flush all the DBs are emptied first. The expired keys are skipped, it returns the number of keys loaded.
+// The keys don't go through the change log, the replicas must resync from scratch and the journal is rewritten
+func ImportRDB(r io.Reader, flush bool) (int, error) {
+	return importRDB(r, flush, newReplicationID)
+}
+
+// importRDB is ImportRDB, with done run as the last step of the transaction
+func importRDB(r io.Reader, flush bool, done func(dbOp *dbOperation) error) (int, error) {
+	reader, err := rdb.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+
+	dbOp, err := startDBOperation(nil, true)
+	if err != nil {
+		return 0, err
+	}
+	defer dbOp.Txn.Rollback()
+
+	if flush {
+		for _, dbNum := range availableDBs() {
+			if err := dropDB(dbOp, dbNum); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	// the DBs are only made available once the transaction creating their tables is committed
+	created := map[int]struct{}{}
+	var keys int
+	now := time.Now()
+	for {
+		entry, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if !entry.ExpireAt.IsZero() && !entry.ExpireAt.After(now) {
+			continue
+		}
+
+		if _, exists := created[entry.DB]; !exists && !IsAvailableDB(entry.DB) {
+			if err := createDBTables(dbOp.Txn, entry.DB); err != nil {
+				return 0, err
+			}
+			created[entry.DB] = struct{}{}
+		}
+
+		if err := importEntry(dbOp, entry); err != nil {
+			return 0, err
+		}
+		keys++
+	}
+
+	if err := done(dbOp); err != nil {
+		return 0, err
+	}
+
+	if err := dbOp.Txn.Commit(); err != nil {
+		return 0, err
+	}
+	if dbOp.events {
+		notifyEvents()
+	}
+
+	availableDBsLock.Lock()
+	for dbNum := range created {
+		AvailableDBs[dbNum] = struct{}{}
+	}
+	availableDBsLock.Unlock()
+
+	// the keys didn't go through the change log either
+	keysReplaced()
+
+	return keys, nil
+}
+
+var rdbTypes = map[rdb.Type]string{
+	rdb.TypeString: "s",
+	rdb.TypeHash:   "h",
+	rdb.TypeList:   "l",
+	rdb.TypeSet:    "S",
+	rdb.TypeZSet:   "z",
+}
+
+// importEntry replaces a key with the one read from the RDB file
+func importEntry(dbOp *dbOperation, entry *rdb.Entry) error {
+	dbNum := entry.DB
+	if _, err := dropKey(dbOp, dbNum, entry.Key); err != nil {
+		return err
+	}
+
+	// Redis never keeps empty aggregates, but a file could still hold one
+	empty := len(entry.Elements) == 0 && len(entry.Fields) == 0 && len(entry.Members) == 0
+	if entry.Type != rdb.TypeString && empty {
+		return nil
+	}
+
+	value := entry.Value
+	if value == nil {
+		value = []byte{}
+	}
+	var exp sql.NullTime
+	if !entry.ExpireAt.IsZero() {
+		// Redis accepts later expirations than the exp column holds, they are as good as never
+		exp = sql.NullTime{Time: entry.ExpireAt.UTC(), Valid: true}
+		if exp.Time.After(maxExpireTime) {
+			exp.Time = maxExpireTime
+		}
+	}
+
+	var id int64
+	if err := dbOp.Txn.QueryRow(fmt.Sprintf("INSERT INTO bigdis_%d (key, value, type, exp) VALUES (?, ?, ?, ?) RETURNING id", dbNum),
+		entry.Key, value, rdbTypes[entry.Type], exp).Scan(&id); err != nil {
+		return err
+	}
+	var newValue []byte
+	if entry.Type == rdb.TypeString {
+		newValue = value
+	}
+	if err := dbOp.recordEvent(dbNum, entry.Key, eventSet, rdbTypes[entry.Type], nil, newValue); err != nil {
+		return err
+	}
+
+	switch entry.Type {
+	case rdb.TypeList:
+		for pos, element := range entry.Elements {
+			if _, err := dbOp.Txn.Exec(fmt.Sprintf("INSERT INTO bigdis_%d_list (key_id, pos, value) VALUES (?, ?, ?)", dbNum), id, pos, element); err != nil {
+				return err
+			}
+		}
+	case rdb.TypeSet:
+		for _, member := range entry.Elements {
+			if _, err := dbOp.Txn.Exec(fmt.Sprintf("INSERT INTO bigdis_%d_set (key_id, member) VALUES (?, ?) ON CONFLICT DO NOTHING", dbNum), id, member); err != nil {
+				return err
+			}
+		}
+	case rdb.TypeHash:
+		for _, field := range entry.Fields {
+			if _, err := dbOp.Txn.Exec(fmt.Sprintf(`
+				INSERT INTO bigdis_%d_hash (key_id, field, value) VALUES (?, ?, ?)
+				ON CONFLICT (key_id, field) DO UPDATE SET value = excluded.value`, dbNum), id, field[0], field[1]); err != nil {
+				return err
+			}
+		}
+	case rdb.TypeZSet:
+		for _, member := range entry.Members {
+			if _, err := dbOp.Txn.Exec(fmt.Sprintf(`
+				INSERT INTO bigdis_%d_zset (key_id, member, score) VALUES (?, ?, ?)
+				ON CONFLICT (key_id, member) DO UPDATE SET score = excluded.score`, dbNum), id, member.Member, member.Score); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// ExportRDB writes the live keys of every DB to an RDB file, all read in a single transaction
+// so that the file is consistent. It returns the number of keys written
+func ExportRDB(w io.Writer, redisVersion string) (int, error) {
+	dbOp, err := startDBOperation(nil, false)
+	if err != nil {
+		return 0, err
+	}
+	defer dbOp.Txn.Rollback()
+
+	return exportRDB(dbOp, w, redisVersion)
+}
+
+func exportRDB(dbOp *dbOperation, w io.Writer, redisVersion string) (int, error) {
+	writer, err := rdb.NewWriter(w, redisVersion)
+	if err != nil {
+		return 0, err
+	}
+
+	dbNums := availableDBs()
+	sort.Ints(dbNums)
+
+	var keys int
+	for _, dbNum := range dbNums {
+		exported, err := exportDB(dbOp, dbNum, writer.Write)
+		if err != nil {
+			return 0, err
+		}
+		keys += exported
+	}
+
+	if err := writer.Close(); err != nil {
+		return 0, err
+	}
+
+	return keys, nil
+}
+
+// exportDB reads the live keys of a DB and passes them to write one at a time
+func exportDB(dbOp *dbOperation, dbNum int, write func(entry *rdb.Entry) error) (int, error) {
+	rows, err := dbOp.Txn.Query(fmt.Sprintf("SELECT id, key, value, type, exp FROM bigdis_%d WHERE %s ORDER BY id", dbNum, liveKey))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var keys int
+	for rows.Next() {
+		var id int64
+		var keyType string
+		var exp sql.NullTime
+		entry := &rdb.Entry{DB: dbNum}
+		if err := rows.Scan(&id, &entry.Key, &entry.Value, &keyType, &exp); err != nil {
+			return 0, err
+		}
+		if exp.Valid {
+			entry.ExpireAt = exp.Time
+		}
+
+		if err := exportElements(dbOp, dbNum, id, keyType, entry); err != nil {
+			return 0, err
+		}
+		if err := write(entry); err != nil {
+			return 0, err
+		}
+		keys++
+	}
+
+	return keys, rows.Err()
+}
+
+// exportElements reads the elements of an aggregate key into the entry
+func exportElements(dbOp *dbOperation, dbNum int, id int64, keyType string, entry *rdb.Entry) error {
+	var query string
+	switch keyType {
+	case "s":
+		entry.Type = rdb.TypeString
+		return nil
+	case "l":
+		entry.Type = rdb.TypeList
+		query = "SELECT value FROM bigdis_%d_list WHERE key_id = ? ORDER BY pos"
+	case "S":
+		entry.Type = rdb.TypeSet
+		query = "SELECT member FROM bigdis_%d_set WHERE key_id = ? ORDER BY id"
+	case "h":
+		entry.Type = rdb.TypeHash
+		query = "SELECT field, value FROM bigdis_%d_hash WHERE key_id = ? ORDER BY id"
+	case "z":
+		entry.Type = rdb.TypeZSet
+		query = "SELECT member, score FROM bigdis_%d_zset WHERE key_id = ? ORDER BY score, member"
+	default:
+		return fmt.Errorf("unknown type %q of key %q", keyType, entry.Key)
+	}
+	entry.Value = nil
+
+	rows, err := dbOp.Txn.Query(fmt.Sprintf(query, dbNum), id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		switch entry.Type {
+		case rdb.TypeList, rdb.TypeSet:
+			var element []byte
+			if err := rows.Scan(&element); err != nil {
+				return err
+			}
+			entry.Elements = append(entry.Elements, element)
+		case rdb.TypeHash:
+			var field, value []byte
+			if err := rows.Scan(&field, &value); err != nil {
+				return err
+			}
+			entry.Fields = append(entry.Fields, [2][]byte{field, value})
+		case rdb.TypeZSet:
+			var member rdb.ZMember
+			if err := rows.Scan(&member.Member, &member.Score); err != nil {
+				return err
+			}
+			entry.Members = append(entry.Members, member)
+		}
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,368 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bigdis/config"
+)
+
+/*
+The change log records every write command committed on the primary, in the same transaction as the write itself.
+
+Each change gets the next offset of the replication table, which also holds the replication ID:
+the offsets are only comparable between two servers with the same ID. A replica writes the changes
+it applies to its own log with the offsets of the primary, so it knows where to resume after a restart.
+The changes are logged whether replicas are connected or not: the replicas pull them, so one that is
+restarting or that lost its link catches up from its offset, and the offsets number the journal and
+the snapshots. The transaction logging a change drops the ones beyond the last change_log_size, so the
+log never holds more, a replica that fell behind further needs a full resync.
+*/
+
+var ErrChangesUnavailable = errors.New("the changes are no longer in the change log")
+
+// Change is a write command of the change log
+type Change struct {
+	Offset int64
+	DB     int
+	Args   [][]byte // the command name followed by its arguments
+	Time   time.Time
+}
+
+// changeLogSize holds change_log_size, read by every write without taking config.Lock
+var changeLogSize atomic.Int64
+
+func initChangeLog() {
+	apply := func() error {
+		changeLogSize.Store(int64(config.Config.Replication.ChangeLogSize))
+		return nil
+	}
+
+	config.OnSet("change_log_size", apply)
+	apply()
+}
+
+// committedChanges is closed and replaced every time a transaction logging changes commits
+var committedChanges = struct {
+	sync.Mutex
+	ch chan struct{}
+}{
+	ch: make(chan struct{}),
+}
+
+func notifyChanges() {
+	committedChanges.Lock()
+	close(committedChanges.ch)
+	committedChanges.ch = make(chan struct{})
+	committedChanges.Unlock()
+}
+
+// Replication returns the replication ID and the offset of the last change
+func Replication() (string, int64, error) {
+	var replid string
+	var offset int64
+	if err := DBrp.QueryRow("SELECT replid, offset FROM replication").Scan(&replid, &offset); err != nil {
+		return "", 0, err
+	}
+
+	return replid, offset, nil
+}
+
+// LogChange appends a write command to the change log, as part of the transaction that runs it
+func LogChange(dbOp *DBOperation, dbNum int, args [][]byte) error {
+	var offset int64
+	if err := dbOp.Txn.QueryRow("UPDATE replication SET offset = offset + 1 RETURNING offset").Scan(&offset); err != nil {
+		return err
+	}
+
+	return insertChange(dbOp, &Change{Offset: offset, DB: dbNum, Args: args})
+}
+
+// LogReplicatedChange appends a change received from the primary with its offset
+func LogReplicatedChange(dbOp *DBOperation, change *Change) error {
+	if _, err := dbOp.Txn.Exec("UPDATE replication SET offset = ?", change.Offset); err != nil {
+		return err
+	}
+
+	return insertChange(dbOp, change)
+}
+
+func insertChange(dbOp *DBOperation, change *Change) error {
+	if _, err := dbOp.Txn.Exec("INSERT INTO change_log (offset, db, command) VALUES (?, ?, ?)",
+		change.Offset, change.DB, EncodeCommand(change.Args)); err != nil {
+		return err
+	}
+	if _, err := dbOp.Txn.Exec("DELETE FROM change_log WHERE offset <= ?", change.Offset-changeLogSize.Load()); err != nil {
+		return err
+	}
+	if change.Time.IsZero() {
+		change.Time = time.Now()
+	}
+	dbOp.changes = append(dbOp.changes, change)
+
+	return nil
+}
+
+// Changes returns up to count changes following the offset after, of the history with the replication ID replid.
+// It returns ErrChangesUnavailable when they are not all in the change log anymore, or never were
+func Changes(replid string, after int64, count int) ([]*Change, error) {
+	dbOp, err := startDBOperation(nil, false)
+	if err != nil {
+		return nil, err
+	}
+	defer dbOp.Txn.Rollback()
+
+	var currentID string
+	var offset int64
+	if err := dbOp.Txn.QueryRow("SELECT replid, offset FROM replication").Scan(&currentID, &offset); err != nil {
+		return nil, err
+	}
+	var first sql.NullInt64
+	if err := dbOp.Txn.QueryRow("SELECT min(offset) FROM change_log").Scan(&first); err != nil {
+		return nil, err
+	}
+	if !first.Valid {
+		first.Int64 = offset + 1
+	}
+	if replid != currentID || after < first.Int64-1 || after > offset {
+		return nil, ErrChangesUnavailable
+	}
+
+	rows, err := dbOp.Txn.Query("SELECT offset, db, command, created FROM change_log WHERE offset > ? ORDER BY offset LIMIT ?", after, count)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []*Change{}
+	for rows.Next() {
+		change := &Change{}
+		var command []byte
+		if err := rows.Scan(&change.Offset, &change.DB, &command, &change.Time); err != nil {
+			return nil, err
+		}
+		if change.Args, err = DecodeCommand(bufio.NewReader(bytes.NewReader(command))); err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+
+	return changes, rows.Err()
+}
+
+// WaitChanges returns once there are changes after the offset after, or once the timeout expired
+func WaitChanges(after int64, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		// the channel is taken first so that a commit can't be missed between the check and the wait
+		committedChanges.Lock()
+		committed := committedChanges.ch
+		committedChanges.Unlock()
+
+		_, offset, err := Replication()
+		if err != nil {
+			return err
+		}
+		if offset > after {
+			return nil
+		}
+
+		select {
+		case <-committed:
+		case <-timer.C:
+			return nil
+		}
+	}
+}
+
+// ChangeLogRange returns the offsets of the first and the last change in the change log, 0 when it is empty
+func ChangeLogRange() (int64, int64, error) {
+	var first, last int64
+	if err := DBrp.QueryRow("SELECT coalesce(min(offset), 0), coalesce(max(offset), 0) FROM change_log").Scan(&first, &last); err != nil {
+		return 0, 0, err
+	}
+
+	return first, last, nil
+}
+
+// NewReplicationID starts a new history, as when a replica becomes a primary: the offsets go on from where they are
+func NewReplicationID() error {
+	dbOp, err := startDBOperation(nil, true)
+	if err != nil {
+		return err
+	}
+	defer dbOp.Txn.Rollback()
+
+	if err := newReplicationID(dbOp); err != nil {
+		return err
+	}
+
+	return dbOp.endDBOperation()
+}
+
+// newReplicationID is NewReplicationID as part of a wider transaction
+func newReplicationID(dbOp *dbOperation) error {
+	_, err := dbOp.Txn.Exec("UPDATE replication SET replid = lower(hex(randomblob(20)))")
+	return err
+}
+
+// RDBSnapshot is an RDB file of the keys at an offset of the change log, in a temporary file that Close deletes
+type RDBSnapshot struct {
+	*os.File
+	Size   int64
+	ReplID string
+	Offset int64
+}
+
+// Close closes and deletes the file
+func (s *RDBSnapshot) Close() error {
+	err := s.File.Close()
+	os.Remove(s.Name())
+
+	return err
+}
+
+// SnapshotRDB writes the keys as an RDB file along with the replication ID and the offset they are at.
+// The file is written next to the dump file rather than in memory, it is read from the start once complete
+func SnapshotRDB(redisVersion string) (*RDBSnapshot, error) {
+	config.Lock.RLock()
+	dir := filepath.Dir(config.Config.Storage.DumpPath)
+	config.Lock.RUnlock()
+
+	file, err := os.CreateTemp(dir, "bigdis-snapshot-*.rdb")
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &RDBSnapshot{File: file}
+
+	if err := snapshotRDB(snapshot, redisVersion); err != nil {
+		snapshot.Close()
+		return nil, err
+	}
+
+	return snapshot, nil
+}
+
+func snapshotRDB(snapshot *RDBSnapshot, redisVersion string) error {
+	dbOp, err := startDBOperation(nil, false)
+	if err != nil {
+		return err
+	}
+	defer dbOp.Txn.Rollback()
+
+	if err := dbOp.Txn.QueryRow("SELECT replid, offset FROM replication").Scan(&snapshot.ReplID, &snapshot.Offset); err != nil {
+		return err
+	}
+
+	if _, err := exportRDB(dbOp, snapshot.File, redisVersion); err != nil {
+		return err
+	}
+
+	if snapshot.Size, err = snapshot.Seek(0, io.SeekCurrent); err != nil {
+		return err
+	}
+	_, err = snapshot.Seek(0, io.SeekStart)
+
+	return err
+}
+
+// LoadSnapshot replaces all the keys with the ones of an RDB snapshot of the primary,
+// taking its replication ID and offset. The change log of the previous history is dropped
+func LoadSnapshot(r io.Reader, replid string, offset int64) error {
+	_, err := importRDB(r, true, func(dbOp *dbOperation) error {
+		if _, err := dbOp.Txn.Exec("DELETE FROM change_log"); err != nil {
+			return err
+		}
+
+		_, err := dbOp.Txn.Exec("UPDATE replication SET replid = ?, offset = ?", replid, offset)
+		return err
+	})
+
+	return err
+}
+
+// trimChangeLog drops the oldest changes beyond change_log_size, after it was lowered
+func trimChangeLog() (int64, error) {
+	result, err := DBwp.Exec("DELETE FROM change_log WHERE offset <= (SELECT offset FROM replication) - ?", changeLogSize.Load())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// EncodeCommand encodes a command the way clients send them, as an array of bulk strings
+func EncodeCommand(args [][]byte) []byte {
+	buf := fmt.Appendf(nil, "*%d\r\n", len(args))
+	for _, arg := range args {
+		buf = fmt.Appendf(buf, "$%d\r\n", len(arg))
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+
+	return buf
+}
+
+// DecodeCommand reads a command encoded by EncodeCommand
+func DecodeCommand(r *bufio.Reader) ([][]byte, error) {
+	args, _, err := decodeCommand(r)
+	return args, err
+}
+
+// decodeCommand is DecodeCommand, also returning the number of bytes the command took.
+// It returns io.EOF when the input ends before the command does
+func decodeCommand(r *bufio.Reader) ([][]byte, int64, error) {
+	count, read, err := readPrefixedLength(r, '*')
+	if err != nil {
+		return nil, 0, err
+	}
+
+	args := make([][]byte, count)
+	for i := range args {
+		size, n, err := readPrefixedLength(r, '$')
+		if err != nil {
+			return nil, 0, err
+		}
+
+		args[i] = make([]byte, size+2)
+		if _, err := io.ReadFull(r, args[i]); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			return nil, 0, err
+		}
+		args[i] = args[i][:size]
+		read += n + int64(size) + 2
+	}
+
+	return args, read, nil
+}
+
+func readPrefixedLength(r *bufio.Reader, prefix byte) (int, int64, error) {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(line) < 3 || line[0] != prefix || line[len(line)-2] != '\r' {
+		return 0, 0, fmt.Errorf("invalid command encoding %q", line)
+	}
+
+	length, err := strconv.Atoi(string(line[1 : len(line)-2]))
+	if err != nil || length < 0 {
+		return 0, 0, fmt.Errorf("invalid command encoding %q", line)
+	}
+
+	return length, int64(len(line)), nil
+}
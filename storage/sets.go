@@ -1 +1,684 @@
 package storage
+
+import (
+	"bigdis/config"
+	"bigdis/utils"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+/*
+Sets are stored one row per member in the bigdis_N_set table.
+
+The set algebra (SINTER, SUNION, SDIFF and friends) is pushed down
+to SQLite compound selects, so that huge sets are never loaded in memory.
+*/
+
+const setType = "S"
+
+type setOperation string
+
+const (
+	setInter setOperation = "INTERSECT"
+	setUnion setOperation = "UNION"
+	setDiff  setOperation = "EXCEPT"
+)
+
+// setIDs returns the ids of the given sets, 0 for the ones that don't exist
+func setIDs(dbOp *dbOperation, dbNum int, keys [][]byte) ([]int64, error) {
+	ids := make([]int64, len(keys))
+	for i, key := range keys {
+		id, err := getKeyID(dbOp, dbNum, key, setType)
+		if err != nil {
+			return nil, err
+		}
+
+		ids[i] = id
+	}
+
+	return ids, nil
+}
+
+// setAlgebraQuery builds the compound select computing op over the given sets.
+// ok is false when the result is known to be empty.
+func setAlgebraQuery(dbNum int, op setOperation, ids []int64) (query string, args []any, ok bool) {
+	var selects []string
+	for i, id := range ids {
+		if id == 0 {
+			// a missing key is an empty set
+			if op == setInter || (op == setDiff && i == 0) {
+				return "", nil, false
+			}
+
+			continue
+		}
+
+		selects = append(selects, fmt.Sprintf("SELECT member FROM bigdis_%d_set WHERE key_id = ?", dbNum))
+		args = append(args, id)
+	}
+
+	if len(selects) == 0 {
+		return "", nil, false
+	}
+
+	return strings.Join(selects, fmt.Sprintf(" %s ", op)), args, true
+}
+
+func setAdd(dbOp *dbOperation, dbNum int, id int64, members [][]byte) (int, error) {
+	var added int
+	for _, member := range members {
+		result, err := dbOp.Txn.Exec(fmt.Sprintf("INSERT INTO bigdis_%d_set (key_id, member) VALUES (?, ?) ON CONFLICT(key_id, member) DO NOTHING", dbNum), id, member)
+		if err != nil {
+			return 0, err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+
+		added += int(rowsAffected)
+	}
+
+	return added, nil
+}
+
+func setRem(dbOp *dbOperation, dbNum int, key []byte, id int64, members [][]byte) (int, error) {
+	var removed int
+	for _, member := range members {
+		result, err := dbOp.Txn.Exec(fmt.Sprintf("DELETE FROM bigdis_%d_set WHERE key_id = ? and member = ?", dbNum), id, member)
+		if err != nil {
+			return 0, err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+
+		removed += int(rowsAffected)
+	}
+
+	if removed > 0 {
+		dbOp.notify(config.NotifySet, "srem", dbNum, key)
+		if err := deleteKeyIfEmpty(dbOp, dbNum, id, fmt.Sprintf("bigdis_%d_set", dbNum)); err != nil {
+			return 0, err
+		}
+	}
+
+	return removed, nil
+}
+
+func SAdd(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	var err error
+	dbOp, err = startDBOperation(dbOp, true)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	id, err := createKeyID(dbOp, dbNum, args[0], setType)
+	if err != nil {
+		return 0, err
+	}
+
+	added, err := setAdd(dbOp, dbNum, id, args[1:])
+	if err != nil {
+		return 0, err
+	}
+
+	if err := touchKey(dbOp, dbNum, id); err != nil {
+		return 0, err
+	}
+	if added > 0 {
+		dbOp.notify(config.NotifySet, "sadd", dbNum, args[0])
+	}
+
+	return added, nil
+}
+
+func SRem(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	var err error
+	dbOp, err = startDBOperation(dbOp, true)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	id, err := getKeyID(dbOp, dbNum, args[0], setType)
+	if err != nil || id == 0 {
+		return 0, err
+	}
+
+	return setRem(dbOp, dbNum, args[0], id, args[1:])
+}
+
+func SMembers(dbNum int, args [][]byte, dbOp *dbOperation) ([]any, error) {
+	return setAlgebra(dbNum, setUnion, args[:1], dbOp)
+}
+
+func SMIsMember(dbNum int, args [][]byte, dbOp *dbOperation) ([]any, error) {
+	var err error
+	dbOp, err = startDBOperation(dbOp, false)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	results := make([]any, len(args)-1)
+	for i := range results {
+		results[i] = 0
+	}
+
+	id, err := getKeyID(dbOp, dbNum, args[0], setType)
+	if err != nil || id == 0 {
+		return results, err
+	}
+
+	for i, member := range args[1:] {
+		var exists bool
+		if err := dbOp.Txn.QueryRow(fmt.Sprintf("SELECT EXISTS(SELECT 1 FROM bigdis_%d_set WHERE key_id = ? and member = ?)", dbNum), id, member).Scan(&exists); err != nil {
+			return nil, err
+		}
+
+		if exists {
+			results[i] = 1
+		}
+	}
+
+	return results, nil
+}
+
+func SIsMember(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	results, err := SMIsMember(dbNum, args, dbOp)
+	if err != nil {
+		return 0, err
+	}
+
+	return results[0].(int), nil
+}
+
+func SCard(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	var err error
+	dbOp, err = startDBOperation(dbOp, false)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	id, err := getKeyID(dbOp, dbNum, args[0], setType)
+	if err != nil || id == 0 {
+		return 0, err
+	}
+
+	var card int
+	if err := dbOp.Txn.QueryRow(fmt.Sprintf("SELECT count(*) FROM bigdis_%d_set WHERE key_id = ?", dbNum), id).Scan(&card); err != nil {
+		return 0, err
+	}
+
+	return card, nil
+}
+
+/*
+SPop returns nil if the key doesn't exist.
+
+Without the count argument at most one member is returned,
+the handler is in charge of replying with a bulk string in that case.
+*/
+func SPop(dbNum int, args [][]byte, dbOp *dbOperation) ([]any, error) {
+	count := int64(1)
+	if len(args) > 1 {
+		var err error
+		count, err = strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil || count < 0 {
+			return nil, utils.ErrValueOutOfRange
+		}
+	}
+
+	var err error
+	dbOp, err = startDBOperation(dbOp, true)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	id, err := getKeyID(dbOp, dbNum, args[0], setType)
+	if err != nil || id == 0 {
+		return nil, err
+	}
+
+	rows, err := dbOp.Txn.Query(fmt.Sprintf("DELETE FROM bigdis_%[1]d_set WHERE id IN (SELECT id FROM bigdis_%[1]d_set WHERE key_id = ? ORDER BY random() LIMIT ?) RETURNING member", dbNum), id, count)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []any{}
+	for rows.Next() {
+		var member []byte
+		if err := rows.Scan(&member); err != nil {
+			return nil, err
+		}
+
+		members = append(members, member)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+
+	if len(members) > 0 {
+		dbOp.notify(config.NotifySet, "spop", dbNum, args[0])
+		if err := deleteKeyIfEmpty(dbOp, dbNum, id, fmt.Sprintf("bigdis_%d_set", dbNum)); err != nil {
+			return nil, err
+		}
+	}
+
+	return members, nil
+}
+
+/*
+SRandMember returns random members of a set.
+
+A positive count returns distinct members, a negative count allows the same member
+to be returned multiple times and always returns exactly -count members.
+*/
+func SRandMember(dbNum int, args [][]byte, dbOp *dbOperation) ([]any, error) {
+	count := int64(1)
+	if len(args) > 1 {
+		var err error
+		count, err = strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil {
+			return nil, utils.ErrNotInteger
+		}
+	}
+
+	var err error
+	dbOp, err = startDBOperation(dbOp, false)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	members := []any{}
+
+	id, err := getKeyID(dbOp, dbNum, args[0], setType)
+	if err != nil || id == 0 || count == 0 {
+		return members, err
+	}
+
+	if count < 0 {
+		// every pick is independent so the same member can show up more than once
+		var card int64
+		if err := dbOp.Txn.QueryRow(fmt.Sprintf("SELECT count(*) FROM bigdis_%d_set WHERE key_id = ?", dbNum), id).Scan(&card); err != nil {
+			return nil, err
+		}
+
+		for i := int64(0); i < -count; i++ {
+			var member []byte
+			if err := dbOp.Txn.QueryRow(fmt.Sprintf("SELECT member FROM bigdis_%d_set WHERE key_id = ? ORDER BY id LIMIT 1 OFFSET ?", dbNum), id, rand.Int63n(card)).Scan(&member); err != nil {
+				return nil, err
+			}
+
+			members = append(members, member)
+		}
+
+		return members, nil
+	}
+
+	rows, err := dbOp.Txn.Query(fmt.Sprintf("SELECT member FROM bigdis_%d_set WHERE key_id = ? ORDER BY random() LIMIT ?", dbNum), id, count)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var member []byte
+		if err := rows.Scan(&member); err != nil {
+			return nil, err
+		}
+
+		members = append(members, member)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return members, nil
+}
+
+func SMove(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	var err error
+	dbOp, err = startDBOperation(dbOp, true)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	ids, err := setIDs(dbOp, dbNum, args[:2])
+	if err != nil {
+		return 0, err
+	}
+	if ids[0] == 0 {
+		return 0, nil
+	}
+
+	removed, err := setRem(dbOp, dbNum, args[0], ids[0], args[2:])
+	if err != nil || removed == 0 {
+		return 0, err
+	}
+
+	dstID, err := createKeyID(dbOp, dbNum, args[1], setType)
+	if err != nil {
+		return 0, err
+	}
+
+	added, err := setAdd(dbOp, dbNum, dstID, args[2:])
+	if err != nil {
+		return 0, err
+	}
+
+	if err := touchKey(dbOp, dbNum, dstID); err != nil {
+		return 0, err
+	}
+	if added > 0 {
+		dbOp.notify(config.NotifySet, "sadd", dbNum, args[1])
+	}
+
+	return 1, nil
+}
+
+func setAlgebra(dbNum int, op setOperation, keys [][]byte, dbOp *dbOperation) ([]any, error) {
+	var err error
+	dbOp, err = startDBOperation(dbOp, false)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	members := []any{}
+
+	ids, err := setIDs(dbOp, dbNum, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	query, queryArgs, ok := setAlgebraQuery(dbNum, op, ids)
+	if !ok {
+		return members, nil
+	}
+
+	rows, err := dbOp.Txn.Query(query, queryArgs...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var member []byte
+		if err := rows.Scan(&member); err != nil {
+			return nil, err
+		}
+
+		members = append(members, member)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return members, nil
+}
+
+func SInter(dbNum int, args [][]byte, dbOp *dbOperation) ([]any, error) {
+	return setAlgebra(dbNum, setInter, args, dbOp)
+}
+
+func SUnion(dbNum int, args [][]byte, dbOp *dbOperation) ([]any, error) {
+	return setAlgebra(dbNum, setUnion, args, dbOp)
+}
+
+func SDiff(dbNum int, args [][]byte, dbOp *dbOperation) ([]any, error) {
+	return setAlgebra(dbNum, setDiff, args, dbOp)
+}
+
+/*
+setAlgebraStore stores the result of op in the set at args[0], replacing whatever was there.
+
+The destination can be one of the sources too, so the result is first
+staged in a temporary table and only then moved to the destination.
+*/
+func setAlgebraStore(dbNum int, op setOperation, event string, args [][]byte, dbOp *dbOperation) (int, error) {
+	var err error
+	dbOp, err = startDBOperation(dbOp, true)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	ids, err := setIDs(dbOp, dbNum, args[1:])
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := dbOp.Txn.Exec(`
+		CREATE TEMP TABLE IF NOT EXISTS bigdis_set_store (member BLOB PRIMARY KEY);
+		DELETE FROM temp.bigdis_set_store`); err != nil {
+		return 0, err
+	}
+
+	if query, queryArgs, ok := setAlgebraQuery(dbNum, op, ids); ok {
+		if _, err := dbOp.Txn.Exec(fmt.Sprintf("INSERT INTO temp.bigdis_set_store %s", query), queryArgs...); err != nil {
+			return 0, err
+		}
+	}
+
+	// the destination is overwritten whatever its type
+	overwritten, err := dropKey(dbOp, dbNum, args[0])
+	if err != nil {
+		return 0, err
+	}
+
+	var card int
+	if err := dbOp.Txn.QueryRow("SELECT count(*) FROM temp.bigdis_set_store").Scan(&card); err != nil {
+		return 0, err
+	}
+
+	if card > 0 {
+		id, err := createKeyID(dbOp, dbNum, args[0], setType)
+		if err != nil {
+			return 0, err
+		}
+
+		if _, err := dbOp.Txn.Exec(fmt.Sprintf("INSERT INTO bigdis_%d_set (key_id, member) SELECT ?, member FROM temp.bigdis_set_store", dbNum), id); err != nil {
+			return 0, err
+		}
+		if err := touchKey(dbOp, dbNum, id); err != nil {
+			return 0, err
+		}
+		dbOp.notify(config.NotifySet, event, dbNum, args[0])
+	} else if overwritten {
+		dbOp.notify(config.NotifyGeneric, "del", dbNum, args[0])
+	}
+
+	if _, err := dbOp.Txn.Exec("DELETE FROM temp.bigdis_set_store"); err != nil {
+		return 0, err
+	}
+
+	return card, nil
+}
+
+func SInterStore(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	return setAlgebraStore(dbNum, setInter, "sinterstore", args, dbOp)
+}
+
+func SUnionStore(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	return setAlgebraStore(dbNum, setUnion, "sunionstore", args, dbOp)
+}
+
+func SDiffStore(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	return setAlgebraStore(dbNum, setDiff, "sdiffstore", args, dbOp)
+}
+
+// SInterCard takes numkeys key [key ...] [LIMIT limit]
+func SInterCard(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	numKeys, err := strconv.Atoi(string(args[0]))
+	if err != nil || numKeys < 1 {
+		return 0, errors.New("ERR numkeys should be greater than 0")
+	}
+	if numKeys > len(args)-1 {
+		return 0, errors.New("ERR Number of keys can't be greater than number of args")
+	}
+
+	limit := -1
+	options := args[1+numKeys:]
+	if len(options) > 0 {
+		if len(options) != 2 || strings.ToLower(string(options[0])) != "limit" {
+			return 0, utils.ErrSyntaxError
+		}
+
+		limit, err = strconv.Atoi(string(options[1]))
+		if err != nil || limit < 0 {
+			return 0, errors.New("ERR LIMIT can't be negative")
+		}
+
+		// LIMIT 0 means unlimited
+		if limit == 0 {
+			limit = -1
+		}
+	}
+
+	dbOp, err = startDBOperation(dbOp, false)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	ids, err := setIDs(dbOp, dbNum, args[1:1+numKeys])
+	if err != nil {
+		return 0, err
+	}
+
+	query, queryArgs, ok := setAlgebraQuery(dbNum, setInter, ids)
+	if !ok {
+		return 0, nil
+	}
+
+	var card int
+	if err := dbOp.Txn.QueryRow(fmt.Sprintf("SELECT count(*) FROM (%s LIMIT ?)", query), append(queryArgs, limit)...).Scan(&card); err != nil {
+		return 0, err
+	}
+
+	return card, nil
+}
+
+// SScan works like HScan, see there for the cursor semantics
+func SScan(dbNum int, args [][]byte, dbOp *dbOperation) (int64, []any, error) {
+	cursor, err := parseCursor(args[1])
+	if err != nil {
+		return 0, nil, err
+	}
+
+	pattern, count, err := parseScanArgs(args[2:], nil)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	dbOp, err = startDBOperation(dbOp, false)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	members := []any{}
+
+	id, err := getKeyID(dbOp, dbNum, args[0], setType)
+	if err != nil || id == 0 {
+		return 0, members, err
+	}
+
+	rows, err := dbOp.Txn.Query(fmt.Sprintf("SELECT id, member FROM bigdis_%d_set WHERE key_id = ? and id > ? ORDER BY id LIMIT ?", dbNum), id, cursor, count)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	var scanned int
+	var lastID int64
+	for rows.Next() {
+		var member []byte
+		if err := rows.Scan(&lastID, &member); err != nil {
+			return 0, nil, err
+		}
+		scanned++
+
+		if pattern != nil && !utils.GlobMatch(pattern, member, false) {
+			continue
+		}
+
+		members = append(members, member)
+	}
+
+	if err := rows.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	// iteration is over
+	if scanned < count {
+		lastID = 0
+	}
+
+	return lastID, members, nil
+}
@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"bigdis/config"
+)
+
+/*
+Snapshots are consistent copies of the database file.
+
+The database is copied with VACUUM INTO from a connection of the read pool, in a single read transaction:
+the copy is the database as it was when the snapshot started, and the clients keep reading and writing meanwhile
+as the WAL leaves the writers alone. The copy is written next to the dump file and renamed over it once complete,
+its progress is estimated from the size of the file.
+*/
+
+// snapshotProgressInterval is the period of the updates of the progress of a snapshot
+const snapshotProgressInterval = 100 * time.Millisecond
+
+var (
+	ErrSaveInProgress = errors.New("ERR Background save already in progress")
+	errSnapshotFailed = errors.New("ERR Snapshot failed, check the server logs for more information")
+)
+
+// SnapshotState is the progress of the snapshots reported by INFO persistence
+type SnapshotState struct {
+	InProgress bool
+	Started    time.Time
+	PagesDone  int
+	PagesTotal int
+	Scheduled  bool // BGSAVE SCHEDULE asked for another snapshot once the current one is done
+
+	LastSave     time.Time // end of the last successful snapshot, the start of the server before any
+	LastStatus   string
+	LastDuration time.Duration
+	Saves        int
+}
+
+var snapshot = struct {
+	sync.Mutex
+	state SnapshotState
+}{
+	state: SnapshotState{
+		LastSave:     time.Now(),
+		LastStatus:   "ok",
+		LastDuration: -1,
+	},
+}
+
+// Snapshot returns the state of the snapshots
+func Snapshot() SnapshotState {
+	snapshot.Lock()
+	defer snapshot.Unlock()
+
+	return snapshot.state
+}
+
+// Save writes a snapshot to the dump path and returns once it is complete
+func Save() error {
+	if err := startSnapshot(); err != nil {
+		return err
+	}
+
+	if err := runSnapshot(); err != nil {
+		return errSnapshotFailed
+	}
+
+	return nil
+}
+
+// BGSave writes a snapshot in the background. With schedule, a snapshot already
+// in progress is not an error: another one starts when it ends, and scheduled is true
+func BGSave(schedule bool) (scheduled bool, err error) {
+	if err := startSnapshot(); err != nil {
+		if !schedule {
+			return false, err
+		}
+
+		snapshot.Lock()
+		snapshot.state.Scheduled = true
+		snapshot.Unlock()
+
+		return true, nil
+	}
+
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		runSnapshot()
+	}()
+
+	return false, nil
+}
+
+func startSnapshot() error {
+	snapshot.Lock()
+	defer snapshot.Unlock()
+
+	if snapshot.state.InProgress {
+		return ErrSaveInProgress
+	}
+	snapshot.state.InProgress = true
+	snapshot.state.Started = time.Now()
+	snapshot.state.PagesDone, snapshot.state.PagesTotal = 0, 0
+
+	return nil
+}
+
+// runSnapshot copies the database and records the outcome, then starts the snapshot scheduled meanwhile
+func runSnapshot() error {
+	config.Lock.RLock()
+	path := config.Config.Storage.DumpPath
+	config.Lock.RUnlock()
+
+	err := backup(path)
+	if err != nil {
+		log.Printf("Error while writing the snapshot to %s: %s\n", path, err)
+	}
+
+	snapshot.Lock()
+	snapshot.state.InProgress = false
+	snapshot.state.PagesDone, snapshot.state.PagesTotal = 0, 0
+	snapshot.state.LastDuration = time.Since(snapshot.state.Started)
+	if err == nil {
+		snapshot.state.LastSave = time.Now()
+		snapshot.state.LastStatus = "ok"
+		snapshot.state.Saves++
+	} else {
+		snapshot.state.LastStatus = "err"
+	}
+	scheduled := snapshot.state.Scheduled
+	snapshot.state.Scheduled = false
+	snapshot.Unlock()
+
+	if scheduled {
+		BGSave(true)
+	}
+
+	return err
+}
+
+// backup copies the database into path, through a temporary file renamed once the copy is complete
+func backup(path string) error {
+	tmpPath := fmt.Sprintf("%s.%d.tmp", path, os.Getpid())
+	defer os.Remove(tmpPath)
+	// VACUUM INTO refuses to write over an existing file, a previous run may have left one behind
+	os.Remove(tmpPath)
+
+	ctx := context.Background()
+	conn, err := DBrp.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var pageSize, pageCount int
+	if err := conn.QueryRowContext(ctx, "PRAGMA page_size").Scan(&pageSize); err != nil {
+		return err
+	}
+	if err := conn.QueryRowContext(ctx, "PRAGMA page_count").Scan(&pageCount); err != nil {
+		return err
+	}
+	snapshot.Lock()
+	snapshot.state.PagesTotal = pageCount
+	snapshot.Unlock()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(snapshotProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if info, err := os.Stat(tmpPath); err == nil {
+					snapshot.Lock()
+					snapshot.state.PagesDone = min(int(info.Size()/int64(pageSize)), pageCount)
+					snapshot.Unlock()
+				}
+			}
+		}
+	}()
+
+	if _, err := conn.ExecContext(ctx, "VACUUM INTO ?", tmpPath); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
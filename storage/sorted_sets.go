@@ -1 +1,1037 @@
 package storage
+
+import (
+	"bigdis/config"
+	"bigdis/utils"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+/*
+Sorted sets are stored one row per member in the bigdis_N_zset table,
+indexed on (key_id, score, member) so that every range query is an index scan.
+
+Members with the same score are ordered lexicographically, exactly as in Redis,
+since SQLite compares BLOBs with memcmp().
+*/
+
+const zsetType = "z"
+
+var (
+	errZSetNotFloat     = errors.New("ERR min or max is not a float")
+	errZSetNotLex       = errors.New("ERR min or max not valid string range item")
+	errZSetNaN          = errors.New("ERR resulting score is not a number (NaN)")
+	errZAddNXAndXX      = errors.New("ERR XX and NX options at the same time are not compatible")
+	errZAddNXAndGTLT    = errors.New("ERR GT, LT, and/or NX options at the same time are not compatible")
+	errZAddIncrPairs    = errors.New("ERR INCR option supports a single increment-element pair")
+	errZRangeLimit      = errors.New("ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+	errZRangeWithScores = errors.New("ERR syntax error, WITHSCORES not supported in combination with BYLEX")
+)
+
+// parseScore parses a score the way Redis does, accepting inf, +inf and -inf
+func parseScore(value []byte) (float64, error) {
+	score, err := strconv.ParseFloat(string(value), 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, utils.ErrNotFloat
+	}
+
+	return score, nil
+}
+
+// formatScore formats a score the way Redis replies with it
+func formatScore(score float64) []byte {
+	switch {
+	case math.IsInf(score, 1):
+		return []byte("inf")
+	case math.IsInf(score, -1):
+		return []byte("-inf")
+	}
+
+	return []byte(strconv.FormatFloat(score, 'g', -1, 64))
+}
+
+// scoreCondition parses a score range item, e.g. 1.5, (1.5 or -inf, into an SQL condition
+func scoreCondition(item []byte, min bool) (string, any, error) {
+	operator := "<="
+	if min {
+		operator = ">="
+	}
+
+	if len(item) > 0 && item[0] == '(' {
+		item = item[1:]
+		operator = operator[:1]
+	}
+
+	score, err := strconv.ParseFloat(string(item), 64)
+	if err != nil || math.IsNaN(score) {
+		return "", nil, errZSetNotFloat
+	}
+
+	return "score " + operator + " ?", score, nil
+}
+
+// lexCondition parses a lex range item, e.g. [a, (a, - or +, into an SQL condition.
+// The condition is empty when the item doesn't limit the range.
+func lexCondition(item []byte, min bool) (string, any, error) {
+	if len(item) == 0 {
+		return "", nil, errZSetNotLex
+	}
+
+	switch item[0] {
+	case '-':
+		if len(item) != 1 {
+			return "", nil, errZSetNotLex
+		}
+		if min {
+			return "", nil, nil
+		}
+		// nothing is lower than the lowest member
+		return "0", nil, nil
+	case '+':
+		if len(item) != 1 {
+			return "", nil, errZSetNotLex
+		}
+		if !min {
+			return "", nil, nil
+		}
+		return "0", nil, nil
+	case '[', '(':
+		operator := "<"
+		if min {
+			operator = ">"
+		}
+		if item[0] == '[' {
+			operator += "="
+		}
+
+		return "member " + operator + " ?", item[1:], nil
+	}
+
+	return "", nil, errZSetNotLex
+}
+
+// zrangeSpec is a parsed ZRANGE-like request
+type zrangeSpec struct {
+	byScore, byLex bool
+	rev            bool
+	start, stop    []byte
+	offset, count  int64
+	withScores     bool
+}
+
+func parseZRangeSpec(args [][]byte) (*zrangeSpec, error) {
+	spec := &zrangeSpec{
+		start: args[0],
+		stop:  args[1],
+		count: -1,
+	}
+
+	var limit bool
+	for i := 2; i < len(args); i++ {
+		switch strings.ToLower(string(args[i])) {
+		case "byscore":
+			spec.byScore = true
+		case "bylex":
+			spec.byLex = true
+		case "rev":
+			spec.rev = true
+		case "withscores":
+			spec.withScores = true
+		case "limit":
+			if i+2 >= len(args) {
+				return nil, utils.ErrSyntaxError
+			}
+
+			var err error
+			if spec.offset, err = strconv.ParseInt(string(args[i+1]), 10, 64); err != nil {
+				return nil, utils.ErrNotInteger
+			}
+			if spec.count, err = strconv.ParseInt(string(args[i+2]), 10, 64); err != nil {
+				return nil, utils.ErrNotInteger
+			}
+
+			limit = true
+			i += 2
+		default:
+			return nil, utils.ErrSyntaxError
+		}
+	}
+
+	if spec.byScore && spec.byLex {
+		return nil, utils.ErrSyntaxError
+	}
+	if limit && !spec.byScore && !spec.byLex {
+		return nil, errZRangeLimit
+	}
+	if spec.withScores && spec.byLex {
+		return nil, errZRangeWithScores
+	}
+
+	// with REV the range is given from max to min
+	if spec.rev && (spec.byScore || spec.byLex) {
+		spec.start, spec.stop = spec.stop, spec.start
+	}
+
+	return spec, nil
+}
+
+// zsetCard returns the number of members of a sorted set
+func zsetCard(dbOp *dbOperation, dbNum int, id int64) (int64, error) {
+	var card int64
+	if err := dbOp.Txn.QueryRow(fmt.Sprintf("SELECT count(*) FROM bigdis_%d_zset WHERE key_id = ?", dbNum), id).Scan(&card); err != nil {
+		return 0, err
+	}
+
+	return card, nil
+}
+
+// zrange returns members (and scores, if requested) of the sorted set id in the given range
+func zrange(dbOp *dbOperation, dbNum int, id int64, spec *zrangeSpec) ([]any, error) {
+	values := []any{}
+
+	conditions := []string{"key_id = ?"}
+	queryArgs := []any{id}
+	offset, limit := spec.offset, spec.count
+
+	switch {
+	case spec.byScore || spec.byLex:
+		parse := scoreCondition
+		if spec.byLex {
+			parse = lexCondition
+		}
+
+		for i, item := range [][]byte{spec.start, spec.stop} {
+			condition, arg, err := parse(item, i == 0)
+			if err != nil {
+				return nil, err
+			}
+
+			if condition != "" {
+				conditions = append(conditions, condition)
+			}
+			if arg != nil {
+				queryArgs = append(queryArgs, arg)
+			}
+		}
+
+		// a negative offset returns nothing, a negative count everything
+		if offset < 0 {
+			return values, nil
+		}
+	default:
+		start, err := strconv.ParseInt(string(spec.start), 10, 64)
+		if err != nil {
+			return nil, utils.ErrNotInteger
+		}
+		stop, err := strconv.ParseInt(string(spec.stop), 10, 64)
+		if err != nil {
+			return nil, utils.ErrNotInteger
+		}
+
+		card, err := zsetCard(dbOp, dbNum, id)
+		if err != nil {
+			return nil, err
+		}
+
+		from, to, ok := listRange(0, card-1, start, stop)
+		if !ok {
+			return values, nil
+		}
+
+		offset, limit = from, to-from+1
+	}
+
+	order := "ASC"
+	if spec.rev {
+		order = "DESC"
+	}
+
+	rows, err := dbOp.Txn.Query(fmt.Sprintf(`
+		SELECT member, score FROM bigdis_%d_zset
+		WHERE %s
+		ORDER BY score %[3]s, member %[3]s
+		LIMIT ? OFFSET ?`, dbNum, strings.Join(conditions, " and "), order), append(queryArgs, limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var member []byte
+		var score float64
+		if err := rows.Scan(&member, &score); err != nil {
+			return nil, err
+		}
+
+		values = append(values, member)
+		if spec.withScores {
+			values = append(values, formatScore(score))
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+// zsetScore returns the score of a member, ok is false if the member doesn't exist
+func zsetScore(dbOp *dbOperation, dbNum int, id int64, member []byte) (float64, bool, error) {
+	var score float64
+	if err := dbOp.Txn.QueryRow(fmt.Sprintf("SELECT score FROM bigdis_%d_zset WHERE key_id = ? and member = ?", dbNum), id, member).Scan(&score); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, false, nil
+		}
+
+		return 0, false, err
+	}
+
+	return score, true, nil
+}
+
+/*
+ZAdd takes key [NX | XX] [GT | LT] [CH] [INCR] score member [score member ...].
+
+It returns the number of added members (or changed ones with CH) as an int,
+or the new score as []byte with INCR, nil if the member was not updated.
+*/
+func ZAdd(dbNum int, args [][]byte, dbOp *dbOperation) (any, error) {
+	zaddGrammar := make(map[string]struct{})
+	zaddGrammar["existence"] = struct{}{}
+	zaddGrammar["comparison"] = struct{}{}
+	zaddGrammar["ch"] = struct{}{}
+	zaddGrammar["incr"] = struct{}{}
+	var nx, xx, gt, lt, ch, incr bool
+
+	currentArg := 1
+parse_args:
+	if currentArg >= len(args) {
+		return nil, utils.ErrSyntaxError
+	}
+
+	switch strings.ToLower(string(args[currentArg])) {
+	case "nx", "xx":
+		if _, ok := zaddGrammar["existence"]; !ok {
+			return nil, errZAddNXAndXX
+		}
+		delete(zaddGrammar, "existence")
+
+		nx = strings.ToLower(string(args[currentArg])) == "nx"
+		xx = !nx
+		currentArg++
+		goto parse_args
+	case "gt", "lt":
+		if _, ok := zaddGrammar["comparison"]; !ok {
+			return nil, errZAddNXAndGTLT
+		}
+		delete(zaddGrammar, "comparison")
+
+		gt = strings.ToLower(string(args[currentArg])) == "gt"
+		lt = !gt
+		currentArg++
+		goto parse_args
+	case "ch":
+		if _, ok := zaddGrammar["ch"]; !ok {
+			return nil, utils.ErrSyntaxError
+		}
+		delete(zaddGrammar, "ch")
+
+		ch = true
+		currentArg++
+		goto parse_args
+	case "incr":
+		if _, ok := zaddGrammar["incr"]; !ok {
+			return nil, utils.ErrSyntaxError
+		}
+		delete(zaddGrammar, "incr")
+
+		incr = true
+		currentArg++
+		goto parse_args
+	}
+
+	pairs := args[currentArg:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return nil, utils.ErrSyntaxError
+	}
+	if nx && (gt || lt) {
+		return nil, errZAddNXAndGTLT
+	}
+	if incr && len(pairs) > 2 {
+		return nil, errZAddIncrPairs
+	}
+
+	// validate every score before touching the DB
+	scores := make([]float64, len(pairs)/2)
+	for i := range scores {
+		score, err := parseScore(pairs[i*2])
+		if err != nil {
+			return nil, err
+		}
+
+		scores[i] = score
+	}
+
+	var err error
+	dbOp, err = startDBOperation(dbOp, true)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	id, err := getKeyID(dbOp, dbNum, args[0], zsetType)
+	if err != nil {
+		return nil, err
+	}
+
+	// XX never creates a new sorted set
+	if id == 0 && xx {
+		if incr {
+			return nil, nil
+		}
+		return 0, nil
+	}
+
+	if id == 0 {
+		if id, err = createKeyID(dbOp, dbNum, args[0], zsetType); err != nil {
+			return nil, err
+		}
+	}
+
+	var added, changed int
+	var newScore []byte
+	for i, score := range scores {
+		member := pairs[i*2+1]
+
+		current, exists, err := zsetScore(dbOp, dbNum, id, member)
+		if err != nil {
+			return nil, err
+		}
+
+		if incr {
+			score += current
+			if math.IsNaN(score) {
+				return nil, errZSetNaN
+			}
+		}
+
+		if exists {
+			if nx || (gt && score <= current) || (lt && score >= current) {
+				continue
+			}
+
+			if score != current {
+				if _, err := dbOp.Txn.Exec(fmt.Sprintf("UPDATE bigdis_%d_zset SET score = ? WHERE key_id = ? and member = ?", dbNum), score, id, member); err != nil {
+					return nil, err
+				}
+
+				changed++
+			}
+		} else {
+			if xx {
+				continue
+			}
+
+			if _, err := dbOp.Txn.Exec(fmt.Sprintf("INSERT INTO bigdis_%d_zset (key_id, member, score) VALUES (?, ?, ?)", dbNum), id, member, score); err != nil {
+				return nil, err
+			}
+
+			added++
+		}
+
+		newScore = formatScore(score)
+	}
+
+	if added+changed > 0 {
+		if incr {
+			dbOp.notify(config.NotifyZSet, "zincr", dbNum, args[0])
+		} else {
+			dbOp.notify(config.NotifyZSet, "zadd", dbNum, args[0])
+		}
+	}
+
+	// with NX or XX the sorted set might have been created for nothing
+	if err := deleteKeyIfEmpty(dbOp, dbNum, id, fmt.Sprintf("bigdis_%d_zset", dbNum)); err != nil {
+		return nil, err
+	}
+
+	if incr {
+		return newScore, nil
+	}
+
+	if ch {
+		return added + changed, nil
+	}
+
+	return added, nil
+}
+
+func ZIncrBy(dbNum int, args [][]byte, dbOp *dbOperation) ([]byte, error) {
+	result, err := ZAdd(dbNum, [][]byte{args[0], []byte("incr"), args[1], args[2]}, dbOp)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.([]byte), nil
+}
+
+func ZRem(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	var err error
+	dbOp, err = startDBOperation(dbOp, true)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	id, err := getKeyID(dbOp, dbNum, args[0], zsetType)
+	if err != nil || id == 0 {
+		return 0, err
+	}
+
+	var removed int
+	for _, member := range args[1:] {
+		result, err := dbOp.Txn.Exec(fmt.Sprintf("DELETE FROM bigdis_%d_zset WHERE key_id = ? and member = ?", dbNum), id, member)
+		if err != nil {
+			return 0, err
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+
+		removed += int(rowsAffected)
+	}
+
+	if removed > 0 {
+		dbOp.notify(config.NotifyZSet, "zrem", dbNum, args[0])
+		if err := deleteKeyIfEmpty(dbOp, dbNum, id, fmt.Sprintf("bigdis_%d_zset", dbNum)); err != nil {
+			return 0, err
+		}
+	}
+
+	return removed, nil
+}
+
+func ZCard(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	var err error
+	dbOp, err = startDBOperation(dbOp, false)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	id, err := getKeyID(dbOp, dbNum, args[0], zsetType)
+	if err != nil || id == 0 {
+		return 0, err
+	}
+
+	card, err := zsetCard(dbOp, dbNum, id)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(card), nil
+}
+
+func ZScore(dbNum int, args [][]byte, dbOp *dbOperation) ([]byte, error) {
+	var err error
+	dbOp, err = startDBOperation(dbOp, false)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	id, err := getKeyID(dbOp, dbNum, args[0], zsetType)
+	if err != nil || id == 0 {
+		return nil, err
+	}
+
+	score, ok, err := zsetScore(dbOp, dbNum, id, args[1])
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	return formatScore(score), nil
+}
+
+/*
+zrank returns the rank of a member, optionally followed by its score.
+It returns nil if the key or the member don't exist.
+*/
+func zrank(dbNum int, args [][]byte, rev bool, dbOp *dbOperation) ([]any, error) {
+	var withScore bool
+	if len(args) > 2 {
+		if len(args) > 3 || strings.ToLower(string(args[2])) != "withscore" {
+			return nil, utils.ErrSyntaxError
+		}
+		withScore = true
+	}
+
+	var err error
+	dbOp, err = startDBOperation(dbOp, false)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	id, err := getKeyID(dbOp, dbNum, args[0], zsetType)
+	if err != nil || id == 0 {
+		return nil, err
+	}
+
+	score, ok, err := zsetScore(dbOp, dbNum, id, args[1])
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	// the rank is the number of members ordered before this one
+	condition := "score < ?1 or (score = ?1 and member < ?2)"
+	if rev {
+		condition = "score > ?1 or (score = ?1 and member > ?2)"
+	}
+
+	var rank int
+	if err := dbOp.Txn.QueryRow(fmt.Sprintf("SELECT count(*) FROM bigdis_%d_zset WHERE key_id = ?3 and (%s)", dbNum, condition), score, args[1], id).Scan(&rank); err != nil {
+		return nil, err
+	}
+
+	result := []any{rank}
+	if withScore {
+		result = append(result, formatScore(score))
+	}
+
+	return result, nil
+}
+
+func ZRank(dbNum int, args [][]byte, dbOp *dbOperation) ([]any, error) {
+	return zrank(dbNum, args, false, dbOp)
+}
+
+func ZRevRank(dbNum int, args [][]byte, dbOp *dbOperation) ([]any, error) {
+	return zrank(dbNum, args, true, dbOp)
+}
+
+// ZRange takes key start stop [BYSCORE | BYLEX] [REV] [LIMIT offset count] [WITHSCORES]
+func ZRange(dbNum int, args [][]byte, dbOp *dbOperation) ([]any, error) {
+	spec, err := parseZRangeSpec(args[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	dbOp, err = startDBOperation(dbOp, false)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	id, err := getKeyID(dbOp, dbNum, args[0], zsetType)
+	if err != nil {
+		return nil, err
+	}
+	if id == 0 {
+		return []any{}, nil
+	}
+
+	return zrange(dbOp, dbNum, id, spec)
+}
+
+// ZRevRange, ZRangeByScore and ZRevRangeByScore are the legacy forms of ZRANGE
+
+func ZRevRange(dbNum int, args [][]byte, dbOp *dbOperation) ([]any, error) {
+	return ZRange(dbNum, append(append([][]byte{}, args...), []byte("rev")), dbOp)
+}
+
+func ZRangeByScore(dbNum int, args [][]byte, dbOp *dbOperation) ([]any, error) {
+	return ZRange(dbNum, append(append([][]byte{}, args...), []byte("byscore")), dbOp)
+}
+
+func ZRevRangeByScore(dbNum int, args [][]byte, dbOp *dbOperation) ([]any, error) {
+	return ZRange(dbNum, append(append([][]byte{}, args...), []byte("byscore"), []byte("rev")), dbOp)
+}
+
+// zcount counts the members in a score or lex range
+func zcount(dbNum int, args [][]byte, parse func(item []byte, min bool) (string, any, error), dbOp *dbOperation) (int, error) {
+	conditions := []string{"key_id = ?"}
+	var queryArgs []any
+	for i, item := range args[1:3] {
+		condition, arg, err := parse(item, i == 0)
+		if err != nil {
+			return 0, err
+		}
+
+		if condition != "" {
+			conditions = append(conditions, condition)
+		}
+		if arg != nil {
+			queryArgs = append(queryArgs, arg)
+		}
+	}
+
+	var err error
+	dbOp, err = startDBOperation(dbOp, false)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	id, err := getKeyID(dbOp, dbNum, args[0], zsetType)
+	if err != nil || id == 0 {
+		return 0, err
+	}
+
+	var count int
+	if err := dbOp.Txn.QueryRow(fmt.Sprintf("SELECT count(*) FROM bigdis_%d_zset WHERE %s", dbNum, strings.Join(conditions, " and ")), append([]any{id}, queryArgs...)...).Scan(&count); err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func ZCount(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	return zcount(dbNum, args, scoreCondition, dbOp)
+}
+
+func ZLexCount(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	return zcount(dbNum, args, lexCondition, dbOp)
+}
+
+/*
+zpop removes and returns the members with the lowest (or highest) scores,
+as a flat list of members and scores.
+*/
+func zpop(dbNum int, args [][]byte, max bool, dbOp *dbOperation) ([]any, error) {
+	if len(args) > 2 {
+		return nil, utils.ErrSyntaxError
+	}
+
+	count := int64(1)
+	if len(args) > 1 {
+		var err error
+		count, err = strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil || count < 0 {
+			return nil, utils.ErrValueOutOfRange
+		}
+	}
+
+	var err error
+	dbOp, err = startDBOperation(dbOp, true)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	values := []any{}
+
+	id, err := getKeyID(dbOp, dbNum, args[0], zsetType)
+	if err != nil || id == 0 || count == 0 {
+		return values, err
+	}
+
+	spec := &zrangeSpec{
+		start:      []byte("0"),
+		stop:       []byte(strconv.FormatInt(count-1, 10)),
+		rev:        max,
+		withScores: true,
+	}
+
+	if values, err = zrange(dbOp, dbNum, id, spec); err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < len(values); i += 2 {
+		if _, err := dbOp.Txn.Exec(fmt.Sprintf("DELETE FROM bigdis_%d_zset WHERE key_id = ? and member = ?", dbNum), id, values[i]); err != nil {
+			return nil, err
+		}
+	}
+	if len(values) > 0 {
+		if max {
+			dbOp.notify(config.NotifyZSet, "zpopmax", dbNum, args[0])
+		} else {
+			dbOp.notify(config.NotifyZSet, "zpopmin", dbNum, args[0])
+		}
+	}
+
+	if err := deleteKeyIfEmpty(dbOp, dbNum, id, fmt.Sprintf("bigdis_%d_zset", dbNum)); err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+func ZPopMin(dbNum int, args [][]byte, dbOp *dbOperation) ([]any, error) {
+	return zpop(dbNum, args, false, dbOp)
+}
+
+func ZPopMax(dbNum int, args [][]byte, dbOp *dbOperation) ([]any, error) {
+	return zpop(dbNum, args, true, dbOp)
+}
+
+/*
+zsetStore computes the union or the intersection of sorted sets into a destination,
+it takes destination numkeys key [key ...] [WEIGHTS weight [weight ...]] [AGGREGATE SUM | MIN | MAX].
+
+Plain sets are accepted as sources too, their members having a score of 1.
+As for the set algebra the result is staged in a temporary table,
+because the destination can be one of the sources.
+*/
+func zsetStore(dbNum int, args [][]byte, inter bool, dbOp *dbOperation) (int, error) {
+	numKeys, err := strconv.Atoi(string(args[1]))
+	if err != nil {
+		return 0, utils.ErrNotInteger
+	}
+	if numKeys < 1 {
+		return 0, errors.New("ERR at least 1 input key is needed for this command")
+	}
+	if numKeys > len(args)-2 {
+		return 0, utils.ErrSyntaxError
+	}
+
+	keys := args[2 : 2+numKeys]
+	weights := make([]float64, numKeys)
+	for i := range weights {
+		weights[i] = 1
+	}
+	aggregate := "sum"
+
+	options := args[2+numKeys:]
+	for i := 0; i < len(options); i++ {
+		switch strings.ToLower(string(options[i])) {
+		case "weights":
+			if i+numKeys >= len(options) {
+				return 0, utils.ErrSyntaxError
+			}
+
+			for j := range weights {
+				weight, err := strconv.ParseFloat(string(options[i+1+j]), 64)
+				if err != nil || math.IsNaN(weight) {
+					return 0, errors.New("ERR weight value is not a float")
+				}
+
+				weights[j] = weight
+			}
+
+			i += numKeys
+		case "aggregate":
+			if i+1 >= len(options) {
+				return 0, utils.ErrSyntaxError
+			}
+
+			aggregate = strings.ToLower(string(options[i+1]))
+			if aggregate != "sum" && aggregate != "min" && aggregate != "max" {
+				return 0, utils.ErrSyntaxError
+			}
+
+			i++
+		default:
+			return 0, utils.ErrSyntaxError
+		}
+	}
+
+	dbOp, err = startDBOperation(dbOp, true)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	var selects []string
+	var queryArgs []any
+	for i, key := range keys {
+		table := "zset"
+		column := "score"
+		id, err := getKeyID(dbOp, dbNum, key, zsetType)
+		if err == utils.ErrWrongType {
+			table, column = "set", "1.0"
+			id, err = getKeyID(dbOp, dbNum, key, setType)
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if id == 0 {
+			if inter {
+				selects = nil
+				break
+			}
+
+			continue
+		}
+
+		selects = append(selects, fmt.Sprintf("SELECT member, %s * ? AS score FROM bigdis_%d_%s WHERE key_id = ?", column, dbNum, table))
+		queryArgs = append(queryArgs, weights[i], id)
+	}
+
+	if _, err := dbOp.Txn.Exec(`
+		CREATE TEMP TABLE IF NOT EXISTS bigdis_zset_store (member BLOB PRIMARY KEY, score REAL NOT NULL);
+		DELETE FROM temp.bigdis_zset_store`); err != nil {
+		return 0, err
+	}
+
+	if len(selects) > 0 {
+		// the intersection keeps the members found in every source
+		having := ""
+		if inter {
+			having = fmt.Sprintf("HAVING count(*) = %d", numKeys)
+		}
+
+		// inf * 0 is NaN, which is stored as NULL and Redis considers 0
+		if _, err := dbOp.Txn.Exec(fmt.Sprintf(`
+			INSERT INTO temp.bigdis_zset_store
+			SELECT member, coalesce(%s(score), 0) FROM (%s)
+			GROUP BY member %s`, aggregate, strings.Join(selects, " UNION ALL "), having), queryArgs...); err != nil {
+			return 0, err
+		}
+	}
+
+	// the destination is overwritten whatever its type
+	overwritten, err := dropKey(dbOp, dbNum, args[0])
+	if err != nil {
+		return 0, err
+	}
+
+	var card int
+	if err := dbOp.Txn.QueryRow("SELECT count(*) FROM temp.bigdis_zset_store").Scan(&card); err != nil {
+		return 0, err
+	}
+
+	if card > 0 {
+		id, err := createKeyID(dbOp, dbNum, args[0], zsetType)
+		if err != nil {
+			return 0, err
+		}
+
+		if _, err := dbOp.Txn.Exec(fmt.Sprintf("INSERT INTO bigdis_%d_zset (key_id, member, score) SELECT ?, member, score FROM temp.bigdis_zset_store", dbNum), id); err != nil {
+			return 0, err
+		}
+		if err := touchKey(dbOp, dbNum, id); err != nil {
+			return 0, err
+		}
+
+		if inter {
+			dbOp.notify(config.NotifyZSet, "zinterstore", dbNum, args[0])
+		} else {
+			dbOp.notify(config.NotifyZSet, "zunionstore", dbNum, args[0])
+		}
+	} else if overwritten {
+		dbOp.notify(config.NotifyGeneric, "del", dbNum, args[0])
+	}
+
+	if _, err := dbOp.Txn.Exec("DELETE FROM temp.bigdis_zset_store"); err != nil {
+		return 0, err
+	}
+
+	return card, nil
+}
+
+func ZUnionStore(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	return zsetStore(dbNum, args, false, dbOp)
+}
+
+func ZInterStore(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	return zsetStore(dbNum, args, true, dbOp)
+}
+
+// ZScan works like HScan, see there for the cursor semantics
+func ZScan(dbNum int, args [][]byte, dbOp *dbOperation) (int64, []any, error) {
+	cursor, err := parseCursor(args[1])
+	if err != nil {
+		return 0, nil, err
+	}
+
+	pattern, count, err := parseScanArgs(args[2:], nil)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	dbOp, err = startDBOperation(dbOp, false)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer func() {
+		if err := dbOp.endDBOperation(); err != nil {
+			utils.Print("Error while ending DB operation: %s\n", err)
+		}
+	}()
+
+	values := []any{}
+
+	id, err := getKeyID(dbOp, dbNum, args[0], zsetType)
+	if err != nil || id == 0 {
+		return 0, values, err
+	}
+
+	rows, err := dbOp.Txn.Query(fmt.Sprintf("SELECT id, member, score FROM bigdis_%d_zset WHERE key_id = ? and id > ? ORDER BY id LIMIT ?", dbNum), id, cursor, count)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	var scanned int
+	var lastID int64
+	for rows.Next() {
+		var member []byte
+		var score float64
+		if err := rows.Scan(&lastID, &member, &score); err != nil {
+			return 0, nil, err
+		}
+		scanned++
+
+		if pattern != nil && !utils.GlobMatch(pattern, member, false) {
+			continue
+		}
+
+		values = append(values, member, formatScore(score))
+	}
+
+	if err := rows.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	// iteration is over
+	if scanned < count {
+		lastID = 0
+	}
+
+	return lastID, values, nil
+}
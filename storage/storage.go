@@ -7,6 +7,7 @@ import (
 	_ "embed"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -38,12 +39,46 @@ var DBrp *sql.DB
 
 var AvailableDBs = map[int]struct{}{}
 
+// background tracks the asynchronous flushes, Close waits for them
+var background sync.WaitGroup
+
+// stopGC stops the garbage collector, gcDone is closed once it has returned
+var (
+	stopGC = make(chan struct{})
+	gcDone = make(chan struct{})
+)
+
+// availableDBsLock guards AvailableDBs, since DBs are also created on the fly by the clients
+var availableDBsLock sync.RWMutex
+
+// IsAvailableDB reports whether the tables of a DB have already been created
+func IsAvailableDB(dbNum int) bool {
+	availableDBsLock.RLock()
+	defer availableDBsLock.RUnlock()
+
+	_, exists := AvailableDBs[dbNum]
+	return exists
+}
+
+// availableDBs returns the DBs created so far
+func availableDBs() []int {
+	availableDBsLock.RLock()
+	defer availableDBsLock.RUnlock()
+
+	dbNums := make([]int, 0, len(AvailableDBs))
+	for dbNum := range AvailableDBs {
+		dbNums = append(dbNums, dbNum)
+	}
+
+	return dbNums
+}
+
 //go:embed init.sql
 var initSQL string
 
 func Init() {
 	connString := fmt.Sprintf(
-		"file:%s?_auto_vacuum=1&_journal_mode=%s&_synchronous=%s&_busy_timeout=20000&_tx_lock=immediate",
+		"file:%s?_auto_vacuum=1&_journal_mode=%s&_synchronous=%s&_busy_timeout=20000&_tx_lock=immediate&_foreign_keys=1",
 		config.Config.Storage.Path,
 		config.Config.Storage.JournalMode,
 		config.Config.Storage.Synchronous)
@@ -90,6 +125,13 @@ func Init() {
 		AvailableDBs[dbNum] = struct{}{}
 	}
 
+	// make sure DBs created by older versions have all the side tables
+	for dbNum := range AvailableDBs {
+		if err := NewDB(dbNum); err != nil {
+			panic(err)
+		}
+	}
+
 	// print detected DBs
 	var detectedDBs []int
 	for dbNum := range AvailableDBs {
@@ -101,42 +143,307 @@ func Init() {
 		fmt.Printf("Detected non-empty DBs: %v\n", detectedDBs)
 	}
 
+	// the write pool keeps its only connection open, setting the pragma on it is enough
+	config.OnSet("synchronous", func() error {
+		_, err := DBwp.Exec("PRAGMA synchronous = " + config.Config.Storage.Synchronous)
+		return err
+	})
+
+	initChangeLog()
+	initJournal()
+	initCDC()
+	initKeyspaceEvents()
+
+	gcIntervalChanged := make(chan struct{}, 1)
+	config.OnSet("gc_interval", func() error {
+		select {
+		case gcIntervalChanged <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+
 	// garbage collect expired keys
 	go func() {
-		ticker := time.NewTicker(time.Duration(config.Config.Storage.GCInterval) * time.Second)
+		defer close(gcDone)
 		for {
 			var gcKeys int64
-			for dbNum := range AvailableDBs {
-				if rows, err := DBwp.Exec(fmt.Sprintf("DELETE FROM bigdis_%d WHERE exp < current_timestamp", dbNum)); err != nil {
+			for _, dbNum := range availableDBs() {
+				// current_timestamp has no fractional seconds, the keys announced
+				// by the reads are forgotten once they are certainly deleted
+				start := time.Now().Truncate(time.Second)
+				if expired, err := deleteExpiredKeys(dbNum); err != nil {
 					utils.Print("Error while deleting expired keys: %s\n", err)
 				} else {
-					if rowsAffected, err := rows.RowsAffected(); err != nil {
-						utils.Print("Error while getting rows affected: %s\n", err)
-					} else {
-						gcKeys += rowsAffected
-					}
+					gcKeys += expired
+					forgetLazilyExpired(dbNum, start)
+				}
+
+				if err := deleteTombstones(dbNum); err != nil {
+					utils.Print("Error while deleting the tombstones of deleted keys: %s\n", err)
 				}
 			}
 
 			if gcKeys > 0 {
+				Stats.ExpiredKeys.Add(gcKeys)
 				utils.Print("Garbage collected %d expired keys", gcKeys)
 			}
 
-			<-ticker.C
+			if trimmed, err := trimChangeLog(); err != nil {
+				utils.Print("Error while trimming the change log: %s\n", err)
+			} else if trimmed > 0 {
+				utils.Print("Trimmed %d changes from the change log", trimmed)
+			}
+
+			config.Lock.RLock()
+			interval := time.Duration(config.Config.Storage.GCInterval) * time.Second
+			config.Lock.RUnlock()
+
+			select {
+			case <-time.After(interval):
+			case <-gcIntervalChanged:
+			case <-stopGC:
+				return
+			}
 		}
 	}()
 }
 
+// deleteExpiredKeys deletes the expired keys of a DB, records and announces their expiration
+func deleteExpiredKeys(dbNum int) (int64, error) {
+	if !cdcEnabled && !notifying(config.NotifyExpired) {
+		result, err := DBwp.Exec(fmt.Sprintf("DELETE FROM bigdis_%d WHERE exp < current_timestamp", dbNum))
+		if err != nil {
+			return 0, err
+		}
+
+		return result.RowsAffected()
+	}
+
+	dbOp, err := startDBOperation(nil, true)
+	if err != nil {
+		return 0, err
+	}
+	defer dbOp.Txn.Rollback()
+
+	rows, err := dbOp.Txn.Query(fmt.Sprintf("DELETE FROM bigdis_%d WHERE exp < current_timestamp RETURNING key, type, exp", dbNum))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	// the events are recorded once all the rows are read, the connection can't run both at once
+	type expiredKey struct {
+		key     []byte
+		keyType string
+		exp     time.Time
+	}
+	var expired []expiredKey
+	for rows.Next() {
+		var key expiredKey
+		if err := rows.Scan(&key.key, &key.keyType, &key.exp); err != nil {
+			return 0, err
+		}
+		expired = append(expired, key)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	rows.Close()
+
+	for _, key := range expired {
+		if err := dbOp.recordEvent(dbNum, key.key, eventExpired, key.keyType, nil, nil); err != nil {
+			return 0, err
+		}
+		dbOp.notifyExpired(dbNum, key.key, key.exp)
+	}
+
+	return int64(len(expired)), dbOp.endDBOperation()
+}
+
+// deleteTombstones forgets the versions of the deleted keys once no client watches keys
+func deleteTombstones(dbNum int) error {
+	if watchers.Load() > 0 {
+		return nil
+	}
+
+	_, err := DBwp.Exec(fmt.Sprintf("DELETE FROM bigdis_%d_deleted", dbNum))
+	return err
+}
+
+// Checkpoint moves the content of the WAL into the database file and truncates the WAL
+func Checkpoint() error {
+	if config.Config.Storage.JournalMode != "wal" {
+		return nil
+	}
+
+	var busy, logFrames, checkpointed int
+	if err := DBwp.QueryRow("PRAGMA wal_checkpoint(TRUNCATE)").Scan(&busy, &logFrames, &checkpointed); err != nil {
+		return err
+	}
+	if busy != 0 {
+		return fmt.Errorf("WAL checkpoint could not complete, %d of %d frames checkpointed", checkpointed, logFrames)
+	}
+
+	return nil
+}
+
+// Close stops the garbage collector, waits for the asynchronous flushes and rewrites,
+// stops the change data capture dispatcher, closes the journal and both pools
+func Close() error {
+	close(stopGC)
+	<-gcDone
+	background.Wait()
+
+	stopDispatcher()
+
+	if err := closeJournal(); err != nil {
+		return err
+	}
+
+	if err := DBrp.Close(); err != nil {
+		return err
+	}
+
+	return DBwp.Close()
+}
+
+// execer is implemented by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
 func NewDB(dbNum int) error {
-	_, err := DBwp.Exec(fmt.Sprintf(`
-		CREATE TABLE IF NOT EXISTS bigdis_%d (
+	if err := createDBTables(DBwp, dbNum); err != nil {
+		return err
+	}
+
+	availableDBsLock.Lock()
+	AvailableDBs[dbNum] = struct{}{}
+	availableDBsLock.Unlock()
+
+	return nil
+}
+
+// createDBTables creates the main table of a DB along with its side tables
+func createDBTables(db execer, dbNum int) error {
+	// DBs created before keys were versioned lack the version column
+	var unversioned bool
+	if err := db.QueryRow(fmt.Sprintf(`
+		SELECT EXISTS(SELECT 1 FROM sqlite_schema WHERE type = 'table' and name = 'bigdis_%[1]d')
+			and NOT EXISTS(SELECT 1 FROM pragma_table_info('bigdis_%[1]d') WHERE name = 'version')`, dbNum)).Scan(&unversioned); err != nil {
+		return err
+	}
+
+	if unversioned {
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE bigdis_%d ADD COLUMN version INTEGER NOT NULL DEFAULT 0", dbNum)); err != nil {
+			return err
+		}
+	}
+
+	_, err := db.Exec(fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS bigdis_%[1]d (
 			id INTEGER PRIMARY KEY,
 			key TEXT UNIQUE NOT NULL,
 			value BLOB NOT NULL,
 			type TEXT NOT NULL,
 			created datetime default current_timestamp,
 			updated datetime default current_timestamp,
-			exp datetime)
+			exp datetime,
+			version INTEGER NOT NULL DEFAULT 0);
+
+		-- every change to a key gives it a version that is unique in the whole database,
+		-- so that WATCH notices a key even when it was deleted and created again
+		CREATE TRIGGER IF NOT EXISTS bigdis_%[1]d_version_insert
+		AFTER INSERT ON bigdis_%[1]d
+		BEGIN
+			UPDATE key_version SET version = version + 1;
+			UPDATE bigdis_%[1]d SET version = (SELECT version FROM key_version) WHERE id = new.id;
+			DELETE FROM bigdis_%[1]d_deleted WHERE key = new.key;
+		END;
+
+		CREATE TRIGGER IF NOT EXISTS bigdis_%[1]d_version_update
+		AFTER UPDATE ON bigdis_%[1]d
+		WHEN old.version = new.version
+		BEGIN
+			UPDATE key_version SET version = version + 1;
+			UPDATE bigdis_%[1]d SET version = (SELECT version FROM key_version) WHERE id = new.id;
+		END;
+
+		-- a deleted key leaves a tombstone with a new version, so that WATCH notices a key
+		-- that was created and deleted again while it didn't exist. The keys deleted once expired
+		-- already changed when they expired. The tombstones are garbage collected once nothing watches
+		CREATE TABLE IF NOT EXISTS bigdis_%[1]d_deleted (
+			key TEXT PRIMARY KEY,
+			version INTEGER NOT NULL);
+
+		CREATE TRIGGER IF NOT EXISTS bigdis_%[1]d_version_delete
+		AFTER DELETE ON bigdis_%[1]d
+		WHEN old.exp IS NULL OR old.exp > strftime('%%Y-%%m-%%d %%H:%%M:%%f', 'now')
+		BEGIN
+			UPDATE key_version SET version = version + 1;
+			INSERT OR REPLACE INTO bigdis_%[1]d_deleted (key, version) VALUES (old.key, (SELECT version FROM key_version));
+		END;
+
+		CREATE TABLE IF NOT EXISTS bigdis_%[1]d_hash (
+			id INTEGER PRIMARY KEY,
+			key_id INTEGER NOT NULL REFERENCES bigdis_%[1]d(id) ON DELETE CASCADE,
+			field BLOB NOT NULL,
+			value BLOB NOT NULL,
+			UNIQUE (key_id, field));
+		CREATE INDEX IF NOT EXISTS bigdis_%[1]d_hash_key_id ON bigdis_%[1]d_hash (key_id);
+
+		-- a key overwritten by a value of another type (e.g. SET) loses its elements
+		CREATE TRIGGER IF NOT EXISTS bigdis_%[1]d_hash_type_change
+		AFTER UPDATE OF type ON bigdis_%[1]d
+		WHEN old.type = 'h' AND new.type != 'h'
+		BEGIN
+			DELETE FROM bigdis_%[1]d_hash WHERE key_id = old.id;
+		END;
+
+		CREATE TABLE IF NOT EXISTS bigdis_%[1]d_list (
+			id INTEGER PRIMARY KEY,
+			key_id INTEGER NOT NULL REFERENCES bigdis_%[1]d(id) ON DELETE CASCADE,
+			pos INTEGER NOT NULL,
+			value BLOB NOT NULL);
+		CREATE INDEX IF NOT EXISTS bigdis_%[1]d_list_key_id_pos ON bigdis_%[1]d_list (key_id, pos);
+
+		CREATE TRIGGER IF NOT EXISTS bigdis_%[1]d_list_type_change
+		AFTER UPDATE OF type ON bigdis_%[1]d
+		WHEN old.type = 'l' AND new.type != 'l'
+		BEGIN
+			DELETE FROM bigdis_%[1]d_list WHERE key_id = old.id;
+		END;
+
+		CREATE TABLE IF NOT EXISTS bigdis_%[1]d_set (
+			id INTEGER PRIMARY KEY,
+			key_id INTEGER NOT NULL REFERENCES bigdis_%[1]d(id) ON DELETE CASCADE,
+			member BLOB NOT NULL,
+			UNIQUE (key_id, member));
+		CREATE INDEX IF NOT EXISTS bigdis_%[1]d_set_key_id ON bigdis_%[1]d_set (key_id);
+
+		CREATE TRIGGER IF NOT EXISTS bigdis_%[1]d_set_type_change
+		AFTER UPDATE OF type ON bigdis_%[1]d
+		WHEN old.type = 'S' AND new.type != 'S'
+		BEGIN
+			DELETE FROM bigdis_%[1]d_set WHERE key_id = old.id;
+		END;
+
+		CREATE TABLE IF NOT EXISTS bigdis_%[1]d_zset (
+			id INTEGER PRIMARY KEY,
+			key_id INTEGER NOT NULL REFERENCES bigdis_%[1]d(id) ON DELETE CASCADE,
+			member BLOB NOT NULL,
+			score REAL NOT NULL,
+			UNIQUE (key_id, member));
+		CREATE INDEX IF NOT EXISTS bigdis_%[1]d_zset_key_id_score_member ON bigdis_%[1]d_zset (key_id, score, member);
+
+		CREATE TRIGGER IF NOT EXISTS bigdis_%[1]d_zset_type_change
+		AFTER UPDATE OF type ON bigdis_%[1]d
+		WHEN old.type = 'z' AND new.type != 'z'
+		BEGIN
+			DELETE FROM bigdis_%[1]d_zset WHERE key_id = old.id;
+		END;
 			`, dbNum))
 	if err != nil {
 		return err
@@ -145,26 +452,52 @@ func NewDB(dbNum int) error {
 	return nil
 }
 
-func FlushDB(dbNum int, args [][]byte) error {
-	dbOp, err := startDBOperation(nil, true)
-	if err != nil {
+// dropDB empties a DB by dropping and recreating its tables,
+// side tables first so that nothing has to cascade.
+func dropDB(dbOp *dbOperation, dbNum int) error {
+	// dropping the tables doesn't run the triggers, the live keys get their tombstones here
+	if watchers.Load() > 0 {
+		if _, err := dbOp.Txn.Exec(fmt.Sprintf(`
+			UPDATE key_version SET version = version + 1;
+			INSERT OR REPLACE INTO bigdis_%[1]d_deleted (key, version)
+			SELECT key, (SELECT version FROM key_version) FROM bigdis_%[1]d WHERE %[2]s`, dbNum, liveKey)); err != nil {
+			return err
+		}
+	}
+
+	for _, table := range []string{"bigdis_%d_hash", "bigdis_%d_list", "bigdis_%d_set", "bigdis_%d_zset", "bigdis_%d"} {
+		table = fmt.Sprintf(table, dbNum)
+		if _, err := dbOp.Txn.Exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", table)); err != nil {
+			return err
+		}
+	}
+
+	if err := dbOp.recordEvent(dbNum, nil, eventFlushDB, "", nil, nil); err != nil {
 		return err
 	}
 
+	return createDBTables(dbOp.Txn, dbNum)
+}
+
+func FlushDB(dbNum int, args [][]byte, dbOp *dbOperation) error {
 	sync := true
 	if len(args) > 0 {
 		if strings.ToLower(string(args[0])) == "async" {
-			sync = false
+			// a flush that is part of a wider operation can't be run in background
+			sync = dbOp != nil
 		} else if strings.ToLower(string(args[0])) != "sync" {
 			return utils.ErrWrongSyntax
 		}
 	}
 
+	dbOp, err := startDBOperation(dbOp, true)
+	if err != nil {
+		return err
+	}
+
 	if sync {
-		if _, err = dbOp.Txn.Exec(fmt.Sprintf("DROP TABLE bigdis_%d", dbNum)); err != nil {
-			if err.Error() != fmt.Sprintf("no such table: bigdis_%d", dbNum) {
-				return err
-			}
+		if err := dropDB(dbOp, dbNum); err != nil {
+			return err
 		}
 
 		if err := dbOp.endDBOperation(); err != nil {
@@ -174,8 +507,11 @@ func FlushDB(dbNum int, args [][]byte) error {
 		return nil
 	}
 
+	background.Add(1)
 	go func() {
-		if _, err = dbOp.Txn.Exec(fmt.Sprintf("DROP TABLE bigdis_%d", dbNum)); err != nil {
+		defer background.Done()
+
+		if err := dropDB(dbOp, dbNum); err != nil {
 			utils.Print("Error while dropping table: %s\n", err)
 		}
 
@@ -200,7 +536,7 @@ func Exists(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
 			SELECT EXISTS(
 				SELECT 1 FROM bigdis_%d
 				WHERE key = ?
-					and exp >= current_timestamp)`, dbNum), args[i]).Scan(&exists); err != nil {
+					and %s)`, dbNum, liveKey), args[i]).Scan(&exists); err != nil {
 			return 0, err
 		}
 
@@ -224,11 +560,14 @@ func Del(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
 
 	var deleted int
 	for i := range args {
-		if _, err := dbOp.Txn.Exec(fmt.Sprintf("DELETE FROM bigdis_%d WHERE key = ?", dbNum), args[i]); err != nil {
+		existed, err := deleteKey(dbOp, dbNum, args[i])
+		if err != nil {
 			return 0, err
 		}
 
-		deleted += 1
+		if existed {
+			deleted++
+		}
 	}
 
 	if err := dbOp.endDBOperation(); err != nil {
@@ -238,27 +577,68 @@ func Del(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
 	return deleted, nil
 }
 
-func FlushAll(args [][]byte) error {
-	dbOp, err := startDBOperation(nil, true)
+// deleteKey deletes a key and records its deletion, or its expiration when it was already expired.
+// It tells whether a live key was deleted
+func deleteKey(dbOp *dbOperation, dbNum int, key []byte) (bool, error) {
+	deleted, err := dropKey(dbOp, dbNum, key)
 	if err != nil {
-		return err
+		return false, err
+	}
+	if deleted {
+		dbOp.notify(config.NotifyGeneric, "del", dbNum, key)
 	}
 
+	return deleted, nil
+}
+
+// dropKey deletes a key and records its deletion, or its expiration when it was already expired.
+// It tells whether a live key was deleted, the del event is left to the caller
+func dropKey(dbOp *dbOperation, dbNum int, key []byte) (bool, error) {
+	var value []byte
+	var keyType string
+	var expired bool
+	var exp sql.NullTime
+	if err := dbOp.Txn.QueryRow(fmt.Sprintf("DELETE FROM bigdis_%d WHERE key = ? RETURNING value, type, NOT (%s), exp", dbNum, liveKey), key).Scan(&value, &keyType, &expired, &exp); err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	if expired {
+		dbOp.notifyExpired(dbNum, key, exp.Time)
+		return false, dbOp.recordEvent(dbNum, key, eventExpired, keyType, nil, nil)
+	}
+	if keyType != "s" {
+		value = nil
+	} else if value == nil {
+		value = []byte{}
+	}
+
+	return true, dbOp.recordEvent(dbNum, key, eventDel, keyType, value, nil)
+}
+
+func FlushAll(args [][]byte, dbOp *dbOperation) error {
 	sync := true
 	if len(args) > 0 {
 		if strings.ToLower(string(args[0])) == "async" {
-			sync = false
+			// a flush that is part of a wider operation can't be run in background
+			sync = dbOp != nil
 		} else if strings.ToLower(string(args[0])) != "sync" {
 			return utils.ErrWrongSyntax
 		}
 	}
 
+	dbOp, err := startDBOperation(dbOp, true)
+	if err != nil {
+		return err
+	}
+
 	if sync {
-		for dbNum := range AvailableDBs {
-			if _, err = dbOp.Txn.Exec(fmt.Sprintf("DROP TABLE bigdis_%d", dbNum)); err != nil {
-				if err.Error() != fmt.Sprintf("no such table: bigdis_%d", dbNum) {
-					return err
-				}
+		for _, dbNum := range availableDBs() {
+			if err := dropDB(dbOp, dbNum); err != nil {
+				return err
 			}
 		}
 
@@ -269,9 +649,12 @@ func FlushAll(args [][]byte) error {
 		return nil
 	}
 
+	background.Add(1)
 	go func() {
-		for dbNum := range AvailableDBs {
-			if _, err = dbOp.Txn.Exec(fmt.Sprintf("DROP TABLE bigdis_%d", dbNum)); err != nil {
+		defer background.Done()
+
+		for _, dbNum := range availableDBs() {
+			if err := dropDB(dbOp, dbNum); err != nil {
 				utils.Print("Error while dropping table: %s\n", err)
 			}
 		}
@@ -1,8 +1,8 @@
 package storage
 
 import (
+	"bigdis/config"
 	"bigdis/utils"
-	"bytes"
 	"database/sql"
 	"fmt"
 	"strconv"
@@ -33,29 +33,35 @@ func Get(dbNum int, args [][]byte, dbOp *dbOperation) ([]byte, error) {
 		return nil, err
 	}
 
-	if keyType != "s" {
-		return nil, utils.ErrWrongType
+	if exp.Valid && exp.Time.Before(time.Now()) {
+		dbOp.notifyLazilyExpired(dbNum, args[0], exp.Time)
+		return nil, nil
 	}
 
-	if exp.Valid && exp.Time.UTC().Before(time.Now().Local()) {
-		return nil, nil
+	if keyType != "s" {
+		return nil, utils.ErrWrongType
 	}
 
 	return value, nil
 }
 
 /*
-set returns bulkReplyValue in form of []byte and error.
-In case of error, bulkReplyValue is nil.
-
-set could write a statusreply or a bulk reply (get parameter of the set command).
+Set returns the value of the bulk reply of SET when bulk is true, nil for a null,
+and SET replies OK otherwise. The reply is a bulk with the get option,
+or when the nx or xx condition is not met.
 */
-func Set(dbNum int, args [][]byte, dbOp *dbOperation) ([]byte, error) {
+func Set(dbNum int, args [][]byte, dbOp *dbOperation) ([]byte, bool, error) {
+	return set(dbNum, args, "set", dbOp)
+}
+
+// set runs SET on behalf of the string commands, event is the keyspace event of the command
+func set(dbNum int, args [][]byte, event string, dbOp *dbOperation) ([]byte, bool, error) {
 	var replyBytes []byte
+	var bulk bool
 	var err error
 	dbOp, err = startDBOperation(dbOp, true)
 	if err != nil {
-		return replyBytes, err
+		return replyBytes, bulk, err
 	}
 	wasChained := dbOp.chainDBOperation()
 	defer func() {
@@ -67,208 +73,177 @@ func Set(dbNum int, args [][]byte, dbOp *dbOperation) ([]byte, error) {
 		}
 	}()
 
+	// a plain set discards any previous expiration
 	if len(args) == 2 {
+		old, err := dbOp.previousValue(dbNum, args[0])
+		if err != nil {
+			return replyBytes, bulk, err
+		}
+		if err := dbOp.notifyNewKey(dbNum, args[0]); err != nil {
+			return replyBytes, bulk, err
+		}
+
 		if _, err := dbOp.Txn.Exec(fmt.Sprintf(`
 			INSERT INTO bigdis_%d (key, value, type) VALUES (?, ?, 's')
 			ON CONFLICT(key) DO UPDATE SET
 				value = ?,
-				updated = current_timestamp
+				type = 's',
+				updated = current_timestamp,
+				exp = NULL
 			where key = ?`, dbNum), args[0], args[1], args[1], args[0]); err != nil {
-			return replyBytes, err
+			return replyBytes, bulk, err
 		}
+		dbOp.notify(config.NotifyString, event, dbNum, args[0])
 
-		return replyBytes, nil
+		return replyBytes, bulk, dbOp.recordEvent(dbNum, args[0], eventSet, "s", old, args[1])
 	}
 
 	// extended set command features, expensive operation
-	count, err := Exists(dbNum, [][]byte{args[0]}, dbOp)
-	if err != nil {
-		return replyBytes, err
-	}
-
 	var currentArg = 1
 	setGrammar := make(map[string]struct{})
 	setGrammar["existence"] = struct{}{}
 	setGrammar["expiration"] = struct{}{}
 	setGrammar["get"] = struct{}{}
-	var expirationSeconds bool
+	var expirationSeconds, nx, xx, keepTTL, get bool
+	var userExpTime sql.NullTime
 
+	// options are all parsed before writing anything,
+	// their effect must not depend on the order they are given in
 parse_args:
 	currentArg++
-	if currentArg >= len(args) {
-		dbOp.unchainDBOperation()
-		return replyBytes, nil
-	}
+	if currentArg < len(args) {
+		switch strings.ToLower(string((args[currentArg]))) {
+		case "nx", "xx":
+			if _, ok := setGrammar["existence"]; !ok {
+				return replyBytes, bulk, utils.ErrWrongSyntax
+			}
+			delete(setGrammar, "existence")
+
+			nx = strings.ToLower(string(args[currentArg])) == "nx"
+			xx = !nx
+		case "ex", "exat":
+			expirationSeconds = true
+			fallthrough
+		case "px", "pxat":
+			if _, ok := setGrammar["expiration"]; !ok {
+				return replyBytes, bulk, utils.ErrWrongSyntax
+			}
+			delete(setGrammar, "expiration")
 
-	switch strings.ToLower(string((args[currentArg]))) {
-	case "nx":
-		if _, ok := setGrammar["existence"]; !ok {
-			return replyBytes, utils.ErrWrongSyntax
-		}
-		delete(setGrammar, "existence")
+			// ex, px, exat and pxat need an argument
+			if currentArg+1 >= len(args) {
+				return replyBytes, bulk, utils.ErrSyntaxError
+			}
 
-		if count > 0 {
-			replyBytes = []byte{}
-			return replyBytes, nil
-		}
+			// check if user input is an integer
+			//
+			// not using Atoi so no need to convert back and forth to int64 for later calls
+			userExp, err := strconv.ParseInt(string(args[currentArg+1]), 10, 64)
+			if err != nil {
+				return replyBytes, bulk, utils.ErrSyntaxError
+			}
 
-		if _, err := Set(dbNum, [][]byte{args[0], args[1]}, dbOp); err != nil {
-			return replyBytes, err
-		}
+			// convert to time.Time, userExp can be seconds or milliseconds
+			// and relative to now or a unix time
+			option := strings.ToLower(string(args[currentArg]))
+			unit := time.Millisecond
+			if expirationSeconds {
+				unit = time.Second
+			}
+			expTime, ok := expireTime(userExp, unit, strings.HasSuffix(option, "at"))
+			if userExp <= 0 || !ok {
+				return replyBytes, bulk, errInvalidExpireTime("set")
+			}
+			userExpTime = sql.NullTime{
+				Time:  expTime,
+				Valid: true,
+			}
 
-		goto parse_args
-	case "xx":
-		if _, ok := setGrammar["existence"]; !ok {
-			return replyBytes, utils.ErrWrongSyntax
-		}
-		delete(setGrammar, "existence")
+			// the expiration takes an argument, skip it
+			currentArg++
+		case "keepttl":
+			if _, ok := setGrammar["expiration"]; !ok {
+				return replyBytes, bulk, utils.ErrWrongSyntax
+			}
+			delete(setGrammar, "expiration")
 
-		if count == 0 {
-			replyBytes = []byte{}
-			return replyBytes, nil
-		}
+			keepTTL = true
+		case "get":
+			if _, ok := setGrammar["get"]; !ok {
+				return replyBytes, bulk, utils.ErrWrongSyntax
+			}
+			delete(setGrammar, "get")
 
-		if _, err := Set(dbNum, [][]byte{args[0], args[1]}, dbOp); err != nil {
-			return replyBytes, err
+			get = true
+		default:
+			return replyBytes, bulk, utils.ErrSyntaxError
 		}
 
 		goto parse_args
-	case "ex":
-		expirationSeconds = true
-		fallthrough
-	case "px":
-		if _, ok := setGrammar["expiration"]; !ok {
-			return replyBytes, utils.ErrWrongSyntax
-		}
-		delete(setGrammar, "expiration")
-
-		// ex and px need an argument
-		if currentArg+1 >= len(args) {
-			return replyBytes, utils.ErrSyntaxError
-		}
+	}
 
-		// check if user input is an integer
-		//
-		// not using Atoi so no need to convert back and forth to int64 for later calls
-		userExp, err := strconv.ParseInt(string(args[currentArg+1]), 10, 64)
+	if get {
+		value, err := Get(dbNum, args, dbOp)
 		if err != nil {
-			return replyBytes, utils.ErrSyntaxError
-		}
-
-		// convert to time.Time, userExp can be seconds or milliseconds
-		var userExpTime time.Time
-		if expirationSeconds {
-			userExpTime = time.Unix(time.Now().Unix()+userExp, 0).UTC()
-		} else {
-			userExpTime = time.Unix(time.Now().Unix(), userExp*1000000).UTC()
-		}
-
-		if _, err := dbOp.Txn.Exec(fmt.Sprintf(`
-			INSERT INTO bigdis_%d (key, value, type, exp) VALUES (?, ?, 's', ?)
-			ON CONFLICT(key) DO UPDATE SET
-				value = ?,
-				updated = current_timestamp,
-				exp = ?
-			where key = ?`, dbNum), args[0], args[1], userExpTime, args[1], userExpTime, args[0]); err != nil {
-			return replyBytes, err
-		}
-
-		// ex/px take an argument, skip it
-		currentArg++
-		goto parse_args
-	case "keepttl":
-		if _, ok := setGrammar["expiration"]; !ok {
-			return replyBytes, utils.ErrWrongSyntax
-		}
-		delete(setGrammar, "expiration")
-
-		// just insert, disregard the expiration
-		if _, err := Set(dbNum, [][]byte{args[0], args[1]}, dbOp); err != nil {
-			return replyBytes, err
-		}
-
-		goto parse_args
-	case "exat":
-		expirationSeconds = true
-		fallthrough
-	case "pxat":
-		if _, ok := setGrammar["expiration"]; !ok {
-			return replyBytes, utils.ErrWrongSyntax
+			return replyBytes, bulk, err
 		}
-		delete(setGrammar, "expiration")
 
-		// exat and pxat need an argument
-		if currentArg+1 >= len(args) {
-			return replyBytes, utils.ErrWrongSyntax
-		}
+		// the previous value, a null without one
+		replyBytes, bulk = value, true
+	}
 
-		// check if user input is an integer
-		//
-		// not using Atoi so no need to convert back and forth to int64 for later calls
-		userExp, err := strconv.ParseInt(string(args[currentArg+1]), 10, 64)
+	if nx || xx {
+		count, err := Exists(dbNum, [][]byte{args[0]}, dbOp)
 		if err != nil {
-			return replyBytes, utils.ErrSyntaxError
+			return replyBytes, bulk, err
 		}
 
-		// convert to time.Time, userExp can be seconds or milliseconds
-		var userExpTime time.Time
-		if expirationSeconds {
-			userExpTime = time.Unix(userExp, 0).UTC()
-		} else {
-			userExpTime = time.Unix(0, userExp*1000000).UTC()
+		if (nx && count > 0) || (xx && count == 0) {
+			return replyBytes, true, nil
 		}
+	}
 
-		if _, err := dbOp.Txn.Exec(fmt.Sprintf(`
-			INSERT INTO bigdis_%d (key, value, type, exp) VALUES (?, ?, 's', ?)
-			ON CONFLICT(key) DO UPDATE SET
-				value = ?,
-				updated = current_timestamp,
-				exp = ?
-			where key = ?`, dbNum), args[0], args[1], userExpTime, args[1], userExpTime, args[0]); err != nil {
-			return replyBytes, err
-		}
-
-		// exat/pxat take an argument, skip it
-		currentArg++
-		goto parse_args
-	case "get":
-		if _, ok := setGrammar["get"]; !ok {
-			return replyBytes, utils.ErrWrongSyntax
-		}
-		delete(setGrammar, "get")
-
-		value, err := GetSet(dbNum, [][]byte{args[0], args[1]}, dbOp)
-		if err != nil {
-			if err := dbOp.Txn.Rollback(); err != nil {
-				return replyBytes, err
-			}
-
-			return replyBytes, err
-		}
+	old, err := dbOp.previousValue(dbNum, args[0])
+	if err != nil {
+		return replyBytes, bulk, err
+	}
+	if err := dbOp.notifyNewKey(dbNum, args[0]); err != nil {
+		return replyBytes, bulk, err
+	}
 
-		if len(value) > 0 {
-			replyBytes = value
-		} else {
-			// Return bulk reply with nil to the client.
-			// Non-nil empty slice is to signal to the handler
-			// that a bulk reply is needed
-			replyBytes = []byte{}
-		}
+	// keepttl retains the expiration of a live key, anything else replaces it
+	exp := "excluded.exp"
+	if keepTTL {
+		exp = fmt.Sprintf("CASE WHEN %s THEN exp END", liveKey)
+	}
 
-		goto parse_args
-	default:
-		return replyBytes, utils.ErrSyntaxError
+	if _, err := dbOp.Txn.Exec(fmt.Sprintf(`
+		INSERT INTO bigdis_%d (key, value, type, exp) VALUES (?, ?, 's', ?)
+		ON CONFLICT(key) DO UPDATE SET
+			value = excluded.value,
+			type = 's',
+			updated = current_timestamp,
+			exp = %s`, dbNum, exp), args[0], args[1], userExpTime); err != nil {
+		return replyBytes, bulk, err
+	}
+	dbOp.notify(config.NotifyString, event, dbNum, args[0])
+	if userExpTime.Valid {
+		dbOp.notify(config.NotifyGeneric, "expire", dbNum, args[0])
 	}
+
+	return replyBytes, bulk, dbOp.recordEvent(dbNum, args[0], eventSet, "s", old, args[1])
 }
 
-func GetDel(dbNum int, args [][]byte) ([]byte, error) {
-	dbOp, err := startDBOperation(nil, true)
+func GetDel(dbNum int, args [][]byte, dbOp *dbOperation) ([]byte, error) {
+	dbOp, err := startDBOperation(dbOp, true)
 	if err != nil {
 		return nil, err
 	}
-	dbOp.chainDBOperation()
+	wasChained := dbOp.chainDBOperation()
 	defer func() {
-		dbOp.unchainDBOperation()
+		if !wasChained {
+			dbOp.unchainDBOperation()
+		}
 		if err := dbOp.endDBOperation(); err != nil {
 			utils.Print("Error while ending DB operation: %s\n", err)
 		}
@@ -285,17 +260,26 @@ func GetDel(dbNum int, args [][]byte) ([]byte, error) {
 		return nil, err
 	}
 
+	if value != nil {
+		dbOp.notify(config.NotifyGeneric, "del", dbNum, args[0])
+		if err := dbOp.recordEvent(dbNum, args[0], eventDel, "s", value, nil); err != nil {
+			return nil, err
+		}
+	}
+
 	return value, nil
 }
 
-func Incr(dbNum int, args [][]byte) (int, error) {
-	dbOp, err := startDBOperation(nil, true)
+func Incr(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	dbOp, err := startDBOperation(dbOp, true)
 	if err != nil {
 		return 0, err
 	}
-	dbOp.chainDBOperation()
+	wasChained := dbOp.chainDBOperation()
 	defer func() {
-		dbOp.unchainDBOperation()
+		if !wasChained {
+			dbOp.unchainDBOperation()
+		}
 		if err := dbOp.endDBOperation(); err != nil {
 			utils.Print("Error while ending DB operation: %s\n", err)
 		}
@@ -316,7 +300,6 @@ func IncrBy(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
 		return 0, err
 	}
 	wasChained := dbOp.chainDBOperation()
-	dbOp.chainDBOperation()
 	defer func() {
 		if !wasChained {
 			dbOp.unchainDBOperation()
@@ -348,9 +331,8 @@ func IncrBy(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
 		newValue += userIncr
 	}
 
-	args[1] = []byte(strconv.Itoa(newValue))
-
-	if _, err := Set(dbNum, args, dbOp); err != nil {
+	// incrementing a key doesn't change its expiration
+	if _, _, err := set(dbNum, [][]byte{args[0], []byte(strconv.Itoa(newValue)), []byte("keepttl")}, "incrby", dbOp); err != nil {
 		return 0, err
 	}
 
@@ -377,15 +359,15 @@ func GetSet(dbNum int, args [][]byte, dbOp *dbOperation) ([]byte, error) {
 		return nil, err
 	}
 
-	if _, err := Set(dbNum, args, dbOp); err != nil {
+	if _, _, err := Set(dbNum, args, dbOp); err != nil {
 		return nil, err
 	}
 
 	return value, nil
 }
 
-func Strlen(dbNum int, args [][]byte) (int, error) {
-	dbOp, err := startDBOperation(nil, false)
+func Strlen(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	dbOp, err := startDBOperation(dbOp, false)
 	if err != nil {
 		return 0, err
 	}
@@ -396,11 +378,11 @@ func Strlen(dbNum int, args [][]byte) (int, error) {
 	}()
 
 	var length int
-	if err := dbOp.Txn.QueryRow(fmt.Sprintf("SELECT length(value) FROM bigdis_%d WHERE key = ? and type='s' and exp >= current_timestamp", dbNum), args[0]).Scan(&length); err != nil {
+	if err := dbOp.Txn.QueryRow(fmt.Sprintf("SELECT length(value) FROM bigdis_%d WHERE key = ? and type='s' and %s", dbNum, liveKey), args[0]).Scan(&length); err != nil {
 		if err == sql.ErrNoRows {
 			// check if key exists of type other than string
 			var exists bool
-			if err := dbOp.Txn.QueryRow(fmt.Sprintf("SELECT EXISTS(SELECT 1 FROM bigdis_%d WHERE key = ? and exp >= current_timestamp)", dbNum), args[0]).Scan(&exists); err != nil {
+			if err := dbOp.Txn.QueryRow(fmt.Sprintf("SELECT EXISTS(SELECT 1 FROM bigdis_%d WHERE key = ? and %s)", dbNum, liveKey), args[0]).Scan(&exists); err != nil {
 				return 0, err
 			}
 
@@ -421,14 +403,16 @@ func Strlen(dbNum int, args [][]byte) (int, error) {
 	return length, nil
 }
 
-func Append(dbNum int, args [][]byte) (int, error) {
-	dbOp, err := startDBOperation(nil, true)
+func Append(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	dbOp, err := startDBOperation(dbOp, true)
 	if err != nil {
 		return 0, err
 	}
-	dbOp.chainDBOperation()
+	wasChained := dbOp.chainDBOperation()
 	defer func() {
-		dbOp.unchainDBOperation()
+		if !wasChained {
+			dbOp.unchainDBOperation()
+		}
 		if err := dbOp.endDBOperation(); err != nil {
 			utils.Print("Error while ending DB operation: %s\n", err)
 		}
@@ -446,31 +430,30 @@ func Append(dbNum int, args [][]byte) (int, error) {
 		newValue = append(value, args[1]...)
 	}
 
-	args[1] = newValue
-
-	if _, err := Set(dbNum, args, dbOp); err != nil {
+	// appending to a key doesn't change its expiration
+	if _, _, err := set(dbNum, [][]byte{args[0], newValue, []byte("keepttl")}, "append", dbOp); err != nil {
 		return 0, err
 	}
 
 	return len(newValue), nil
 }
 
-func Decr(dbNum int, args [][]byte) (int, error) {
-	dbOp, err := startDBOperation(nil, true)
+func Decr(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	dbOp, err := startDBOperation(dbOp, true)
 	if err != nil {
 		return 0, err
 	}
-	dbOp.chainDBOperation()
+	wasChained := dbOp.chainDBOperation()
 	defer func() {
-		dbOp.unchainDBOperation()
+		if !wasChained {
+			dbOp.unchainDBOperation()
+		}
 		if err := dbOp.endDBOperation(); err != nil {
 			utils.Print("Error while ending DB operation: %s\n", err)
 		}
 	}()
 
-	args[1] = []byte("-1")
-
-	newValue, err := IncrBy(dbNum, args, dbOp)
+	newValue, err := IncrBy(dbNum, [][]byte{args[0], []byte("-1")}, dbOp)
 	if err != nil {
 		return 0, err
 	}
@@ -478,14 +461,16 @@ func Decr(dbNum int, args [][]byte) (int, error) {
 	return newValue, nil
 }
 
-func DecrBy(dbNum int, args [][]byte) (int, error) {
-	dbOp, err := startDBOperation(nil, true)
+func DecrBy(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	dbOp, err := startDBOperation(dbOp, true)
 	if err != nil {
 		return 0, err
 	}
-	dbOp.chainDBOperation()
+	wasChained := dbOp.chainDBOperation()
 	defer func() {
-		dbOp.unchainDBOperation()
+		if !wasChained {
+			dbOp.unchainDBOperation()
+		}
 		if err := dbOp.endDBOperation(); err != nil {
 			utils.Print("Error while ending DB operation: %s\n", err)
 		}
@@ -498,9 +483,7 @@ func DecrBy(dbNum int, args [][]byte) (int, error) {
 	}
 
 	// reverse user input
-	args[1] = []byte(strconv.Itoa(userDecr * -1))
-
-	newValue, err := IncrBy(dbNum, args, dbOp)
+	newValue, err := IncrBy(dbNum, [][]byte{args[0], []byte(strconv.Itoa(userDecr * -1))}, dbOp)
 	if err != nil {
 		return 0, err
 	}
@@ -508,13 +491,13 @@ func DecrBy(dbNum int, args [][]byte) (int, error) {
 	return newValue, nil
 }
 
-func MGet(dbNum int, args [][]byte) ([]any, error) {
+func MGet(dbNum int, args [][]byte, dbOp *dbOperation) ([]any, error) {
 	var anyArgs []any
 	for i := range args {
 		anyArgs = append(anyArgs, args[i])
 	}
 
-	dbOp, err := startDBOperation(nil, false)
+	dbOp, err := startDBOperation(dbOp, false)
 	if err != nil {
 		return nil, err
 	}
@@ -524,36 +507,30 @@ func MGet(dbNum int, args [][]byte) ([]any, error) {
 		}
 	}()
 
-	rows, err := dbOp.Txn.Query(fmt.Sprintf("SELECT key, value FROM bigdis_%d WHERE key IN (%s) and exp >= current_timestamp", dbNum, strings.Repeat("?,", len(args)-1)+"?"), anyArgs...)
+	rows, err := dbOp.Txn.Query(fmt.Sprintf("SELECT key, value FROM bigdis_%d WHERE key IN (%s) and type = 's' and %s", dbNum, strings.Repeat("?,", len(args)-1)+"?", liveKey), anyArgs...)
 	if err != nil {
 		return nil, err
 	}
 
-	var values []any
-	var returnedKeys [][]byte // needed to fill in nil values for keys not found
+	found := make(map[string][]byte)
 	for rows.Next() {
 		var key, value []byte
 		if err := rows.Scan(&key, &value); err != nil {
 			return nil, err
 		}
 
-		returnedKeys = append(returnedKeys, key)
-		values = append(values, value)
+		found[string(key)] = value
 	}
 
 	if err := rows.Close(); err != nil {
 		return nil, err
 	}
 
-	// must append (in the right spot) nil if key is not found
+	// keys not found are replied as nil, in the order they were requested
+	values := make([]any, len(args))
 	for i := range args {
-		if i >= len(returnedKeys) || !bytes.Equal(args[i], returnedKeys[i]) {
-			values = append(values[:i+1], values[i:]...)
-			values[i] = nil
-
-			// must also append to returnedKeys
-			returnedKeys = append(returnedKeys[:i+1], returnedKeys[i:]...)
-			returnedKeys[i] = args[i]
+		if value, ok := found[string(args[i])]; ok {
+			values[i] = value
 		}
 	}
 
@@ -577,32 +554,75 @@ func MSet(dbNum int, args [][]byte, dbOp *dbOperation) error {
 		}
 	}()
 
+	// the previous values are read before the keys change, a key given twice was first set by this command
+	var olds [][]byte
+	if cdcEnabled {
+		set := map[string][]byte{}
+		for i := 0; i < len(args); i += 2 {
+			old, seen := set[string(args[i])]
+			if !seen {
+				if old, err = dbOp.previousValue(dbNum, args[i]); err != nil {
+					return err
+				}
+			}
+			olds = append(olds, old)
+			set[string(args[i])] = args[i+1]
+		}
+	}
+
+	// a key given twice is only new the first time
+	created := map[string]struct{}{}
+	for i := 0; i < len(args); i += 2 {
+		if _, seen := created[string(args[i])]; seen {
+			continue
+		}
+		created[string(args[i])] = struct{}{}
+
+		if err := dbOp.notifyNewKey(dbNum, args[i]); err != nil {
+			return err
+		}
+	}
+
 	// insert all keys and values in one shot
 
 	if _, err := dbOp.Txn.Exec(fmt.Sprintf(`
 		INSERT INTO bigdis_%d (key, value, type) VALUES %s
 		ON CONFLICT(key) DO UPDATE SET
 			value = excluded.value,
-			updated = current_timestamp`, dbNum, strings.Repeat("(?, ?, 's'),", len(args)/2-1)+"(?, ?, 's')"), anyArgs...); err != nil {
+			type = 's',
+			updated = current_timestamp,
+			exp = NULL`, dbNum, strings.Repeat("(?, ?, 's'),", len(args)/2-1)+"(?, ?, 's')"), anyArgs...); err != nil {
 		return err
 	}
 
+	for i := 0; i < len(args); i += 2 {
+		dbOp.notify(config.NotifyString, "set", dbNum, args[i])
+	}
+
+	for i, old := range olds {
+		if err := dbOp.recordEvent(dbNum, args[i*2], eventSet, "s", old, args[i*2+1]); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func MSetNX(dbNum int, args [][]byte) (int, error) {
+func MSetNX(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
 	var keys [][]byte
 	for i := 0; i < len(args); i += 2 {
 		keys = append(keys, args[i])
 	}
 
-	dbOp, err := startDBOperation(nil, true)
+	dbOp, err := startDBOperation(dbOp, true)
 	if err != nil {
 		return 0, err
 	}
-	dbOp.chainDBOperation()
+	wasChained := dbOp.chainDBOperation()
 	defer func() {
-		dbOp.unchainDBOperation()
+		if !wasChained {
+			dbOp.unchainDBOperation()
+		}
 		if err := dbOp.endDBOperation(); err != nil {
 			utils.Print("Error while ending DB operation: %s\n", err)
 		}
@@ -625,8 +645,8 @@ func MSetNX(dbNum int, args [][]byte) (int, error) {
 	return 1, nil
 }
 
-func SetNX(dbNum int, args [][]byte) (int, error) {
-	result, err := MSetNX(dbNum, args)
+func SetNX(dbNum int, args [][]byte, dbOp *dbOperation) (int, error) {
+	result, err := MSetNX(dbNum, args, dbOp)
 	if err != nil {
 		return 0, err
 	}
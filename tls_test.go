@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testPKI is a CA with the certificates it signed for the server and a client, written as PEM files
+type testPKI struct {
+	dir        string
+	ca         *x509.Certificate
+	caKey      *ecdsa.PrivateKey
+	pool       *x509.CertPool
+	clientCert tls.Certificate
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+
+	pki := &testPKI{dir: t.TempDir(), pool: x509.NewCertPool()}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Bigdis test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	pki.ca, pki.caKey = pki.sign(t, caTemplate, "ca")
+	pki.pool.AddCert(pki.ca)
+
+	pki.sign(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, "server")
+
+	pki.sign(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, "client")
+	var err error
+	if pki.clientCert, err = tls.LoadX509KeyPair(pki.path("client.crt"), pki.path("client.key")); err != nil {
+		t.Fatal(err)
+	}
+
+	return pki
+}
+
+func (pki *testPKI) path(name string) string {
+	return filepath.Join(pki.dir, name)
+}
+
+// sign creates a key and its certificate, signed by the CA or by itself for the CA, in name.crt and name.key
+func (pki *testPKI) sign(t *testing.T, template *x509.Certificate, name string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent, parentKey := template, key
+	if pki.ca != nil {
+		parent, parentKey = pki.ca, pki.caKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(pki.path(name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pki.path(name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certificate, key
+}
+
+// startTLSServer starts a server with a TLS port and the given settings of the tls section, it returns the TLS address
+func startTLSServer(t *testing.T, pki *testPKI, settings map[string]any) string {
+	t.Helper()
+
+	port := freePort(t)
+	section := map[string]any{
+		"port":         port,
+		"cert_file":    pki.path("server.crt"),
+		"key_file":     pki.path("server.key"),
+		"ca_cert_file": pki.path("ca.crt"),
+	}
+	for key, value := range settings {
+		section[key] = value
+	}
+	startServer(t, map[string]map[string]any{"tls": section})
+
+	return net.JoinHostPort("localhost", strconv.Itoa(port))
+}
+
+// pingTLS connects with the client settings and sends a PING, it returns the error of the handshake or of the PING
+func pingTLS(t *testing.T, addr string, settings *tls.Config) error {
+	t.Helper()
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr, settings)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// with TLS 1.3 the server checks the certificate of the client after the client is done with the handshake,
+	// a rejection shows up on the first read
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("*1\r\n$4\r\nPING\r\n")); err != nil {
+		return err
+	}
+	reply, err := readReply(newTestClient(t, conn).reader)
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		t.Errorf("ping over TLS = %q", reply)
+	}
+
+	return nil
+}
+
+func TestTLS(t *testing.T) {
+	pki := newTestPKI(t)
+	addr := startTLSServer(t, pki, nil)
+
+	if err := pingTLS(t, addr, &tls.Config{RootCAs: pki.pool, Certificates: []tls.Certificate{pki.clientCert}}); err != nil {
+		t.Errorf("client with a certificate: %s", err)
+	}
+
+	// the client certificates are required by default
+	if err := pingTLS(t, addr, &tls.Config{RootCAs: pki.pool}); err == nil {
+		t.Error("client without a certificate accepted")
+	}
+
+	// a certificate the CA didn't sign is refused too
+	other := newTestPKI(t)
+	if err := pingTLS(t, addr, &tls.Config{RootCAs: pki.pool, Certificates: []tls.Certificate{other.clientCert}}); err == nil {
+		t.Error("client with a certificate of another CA accepted")
+	}
+
+	// TLS 1.2 is accepted by default
+	tls12 := &tls.Config{RootCAs: pki.pool, Certificates: []tls.Certificate{pki.clientCert}, MaxVersion: tls.VersionTLS12}
+	if err := pingTLS(t, addr, tls12); err != nil {
+		t.Errorf("TLS 1.2 client: %s", err)
+	}
+}
+
+func TestTLSOptionalClientCertificate(t *testing.T) {
+	pki := newTestPKI(t)
+	addr := startTLSServer(t, pki, map[string]any{"auth_clients": "optional"})
+
+	if err := pingTLS(t, addr, &tls.Config{RootCAs: pki.pool}); err != nil {
+		t.Errorf("client without a certificate: %s", err)
+	}
+	if err := pingTLS(t, addr, &tls.Config{RootCAs: pki.pool, Certificates: []tls.Certificate{newTestPKI(t).clientCert}}); err == nil {
+		t.Error("client with a certificate of another CA accepted")
+	}
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	pki := newTestPKI(t)
+	addr := startTLSServer(t, pki, map[string]any{"min_version": "1.3"})
+
+	client := &tls.Config{RootCAs: pki.pool, Certificates: []tls.Certificate{pki.clientCert}}
+	if err := pingTLS(t, addr, client); err != nil {
+		t.Errorf("TLS 1.3 client: %s", err)
+	}
+
+	client.MaxVersion = tls.VersionTLS12
+	if err := pingTLS(t, addr, client); err == nil {
+		t.Error("TLS 1.2 client accepted with min_version 1.3")
+	}
+}
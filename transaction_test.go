@@ -0,0 +1,177 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestConfigInMulti checks that CONFIG is refused inside MULTI: CONFIG SET synchronous applies the pragma
+// on the write connection, which EXEC holds
+func TestConfigInMulti(t *testing.T) {
+	srv := startServer(t, nil)
+	c := srv.client()
+
+	c.ok("multi")
+	if reply, ok := c.do("config", "set", "synchronous", "full").(replyError); !ok {
+		t.Fatalf("config set inside multi = %q, expected an error", reply)
+	}
+	if reply, ok := c.do("exec").(replyError); !ok {
+		t.Errorf("exec of an aborted transaction = %q, expected an error", reply)
+	}
+
+	// the write connection is still available
+	c.ok("config", "set", "synchronous", "full")
+	c.ok("set", "k", "v")
+	if got := c.ok("config", "get", "synchronous").([]any); str(got[1]) != "full" {
+		t.Errorf("config get synchronous = %q", got)
+	}
+}
+
+// clientDB returns the DB of the client with the given id in CLIENT LIST, asked by another connection
+func clientDB(t *testing.T, observer *testClient, id int64) string {
+	t.Helper()
+	for _, line := range strings.Split(str(observer.ok("client", "list")), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != "id="+strconv.FormatInt(id, 10) {
+			continue
+		}
+		for _, field := range fields {
+			if db, found := strings.CutPrefix(field, "db="); found {
+				return db
+			}
+		}
+	}
+	t.Fatalf("client %d not in client list", id)
+	return ""
+}
+
+// TestSelectInMulti checks that a SELECT queued by MULTI only switches the DB when EXEC runs it
+func TestSelectInMulti(t *testing.T) {
+	srv := startServer(t, nil)
+	c, observer := srv.client(), srv.client()
+	id := c.ok("client", "id").(int64)
+
+	c.ok("select", "7")
+	c.ok("multi")
+	c.ok("select", "8")
+	if db := clientDB(t, observer, id); db != "7" {
+		t.Errorf("db after a queued select = %s", db)
+	}
+	c.ok("discard")
+	if db := clientDB(t, observer, id); db != "7" {
+		t.Errorf("db after discard = %s", db)
+	}
+
+	// an aborted EXEC doesn't run the SELECT either
+	c.ok("multi")
+	c.ok("select", "8")
+	c.do("nosuchcommand")
+	if reply, ok := c.do("exec").(replyError); !ok {
+		t.Fatalf("exec of an aborted transaction = %q", reply)
+	}
+	if db := clientDB(t, observer, id); db != "7" {
+		t.Errorf("db after an aborted exec = %s", db)
+	}
+
+	// an invalid SELECT leaves the DB alone
+	for _, index := range []string{"abc", "-1"} {
+		if reply, ok := c.do("select", index).(replyError); !ok {
+			t.Errorf("select %s = %q", index, reply)
+		}
+	}
+	if db := clientDB(t, observer, id); db != "7" {
+		t.Errorf("db after an invalid select = %s", db)
+	}
+
+	// the commands queued after a SELECT run in its DB, the connection stays in the last one
+	c.ok("multi")
+	c.ok("set", "k", "in7")
+	c.ok("select", "8")
+	c.ok("set", "k", "in8")
+	c.ok("select", "abc")
+	c.ok("set", "other", "in8")
+	replies := c.ok("exec").([]any)
+	if _, ok := replies[3].(replyError); !ok {
+		t.Errorf("queued select abc = %q", replies[3])
+	}
+	if db := clientDB(t, observer, id); db != "8" {
+		t.Errorf("db after exec = %s", db)
+	}
+	if got := str(c.ok("get", "k")); got != "in8" {
+		t.Errorf("get k in db 8 = %q", got)
+	}
+	if got := str(c.ok("get", "other")); got != "in8" {
+		t.Errorf("get other in db 8 = %q", got)
+	}
+	c.ok("select", "7")
+	if got := str(c.ok("get", "k")); got != "in7" {
+		t.Errorf("get k in db 7 = %q", got)
+	}
+}
+
+// watchExec runs an empty transaction on the watched keys and tells whether it ran
+func watchExec(t *testing.T, c *testClient) bool {
+	t.Helper()
+	c.ok("multi")
+	c.ok("set", "unrelated", "1")
+	return c.ok("exec") != nil
+}
+
+// TestWatch checks that EXEC fails once a watched key changed, whatever the change
+func TestWatch(t *testing.T) {
+	srv := startServer(t, nil)
+	c, other := srv.client(), srv.client()
+
+	c.ok("set", "k", "v")
+	c.ok("watch", "k", "missing")
+	if !watchExec(t, c) {
+		t.Error("exec failed without any change")
+	}
+
+	c.ok("watch", "k")
+	other.ok("set", "k", "w")
+	if watchExec(t, c) {
+		t.Error("exec ran after the watched key was written")
+	}
+
+	c.ok("watch", "k")
+	other.ok("del", "k")
+	if watchExec(t, c) {
+		t.Error("exec ran after the watched key was deleted")
+	}
+
+	// a key created and deleted again while watched didn't exist before and after, yet it changed
+	c.ok("watch", "missing")
+	other.ok("set", "missing", "1")
+	other.ok("del", "missing")
+	if watchExec(t, c) {
+		t.Error("exec ran after the watched key was created and deleted")
+	}
+
+	c.ok("watch", "missing")
+	other.ok("rpush", "missing", "a")
+	other.ok("flushdb")
+	if watchExec(t, c) {
+		t.Error("exec ran after the watched key was created and flushed")
+	}
+
+	c.ok("set", "expiring", "v")
+	c.ok("pexpire", "expiring", "100")
+	c.ok("watch", "expiring")
+	time.Sleep(200 * time.Millisecond)
+	if watchExec(t, c) {
+		t.Error("exec ran after the watched key expired")
+	}
+
+	// the key expired before WATCH was already gone, its deletion changes nothing
+	c.ok("set", "expired", "v")
+	c.ok("pexpire", "expired", "1")
+	time.Sleep(20 * time.Millisecond)
+	c.ok("watch", "expired")
+	time.Sleep(1500 * time.Millisecond)
+	if !watchExec(t, c) {
+		t.Error("exec failed after a key expired before WATCH was garbage collected")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// unixClient connects to the unix socket at path once the server listens on it
+func unixClient(t *testing.T, path string) *testClient {
+	t.Helper()
+
+	var conn net.Conn
+	if !eventually(t, 10*time.Second, func() bool {
+		var err error
+		conn, err = net.Dial("unix", path)
+		return err == nil
+	}) {
+		t.Fatalf("no server listening on %s", path)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return newTestClient(t, conn)
+}
+
+func TestUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bigdis.sock")
+	// the socket left by a server that was killed is replaced
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.SetUnlinkOnClose(false)
+	listener.Close()
+
+	// TCP is disabled with the port 0
+	srv := startServer(t, map[string]map[string]any{"server": {"port": 0, "unixsocket": path, "unixsocketperm": "700"}})
+	c := unixClient(t, path)
+
+	c.ok("set", "k", "v")
+	checkReplies(t, c, []replyTest{
+		{[]string{"get", "k"}, []byte("v")},
+		{[]string{"config", "get", "unixsocket"}, bulks("unixsocket", path)},
+		{[]string{"config", "get", "unixsocketperm"}, bulks("unixsocketperm", "700")},
+	})
+	if got, expected := str(c.ok("client", "info")), " addr=unix:"+path+" laddr=unix:"+path+" "; !strings.Contains(got, expected) {
+		t.Errorf("client info = %q, expected %q", got, expected)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o700 {
+		t.Errorf("the socket has the permissions %o, expected 700", perm)
+	}
+
+	// the socket is removed when the server stops
+	srv.stop()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("the socket is left after the server stopped: %v", err)
+	}
+}
+
+func TestInvalidUnixSocketPerm(t *testing.T) {
+	dir := t.TempDir()
+	srv := startServer(t, map[string]map[string]any{"server": {"port": 0, "unixsocket": filepath.Join(dir, "bigdis.sock"), "unixsocketperm": "800"}})
+
+	done := make(chan error, 1)
+	go func() { done <- srv.cmd.Wait() }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("the server exited successfully")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the server started with the unixsocketperm 800")
+	}
+	if output := srv.output(); !strings.Contains(output, `invalid unixsocketperm "800"`) {
+		t.Errorf("the server printed %q", output)
+	}
+}
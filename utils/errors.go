@@ -1,13 +1,34 @@
 package utils
 
-import "errors"
+import (
+	"errors"
+	"strings"
+)
 
 var (
-	ErrSyntaxError  = errors.New("ERR syntax error")
-	ErrWrongSyntax  = errors.New("ERR wrong command syntax")
-	ErrNotFound     = errors.New("(nil)")
-	WrongNumberArgs = "wrong number of arguments for '%s' command"
-	ErrNotInteger   = errors.New("ERR value is not an integer or out of range")
-	ErrNotFloat     = errors.New("ERR value is not a valid float")
-	ErrWrongType    = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+	ErrSyntaxError     = errors.New("ERR syntax error")
+	ErrWrongSyntax     = errors.New("ERR wrong command syntax")
+	ErrNotFound        = errors.New("(nil)")
+	WrongNumberArgs    = "wrong number of arguments for '%s' command"
+	ErrNotInteger      = errors.New("ERR value is not an integer or out of range")
+	ErrNotFloat        = errors.New("ERR value is not a valid float")
+	ErrWrongType       = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+	ErrOverflow        = errors.New("ERR increment or decrement would overflow")
+	ErrHashNotInteger  = errors.New("ERR hash value is not an integer")
+	ErrHashNotFloat    = errors.New("ERR hash value is not a float")
+	ErrNaNOrInfinity   = errors.New("ERR increment would produce NaN or Infinity")
+	ErrInvalidCursor   = errors.New("ERR invalid cursor")
+	ErrValueOutOfRange = errors.New("ERR value is out of range, must be positive")
 )
+
+// IsReplyError reports whether err is a Redis error meant to be replied to the client,
+// as opposed to an I/O or storage failure that should drop the connection.
+func IsReplyError(err error) bool {
+	code, _, _ := strings.Cut(err.Error(), " ")
+	switch code {
+	case "ERR", "WRONGTYPE", "EXECABORT", "NOPROTO", "WRONGPASS", "NOAUTH", "NOPERM", "READONLY", "MISCONF":
+		return true
+	}
+
+	return false
+}
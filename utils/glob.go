@@ -0,0 +1,97 @@
+package utils
+
+// GlobMatch reports whether str matches the Redis glob-style pattern.
+// Supported: *, ?, [abc], [^abc], [a-z] and \ to escape special characters.
+// This is a port of stringmatchlen() from the Redis sources.
+func GlobMatch(pattern, str []byte, nocase bool) bool {
+	lower := func(b byte) byte {
+		if nocase && b >= 'A' && b <= 'Z' {
+			return b + ('a' - 'A')
+		}
+		return b
+	}
+
+	for len(pattern) > 0 && len(str) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for len(str) > 0 {
+				if GlobMatch(pattern[1:], str, nocase) {
+					return true
+				}
+				str = str[1:]
+			}
+			return GlobMatch(pattern[1:], str, nocase)
+		case '?':
+			str = str[1:]
+		case '[':
+			pattern = pattern[1:]
+			not := len(pattern) > 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+
+			match := false
+			for len(pattern) > 0 && pattern[0] != ']' {
+				switch {
+				case pattern[0] == '\\' && len(pattern) >= 2:
+					pattern = pattern[1:]
+					if pattern[0] == str[0] {
+						match = true
+					}
+				case len(pattern) >= 3 && pattern[1] == '-':
+					start, end := lower(pattern[0]), lower(pattern[2])
+					if start > end {
+						start, end = end, start
+					}
+					c := lower(str[0])
+					if c >= start && c <= end {
+						match = true
+					}
+					pattern = pattern[2:]
+				default:
+					if lower(pattern[0]) == lower(str[0]) {
+						match = true
+					}
+				}
+				pattern = pattern[1:]
+			}
+
+			if not {
+				match = !match
+			}
+			if !match {
+				return false
+			}
+			str = str[1:]
+
+			// unterminated class, the pattern is over
+			if len(pattern) == 0 {
+				return len(str) == 0
+			}
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if lower(pattern[0]) != lower(str[0]) {
+				return false
+			}
+			str = str[1:]
+		}
+
+		pattern = pattern[1:]
+	}
+
+	for len(pattern) > 0 && pattern[0] == '*' {
+		pattern = pattern[1:]
+	}
+
+	return len(pattern) == 0 && len(str) == 0
+}